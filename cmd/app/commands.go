@@ -0,0 +1,600 @@
+package main
+
+import (
+	"GoAuthentication/internal/app"
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/models"
+	"GoAuthentication/internal/services"
+	"GoAuthentication/migrations"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// runCommand executes an administrative subcommand instead of starting the
+// server, e.g. `go-auth client create -name shop -redirect-uri https://shop/cb`.
+// A leading `-tenant ID` runs it in another tenant than the default one.
+func runCommand(pool database.DBPool, cfg app.Config, args []string) error {
+	tenant := database.DefaultTenant
+	if len(args) >= 2 && args[0] == "-tenant" {
+		tenant, args = args[1], args[2:]
+	}
+	if len(args) == 0 {
+		return errors.New("usage: [-tenant ID] apikey|client|exchange|gc|idp|migrate|role|saml|tenant|tokens ...")
+	}
+	switch args[0] {
+	case "apikey":
+		return runAPIKeyCommand(pool, cfg, tenant, args[1:])
+	case "client":
+		return runClientCommand(pool, cfg, tenant, args[1:])
+	case "exchange":
+		return runExchangeCommand(pool, cfg, tenant, args[1:])
+	case "gc":
+		return runGCCommand(pool, cfg, args[1:])
+	case "idp":
+		return runIdentityProviderCommand(pool, cfg, tenant, args[1:])
+	case "migrate":
+		return runMigrateCommand(pool, args[1:])
+	case "role":
+		return runRoleCommand(pool, cfg, tenant, args[1:])
+	case "saml":
+		return runSAMLCommand(pool, cfg, tenant, args[1:])
+	case "tenant":
+		return runTenantCommand(pool, cfg, args[1:])
+	case "tokens":
+		return runTokensCommand(pool, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// runAPIKeyCommand manages API keys of clients; users create their own keys
+// at /apikeys:
+//
+//	apikey create -client ID [-name NAME] [-scope SCOPES] [-ttl 2160h]
+//	apikey revoke -id ID
+func runAPIKeyCommand(pool database.DBPool, cfg app.Config, tenant string, args []string) error {
+	usage := errors.New("usage: apikey create -client ID [-name NAME] [-scope SCOPES] [-ttl DURATION] | apikey revoke -id ID")
+	if len(args) == 0 {
+		return usage
+	}
+	s, err := app.LoadServices(pool, cfg, tenant)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("apikey "+args[0], flag.ContinueOnError)
+	clientID := fs.String("client", "", "client owning the key")
+	name := fs.String("name", "", "human readable key name")
+	scope := fs.String("scope", "", "space separated scopes, the client's scopes by default")
+	ttl := fs.Duration("ttl", 0, "lifetime of the key, 0 never expires")
+	id := fs.String("id", "", "key id")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		if *clientID == "" {
+			return usage
+		}
+		key, err := s.APIKeys.CreateClientKey(*clientID, *name, strings.Fields(*scope), *ttl)
+		if err != nil {
+			return err
+		}
+		fmt.Println("id:", key.ID)
+		fmt.Println("key:", key.Key)
+		return nil
+	case "revoke":
+		if *id == "" {
+			return usage
+		}
+		return s.APIKeys.RevokeAnyKey(*id)
+	default:
+		return usage
+	}
+}
+
+func runClientCommand(pool database.DBPool, cfg app.Config, tenant string, args []string) error {
+	if len(args) == 0 || args[0] != "create" {
+		return errors.New("usage: client create -name NAME [-redirect-uri URI]... [-scope SCOPES] [-grant-type TYPE]... [-public | -auth-method METHOD] [-dpop] [-cert-bound]")
+	}
+	fs := flag.NewFlagSet("client create", flag.ContinueOnError)
+	name := fs.String("name", "", "human readable client name")
+	scope := fs.String("scope", "", "space separated scopes the client may request, empty allows any")
+	public := fs.Bool("public", false, "register a public client without a secret (SPA, mobile app)")
+	authMethod := fs.String("auth-method", "", "token endpoint authentication method, client_secret_basic by default")
+	jwksFile := fs.String("jwks-file", "", "JWK Set with the client's public keys for private_key_jwt")
+	subjectDN := fs.String("tls-subject-dn", "", "expected certificate subject for tls_client_auth")
+	certFile := fs.String("cert-file", "", "PEM certificate for self_signed_tls_client_auth")
+	dpop := fs.Bool("dpop", false, "require DPoP proofs at the token endpoint")
+	certBound := fs.Bool("cert-bound", false, "require a TLS client certificate at the token endpoint and bind tokens to it")
+	var redirectURIs, grantTypes stringList
+	fs.Var(&redirectURIs, "redirect-uri", "allowed redirect URI, may be repeated")
+	fs.Var(&grantTypes, "grant-type", "allowed grant type, may be repeated; authorization_code and refresh_token by default")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+
+	reg := models.ClientRegistration{
+		Name:         *name,
+		RedirectURIs: redirectURIs,
+		Scopes:       strings.Fields(*scope),
+		GrantTypes:   grantTypes,
+		AuthMethod:   *authMethod,
+		TLSSubjectDN: *subjectDN,
+		DPoPBound:    *dpop,
+		CertBound:    *certBound,
+	}
+	if *public {
+		reg.AuthMethod = services.AuthMethodNone
+	}
+	if *jwksFile != "" {
+		data, err := os.ReadFile(*jwksFile)
+		if err != nil {
+			return err
+		}
+		reg.JWKS = string(data)
+	}
+	if *certFile != "" {
+		data, err := os.ReadFile(*certFile)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return errors.New("no PEM data found in -cert-file")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		reg.CertThumbprint = services.CertificateThumbprint(cert)
+	}
+
+	s, err := app.LoadServices(pool, cfg, tenant)
+	if err != nil {
+		return err
+	}
+	id, secret, err := s.OAuth.RegisterClient(reg)
+	if err != nil {
+		return err
+	}
+	fmt.Println("client_id:", id)
+	if secret != "" {
+		fmt.Println("client_secret:", secret)
+	}
+	return nil
+}
+
+// runExchangeCommand manages token exchange policies:
+//
+//	exchange policy -client ID -audience AUD... [-scope SCOPES] [-impersonation]
+//	exchange impersonate -actor GUID [-subject GUID]
+func runExchangeCommand(pool database.DBPool, cfg app.Config, tenant string, args []string) error {
+	usage := errors.New("usage: exchange policy -client ID -audience AUD... [-scope SCOPES] [-impersonation] | exchange impersonate -actor GUID [-subject GUID]")
+	if len(args) == 0 {
+		return usage
+	}
+	s, err := app.LoadServices(pool, cfg, tenant)
+	if err != nil {
+		return err
+	}
+	oauthservice := s.OAuth
+
+	switch args[0] {
+	case "policy":
+		fs := flag.NewFlagSet("exchange policy", flag.ContinueOnError)
+		clientID := fs.String("client", "", "client allowed to exchange tokens")
+		scope := fs.String("scope", "", "space separated scopes exchanged tokens may carry")
+		impersonation := fs.Bool("impersonation", false, "allow the client to impersonate users on behalf of an actor")
+		var audiences stringList
+		fs.Var(&audiences, "audience", "allowed target audience, may be repeated")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *clientID == "" || len(audiences) == 0 {
+			return usage
+		}
+		return oauthservice.SetExchangePolicy(models.ExchangePolicy{
+			ClientID:      *clientID,
+			Audiences:     audiences,
+			Scopes:        strings.Fields(*scope),
+			Impersonation: *impersonation,
+		})
+	case "impersonate":
+		fs := flag.NewFlagSet("exchange impersonate", flag.ContinueOnError)
+		actor := fs.String("actor", "", "guid of the user who may impersonate")
+		subject := fs.String("subject", "0", "guid of the user who may be impersonated, 0 for anyone")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		actorGUID, err := strconv.Atoi(*actor)
+		if err != nil {
+			return usage
+		}
+		subjectGUID, err := strconv.Atoi(*subject)
+		if err != nil {
+			return usage
+		}
+		return oauthservice.GrantImpersonation(actorGUID, subjectGUID)
+	default:
+		return usage
+	}
+}
+
+// runIdentityProviderCommand registers upstream OpenID Connect providers:
+//
+//	idp add -id ID -issuer URL -client-id ID [-client-secret SECRET] [-scope SCOPES]
+//
+// It prints the redirect URI to register with the provider.
+func runIdentityProviderCommand(pool database.DBPool, cfg app.Config, tenant string, args []string) error {
+	usage := errors.New("usage: idp add -id ID -issuer URL -client-id ID [-client-secret SECRET] [-scope SCOPES]")
+	if len(args) == 0 || args[0] != "add" {
+		return usage
+	}
+	fs := flag.NewFlagSet("idp add", flag.ContinueOnError)
+	id := fs.String("id", "", "provider id, used in /federation/{id}/login")
+	issuer := fs.String("issuer", "", "issuer URL of the provider")
+	clientID := fs.String("client-id", "", "client id registered with the provider")
+	clientSecret := fs.String("client-secret", "", "client secret registered with the provider")
+	scope := fs.String("scope", "", "space separated scopes to request, openid email profile by default")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *id == "" || *issuer == "" || *clientID == "" {
+		return usage
+	}
+
+	s, err := app.LoadServices(pool, cfg, tenant)
+	if err != nil {
+		return err
+	}
+	err = s.Federation.SaveProvider(models.IdentityProvider{
+		ID:           *id,
+		Issuer:       *issuer,
+		ClientID:     *clientID,
+		ClientSecret: *clientSecret,
+		Scopes:       strings.Fields(*scope),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("redirect_uri:", s.Federation.CallbackURL(*id))
+	return nil
+}
+
+// runSAMLCommand registers SAML identity providers:
+//
+//	saml add -id ID -entity-id ID -sso-url URL -cert-file FILE [-attr CLAIM=ATTRIBUTE]... [-link-email]
+//
+// It prints the metadata URL and assertion consumer service to configure at
+// the provider.
+func runSAMLCommand(pool database.DBPool, cfg app.Config, tenant string, args []string) error {
+	usage := errors.New("usage: saml add -id ID -entity-id ID -sso-url URL -cert-file FILE [-attr CLAIM=ATTRIBUTE]... [-link-email]")
+	if len(args) == 0 || args[0] != "add" {
+		return usage
+	}
+	fs := flag.NewFlagSet("saml add", flag.ContinueOnError)
+	id := fs.String("id", "", "provider id, used in /saml/{id}/login")
+	entityID := fs.String("entity-id", "", "entity id of the identity provider, the Issuer of its assertions")
+	ssoURL := fs.String("sso-url", "", "single sign-on URL of the identity provider (HTTP-Redirect binding)")
+	certFile := fs.String("cert-file", "", "PEM certificate the identity provider signs with")
+	linkEmail := fs.Bool("link-email", false, "trust asserted email addresses and link them to existing users")
+	var attrs stringList
+	fs.Var(&attrs, "attr", "map a claim (email, name, given_name, family_name) to a SAML attribute, may be repeated")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *id == "" || *entityID == "" || *ssoURL == "" || *certFile == "" {
+		return usage
+	}
+	cert, err := os.ReadFile(*certFile)
+	if err != nil {
+		return err
+	}
+	attributes := map[string]string{}
+	for _, a := range attrs {
+		claim, name, ok := strings.Cut(a, "=")
+		if !ok {
+			return usage
+		}
+		attributes[claim] = name
+	}
+
+	s, err := app.LoadServices(pool, cfg, tenant)
+	if err != nil {
+		return err
+	}
+	err = s.SAML.SaveProvider(models.SAMLProvider{
+		ID:          *id,
+		EntityID:    *entityID,
+		SSOURL:      *ssoURL,
+		Certificate: string(cert),
+		Attributes:  attributes,
+		LinkByEmail: *linkEmail,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("metadata:", s.SAML.EntityID(*id))
+	fmt.Println("acs:", s.SAML.ACSURL(*id))
+	return nil
+}
+
+// runRoleCommand manages roles and their assignment to users:
+//
+//	role save -name NAME [-permission PERM]...
+//	role assign|revoke -guid GUID -name NAME
+func runRoleCommand(pool database.DBPool, cfg app.Config, tenant string, args []string) error {
+	usage := errors.New("usage: role save -name NAME [-permission PERM]... | role assign -guid GUID -name NAME | role revoke -guid GUID -name NAME")
+	if len(args) == 0 {
+		return usage
+	}
+	s, err := app.LoadServices(pool, cfg, tenant)
+	if err != nil {
+		return err
+	}
+	tokenservice := s.Tokens
+
+	fs := flag.NewFlagSet("role "+args[0], flag.ContinueOnError)
+	name := fs.String("name", "", "role name")
+	guid := fs.Int("guid", 0, "guid of the user")
+	var permissions stringList
+	fs.Var(&permissions, "permission", "permission granted by the role, usable as a scope, may be repeated")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *name == "" {
+		return usage
+	}
+
+	switch args[0] {
+	case "save":
+		return tokenservice.SaveRole(*name, permissions)
+	case "assign":
+		if *guid <= 0 {
+			return usage
+		}
+		return tokenservice.AssignRole(*guid, *name)
+	case "revoke":
+		if *guid <= 0 {
+			return usage
+		}
+		return tokenservice.RevokeRole(*guid, *name)
+	default:
+		return usage
+	}
+}
+
+// runTenantCommand manages tenants:
+//
+//	tenant create -id ID [-name NAME] [-host HOST]... [-issuer URL] [-access-ttl 24h] [-dpop] [-dpop-nonce]
+//	tenant webhook -id ID -url URL [-event EVENT]...
+//
+// create generates the tenant's secret and signing key; running it again for
+// an existing tenant only updates its settings.
+func runTenantCommand(pool database.DBPool, cfg app.Config, args []string) error {
+	usage := errors.New("usage: tenant create -id ID [-name NAME] [-host HOST]... [-issuer URL] [-access-ttl DURATION] [-dpop] [-dpop-nonce] | tenant webhook -id ID -url URL [-event EVENT]...")
+	if len(args) == 0 {
+		return usage
+	}
+	db := database.NewPGXDatabase(pool)
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("tenant create", flag.ContinueOnError)
+		id := fs.String("id", "", "tenant id, also used in the /t/{id}/ path")
+		name := fs.String("name", "", "human readable tenant name")
+		issuer := fs.String("issuer", "", "issuer URL, PUBLIC_URL/t/{id} by default")
+		ttl := fs.Duration("access-ttl", 24*time.Hour, "access token lifetime")
+		dpop := fs.Bool("dpop", false, "require DPoP for all tokens of the tenant")
+		dpopNonce := fs.Bool("dpop-nonce", false, "require server nonces in DPoP proofs")
+		var hosts stringList
+		fs.Var(&hosts, "host", "host name resolving to the tenant, may be repeated")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *id == "" || *id == database.DefaultTenant || strings.Contains(*id, "/") {
+			return errors.New("-id is required and must not be default or contain /")
+		}
+		t := models.Tenant{
+			ID:               *id,
+			Name:             *name,
+			Hosts:            hosts,
+			Issuer:           *issuer,
+			AccessTokenTTL:   *ttl,
+			RequireDPoP:      *dpop,
+			RequireDPoPNonce: *dpopNonce,
+		}
+		if t.Hosts == nil {
+			t.Hosts = []string{}
+		}
+		if err := cfg.Retention.Check(t); err != nil {
+			return err
+		}
+		if existing, err := db.GetTenant(context.Background(), *id); err == nil {
+			t.Secret, t.SigningKey = existing.Secret, existing.SigningKey
+		} else if !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		} else if t.Secret, t.SigningKey, err = newTenantKeys(); err != nil {
+			return err
+		}
+		return db.SaveTenant(context.Background(), t)
+	case "webhook":
+		fs := flag.NewFlagSet("tenant webhook", flag.ContinueOnError)
+		id := fs.String("id", database.DefaultTenant, "tenant id")
+		url := fs.String("url", "", "endpoint receiving POST requests")
+		var events stringList
+		fs.Var(&events, "event", "event to deliver, may be repeated; all events by default")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *url == "" {
+			return usage
+		}
+		if events == nil {
+			events = stringList{}
+		}
+		return db.AddWebhook(context.Background(), models.WebhookSubscription{TenantID: *id, URL: *url, Events: events})
+	default:
+		return usage
+	}
+}
+
+// runGCCommand runs a retention pass now, across all tenants, with the
+// configured policy unless overridden:
+//
+//	gc [-used DURATION] [-blocked DURATION] [-partitions DURATION] [-archive]
+func runGCCommand(pool database.DBPool, cfg app.Config, args []string) error {
+	p := cfg.Retention
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	fs.DurationVar(&p.Used, "used", p.Used, "keep used sessions this long, 0 forever")
+	fs.DurationVar(&p.Blocked, "blocked", p.Blocked, "keep blocked sessions this long, 0 forever")
+	fs.DurationVar(&p.Partitions, "partitions", p.Partitions, "keep partitions of tokens this long, 0 forever")
+	fs.BoolVar(&p.Archive, "archive", p.Archive, "move purged sessions to tokens_archive and detach dropped partitions")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := app.CheckRetention(context.Background(), pool, cfg, p); err != nil {
+		return err
+	}
+	res, err := app.PurgeExpired(context.Background(), pool, p)
+	if err != nil {
+		return err
+	}
+	if res.Skipped {
+		return errors.New("another instance is purging, try again later")
+	}
+	fmt.Println("used:", res.Used)
+	fmt.Println("blocked:", res.Blocked)
+	fmt.Println("jtis:", res.JTIs)
+	for _, name := range res.Created {
+		fmt.Println("created:", name)
+	}
+	for _, name := range res.Dropped {
+		fmt.Println("dropped:", name)
+	}
+	return nil
+}
+
+// runTokensCommand manages the tokens table, which is shared by all tenants:
+//
+//	tokens partition
+//
+// partition converts tokens to daily partitions by creation time; the
+// retention job maintains them from then on.
+func runTokensCommand(pool database.DBPool, args []string) error {
+	if len(args) != 1 || args[0] != "partition" {
+		return errors.New("usage: tokens partition")
+	}
+	ctx := context.Background()
+	converted, err := database.PartitionTokens(ctx, pool)
+	if err != nil {
+		return err
+	}
+	fmt.Println("converted:", converted)
+	created, err := database.CreateTokenPartitions(ctx, pool, app.PartitionDaysAhead)
+	for _, name := range created {
+		fmt.Println("created:", name)
+	}
+	return err
+}
+
+// runMigrateCommand changes the schema, which is shared by all tenants:
+//
+//	migrate up [-to VERSION]
+//	migrate down [-steps N]
+//	migrate status
+func runMigrateCommand(pool database.DBPool, args []string) error {
+	usage := errors.New("usage: migrate up [-to VERSION] | migrate down [-steps N] | migrate status")
+	if len(args) == 0 {
+		return usage
+	}
+	m, err := database.NewMigrator(pool, migrations.FS)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		fs := flag.NewFlagSet("migrate up", flag.ContinueOnError)
+		to := fs.Int("to", 0, "version to migrate to, the latest by default")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		applied, err := m.Up(ctx, *to)
+		if err != nil {
+			return err
+		}
+		for _, v := range applied {
+			fmt.Println("applied:", v)
+		}
+		return nil
+	case "down":
+		fs := flag.NewFlagSet("migrate down", flag.ContinueOnError)
+		steps := fs.Int("steps", 1, "number of migrations to revert")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		reverted, err := m.Down(ctx, *steps)
+		if err != nil {
+			return err
+		}
+		for _, v := range reverted {
+			fmt.Println("reverted:", v)
+		}
+		return nil
+	case "status":
+		version, err := m.Version(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println("version:", version)
+		fmt.Println("latest:", m.Latest())
+		return nil
+	default:
+		return usage
+	}
+}
+
+// newTenantKeys generates a random access token secret and a PEM encoded RSA
+// key for ID tokens.
+func newTenantKeys() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+	block := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return base64.RawURLEncoding.EncodeToString(raw), string(block), nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"GoAuthentication/internal/app"
+	"crypto/rand"
+	"crypto/rsa"
+	"log"
+	"os"
+)
+
+// loadSigningKey reads an RSA private key in PKCS#1 or PKCS#8 PEM format.
+// Without a path an ephemeral key is generated, so ID tokens stop verifying
+// after a restart.
+func loadSigningKey(path string) (*rsa.PrivateKey, error) {
+	if path == "" {
+		log.Println("OIDC_SIGNING_KEY is not set, generating an ephemeral signing key")
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return app.ParseSigningKey(data)
+}
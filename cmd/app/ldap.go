@@ -0,0 +1,51 @@
+package main
+
+import (
+	"GoAuthentication/internal/services"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// loadAuthenticator configures password login from the LDAP_* variables.
+// Without LDAP_URL password login stays disabled.
+func loadAuthenticator() (services.Authenticator, map[string]string, error) {
+	url := os.Getenv("LDAP_URL")
+	if url == "" {
+		return nil, nil, nil
+	}
+	groupRoles, err := parseGroupRoles(os.Getenv("LDAP_GROUP_ROLES"))
+	if err != nil {
+		return nil, nil, err
+	}
+	auth := services.NewLDAPAuthenticator(services.LDAPConfig{
+		URL:          url,
+		StartTLS:     os.Getenv("LDAP_START_TLS") == "true",
+		BindDN:       os.Getenv("LDAP_BIND_DN"),
+		BindPassword: os.Getenv("LDAP_BIND_PASSWORD"),
+		UserBaseDN:   os.Getenv("LDAP_USER_BASE_DN"),
+		UserFilter:   os.Getenv("LDAP_USER_FILTER"),
+		GroupBaseDN:  os.Getenv("LDAP_GROUP_BASE_DN"),
+		GroupFilter:  os.Getenv("LDAP_GROUP_FILTER"),
+	})
+	return auth, groupRoles, nil
+}
+
+// parseGroupRoles reads "role:groupDN;role:groupDN". DNs contain commas, so
+// the pairs are separated by semicolons.
+func parseGroupRoles(s string) (map[string]string, error) {
+	groupRoles := map[string]string{}
+	for _, pair := range strings.Split(s, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		role, group, ok := strings.Cut(pair, ":")
+		role, group = strings.TrimSpace(role), strings.TrimSpace(group)
+		if !ok || role == "" || group == "" {
+			return nil, fmt.Errorf("invalid LDAP_GROUP_ROLES entry %q, want role:groupDN", pair)
+		}
+		groupRoles[group] = role
+	}
+	return groupRoles, nil
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"GoAuthentication/internal/app"
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/mail"
+	"GoAuthentication/internal/services"
+	"GoAuthentication/migrations"
 	"context"
 	"fmt"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"log"
 	"os"
+	"time"
 )
 
 // @title Go Authentication JWT
@@ -33,12 +38,129 @@ func main() {
 	if dbHost == "" || dbPort == "" || dbUser == "" || dbPassword == "" || dbName == "" || serverPort == "" || jwtSecret == "" || serverIP == "" || webhookurl == "" {
 		log.Fatal("\nNot all environment variables are set")
 	}
+	publicURL := os.Getenv("PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://" + serverIP + ":" + serverPort
+	}
+	mailFrom := os.Getenv("MAIL_FROM")
+	if mailFrom == "" {
+		mailFrom = "no-reply@localhost"
+	}
+	smtpPort := os.Getenv("SMTP_PORT")
+	if smtpPort == "" {
+		smtpPort = "25"
+	}
+	var mailer mail.Mailer
+	switch {
+	case os.Getenv("SMTP_HOST") != "":
+		mailer = mail.NewSMTPMailer(os.Getenv("SMTP_HOST"), smtpPort, os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"), mailFrom)
+	case os.Getenv("MAIL_DIR") != "":
+		mailer = mail.NewFileMailer(os.Getenv("MAIL_DIR"), mailFrom)
+	default:
+		mailer = mail.NewConsoleMailer(os.Stdout, mailFrom)
+	}
 	dsn := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", dbUser, dbPassword, dbHost, dbPort, dbName)
 	db, err := pgxpool.New(context.Background(), dsn)
 	if err != nil {
 		log.Fatal("Error while creating connection to the database!", err)
 	}
 	defer db.Close()
-	application := app.NewApp(db, jwtSecret, serverIP, serverPort, webhookurl)
+	replicas, closeReplicas, err := loadReplicas(dbUser, dbPassword, dbName)
+	if err != nil {
+		log.Fatal("Error while creating connections to the read replicas!", err)
+	}
+	defer closeReplicas()
+	signingKey, err := loadSigningKey(os.Getenv("OIDC_SIGNING_KEY"))
+	if err != nil {
+		log.Fatal("Error while loading the OIDC signing key!", err)
+	}
+	var accessTTL time.Duration
+	if v := os.Getenv("ACCESS_TOKEN_TTL"); v != "" {
+		if accessTTL, err = time.ParseDuration(v); err != nil {
+			log.Fatal("Invalid ACCESS_TOKEN_TTL!", err)
+		}
+	}
+	authenticator, groupRoles, err := loadAuthenticator()
+	if err != nil {
+		log.Fatal("Invalid LDAP configuration!", err)
+	}
+	retention, err := loadRetentionPolicy()
+	if err != nil {
+		log.Fatal("Invalid token retention configuration!", err)
+	}
+	revocations, localRevocations, err := loadRevocationCache()
+	if err != nil {
+		log.Fatal("Invalid revocation cache configuration!", err)
+	}
+	cfg := app.Config{
+		Secret:     jwtSecret,
+		IP:         serverIP,
+		Port:       serverPort,
+		WebhookURL: webhookurl,
+		PublicURL:  publicURL,
+		Mailer:     mailer,
+		SigningKey: signingKey,
+		TokenPolicy: services.TokenPolicy{
+			AccessTokenTTL:   accessTTL,
+			RequireDPoP:      os.Getenv("DPOP_REQUIRED") == "true",
+			RequireDPoPNonce: os.Getenv("DPOP_REQUIRE_NONCE") == "true",
+			RefreshPepper:    os.Getenv("REFRESH_TOKEN_PEPPER"),
+		},
+		TLSCertFile:  os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:   os.Getenv("TLS_KEY_FILE"),
+		ClientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+		AdminAddr:    os.Getenv("ADMIN_ADDR"),
+
+		Authenticator: authenticator,
+		GroupRoles:    groupRoles,
+		Revocations:   revocations,
+		Replicas:      replicas,
+		Retention:     retention,
+	}
+	switch store := os.Getenv("SESSION_STORE"); store {
+	case "", "postgres":
+	case "sqlite":
+		// Only sessions, roles and used JWT ids move to SQLite, for a single
+		// instance; replicas and retention only know the Postgres tables.
+		if replicas != nil {
+			log.Fatal("DATABASE_REPLICAS can not be used with SESSION_STORE=sqlite")
+		}
+		if retention.Interval > 0 {
+			log.Println("Token retention does not purge sessions stored in SQLite")
+		}
+		path := os.Getenv("SESSION_STORE_PATH")
+		if path == "" {
+			path = "sessions.db"
+		}
+		sessions, err := database.OpenSQLite(context.Background(), path)
+		if err != nil {
+			log.Fatal("Error while opening the SQLite session store!", err)
+		}
+		defer sessions.Close()
+		cfg.Sessions = func(tenant string) database.Database {
+			return sessions.ForTenant(tenant)
+		}
+	default:
+		log.Fatal("Unknown SESSION_STORE " + store)
+	}
+	if len(os.Args) > 1 {
+		if err := runCommand(db, cfg, os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if os.Getenv("MIGRATE_ON_START") == "true" {
+		m, err := database.NewMigrator(db, migrations.FS)
+		if err != nil {
+			log.Fatal("Error while reading the migrations!", err)
+		}
+		if _, err := m.Up(context.Background(), 0); err != nil {
+			log.Fatal("Error while migrating the database!", err)
+		}
+	}
+	if localRevocations != nil || replicas != nil {
+		go app.ListenRevocations(context.Background(), db.Config().ConnConfig, localRevocations, replicas)
+	}
+	application := app.NewApp(db, cfg)
 	log.Fatal(application.Run())
 }
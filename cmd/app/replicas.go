@@ -0,0 +1,45 @@
+package main
+
+import (
+	"GoAuthentication/internal/database"
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"os"
+	"strings"
+)
+
+// loadReplicas connects to the read replicas listed in DATABASE_REPLICAS as
+// comma separated host:port pairs, with the credentials and database name of
+// the primary. Without DATABASE_REPLICAS everything is read from the
+// primary. closeAll releases the connections.
+func loadReplicas(user, password, name string) (replicas *database.Replicas, closeAll func(), err error) {
+	v := os.Getenv("DATABASE_REPLICAS")
+	if v == "" {
+		return nil, func() {}, nil
+	}
+	var pools []*pgxpool.Pool
+	closeAll = func() {
+		for _, p := range pools {
+			p.Close()
+		}
+	}
+	var replicaPools []database.DBPool
+	for _, addr := range strings.Split(v, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if !strings.Contains(addr, ":") {
+			addr += ":5432"
+		}
+		pool, err := pgxpool.New(context.Background(), fmt.Sprintf("postgres://%s:%s@%s/%s", user, password, addr, name))
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("invalid DATABASE_REPLICAS entry %q: %w", addr, err)
+		}
+		pools = append(pools, pool)
+		replicaPools = append(replicaPools, pool)
+	}
+	return database.NewReplicas(replicaPools...), closeAll, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"GoAuthentication/internal/app"
+	"fmt"
+	"os"
+	"time"
+)
+
+// loadRetentionPolicy reads the TOKEN_RETENTION_* variables. Used sessions
+// are kept for a week and blocked ones for 30 days by default, checked
+// every hour. Partitions of tokens are kept unless TOKEN_PARTITION_RETENTION
+// is set.
+func loadRetentionPolicy() (app.RetentionPolicy, error) {
+	p := app.RetentionPolicy{
+		Used:     7 * 24 * time.Hour,
+		Blocked:  30 * 24 * time.Hour,
+		Archive:  os.Getenv("TOKEN_RETENTION_ARCHIVE") == "true",
+		Interval: time.Hour,
+	}
+	for name, d := range map[string]*time.Duration{
+		"TOKEN_RETENTION_USED":      &p.Used,
+		"TOKEN_RETENTION_BLOCKED":   &p.Blocked,
+		"TOKEN_RETENTION_INTERVAL":  &p.Interval,
+		"TOKEN_PARTITION_RETENTION": &p.Partitions,
+	} {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		var err error
+		if *d, err = time.ParseDuration(v); err != nil || *d < 0 {
+			return p, fmt.Errorf("invalid %s %q", name, v)
+		}
+	}
+	return p, nil
+}
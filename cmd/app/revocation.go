@@ -0,0 +1,57 @@
+package main
+
+import (
+	"GoAuthentication/internal/services"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRevocationCacheTTL  = 30 * time.Second
+	defaultRevocationCacheSize = 100000
+	revocationCachePrefix      = "goauth:revocation:"
+)
+
+// loadRevocationCache configures the revocation cache from the
+// REVOCATION_CACHE_* variables. Without REVOCATION_CACHE every access token
+// check reads the session from the database. A local cache is returned as
+// well, as it needs to listen for revocations made by other instances.
+func loadRevocationCache() (func(tenant string) services.RevocationCache, *services.LRURevocationCache, error) {
+	ttl := defaultRevocationCacheTTL
+	if v := os.Getenv("REVOCATION_CACHE_TTL"); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 {
+			return nil, nil, fmt.Errorf("invalid REVOCATION_CACHE_TTL %q", v)
+		}
+	}
+	switch kind := os.Getenv("REVOCATION_CACHE"); kind {
+	case "":
+		return nil, nil, nil
+	case "lru":
+		size := defaultRevocationCacheSize
+		if v := os.Getenv("REVOCATION_CACHE_SIZE"); v != "" {
+			var err error
+			if size, err = strconv.Atoi(v); err != nil || size <= 0 {
+				return nil, nil, fmt.Errorf("invalid REVOCATION_CACHE_SIZE %q", v)
+			}
+		}
+		cache := services.NewLRURevocationCache(size, ttl)
+		return func(tenant string) services.RevocationCache {
+			return cache.ForTenant(tenant)
+		}, cache, nil
+	case "redis":
+		opts, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		cache := services.NewRedisRevocationCache(redis.NewClient(opts), revocationCachePrefix, ttl)
+		return func(tenant string) services.RevocationCache {
+			return cache.ForTenant(tenant)
+		}, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown REVOCATION_CACHE %q, want lru or redis", kind)
+	}
+}
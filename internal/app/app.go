@@ -3,33 +3,188 @@ package app
 import (
 	_ "GoAuthentication/docs"
 	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/mail"
 	"GoAuthentication/internal/services"
 	"GoAuthentication/internal/transport/rest"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
 	httpSwagger "github.com/swaggo/http-swagger"
 	"net/http"
+	"os"
+	"strings"
 )
 
+// Config describes the deployment and its default tenant. Further tenants
+// are stored in the database.
+type Config struct {
+	Secret     string
+	IP         string
+	Port       string
+	WebhookURL string
+	PublicURL  string
+	Mailer     mail.Mailer
+	SigningKey *rsa.PrivateKey
+
+	TokenPolicy services.TokenPolicy
+
+	// TLSCertFile and TLSKeyFile switch the listener to HTTPS. Client
+	// certificates are then requested for mTLS client authentication and
+	// certificate-bound tokens; with ClientCAFile they are also verified.
+	TLSCertFile  string
+	TLSKeyFile   string
+	ClientCAFile string
+
+	// AdminAddr, when set, is a separate listener for operators serving
+	// /debug/vars, which reveals the command line and memory statistics and
+	// so is never served on the public port.
+	AdminAddr string
+
+	// Authenticator enables password login for the default tenant, whose
+	// users get the roles that GroupRoles maps their directory groups to.
+	Authenticator services.Authenticator
+	GroupRoles    map[string]string
+
+	// Sessions, when set, returns the store of a tenant's sessions, roles
+	// and used JWT ids, e.g. SQLite, which then replaces Postgres for them.
+	// Everything else, retention and Replicas stay with Postgres.
+	Sessions func(tenant string) database.Database
+	// Revocations, when set, returns the revocation cache of a tenant.
+	Revocations func(tenant string) services.RevocationCache
+	// Replicas, when set, serve the session status lookups of access token
+	// checks in place of the primary.
+	Replicas *database.Replicas
+
+	// Retention purges sessions that can no longer be refreshed.
+	Retention RetentionPolicy
+}
+
 type App struct {
-	pool       database.DBPool
-	secret     string
-	ip         string
-	port       string
-	webhookurl string
+	pool database.DBPool
+	cfg  Config
 }
 
-func NewApp(pool database.DBPool, secret string, ip string, port string, webhookurl string) *App {
-	return &App{pool: pool, secret: secret, ip: ip, port: port, webhookurl: webhookurl}
+func NewApp(pool database.DBPool, cfg Config) *App {
+	return &App{pool: pool, cfg: cfg}
 }
 
 func (a *App) Run() error {
-	db := database.NewPGXDatabase(a.pool)
-	tokenservice := services.NewService(db, a.secret, a.webhookurl)
-	handler := rest.NewHandler(tokenservice)
-	http.HandleFunc("/create", handler.CreateTokens)
-	http.HandleFunc("/refresh", handler.RefreshTokens)
-	http.HandleFunc("/me", handler.GetCurrentUser)
-	http.HandleFunc("/logout", handler.Logout)
-	http.Handle("/swagger/", httpSwagger.WrapHandler)
-	err := http.ListenAndServe(a.ip+":"+a.port, nil)
-	return err
+	if a.cfg.Retention.Interval > 0 {
+		if err := CheckRetention(context.Background(), a.pool, a.cfg, a.cfg.Retention); err != nil {
+			return err
+		}
+	}
+	tenants, err := newTenantRouter(a.pool, a.cfg)
+	if err != nil {
+		return err
+	}
+	go tenants.run(context.Background())
+	go runPartitions(context.Background(), a.pool)
+	if a.cfg.Retention.Interval > 0 {
+		go runRetention(context.Background(), a.pool, a.cfg.Retention)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/swagger/", httpSwagger.WrapHandler)
+	mux.Handle("/", tenants)
+
+	server := &http.Server{Addr: a.cfg.IP + ":" + a.cfg.Port, Handler: mux}
+	if a.cfg.TLSCertFile != "" {
+		if server.TLSConfig, err = a.tlsConfig(); err != nil {
+			return err
+		}
+	}
+	errs := make(chan error, 2)
+	if a.cfg.AdminAddr != "" {
+		admin := http.NewServeMux()
+		admin.Handle("GET /debug/vars", expvar.Handler())
+		go func() { errs <- (&http.Server{Addr: a.cfg.AdminAddr, Handler: admin}).ListenAndServe() }()
+	}
+	go func() {
+		if a.cfg.TLSCertFile == "" {
+			errs <- server.ListenAndServe()
+			return
+		}
+		errs <- server.ListenAndServeTLS(a.cfg.TLSCertFile, a.cfg.TLSKeyFile)
+	}()
+	return <-errs
+}
+
+// routes serves the endpoints of one tenant, both at the root for requests
+// resolved by host name and below /t/{id}/.
+func routes(tenantID string, s *Services) http.Handler {
+	handler := rest.NewHandler(s.Tokens)
+	emailhandler := rest.NewEmailLoginHandler(s.Email)
+	oauthhandler := rest.NewOAuthHandler(s.OAuth)
+	federationhandler := rest.NewFederationHandler(s.Federation)
+	samlhandler := rest.NewSAMLHandler(s.SAML)
+	passwordhandler := rest.NewPasswordLoginHandler(s.Password)
+	apikeyhandler := rest.NewAPIKeyHandler(s.APIKeys)
+
+	mux := http.NewServeMux()
+	handle := func(pattern string, h http.HandlerFunc) {
+		method, path, ok := strings.Cut(pattern, " ")
+		if !ok {
+			method, path = "", pattern
+		} else {
+			method += " "
+		}
+		mux.HandleFunc(method+path, h)
+		mux.HandleFunc(method+tenantPathPrefix+tenantID+path, h)
+	}
+	handle("/create", handler.CreateTokens)
+	handle("/refresh", handler.RefreshTokens)
+	handle("/me", handler.GetCurrentUser)
+	handle("/logout", handler.Logout)
+	handle("POST /login/password", passwordhandler.Login)
+	handle("POST /login/email", emailhandler.SendLoginEmail)
+	handle("POST /login/email/verify", emailhandler.VerifyLoginCode)
+	handle("GET /login/email/verify", emailhandler.ConfirmLoginLink)
+	handle("POST /login/email/link", emailhandler.VerifyLoginLink)
+	handle("POST /stepup/email", emailhandler.SendStepUpCode)
+	handle("POST /stepup/email/verify", emailhandler.StepUp)
+	handle("GET /authorize", oauthhandler.Authorize)
+	handle("POST /authorize", oauthhandler.Authorize)
+	handle("POST /token", oauthhandler.Token)
+	handle("POST /introspect", oauthhandler.Introspect)
+	handle("POST /device_authorization", oauthhandler.DeviceAuthorization)
+	handle("GET /device", oauthhandler.DeviceInfo)
+	handle("POST /device", oauthhandler.VerifyDevice)
+	handle("GET /userinfo", oauthhandler.UserInfo)
+	handle("POST /userinfo", oauthhandler.UserInfo)
+	handle("POST /apikeys", apikeyhandler.CreateKey)
+	handle("GET /apikeys", apikeyhandler.ListKeys)
+	handle("DELETE /apikeys/{id}", apikeyhandler.RevokeKey)
+	handle("POST /apikeys/token", apikeyhandler.Exchange)
+	handle("GET /federation/{provider}/login", federationhandler.StartLogin)
+	handle("GET /federation/{provider}/callback", federationhandler.Callback)
+	handle("GET /saml/{provider}/metadata", samlhandler.Metadata)
+	handle("GET /saml/{provider}/login", samlhandler.StartLogin)
+	handle("POST /saml/{provider}/acs", samlhandler.AssertionConsumer)
+	handle("GET /.well-known/openid-configuration", oauthhandler.Discovery)
+	handle("GET /.well-known/jwks.json", oauthhandler.JWKS)
+	return mux
+}
+
+// tlsConfig asks every client for a certificate without requiring one, so
+// that browsers keep working. Self-signed certificates are accepted unless a
+// client CA is configured; the services decide what a certificate is worth.
+func (a *App) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ClientAuth: tls.RequestClientCert}
+	if a.cfg.ClientCAFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(a.cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificates found in the client CA file")
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return cfg, nil
 }
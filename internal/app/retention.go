@@ -0,0 +1,228 @@
+package app
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/models"
+	"GoAuthentication/internal/services"
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+)
+
+// retentionBatchSize bounds the rows a single statement deletes, so that
+// purging never holds many row locks or a long transaction.
+const retentionBatchSize = 1000
+
+// PartitionDaysAhead is how many daily partitions of a partitioned tokens
+// table are kept ready, so that sessions can still be issued after the
+// background job has been down for a while.
+const PartitionDaysAhead = 14
+
+// partitionInterval is how often every instance makes sure the partitions
+// of the coming days exist, whatever the retention policy.
+const partitionInterval = time.Hour
+
+// RetentionPolicy decides how long sessions are kept once they can no longer
+// be refreshed, which sessions issued without a refresh token never could.
+// Access tokens of a used session stay valid until they expire, so Used must
+// be at least the longest access token lifetime; Check enforces it.
+type RetentionPolicy struct {
+	// Used and Blocked keep sessions for that long after they were
+	// refreshed or revoked; 0 keeps them forever.
+	Used    time.Duration
+	Blocked time.Duration
+	// Archive moves purged sessions to tokens_archive instead of deleting
+	// them.
+	Archive bool
+	// Partitions drops the daily partitions of a partitioned tokens table
+	// once all their sessions were created that long ago and none of them
+	// can still be refreshed; 0 keeps them forever. With Archive they are
+	// detached instead.
+	Partitions time.Duration
+	// Interval between passes of the background job; 0 disables it.
+	Interval time.Duration
+}
+
+// Check rejects a policy that would purge sessions of tenant t while access
+// tokens issued for them are still valid.
+func (p RetentionPolicy) Check(t models.Tenant) error {
+	ttl := services.TokenPolicy{AccessTokenTTL: t.AccessTokenTTL}.SessionTokenTTL()
+	if p.Used > 0 && p.Used < ttl {
+		return fmt.Errorf("Used sessions are kept for %v, shorter than the %v access tokens of tenant %q live", p.Used, ttl, t.ID)
+	}
+	if p.Partitions > 0 && p.Partitions < ttl {
+		return fmt.Errorf("Partitions are kept for %v, shorter than the %v access tokens of tenant %q live", p.Partitions, ttl, t.ID)
+	}
+	return nil
+}
+
+// CheckRetention checks p against the default tenant and every tenant
+// stored in the database.
+func CheckRetention(ctx context.Context, pool database.DBPool, cfg Config, p RetentionPolicy) error {
+	tenants, err := database.NewPGXDatabase(pool).ListTenants(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range append([]models.Tenant{cfg.DefaultTenant()}, tenants...) {
+		if err := p.Check(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetentionResult counts the rows one pass purged.
+type RetentionResult struct {
+	Used    int
+	Blocked int
+	JTIs    int
+	// Created and Dropped name the partitions of tokens added and removed.
+	Created []string
+	Dropped []string
+	// Skipped is set when another instance was purging.
+	Skipped bool
+}
+
+// retentionMetrics are published at /debug/vars on the admin listener.
+var retentionMetrics = expvar.NewMap("token_retention")
+
+// PurgeExpired runs one retention pass over all tenants unless another
+// instance is running one: used and blocked sessions past the policy and
+// expired JWT ids are purged in batches. A partitioned tokens table also
+// gets its future partitions created and its expired ones dropped.
+func PurgeExpired(ctx context.Context, pool database.DBPool, p RetentionPolicy) (RetentionResult, error) {
+	var res RetentionResult
+	release, ok, err := database.LockRetention(ctx, pool)
+	if err != nil {
+		return res, err
+	}
+	if !ok {
+		retentionMetrics.Add("skipped_runs", 1)
+		res.Skipped = true
+		return res, nil
+	}
+	defer release()
+
+	now := time.Now()
+	partitioned, err := database.TokensPartitioned(ctx, pool)
+	if err != nil {
+		return res, err
+	}
+	if partitioned {
+		if res.Created, err = database.CreateTokenPartitions(ctx, pool, PartitionDaysAhead); err != nil {
+			return res, err
+		}
+		retentionMetrics.Add("partitions_created", int64(len(res.Created)))
+		if p.Partitions > 0 {
+			if res.Dropped, err = database.DropTokenPartitions(ctx, pool, now.Add(-p.Partitions), p.Archive); err != nil {
+				return res, err
+			}
+			retentionMetrics.Add("partitions_dropped", int64(len(res.Dropped)))
+		}
+	}
+	if p.Used > 0 {
+		if res.Used, err = purgeAll(func() (int, error) {
+			return database.PurgeTokens(ctx, pool, "used", now.Add(-p.Used), retentionBatchSize, p.Archive)
+		}, "used_purged"); err != nil {
+			return res, err
+		}
+	}
+	if p.Blocked > 0 {
+		if res.Blocked, err = purgeAll(func() (int, error) {
+			return database.PurgeTokens(ctx, pool, "blocked", now.Add(-p.Blocked), retentionBatchSize, p.Archive)
+		}, "blocked_purged"); err != nil {
+			return res, err
+		}
+	}
+	if res.JTIs, err = purgeAll(func() (int, error) {
+		return database.PurgeUsedJTIs(ctx, pool, now, retentionBatchSize)
+	}, "jtis_purged"); err != nil {
+		return res, err
+	}
+	retentionMetrics.Add("runs", 1)
+	last := new(expvar.Int)
+	last.Set(now.Unix())
+	retentionMetrics.Set("last_run_unix", last)
+	return res, nil
+}
+
+// purgeAll repeats batch until it comes back short and counts the rows in
+// the metric name.
+func purgeAll(batch func() (int, error), metric string) (int, error) {
+	total := 0
+	for {
+		n, err := batch()
+		total += n
+		retentionMetrics.Add(metric, int64(n))
+		if err != nil || n < retentionBatchSize {
+			return total, err
+		}
+	}
+}
+
+// runRetention runs PurgeExpired at once and then every p.Interval until
+// ctx is done.
+func runRetention(ctx context.Context, pool database.DBPool, p RetentionPolicy) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		res, err := PurgeExpired(ctx, pool, p)
+		if err != nil {
+			retentionMetrics.Add("failed_runs", 1)
+			log.Printf("Token retention failed: %v", err)
+		} else {
+			if res.Used+res.Blocked+res.JTIs > 0 {
+				log.Printf("Token retention purged %d used and %d blocked sessions and %d JWT ids", res.Used, res.Blocked, res.JTIs)
+			}
+			if len(res.Created)+len(res.Dropped) > 0 {
+				log.Printf("Token retention created partitions %v and removed %v", res.Created, res.Dropped)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// EnsureTokenPartitions creates the partitions of a partitioned tokens table
+// for the next PartitionDaysAhead days and returns their names. An instance
+// purging meanwhile creates them itself, so it is left to it.
+func EnsureTokenPartitions(ctx context.Context, pool database.DBPool) ([]string, error) {
+	partitioned, err := database.TokensPartitioned(ctx, pool)
+	if err != nil || !partitioned {
+		return nil, err
+	}
+	release, ok, err := database.LockRetention(ctx, pool)
+	if err != nil || !ok {
+		return nil, err
+	}
+	defer release()
+	created, err := database.CreateTokenPartitions(ctx, pool, PartitionDaysAhead)
+	retentionMetrics.Add("partitions_created", int64(len(created)))
+	return created, err
+}
+
+// runPartitions runs EnsureTokenPartitions at once and then every
+// partitionInterval until ctx is done, so that sessions can be issued even
+// when retention is disabled.
+func runPartitions(ctx context.Context, pool database.DBPool) {
+	ticker := time.NewTicker(partitionInterval)
+	defer ticker.Stop()
+	for {
+		created, err := EnsureTokenPartitions(ctx, pool)
+		if err != nil {
+			log.Printf("Creating token partitions failed: %v", err)
+		} else if len(created) > 0 {
+			log.Printf("Created token partitions %v", created)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
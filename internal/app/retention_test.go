@@ -0,0 +1,34 @@
+package app
+
+import (
+	"GoAuthentication/internal/models"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicyCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy RetentionPolicy
+		ttl    time.Duration
+		ok     bool
+	}{
+		{"defaults", RetentionPolicy{Used: 7 * 24 * time.Hour, Blocked: 30 * 24 * time.Hour}, 0, true},
+		{"kept forever", RetentionPolicy{}, 30 * 24 * time.Hour, true},
+		{"used shorter than the default lifetime", RetentionPolicy{Used: time.Hour}, 0, false},
+		{"used shorter than the tenant lifetime", RetentionPolicy{Used: 7 * 24 * time.Hour}, 8 * 24 * time.Hour, false},
+		{"used as long as the tenant lifetime", RetentionPolicy{Used: 2 * time.Hour}, 2 * time.Hour, true},
+		// API key and exchanged tokens live 15 minutes whatever the tenant says.
+		{"used shorter than exchanged tokens", RetentionPolicy{Used: 10 * time.Minute}, 5 * time.Minute, false},
+		{"partitions shorter than the tenant lifetime", RetentionPolicy{Partitions: 24 * time.Hour}, 48 * time.Hour, false},
+		// Blocked sessions reject their access tokens anyway.
+		{"blocked shorter than the tenant lifetime", RetentionPolicy{Blocked: time.Minute}, time.Hour, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.policy.Check(models.Tenant{ID: "acme", AccessTokenTTL: tc.ttl})
+			if (err == nil) != tc.ok {
+				t.Fatalf("got %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+}
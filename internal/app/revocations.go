@@ -0,0 +1,80 @@
+package app
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/services"
+	"context"
+	"github.com/jackc/pgx/v5"
+	"log"
+	"time"
+)
+
+const (
+	revocationRetryMin = time.Second
+	revocationRetryMax = time.Minute
+)
+
+// ListenRevocations keeps cache and replicas in step with the revocations and
+// refreshes of every instance sharing the database: it holds a LISTEN
+// connection of its own, evicts the users and sessions announced on it and
+// keeps replicas from being read until they have replayed the change.
+// Notifications missed while the connection is down are unknown, so after
+// every (re)connect the cache is cleared; there is no other resync, sessions
+// are read from the database again as their tokens are checked. Either of
+// cache and replicas may be nil. It returns when ctx is done.
+func ListenRevocations(ctx context.Context, connConfig *pgx.ConnConfig, cache *services.LRURevocationCache, replicas *database.Replicas) {
+	delay := revocationRetryMin
+	for {
+		listening, err := listenRevocations(ctx, connConfig, cache, replicas)
+		if ctx.Err() != nil {
+			return
+		}
+		if listening {
+			delay = revocationRetryMin
+		}
+		log.Printf("Revocation listener stopped, reconnecting in %v: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, revocationRetryMax)
+	}
+}
+
+// listenRevocations serves one connection until it fails. listening reports
+// whether it got as far as subscribing.
+func listenRevocations(ctx context.Context, connConfig *pgx.ConnConfig, cache *services.LRURevocationCache, replicas *database.Replicas) (listening bool, err error) {
+	conn, err := pgx.ConnectConfig(ctx, connConfig)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close(context.Background())
+	if err := database.ListenRevocations(ctx, conn); err != nil {
+		return false, err
+	}
+	if err := replicas.Observe(ctx, conn); err != nil {
+		return true, err
+	}
+	if cache != nil {
+		cache.Clear()
+	}
+	for {
+		r, err := database.WaitRevocation(ctx, conn)
+		if err != nil {
+			return true, err
+		}
+		if err := replicas.Observe(ctx, conn); err != nil {
+			return true, err
+		}
+		if cache == nil {
+			continue
+		}
+		tenant := cache.ForTenant(r.Tenant)
+		if r.GUID != 0 {
+			tenant.EvictUser(r.GUID)
+		} else {
+			tenant.EvictSession(r.ID)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package app
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/models"
+	"GoAuthentication/internal/services"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tenantPathPrefix = "/t/"
+	// Tenants created or changed while the server runs are picked up after
+	// at most this long.
+	tenantReloadInterval = time.Minute
+)
+
+// upstreamClient talks to upstream identity providers.
+var upstreamClient = &http.Client{Timeout: 10 * time.Second}
+
+// Services are the services of one tenant.
+type Services struct {
+	Tokens     *services.Service
+	Email      *services.EmailLoginService
+	OAuth      *services.OAuthService
+	Federation *services.FederationService
+	SAML       *services.SAMLService
+	Password   *services.PasswordLoginService
+	APIKeys    *services.APIKeyService
+}
+
+// DefaultTenant is the tenant described by the environment.
+func (cfg Config) DefaultTenant() models.Tenant {
+	return models.Tenant{
+		ID:               database.DefaultTenant,
+		Issuer:           cfg.PublicURL,
+		Secret:           cfg.Secret,
+		AccessTokenTTL:   cfg.TokenPolicy.AccessTokenTTL,
+		RequireDPoP:      cfg.TokenPolicy.RequireDPoP,
+		RequireDPoPNonce: cfg.TokenPolicy.RequireDPoPNonce,
+	}
+}
+
+// NewServices builds the services of tenant t. Every one of them only sees
+// the tenant's rows and signs with the tenant's keys.
+func NewServices(pool database.DBPool, cfg Config, t models.Tenant, hooks []models.WebhookSubscription) (*Services, error) {
+	signingKey := cfg.SigningKey
+	if t.ID != database.DefaultTenant {
+		key, err := ParseSigningKey([]byte(t.SigningKey))
+		if err != nil {
+			return nil, err
+		}
+		signingKey = key
+	}
+	issuer := t.Issuer
+	if issuer == "" {
+		issuer = strings.TrimRight(cfg.PublicURL, "/") + tenantPathPrefix + t.ID
+	}
+	policy := services.TokenPolicy{
+		AccessTokenTTL:   t.AccessTokenTTL,
+		RequireDPoP:      t.RequireDPoP,
+		RequireDPoPNonce: t.RequireDPoPNonce,
+		RefreshPepper:    cfg.TokenPolicy.RefreshPepper,
+	}
+	if cfg.Revocations != nil {
+		policy.Revocations = cfg.Revocations(t.ID)
+	}
+
+	var auth services.Authenticator
+	if t.ID == database.DefaultTenant {
+		auth = cfg.Authenticator
+	}
+
+	db := database.NewPGXDatabase(pool).WithReplicas(cfg.Replicas).ForTenant(t.ID)
+	var sessions database.Database = db
+	if cfg.Sessions != nil {
+		sessions = cfg.Sessions(t.ID)
+	}
+	tokens := services.NewService(sessions, t.Secret, hooks, policy)
+	return &Services{
+		Tokens:     tokens,
+		Email:      services.NewEmailLoginService(db, tokens, cfg.Mailer, t.Secret, issuer),
+		OAuth:      services.NewOAuthService(db, tokens, issuer, signingKey),
+		Federation: services.NewFederationService(db, tokens, issuer, upstreamClient),
+		SAML:       services.NewSAMLService(db, tokens, issuer),
+		Password:   services.NewPasswordLoginService(passwordLoginStore{db, sessions}, tokens, auth, cfg.GroupRoles),
+		APIKeys:    services.NewAPIKeyService(db, tokens),
+	}, nil
+}
+
+// passwordLoginStore keeps role changes of password logins with the other
+// roles when sessions are stored elsewhere.
+type passwordLoginStore struct {
+	database.FederationStore
+	database.RoleStore
+}
+
+// LoadServices builds the services of the tenant id for administrative
+// commands.
+func LoadServices(pool database.DBPool, cfg Config, id string) (*Services, error) {
+	ctx := context.Background()
+	db := database.NewPGXDatabase(pool)
+	t := cfg.DefaultTenant()
+	if id != database.DefaultTenant {
+		var err error
+		if t, err = db.GetTenant(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	hooks, err := db.ListWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewServices(pool, cfg, t, tenantWebhooks(cfg, id, hooks))
+}
+
+// tenantWebhooks picks the subscriptions of tenant id. WEBHOOK_URL belongs to
+// the default tenant and receives every event.
+func tenantWebhooks(cfg Config, id string, all []models.WebhookSubscription) []models.WebhookSubscription {
+	var hooks []models.WebhookSubscription
+	if id == database.DefaultTenant && cfg.WebhookURL != "" {
+		hooks = append(hooks, models.WebhookSubscription{TenantID: id, URL: cfg.WebhookURL})
+	}
+	for _, h := range all {
+		if h.TenantID == id {
+			hooks = append(hooks, h)
+		}
+	}
+	return hooks
+}
+
+// ParseSigningKey reads an RSA private key in PKCS#1 or PKCS#8 PEM format.
+func ParseSigningKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an RSA key")
+	}
+	return key, nil
+}
+
+// tenantRouter sends each request to the handlers of its tenant: the one
+// named by a /t/{id}/ path prefix, else the one owning the host name, else
+// the default tenant.
+type tenantRouter struct {
+	pool database.DBPool
+	cfg  Config
+
+	tables atomic.Pointer[tenantTables]
+}
+
+// tenantTables are the handlers of every tenant, replaced as a whole when
+// tenants are reloaded.
+type tenantTables struct {
+	byID   map[string]http.Handler
+	byHost map[string]string
+}
+
+func newTenantRouter(pool database.DBPool, cfg Config) (*tenantRouter, error) {
+	tr := &tenantRouter{pool: pool, cfg: cfg}
+	if err := tr.reload(); err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+func (tr *tenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tables := tr.tables.Load()
+	byID, byHost := tables.byID, tables.byHost
+	id, ok := tenantFromPath(r.URL.Path)
+	if !ok {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if id, ok = byHost[strings.ToLower(host)]; !ok {
+			id = database.DefaultTenant
+		}
+	}
+	h, ok := byID[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// run reloads the tenants every tenantReloadInterval until ctx is done.
+// Requests keep being served by the previous tenants meanwhile, and after a
+// failed reload.
+func (tr *tenantRouter) run(ctx context.Context) {
+	ticker := time.NewTicker(tenantReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := tr.reload(); err != nil {
+			log.Println("Error while reloading tenants:", err)
+		}
+	}
+}
+
+func (tr *tenantRouter) reload() error {
+	ctx := context.Background()
+	db := database.NewPGXDatabase(tr.pool)
+	tenants, err := db.ListTenants(ctx)
+	if err != nil {
+		return err
+	}
+	hooks, err := db.ListWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+
+	byID := map[string]http.Handler{}
+	byHost := map[string]string{}
+	for _, t := range append([]models.Tenant{tr.cfg.DefaultTenant()}, tenants...) {
+		if _, dup := byID[t.ID]; dup {
+			continue
+		}
+		// Tenants created after startup may not outlive the retention
+		// policy checked then either.
+		if tr.cfg.Retention.Interval > 0 {
+			if err := tr.cfg.Retention.Check(t); err != nil {
+				log.Printf("Skipping tenant %q: %v", t.ID, err)
+				continue
+			}
+		}
+		s, err := NewServices(tr.pool, tr.cfg, t, tenantWebhooks(tr.cfg, t.ID, hooks))
+		if err != nil {
+			log.Printf("Skipping tenant %q: %v", t.ID, err)
+			continue
+		}
+		byID[t.ID] = routes(t.ID, s)
+		for _, host := range t.Hosts {
+			host = strings.ToLower(host)
+			if owner, taken := byHost[host]; taken {
+				log.Printf("Host %q of tenant %q already belongs to tenant %q", host, t.ID, owner)
+				continue
+			}
+			byHost[host] = t.ID
+		}
+	}
+	tr.tables.Store(&tenantTables{byID: byID, byHost: byHost})
+	return nil
+}
+
+func tenantFromPath(path string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, tenantPathPrefix)
+	if !ok {
+		return "", false
+	}
+	id, _, ok := strings.Cut(rest, "/")
+	return id, ok && id != ""
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+type APIKeyStore interface {
+	AuditStore
+	GetClient(ctx context.Context, id string) (models.Client, error)
+	InsertAPIKey(ctx context.Context, k models.APIKey) error
+	GetAPIKey(ctx context.Context, id string) (models.APIKey, error)
+	ListAPIKeys(ctx context.Context, guid int) ([]models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) (bool, error)
+	TouchAPIKey(ctx context.Context, id string, at time.Time) error
+}
+
+const apiKeyColumns = "id, guid, client_id, name, scopes, secret_hash, expires_at, last_used_at, revoked_at, created_at"
+
+func (db *PGXDatabase) InsertAPIKey(ctx context.Context, k models.APIKey) error {
+	var expiresAt *time.Time
+	if !k.ExpiresAt.IsZero() {
+		expiresAt = &k.ExpiresAt
+	}
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO api_keys(tenant_id, id, guid, client_id, name, scopes, secret_hash, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8)`,
+		db.tenant, k.ID, k.GUID, k.ClientID, k.Name, k.Scopes, k.SecretHash, expiresAt,
+	)
+	return err
+}
+
+func (db *PGXDatabase) GetAPIKey(ctx context.Context, id string) (models.APIKey, error) {
+	return scanAPIKey(db.pool.QueryRow(ctx,
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE id=$1 AND tenant_id=$2",
+		id, db.tenant,
+	))
+}
+
+// ListAPIKeys returns the keys of a user, revoked ones included, newest
+// first.
+func (db *PGXDatabase) ListAPIKeys(ctx context.Context, guid int) ([]models.APIKey, error) {
+	rows, err := db.pool.Query(ctx,
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE guid=$1 AND client_id='' AND tenant_id=$2 ORDER BY created_at DESC",
+		guid, db.tenant,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []models.APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey reports whether the key existed and was not revoked yet.
+func (db *PGXDatabase) RevokeAPIKey(ctx context.Context, id string) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		"UPDATE api_keys SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL AND tenant_id=$2",
+		id, db.tenant,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (db *PGXDatabase) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	_, err := db.pool.Exec(ctx,
+		"UPDATE api_keys SET last_used_at=$1 WHERE id=$2 AND tenant_id=$3",
+		at, id, db.tenant,
+	)
+	return err
+}
+
+func scanAPIKey(row pgx.Row) (models.APIKey, error) {
+	var k models.APIKey
+	var expiresAt, lastUsed, revokedAt *time.Time
+	err := row.Scan(&k.ID, &k.GUID, &k.ClientID, &k.Name, &k.Scopes, &k.SecretHash, &expiresAt, &lastUsed, &revokedAt, &k.CreatedAt)
+	if expiresAt != nil {
+		k.ExpiresAt = *expiresAt
+	}
+	if lastUsed != nil {
+		k.LastUsedAt = *lastUsed
+	}
+	if revokedAt != nil {
+		k.RevokedAt = *revokedAt
+	}
+	return k, err
+}
@@ -0,0 +1,21 @@
+package database
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+)
+
+type AuditStore interface {
+	InsertAuditEvent(ctx context.Context, e models.AuditEvent) error
+}
+
+func (db *PGXDatabase) InsertAuditEvent(ctx context.Context, e models.AuditEvent) error {
+	if e.Details == nil {
+		e.Details = map[string]interface{}{}
+	}
+	_, err := db.pool.Exec(ctx,
+		"INSERT INTO audit_log(tenant_id, event, guid, client_id, details) VALUES($1, $2, $3, $4, $5)",
+		db.tenant, e.Event, e.GUID, e.ClientID, e.Details,
+	)
+	return err
+}
@@ -1,70 +1,181 @@
 package database
 
 import (
+	"GoAuthentication/internal/models"
 	"context"
+	"errors"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
+	"time"
 )
 
 type Database interface {
-	InsertToken(ctx context.Context, guid int) (int, error)
-	StoreRefresh(ctx context.Context, id int, hash string) error
+	RoleStore
+	InsertToken(ctx context.Context, rec models.TokenRecord) (int, error)
+	RotateRefresh(ctx context.Context, id int, next models.TokenRecord) (int, error)
 	GetRefresh(ctx context.Context, id int) (hash, status string, err error)
-	MarkRefreshUsed(ctx context.Context, id int) error
+	GetToken(ctx context.Context, id int) (models.TokenRecord, error)
 	InvalidateAllRefreshForGUID(ctx context.Context, guid int) error
+	UseJTI(ctx context.Context, jti string, expiresAt time.Time) (bool, error)
 }
 
 type DBPool interface {
 	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
 	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	Begin(ctx context.Context) (pgx.Tx, error)
 }
 
+// ErrRefreshNotUnused is returned when a session to be rotated was already
+// refreshed or blocked, possibly by a concurrent request.
+var ErrRefreshNotUnused = errors.New("Refresh token already used or blocked")
+
+// DefaultTenant owns every row of a single-tenant deployment.
+const DefaultTenant = "default"
+
+// PGXDatabase reads and writes the rows of one tenant. Used JWT ids are
+// shared by all tenants.
 type PGXDatabase struct {
-	pool DBPool
+	pool     DBPool
+	replicas *Replicas
+	tenant   string
 }
 
 func NewPGXDatabase(pool DBPool) *PGXDatabase {
-	return &PGXDatabase{pool: pool}
+	return &PGXDatabase{pool: pool, tenant: DefaultTenant}
+}
+
+// ForTenant returns a view of the same pool restricted to tenant.
+func (db *PGXDatabase) ForTenant(tenant string) *PGXDatabase {
+	return &PGXDatabase{pool: db.pool, replicas: db.replicas, tenant: tenant}
+}
+
+// WithReplicas returns a view of the same tenant that reads session status
+// from replicas. Everything else still goes to the primary.
+func (db *PGXDatabase) WithReplicas(replicas *Replicas) *PGXDatabase {
+	return &PGXDatabase{pool: db.pool, replicas: replicas, tenant: db.tenant}
 }
 
-func (db *PGXDatabase) InsertToken(ctx context.Context, guid int) (int, error) {
+// maxLegacyTokenID is the largest SERIAL id of the sessions issued before
+// ids encoded their creation time, when the column was an INTEGER. Every
+// time-encoded id is larger.
+const maxLegacyTokenID = 1<<31 - 1
+
+// tokenCreatedAt is the condition on created_at of the session whose id is
+// $1. Time-encoded ids give the exact creation time, so that lookups visit a
+// single partition; legacy sessions were created some time after the time
+// their id decodes to.
+func tokenCreatedAt(id int) string {
+	if id > maxLegacyTokenID {
+		return "created_at = tokens_id_time($1)"
+	}
+	return "created_at >= tokens_id_time($1)"
+}
+
+// InsertToken stores a new session together with its refresh hash. It is
+// unused unless rec.Status says otherwise; sessions that are never refreshed
+// start out used, so that retention purges them. The session is created at
+// the time its id encodes. Ids have room for 4096 sessions per millisecond;
+// beyond that the counter wraps and the insert fails with a unique
+// violation on the id.
+func (db *PGXDatabase) InsertToken(ctx context.Context, rec models.TokenRecord) (int, error) {
 	var id int
 	err := db.pool.QueryRow(ctx,
-		"INSERT INTO tokens(guid, refresh_hash, status) VALUES($1, '', 'unused') RETURNING id",
-		guid,
+		`WITH next AS (SELECT tokens_next_id() AS id)
+		INSERT INTO tokens(id, created_at, tenant_id, guid, refresh_hash, status, auth_time, acr, amr, client_id, scope, audience, act, jkt, x5t)
+		VALUES((SELECT id FROM next), tokens_id_time((SELECT id FROM next)), $1, $2, $3, COALESCE(NULLIF($13, ''), 'unused'), $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`,
+		db.tenant, rec.GUID, rec.RefreshHash, rec.AuthTime, rec.ACR, rec.AMR, rec.ClientID, rec.Scope, rec.Audience, rec.Act, rec.JKT, rec.X5T, rec.Status,
 	).Scan(&id)
 	return id, err
 }
 
-func (db *PGXDatabase) StoreRefresh(ctx context.Context, id int, hash string) error {
-	_, err := db.pool.Exec(ctx,
-		"UPDATE tokens SET refresh_hash=$1, status='unused' WHERE id=$2",
-		hash, id,
-	)
-	return err
+// RotateRefresh marks the session id used and inserts next in its place in
+// one transaction. The update only matches an unused session and locks its
+// row, so of several concurrent rotations exactly one succeeds; the others
+// get ErrRefreshNotUnused and leave nothing behind. The status change is
+// announced on RevocationChannel when the transaction commits.
+func (db *PGXDatabase) RotateRefresh(ctx context.Context, id int, next models.TokenRecord) (int, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var used int
+	err = tx.QueryRow(ctx,
+		"UPDATE tokens SET status='used', status_changed_at=now() WHERE id=$1 AND "+tokenCreatedAt(id)+" AND status='unused' AND tenant_id=$2 RETURNING id",
+		id, db.tenant,
+	).Scan(&used)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrRefreshNotUnused
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := notifyRevocation(ctx, tx, Revocation{Tenant: db.tenant, ID: id}); err != nil {
+		return 0, err
+	}
+	newID, err := (&PGXDatabase{pool: tx, tenant: db.tenant}).InsertToken(ctx, next)
+	if err != nil {
+		return 0, err
+	}
+	return newID, tx.Commit(ctx)
 }
 
+// GetRefresh is the status lookup of access token checks, so it is served by
+// a replica when there are any. The replica only answers once it has
+// replayed the revocations observed by db.replicas; a lagging replica, one
+// that does not have the session yet or one that fails leaves the lookup to
+// the primary.
 func (db *PGXDatabase) GetRefresh(ctx context.Context, id int) (string, string, error) {
 	var hash, status string
+	if replica := db.replicas.pick(); replica != nil {
+		err := replica.QueryRow(ctx,
+			`SELECT refresh_hash, status FROM tokens WHERE id=$1 AND `+tokenCreatedAt(id)+` AND tenant_id=$2
+			AND COALESCE(pg_last_wal_replay_lsn(), pg_current_wal_lsn()) >= $3::pg_lsn`,
+			id, db.tenant, db.replicas.minLSN(),
+		).Scan(&hash, &status)
+		if err == nil {
+			return hash, status, nil
+		}
+	}
 	err := db.pool.QueryRow(ctx,
-		"SELECT refresh_hash, status FROM tokens WHERE id=$1",
-		id,
+		"SELECT refresh_hash, status FROM tokens WHERE id=$1 AND "+tokenCreatedAt(id)+" AND tenant_id=$2",
+		id, db.tenant,
 	).Scan(&hash, &status)
 	return hash, status, err
 }
 
-func (db *PGXDatabase) MarkRefreshUsed(ctx context.Context, id int) error {
-	_, err := db.pool.Exec(ctx,
-		"UPDATE tokens SET status='used' WHERE id=$1",
-		id,
-	)
-	return err
+func (db *PGXDatabase) GetToken(ctx context.Context, id int) (models.TokenRecord, error) {
+	rec := models.TokenRecord{ID: id}
+	err := db.pool.QueryRow(ctx,
+		"SELECT guid, refresh_hash, status, auth_time, acr, amr, client_id, scope, audience, act, jkt, x5t FROM tokens WHERE id=$1 AND "+tokenCreatedAt(id)+" AND tenant_id=$2",
+		id, db.tenant,
+	).Scan(&rec.GUID, &rec.RefreshHash, &rec.Status, &rec.AuthTime, &rec.ACR, &rec.AMR, &rec.ClientID, &rec.Scope, &rec.Audience, &rec.Act, &rec.JKT, &rec.X5T)
+	return rec, err
 }
 
+// InvalidateAllRefreshForGUID blocks every session of guid and announces it
+// on RevocationChannel when the transaction commits. Replicas are then not
+// read from until they have replayed the revocation.
 func (db *PGXDatabase) InvalidateAllRefreshForGUID(ctx context.Context, guid int) error {
-	_, err := db.pool.Exec(ctx,
-		"UPDATE tokens SET status='blocked' WHERE guid=$1",
-		guid,
-	)
-	return err
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx,
+		"UPDATE tokens SET status='blocked', status_changed_at=now() WHERE guid=$1 AND tenant_id=$2 AND status<>'blocked'",
+		guid, db.tenant,
+	); err != nil {
+		return err
+	}
+	if err := notifyRevocation(ctx, tx, Revocation{Tenant: db.tenant, GUID: guid}); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	return db.replicas.Observe(ctx, db.pool)
 }
@@ -0,0 +1,332 @@
+// Package dbtest checks that an implementation of database.Database behaves
+// like the Postgres one. Like testing/fstest it reports problems as an error
+// instead of depending on a *testing.T, so it can be run from tests or tools:
+//
+//	err := dbtest.TestDatabase(func() database.Database {
+//		return database.NewMemoryDatabase()
+//	})
+//
+// For Postgres, return a view of a fresh tenant on every call, e.g.
+// database.NewPGXDatabase(pool).ForTenant("dbtest-" + random).
+package dbtest
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TestDatabase runs every check against a fresh database from newDB and
+// returns all failures joined.
+func TestDatabase(newDB func() database.Database) error {
+	checks := []struct {
+		name string
+		run  func(context.Context, database.Database) error
+	}{
+		{"tokens round trip", checkRoundTrip},
+		{"missing tokens", checkMissing},
+		{"rotation", checkRotation},
+		{"sessions without refresh", checkUsedAtInsert},
+		{"concurrent rotation", checkConcurrentRotation},
+		{"concurrent inserts", checkConcurrentInserts},
+		{"per-guid invalidation", checkInvalidation},
+		{"roles", checkRoles},
+		{"jti replay", checkJTI},
+	}
+	var errs []error
+	for _, c := range checks {
+		if err := c.run(context.Background(), newDB()); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func record(guid int, hash string) models.TokenRecord {
+	return models.TokenRecord{
+		GUID:        guid,
+		IP:          "192.0.2.1",
+		UserAgent:   "dbtest",
+		RefreshHash: hash,
+		AuthTime:    time.Now().Add(-time.Minute).Truncate(time.Second),
+		ACR:         "1",
+		AMR:         []string{"otp"},
+		ClientID:    "client",
+		Scope:       "a b",
+		Audience:    []string{"api"},
+		Act:         map[string]interface{}{"sub": "7"},
+		JKT:         "jkt",
+		X5T:         "x5t",
+	}
+}
+
+func checkRoundTrip(ctx context.Context, db database.Database) error {
+	want := record(1, "h1$hash")
+	id, err := db.InsertToken(ctx, want)
+	if err != nil {
+		return err
+	}
+	if id <= 0 {
+		return fmt.Errorf("InsertToken returned id %d", id)
+	}
+	got, err := db.GetToken(ctx, id)
+	if err != nil {
+		return err
+	}
+	want.ID, want.Status, want.IP, want.UserAgent = id, "unused", "", ""
+	if !got.AuthTime.Equal(want.AuthTime) {
+		return fmt.Errorf("auth_time %v, want %v", got.AuthTime, want.AuthTime)
+	}
+	got.AuthTime = want.AuthTime
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("GetToken returned %+v, want %+v", got, want)
+	}
+	hash, status, err := db.GetRefresh(ctx, id)
+	if err != nil {
+		return err
+	}
+	if hash != want.RefreshHash || status != "unused" {
+		return fmt.Errorf("GetRefresh returned %q, %q", hash, status)
+	}
+
+	empty, err := db.InsertToken(ctx, models.TokenRecord{GUID: 1, AMR: []string{}, Audience: []string{}, AuthTime: time.Now()})
+	if err != nil {
+		return err
+	}
+	if got, err := db.GetToken(ctx, empty); err != nil || got.Act != nil || got.AMR == nil || got.Audience == nil {
+		return fmt.Errorf("empty record came back as %+v, %v", got, err)
+	}
+	return nil
+}
+
+func checkMissing(ctx context.Context, db database.Database) error {
+	if _, err := db.GetToken(ctx, 1<<30); !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("GetToken of a missing id returned %v, want pgx.ErrNoRows", err)
+	}
+	if _, _, err := db.GetRefresh(ctx, 1<<30); !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("GetRefresh of a missing id returned %v, want pgx.ErrNoRows", err)
+	}
+	if _, err := db.RotateRefresh(ctx, 1<<30, record(1, "x")); !errors.Is(err, database.ErrRefreshNotUnused) {
+		return fmt.Errorf("RotateRefresh of a missing id returned %v, want ErrRefreshNotUnused", err)
+	}
+	return nil
+}
+
+func checkRotation(ctx context.Context, db database.Database) error {
+	old, err := db.InsertToken(ctx, record(1, "old"))
+	if err != nil {
+		return err
+	}
+	next, err := db.RotateRefresh(ctx, old, record(1, "new"))
+	if err != nil {
+		return err
+	}
+	if next == old {
+		return errors.New("RotateRefresh reused the old id")
+	}
+	if err := wantStatus(ctx, db, old, "used"); err != nil {
+		return err
+	}
+	if err := wantStatus(ctx, db, next, "unused"); err != nil {
+		return err
+	}
+	if hash, _, _ := db.GetRefresh(ctx, next); hash != "new" {
+		return fmt.Errorf("rotated session has hash %q", hash)
+	}
+	if _, err := db.RotateRefresh(ctx, old, record(1, "again")); !errors.Is(err, database.ErrRefreshNotUnused) {
+		return fmt.Errorf("second rotation returned %v, want ErrRefreshNotUnused", err)
+	}
+	return nil
+}
+
+func checkUsedAtInsert(ctx context.Context, db database.Database) error {
+	rec := record(1, "none")
+	rec.Status = "used"
+	id, err := db.InsertToken(ctx, rec)
+	if err != nil {
+		return err
+	}
+	if err := wantStatus(ctx, db, id, "used"); err != nil {
+		return err
+	}
+	if _, err := db.RotateRefresh(ctx, id, record(1, "next")); !errors.Is(err, database.ErrRefreshNotUnused) {
+		return fmt.Errorf("rotating a session stored as used returned %v, want ErrRefreshNotUnused", err)
+	}
+	if err := db.InvalidateAllRefreshForGUID(ctx, 1); err != nil {
+		return err
+	}
+	return wantStatus(ctx, db, id, "blocked")
+}
+
+func checkConcurrentRotation(ctx context.Context, db database.Database) error {
+	id, err := db.InsertToken(ctx, record(1, "old"))
+	if err != nil {
+		return err
+	}
+	const n = 16
+	var wg sync.WaitGroup
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := db.RotateRefresh(ctx, id, record(1, strconv.Itoa(i)))
+			results <- err
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+	won := 0
+	for err := range results {
+		switch {
+		case err == nil:
+			won++
+		case !errors.Is(err, database.ErrRefreshNotUnused):
+			return err
+		}
+	}
+	if won != 1 {
+		return fmt.Errorf("%d of %d concurrent rotations succeeded, want 1", won, n)
+	}
+	return nil
+}
+
+func checkConcurrentInserts(ctx context.Context, db database.Database) error {
+	const n = 32
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ids := map[int]bool{}
+	var firstErr error
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := db.InsertToken(ctx, record(1, "h"))
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			ids[id] = true
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if len(ids) != n {
+		return fmt.Errorf("%d concurrent inserts produced %d distinct ids", n, len(ids))
+	}
+	return nil
+}
+
+func checkInvalidation(ctx context.Context, db database.Database) error {
+	unused, err := db.InsertToken(ctx, record(1, "a"))
+	if err != nil {
+		return err
+	}
+	old, err := db.InsertToken(ctx, record(1, "b"))
+	if err != nil {
+		return err
+	}
+	rotated, err := db.RotateRefresh(ctx, old, record(1, "c"))
+	if err != nil {
+		return err
+	}
+	other, err := db.InsertToken(ctx, record(2, "d"))
+	if err != nil {
+		return err
+	}
+	if err := db.InvalidateAllRefreshForGUID(ctx, 1); err != nil {
+		return err
+	}
+	for _, id := range []int{unused, old, rotated} {
+		if err := wantStatus(ctx, db, id, "blocked"); err != nil {
+			return err
+		}
+	}
+	if err := wantStatus(ctx, db, other, "unused"); err != nil {
+		return err
+	}
+	if _, err := db.RotateRefresh(ctx, rotated, record(1, "e")); !errors.Is(err, database.ErrRefreshNotUnused) {
+		return fmt.Errorf("rotating a blocked session returned %v, want ErrRefreshNotUnused", err)
+	}
+	return nil
+}
+
+func checkRoles(ctx context.Context, db database.Database) error {
+	if err := db.SaveRole(ctx, "editor", []string{"posts:write", "posts:read"}); err != nil {
+		return err
+	}
+	if err := db.SaveRole(ctx, "viewer", []string{"posts:read", "comments:read"}); err != nil {
+		return err
+	}
+	for _, role := range []string{"viewer", "editor", "editor"} {
+		if err := db.AssignRole(ctx, 1, role); err != nil {
+			return err
+		}
+	}
+	if err := wantRoles(ctx, db, 1, []string{"editor", "viewer"}, []string{"comments:read", "posts:read", "posts:write"}); err != nil {
+		return err
+	}
+	if err := db.SaveRole(ctx, "editor", []string{"posts:write"}); err != nil {
+		return err
+	}
+	if err := db.RevokeRole(ctx, 1, "viewer"); err != nil {
+		return err
+	}
+	if err := wantRoles(ctx, db, 1, []string{"editor"}, []string{"posts:write"}); err != nil {
+		return err
+	}
+	if err := wantRoles(ctx, db, 2, nil, nil); err != nil {
+		return err
+	}
+	if err := db.AssignRole(ctx, 1, "missing"); err == nil {
+		return errors.New("assigning an unknown role succeeded")
+	}
+	return nil
+}
+
+func checkJTI(ctx context.Context, db database.Database) error {
+	jti := "dbtest-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	exp := time.Now().Add(time.Hour)
+	if fresh, err := db.UseJTI(ctx, jti, exp); err != nil || !fresh {
+		return fmt.Errorf("first use returned %v, %v", fresh, err)
+	}
+	if fresh, err := db.UseJTI(ctx, jti, exp); err != nil || fresh {
+		return fmt.Errorf("replay returned %v, %v", fresh, err)
+	}
+	return nil
+}
+
+func wantStatus(ctx context.Context, db database.Database, id int, want string) error {
+	_, status, err := db.GetRefresh(ctx, id)
+	if err != nil {
+		return err
+	}
+	if status != want {
+		return fmt.Errorf("session %d is %q, want %q", id, status, want)
+	}
+	return nil
+}
+
+func wantRoles(ctx context.Context, db database.Database, guid int, roles, permissions []string) error {
+	gotRoles, gotPermissions, err := db.GetUserRoles(ctx, guid)
+	if err != nil {
+		return err
+	}
+	if len(gotRoles) != len(roles) || (len(roles) > 0 && !reflect.DeepEqual(gotRoles, roles)) {
+		return fmt.Errorf("user %d has roles %v, want %v", guid, gotRoles, roles)
+	}
+	if len(gotPermissions) != len(permissions) || (len(permissions) > 0 && !reflect.DeepEqual(gotPermissions, permissions)) {
+		return fmt.Errorf("user %d has permissions %v, want %v", guid, gotPermissions, permissions)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+	"time"
+)
+
+type DeviceStore interface {
+	InsertDeviceCode(ctx context.Context, c models.DeviceCode) error
+	GetDeviceCode(ctx context.Context, hash string) (models.DeviceCode, error)
+	GetDeviceCodeByUserCode(ctx context.Context, userCode string) (models.DeviceCode, error)
+	RecordDevicePoll(ctx context.Context, hash string, at time.Time, interval int) error
+	ApproveDeviceCode(ctx context.Context, userCode string, guid int, authTime time.Time, acr string, amr []string) (bool, error)
+	DenyDeviceCode(ctx context.Context, userCode string) (bool, error)
+	ConsumeDeviceCode(ctx context.Context, hash string) (bool, error)
+	CountDeviceCodeFailuresSince(ctx context.Context, guid int, since time.Time) (int, error)
+	RecordDeviceCodeFailure(ctx context.Context, guid int) error
+}
+
+const deviceCodeColumns = "device_code_hash, user_code, client_id, scope, status, guid, auth_time, acr, amr, interval_seconds, last_polled_at, expires_at"
+
+func (db *PGXDatabase) InsertDeviceCode(ctx context.Context, c models.DeviceCode) error {
+	_, err := db.pool.Exec(ctx,
+		"INSERT INTO device_codes(tenant_id, device_code_hash, user_code, client_id, scope, interval_seconds, expires_at) VALUES($1, $2, $3, $4, $5, $6, $7)",
+		db.tenant, c.DeviceCodeHash, c.UserCode, c.ClientID, c.Scope, c.Interval, c.ExpiresAt,
+	)
+	return err
+}
+
+func (db *PGXDatabase) GetDeviceCode(ctx context.Context, hash string) (models.DeviceCode, error) {
+	return db.scanDeviceCode(ctx,
+		"SELECT "+deviceCodeColumns+" FROM device_codes WHERE device_code_hash=$1 AND tenant_id=$2",
+		hash, db.tenant,
+	)
+}
+
+func (db *PGXDatabase) GetDeviceCodeByUserCode(ctx context.Context, userCode string) (models.DeviceCode, error) {
+	return db.scanDeviceCode(ctx,
+		"SELECT "+deviceCodeColumns+" FROM device_codes WHERE user_code=$1 AND tenant_id=$2",
+		userCode, db.tenant,
+	)
+}
+
+func (db *PGXDatabase) scanDeviceCode(ctx context.Context, sql string, args ...interface{}) (models.DeviceCode, error) {
+	var c models.DeviceCode
+	var authTime, lastPolled *time.Time
+	err := db.pool.QueryRow(ctx, sql, args...).Scan(
+		&c.DeviceCodeHash, &c.UserCode, &c.ClientID, &c.Scope, &c.Status, &c.GUID,
+		&authTime, &c.ACR, &c.AMR, &c.Interval, &lastPolled, &c.ExpiresAt,
+	)
+	if authTime != nil {
+		c.AuthTime = *authTime
+	}
+	if lastPolled != nil {
+		c.LastPolledAt = *lastPolled
+	}
+	return c, err
+}
+
+func (db *PGXDatabase) RecordDevicePoll(ctx context.Context, hash string, at time.Time, interval int) error {
+	_, err := db.pool.Exec(ctx,
+		"UPDATE device_codes SET last_polled_at=$1, interval_seconds=$2 WHERE device_code_hash=$3 AND tenant_id=$4",
+		at, interval, hash, db.tenant,
+	)
+	return err
+}
+
+// ApproveDeviceCode binds a pending, unexpired code to the user who entered
+// it and reports whether it was still pending.
+func (db *PGXDatabase) ApproveDeviceCode(ctx context.Context, userCode string, guid int, authTime time.Time, acr string, amr []string) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		`UPDATE device_codes SET status='approved', guid=$1, auth_time=$2, acr=$3, amr=$4
+		WHERE user_code=$5 AND status='pending' AND expires_at > now() AND tenant_id=$6`,
+		guid, authTime, acr, amr, userCode, db.tenant,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (db *PGXDatabase) DenyDeviceCode(ctx context.Context, userCode string) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		"UPDATE device_codes SET status='denied' WHERE user_code=$1 AND status='pending' AND tenant_id=$2",
+		userCode, db.tenant,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// ConsumeDeviceCode moves an approved code to consumed so that exactly one
+// poll receives the tokens.
+func (db *PGXDatabase) ConsumeDeviceCode(ctx context.Context, hash string) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		"UPDATE device_codes SET status='consumed' WHERE device_code_hash=$1 AND status='approved' AND tenant_id=$2",
+		hash, db.tenant,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// CountDeviceCodeFailuresSince returns how many wrong user codes the user
+// entered since the given time.
+func (db *PGXDatabase) CountDeviceCodeFailuresSince(ctx context.Context, guid int, since time.Time) (int, error) {
+	var n int
+	err := db.pool.QueryRow(ctx,
+		"SELECT count(*) FROM device_code_failures WHERE guid=$1 AND created_at >= $2 AND tenant_id=$3",
+		guid, since, db.tenant,
+	).Scan(&n)
+	return n, err
+}
+
+func (db *PGXDatabase) RecordDeviceCodeFailure(ctx context.Context, guid int) error {
+	_, err := db.pool.Exec(ctx,
+		"INSERT INTO device_code_failures(tenant_id, guid) VALUES($1, $2)",
+		db.tenant, guid,
+	)
+	return err
+}
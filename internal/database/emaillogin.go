@@ -0,0 +1,116 @@
+package database
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+type EmailLoginStore interface {
+	GetUserByEmail(ctx context.Context, email string) (guid int, err error)
+	GetUserEmail(ctx context.Context, guid int) (string, error)
+	MarkEmailVerified(ctx context.Context, guid int) error
+	CountLoginCodesSince(ctx context.Context, email string, since time.Time) (int, error)
+	InsertLoginCode(ctx context.Context, code models.LoginCode) error
+	GetLatestLoginCode(ctx context.Context, email string) (models.LoginCode, error)
+	GetLoginCodeByLink(ctx context.Context, linkHash string) (models.LoginCode, error)
+	UseLoginCodeAttempt(ctx context.Context, id, max int) (bool, error)
+	ConsumeLoginCode(ctx context.Context, id int) (bool, error)
+}
+
+const loginCodeColumns = "id, email, guid, code_hash, link_hash, attempts, used, expires_at, created_at"
+
+func (db *PGXDatabase) GetUserByEmail(ctx context.Context, email string) (int, error) {
+	var guid int
+	err := db.pool.QueryRow(ctx,
+		"SELECT guid FROM users WHERE email=$1 AND tenant_id=$2",
+		email, db.tenant,
+	).Scan(&guid)
+	return guid, err
+}
+
+func (db *PGXDatabase) GetUserEmail(ctx context.Context, guid int) (string, error) {
+	var email string
+	err := db.pool.QueryRow(ctx,
+		"SELECT email FROM users WHERE guid=$1 AND email IS NOT NULL AND tenant_id=$2",
+		guid, db.tenant,
+	).Scan(&email)
+	return email, err
+}
+
+func (db *PGXDatabase) MarkEmailVerified(ctx context.Context, guid int) error {
+	_, err := db.pool.Exec(ctx,
+		"UPDATE users SET email_verified=TRUE, updated_at=now() WHERE guid=$1 AND NOT email_verified AND tenant_id=$2",
+		guid, db.tenant,
+	)
+	return err
+}
+
+func (db *PGXDatabase) CountLoginCodesSince(ctx context.Context, email string, since time.Time) (int, error) {
+	var n int
+	err := db.pool.QueryRow(ctx,
+		"SELECT count(*) FROM login_codes WHERE email=$1 AND created_at >= $2 AND tenant_id=$3",
+		email, since, db.tenant,
+	).Scan(&n)
+	return n, err
+}
+
+func (db *PGXDatabase) InsertLoginCode(ctx context.Context, code models.LoginCode) error {
+	_, err := db.pool.Exec(ctx,
+		"INSERT INTO login_codes(tenant_id, email, guid, code_hash, link_hash, expires_at) VALUES($1, $2, $3, $4, $5, $6)",
+		db.tenant, code.Email, code.GUID, code.CodeHash, code.LinkHash, code.ExpiresAt,
+	)
+	return err
+}
+
+func (db *PGXDatabase) GetLatestLoginCode(ctx context.Context, email string) (models.LoginCode, error) {
+	return db.scanLoginCode(ctx,
+		"SELECT "+loginCodeColumns+" FROM login_codes WHERE email=$1 AND tenant_id=$2 ORDER BY id DESC LIMIT 1",
+		email, db.tenant,
+	)
+}
+
+func (db *PGXDatabase) GetLoginCodeByLink(ctx context.Context, linkHash string) (models.LoginCode, error) {
+	return db.scanLoginCode(ctx,
+		"SELECT "+loginCodeColumns+" FROM login_codes WHERE link_hash=$1 AND tenant_id=$2",
+		linkHash, db.tenant,
+	)
+}
+
+func (db *PGXDatabase) scanLoginCode(ctx context.Context, sql string, args ...interface{}) (models.LoginCode, error) {
+	var c models.LoginCode
+	err := db.pool.QueryRow(ctx, sql, args...).Scan(
+		&c.ID, &c.Email, &c.GUID, &c.CodeHash, &c.LinkHash, &c.Attempts, &c.Used, &c.ExpiresAt, &c.CreatedAt,
+	)
+	return c, err
+}
+
+// UseLoginCodeAttempt counts an attempt to redeem the code unless max
+// attempts were already made, and reports whether it did. The check and the
+// count are one statement, so concurrent guesses can not exceed max.
+func (db *PGXDatabase) UseLoginCodeAttempt(ctx context.Context, id, max int) (bool, error) {
+	var attempts int
+	err := db.pool.QueryRow(ctx,
+		"UPDATE login_codes SET attempts=attempts+1 WHERE id=$1 AND attempts<$2 AND tenant_id=$3 RETURNING attempts",
+		id, max, db.tenant,
+	).Scan(&attempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ConsumeLoginCode marks the code as used and reports whether this call was
+// the one that did it, so a code can never be redeemed twice.
+func (db *PGXDatabase) ConsumeLoginCode(ctx context.Context, id int) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		"UPDATE login_codes SET used=TRUE WHERE id=$1 AND used=FALSE AND tenant_id=$2",
+		id, db.tenant,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+)
+
+type ExchangeStore interface {
+	GetExchangePolicy(ctx context.Context, clientID string) (models.ExchangePolicy, error)
+	SaveExchangePolicy(ctx context.Context, p models.ExchangePolicy) error
+	GrantImpersonation(ctx context.Context, actorGUID, subjectGUID int) error
+	CanImpersonate(ctx context.Context, actorGUID, subjectGUID int) (bool, error)
+}
+
+func (db *PGXDatabase) GetExchangePolicy(ctx context.Context, clientID string) (models.ExchangePolicy, error) {
+	p := models.ExchangePolicy{ClientID: clientID}
+	err := db.pool.QueryRow(ctx,
+		"SELECT audiences, scopes, impersonation FROM exchange_policies WHERE client_id=$1 AND tenant_id=$2",
+		clientID, db.tenant,
+	).Scan(&p.Audiences, &p.Scopes, &p.Impersonation)
+	return p, err
+}
+
+func (db *PGXDatabase) SaveExchangePolicy(ctx context.Context, p models.ExchangePolicy) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO exchange_policies(tenant_id, client_id, audiences, scopes, impersonation) VALUES($1, $2, $3, $4, $5)
+		ON CONFLICT (tenant_id, client_id) DO UPDATE
+		SET audiences=EXCLUDED.audiences, scopes=EXCLUDED.scopes, impersonation=EXCLUDED.impersonation, updated_at=now()`,
+		db.tenant, p.ClientID, p.Audiences, p.Scopes, p.Impersonation,
+	)
+	return err
+}
+
+// GrantImpersonation allows actorGUID to impersonate subjectGUID, or any user
+// when subjectGUID is 0.
+func (db *PGXDatabase) GrantImpersonation(ctx context.Context, actorGUID, subjectGUID int) error {
+	_, err := db.pool.Exec(ctx,
+		"INSERT INTO impersonation_grants(tenant_id, actor_guid, subject_guid) VALUES($1, $2, $3) ON CONFLICT DO NOTHING",
+		db.tenant, actorGUID, subjectGUID,
+	)
+	return err
+}
+
+func (db *PGXDatabase) CanImpersonate(ctx context.Context, actorGUID, subjectGUID int) (bool, error) {
+	var ok bool
+	err := db.pool.QueryRow(ctx,
+		"SELECT EXISTS(SELECT 1 FROM impersonation_grants WHERE actor_guid=$1 AND subject_guid IN ($2, 0) AND tenant_id=$3)",
+		actorGUID, subjectGUID, db.tenant,
+	).Scan(&ok)
+	return ok, err
+}
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+)
+
+type FederationStore interface {
+	AuditStore
+	SaveIdentityProvider(ctx context.Context, p models.IdentityProvider) error
+	GetIdentityProvider(ctx context.Context, id string) (models.IdentityProvider, error)
+	InsertFederationState(ctx context.Context, st models.FederationState) error
+	ConsumeFederationState(ctx context.Context, stateHash string) (models.FederationState, error)
+	GetExternalIdentity(ctx context.Context, providerID, subject string) (guid int, err error)
+	LinkExternalIdentity(ctx context.Context, providerID, subject string, guid int) (int, error)
+	GetUserByEmail(ctx context.Context, email string) (guid int, err error)
+	CreateUser(ctx context.Context, u models.User) (guid int, err error)
+}
+
+func (db *PGXDatabase) SaveIdentityProvider(ctx context.Context, p models.IdentityProvider) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO identity_providers(tenant_id, id, issuer, client_id, client_secret, scopes)
+		VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (tenant_id, id) DO UPDATE
+		SET issuer=EXCLUDED.issuer, client_id=EXCLUDED.client_id, client_secret=EXCLUDED.client_secret, scopes=EXCLUDED.scopes`,
+		db.tenant, p.ID, p.Issuer, p.ClientID, p.ClientSecret, p.Scopes,
+	)
+	return err
+}
+
+func (db *PGXDatabase) GetIdentityProvider(ctx context.Context, id string) (models.IdentityProvider, error) {
+	var p models.IdentityProvider
+	err := db.pool.QueryRow(ctx,
+		"SELECT id, issuer, client_id, client_secret, scopes, created_at FROM identity_providers WHERE id=$1 AND tenant_id=$2",
+		id, db.tenant,
+	).Scan(&p.ID, &p.Issuer, &p.ClientID, &p.ClientSecret, &p.Scopes, &p.CreatedAt)
+	return p, err
+}
+
+func (db *PGXDatabase) InsertFederationState(ctx context.Context, st models.FederationState) error {
+	_, err := db.pool.Exec(ctx,
+		"INSERT INTO federation_states(state_hash, tenant_id, provider_id, nonce, code_verifier, expires_at) VALUES($1, $2, $3, $4, $5, $6)",
+		st.StateHash, db.tenant, st.ProviderID, st.Nonce, st.CodeVerifier, st.ExpiresAt,
+	)
+	return err
+}
+
+// ConsumeFederationState deletes the state while reading it, so every
+// upstream response can be redeemed only once.
+func (db *PGXDatabase) ConsumeFederationState(ctx context.Context, stateHash string) (models.FederationState, error) {
+	st := models.FederationState{StateHash: stateHash}
+	err := db.pool.QueryRow(ctx,
+		"DELETE FROM federation_states WHERE state_hash=$1 AND tenant_id=$2 RETURNING provider_id, nonce, code_verifier, expires_at",
+		stateHash, db.tenant,
+	).Scan(&st.ProviderID, &st.Nonce, &st.CodeVerifier, &st.ExpiresAt)
+	return st, err
+}
+
+func (db *PGXDatabase) GetExternalIdentity(ctx context.Context, providerID, subject string) (int, error) {
+	var guid int
+	err := db.pool.QueryRow(ctx,
+		"SELECT guid FROM external_identities WHERE provider_id=$1 AND subject=$2 AND tenant_id=$3",
+		providerID, subject, db.tenant,
+	).Scan(&guid)
+	return guid, err
+}
+
+// LinkExternalIdentity links the upstream subject to guid unless it is
+// already linked, and returns the user it is linked to either way.
+func (db *PGXDatabase) LinkExternalIdentity(ctx context.Context, providerID, subject string, guid int) (int, error) {
+	var linked int
+	err := db.pool.QueryRow(ctx,
+		`INSERT INTO external_identities(tenant_id, provider_id, subject, guid) VALUES($1, $2, $3, $4)
+		ON CONFLICT (tenant_id, provider_id, subject) DO UPDATE SET subject=EXCLUDED.subject
+		RETURNING guid`,
+		db.tenant, providerID, subject, guid,
+	).Scan(&linked)
+	return linked, err
+}
+
+func (db *PGXDatabase) CreateUser(ctx context.Context, u models.User) (int, error) {
+	var guid int
+	err := db.pool.QueryRow(ctx,
+		`INSERT INTO users(tenant_id, email, email_verified, name, given_name, family_name)
+		VALUES($1, NULLIF($2, ''), $3, $4, $5, $6) RETURNING guid`,
+		db.tenant, u.Email, u.EmailVerified, u.Name, u.GivenName, u.FamilyName,
+	).Scan(&guid)
+	return guid, err
+}
+
+// PasswordLoginStore links directory accounts and keeps their roles in sync.
+type PasswordLoginStore interface {
+	FederationStore
+	RoleStore
+}
@@ -0,0 +1,231 @@
+package database
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryDatabase implements Database in memory, for tests and single-node
+// development. It follows PGXDatabase: missing rows are pgx.ErrNoRows, only
+// the columns of the tokens table survive a round trip, times are kept to
+// the microsecond and every method is atomic.
+type MemoryDatabase struct {
+	state  *memoryState
+	tenant string
+}
+
+type memoryState struct {
+	mu          sync.Mutex
+	lastTokenID int
+	tokens      map[int]memoryToken
+	roles       map[string]map[string][]string // tenant -> role -> permissions
+	userRoles   map[string]map[int][]string    // tenant -> guid -> roles
+	usedJTIs    map[string]time.Time
+}
+
+type memoryToken struct {
+	tenant string
+	rec    models.TokenRecord
+}
+
+func NewMemoryDatabase() *MemoryDatabase {
+	return &MemoryDatabase{
+		state: &memoryState{
+			tokens:    map[int]memoryToken{},
+			roles:     map[string]map[string][]string{},
+			userRoles: map[string]map[int][]string{},
+			usedJTIs:  map[string]time.Time{},
+		},
+		tenant: DefaultTenant,
+	}
+}
+
+// ForTenant returns a view of the same data restricted to tenant.
+func (db *MemoryDatabase) ForTenant(tenant string) *MemoryDatabase {
+	return &MemoryDatabase{state: db.state, tenant: tenant}
+}
+
+func (db *MemoryDatabase) InsertToken(ctx context.Context, rec models.TokenRecord) (int, error) {
+	db.state.mu.Lock()
+	defer db.state.mu.Unlock()
+	return db.insertToken(rec)
+}
+
+func (db *MemoryDatabase) insertToken(rec models.TokenRecord) (int, error) {
+	stored, err := storedToken(rec)
+	if err != nil {
+		return 0, err
+	}
+	db.state.lastTokenID++
+	stored.ID = db.state.lastTokenID
+	if stored.Status == "" {
+		stored.Status = "unused"
+	}
+	db.state.tokens[stored.ID] = memoryToken{tenant: db.tenant, rec: stored}
+	return stored.ID, nil
+}
+
+func (db *MemoryDatabase) RotateRefresh(ctx context.Context, id int, next models.TokenRecord) (int, error) {
+	db.state.mu.Lock()
+	defer db.state.mu.Unlock()
+	t, ok := db.state.tokens[id]
+	if !ok || t.tenant != db.tenant || t.rec.Status != "unused" {
+		return 0, ErrRefreshNotUnused
+	}
+	newID, err := db.insertToken(next)
+	if err != nil {
+		return 0, err
+	}
+	t.rec.Status = "used"
+	db.state.tokens[id] = t
+	return newID, nil
+}
+
+func (db *MemoryDatabase) GetRefresh(ctx context.Context, id int) (string, string, error) {
+	rec, err := db.GetToken(ctx, id)
+	return rec.RefreshHash, rec.Status, err
+}
+
+func (db *MemoryDatabase) GetToken(ctx context.Context, id int) (models.TokenRecord, error) {
+	db.state.mu.Lock()
+	defer db.state.mu.Unlock()
+	t, ok := db.state.tokens[id]
+	if !ok || t.tenant != db.tenant {
+		return models.TokenRecord{}, pgx.ErrNoRows
+	}
+	return storedToken(t.rec)
+}
+
+func (db *MemoryDatabase) InvalidateAllRefreshForGUID(ctx context.Context, guid int) error {
+	db.state.mu.Lock()
+	defer db.state.mu.Unlock()
+	for id, t := range db.state.tokens {
+		if t.tenant == db.tenant && t.rec.GUID == guid {
+			t.rec.Status = "blocked"
+			db.state.tokens[id] = t
+		}
+	}
+	return nil
+}
+
+// UseJTI records jti like the used_jtis table, which is shared by all
+// tenants. Expired entries are dropped on the way.
+func (db *MemoryDatabase) UseJTI(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	db.state.mu.Lock()
+	defer db.state.mu.Unlock()
+	now := time.Now()
+	for k, exp := range db.state.usedJTIs {
+		if exp.Before(now) {
+			delete(db.state.usedJTIs, k)
+		}
+	}
+	if _, ok := db.state.usedJTIs[jti]; ok {
+		return false, nil
+	}
+	db.state.usedJTIs[jti] = expiresAt
+	return true, nil
+}
+
+func (db *MemoryDatabase) SaveRole(ctx context.Context, role string, permissions []string) error {
+	db.state.mu.Lock()
+	defer db.state.mu.Unlock()
+	roles := db.state.roles[db.tenant]
+	if roles == nil {
+		roles = map[string][]string{}
+		db.state.roles[db.tenant] = roles
+	}
+	roles[role] = sortedUnique(permissions)
+	return nil
+}
+
+// AssignRole fails for unknown roles, as the foreign key does in Postgres.
+func (db *MemoryDatabase) AssignRole(ctx context.Context, guid int, role string) error {
+	db.state.mu.Lock()
+	defer db.state.mu.Unlock()
+	if _, ok := db.state.roles[db.tenant][role]; !ok {
+		return fmt.Errorf("role %q does not exist", role)
+	}
+	users := db.state.userRoles[db.tenant]
+	if users == nil {
+		users = map[int][]string{}
+		db.state.userRoles[db.tenant] = users
+	}
+	users[guid] = sortedUnique(append(users[guid], role))
+	return nil
+}
+
+func (db *MemoryDatabase) RevokeRole(ctx context.Context, guid int, role string) error {
+	db.state.mu.Lock()
+	defer db.state.mu.Unlock()
+	users := db.state.userRoles[db.tenant]
+	var kept []string
+	for _, r := range users[guid] {
+		if r != role {
+			kept = append(kept, r)
+		}
+	}
+	if users != nil {
+		users[guid] = kept
+	}
+	return nil
+}
+
+func (db *MemoryDatabase) GetUserRoles(ctx context.Context, guid int) ([]string, []string, error) {
+	db.state.mu.Lock()
+	defer db.state.mu.Unlock()
+	roles := append([]string{}, db.state.userRoles[db.tenant][guid]...)
+	var permissions []string
+	for _, r := range roles {
+		permissions = append(permissions, db.state.roles[db.tenant][r]...)
+	}
+	return roles, sortedUnique(permissions), nil
+}
+
+// storedToken copies rec the way a round trip through the tokens table
+// would: no IP, user agent or creation time, empty arrays instead of nil
+// and act decoded from JSON.
+func storedToken(rec models.TokenRecord) (models.TokenRecord, error) {
+	stored := models.TokenRecord{
+		ID:          rec.ID,
+		GUID:        rec.GUID,
+		RefreshHash: rec.RefreshHash,
+		Status:      rec.Status,
+		AuthTime:    rec.AuthTime.Round(time.Microsecond),
+		ACR:         rec.ACR,
+		AMR:         append([]string{}, rec.AMR...),
+		ClientID:    rec.ClientID,
+		Scope:       rec.Scope,
+		Audience:    append([]string{}, rec.Audience...),
+		JKT:         rec.JKT,
+		X5T:         rec.X5T,
+	}
+	if rec.Act != nil {
+		data, err := json.Marshal(rec.Act)
+		if err != nil {
+			return models.TokenRecord{}, err
+		}
+		if err := json.Unmarshal(data, &stored.Act); err != nil {
+			return models.TokenRecord{}, err
+		}
+	}
+	return stored, nil
+}
+
+func sortedUnique(values []string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,16 @@
+package database_test
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/database/dbtest"
+	"testing"
+)
+
+func TestMemoryDatabase(t *testing.T) {
+	err := dbtest.TestDatabase(func() database.Database {
+		return database.NewMemoryDatabase()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,179 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// migrationLockID is the advisory lock held while migrating, so that
+// replicas starting at the same time apply every migration once.
+const migrationLockID = 0x676f61757468 // "goauth"
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one version of the schema.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrator applies versioned migrations and records them in the
+// schema_migrations table.
+type Migrator struct {
+	pool       DBPool
+	migrations []Migration
+}
+
+// NewMigrator reads the migrations in the root of fsys.
+func NewMigrator(pool DBPool, fsys fs.FS) (*Migrator, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		m := migrationFile.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(data)
+		} else {
+			mig.Down = string(data)
+		}
+	}
+	var migrations []Migration
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return &Migrator{pool: pool, migrations: migrations}, nil
+}
+
+// Latest is the newest version known to the migrator.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version returns the newest applied version, 0 for an empty database.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	var exists bool
+	if err := m.pool.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil || !exists {
+		return 0, err
+	}
+	var version int
+	err := m.pool.QueryRow(ctx, "SELECT COALESCE(max(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// Up applies the migrations after the current version up to and including
+// target, all of them when target is 0. It returns the versions applied.
+func (m *Migrator) Up(ctx context.Context, target int) ([]int, error) {
+	if target == 0 {
+		target = m.Latest()
+	}
+	return m.migrate(ctx, func(current int) ([]Migration, error) {
+		var todo []Migration
+		for _, mig := range m.migrations {
+			if mig.Version > current && mig.Version <= target {
+				todo = append(todo, mig)
+			}
+		}
+		return todo, nil
+	}, true)
+}
+
+// Down reverts the newest steps applied migrations. It returns the versions
+// reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]int, error) {
+	return m.migrate(ctx, func(current int) ([]Migration, error) {
+		var todo []Migration
+		for i := len(m.migrations) - 1; i >= 0 && len(todo) < steps; i-- {
+			mig := m.migrations[i]
+			if mig.Version > current {
+				continue
+			}
+			if mig.Down == "" {
+				return nil, fmt.Errorf("migration %d_%s can not be reverted", mig.Version, mig.Name)
+			}
+			todo = append(todo, mig)
+		}
+		return todo, nil
+	}, false)
+}
+
+// migrate runs the migrations plan picks for the current version in one
+// transaction holding the migration lock. Postgres DDL is transactional, so
+// a failing migration leaves the schema as it was.
+func (m *Migrator) migrate(ctx context.Context, plan func(current int) ([]Migration, error), up bool) ([]int, error) {
+	tx, err := m.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", int64(migrationLockID)); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+	); err != nil {
+		return nil, err
+	}
+	var current int
+	if err := tx.QueryRow(ctx, "SELECT COALESCE(max(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return nil, err
+	}
+	todo, err := plan(current)
+	if err != nil {
+		return nil, err
+	}
+	var done []int
+	for _, mig := range todo {
+		if up {
+			if _, err := tx.Exec(ctx, mig.Up); err != nil {
+				return nil, fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			_, err = tx.Exec(ctx, "INSERT INTO schema_migrations(version, name) VALUES($1, $2)", mig.Version, mig.Name)
+		} else {
+			if _, err := tx.Exec(ctx, mig.Down); err != nil {
+				return nil, fmt.Errorf("reverting migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			_, err = tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version=$1", mig.Version)
+		}
+		if err != nil {
+			return nil, err
+		}
+		done = append(done, mig.Version)
+	}
+	return done, tx.Commit(ctx)
+}
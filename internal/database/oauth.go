@@ -0,0 +1,119 @@
+package database
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+	"time"
+)
+
+type OAuthStore interface {
+	DeviceStore
+	ExchangeStore
+	AuditStore
+	InsertClient(ctx context.Context, c models.Client) error
+	GetClient(ctx context.Context, id string) (models.Client, error)
+	GetConsent(ctx context.Context, guid int, clientID string) ([]string, error)
+	SaveConsent(ctx context.Context, guid int, clientID string, scopes []string) error
+	InsertAuthorizationCode(ctx context.Context, c models.AuthorizationCode) error
+	GetAuthorizationCode(ctx context.Context, hash string) (models.AuthorizationCode, error)
+	ConsumeAuthorizationCode(ctx context.Context, hash string) (bool, error)
+	GetUser(ctx context.Context, guid int) (models.User, error)
+	UseJTI(ctx context.Context, jti string, expiresAt time.Time) (bool, error)
+}
+
+func (db *PGXDatabase) InsertClient(ctx context.Context, c models.Client) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO clients(tenant_id, client_id, secret_hash, name, redirect_uris, scopes, grant_types, auth_method, jwks, tls_subject_dn, cert_thumbprint, dpop_bound_access_tokens, tls_client_certificate_bound_access_tokens)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		db.tenant, c.ID, c.SecretHash, c.Name, c.RedirectURIs, c.Scopes, c.GrantTypes, c.AuthMethod, c.JWKS, c.TLSSubjectDN, c.CertThumbprint, c.DPoPBound, c.CertBound,
+	)
+	return err
+}
+
+func (db *PGXDatabase) GetClient(ctx context.Context, id string) (models.Client, error) {
+	c := models.Client{ID: id}
+	err := db.pool.QueryRow(ctx,
+		`SELECT secret_hash, name, redirect_uris, scopes, grant_types, auth_method, jwks, tls_subject_dn, cert_thumbprint, dpop_bound_access_tokens, tls_client_certificate_bound_access_tokens, created_at
+		FROM clients WHERE client_id=$1 AND tenant_id=$2`,
+		id, db.tenant,
+	).Scan(&c.SecretHash, &c.Name, &c.RedirectURIs, &c.Scopes, &c.GrantTypes, &c.AuthMethod, &c.JWKS, &c.TLSSubjectDN, &c.CertThumbprint, &c.DPoPBound, &c.CertBound, &c.CreatedAt)
+	return c, err
+}
+
+func (db *PGXDatabase) GetConsent(ctx context.Context, guid int, clientID string) ([]string, error) {
+	var scopes []string
+	err := db.pool.QueryRow(ctx,
+		"SELECT scopes FROM consents WHERE guid=$1 AND client_id=$2 AND tenant_id=$3",
+		guid, clientID, db.tenant,
+	).Scan(&scopes)
+	return scopes, err
+}
+
+// SaveConsent adds scopes to what the user already granted the client.
+func (db *PGXDatabase) SaveConsent(ctx context.Context, guid int, clientID string, scopes []string) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO consents(tenant_id, guid, client_id, scopes) VALUES($1, $2, $3, $4)
+		ON CONFLICT (tenant_id, guid, client_id) DO UPDATE
+		SET scopes=ARRAY(SELECT DISTINCT unnest(consents.scopes || EXCLUDED.scopes)), updated_at=now()`,
+		db.tenant, guid, clientID, scopes,
+	)
+	return err
+}
+
+func (db *PGXDatabase) InsertAuthorizationCode(ctx context.Context, c models.AuthorizationCode) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO authorization_codes(tenant_id, code_hash, client_id, guid, redirect_uri, scope, nonce, code_challenge, auth_time, acr, amr, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		db.tenant, c.CodeHash, c.ClientID, c.GUID, c.RedirectURI, c.Scope, c.Nonce, c.CodeChallenge, c.AuthTime, c.ACR, c.AMR, c.ExpiresAt,
+	)
+	return err
+}
+
+func (db *PGXDatabase) GetAuthorizationCode(ctx context.Context, hash string) (models.AuthorizationCode, error) {
+	c := models.AuthorizationCode{CodeHash: hash}
+	err := db.pool.QueryRow(ctx,
+		`SELECT client_id, guid, redirect_uri, scope, nonce, code_challenge, auth_time, acr, amr, used, expires_at
+		FROM authorization_codes WHERE code_hash=$1 AND tenant_id=$2`,
+		hash, db.tenant,
+	).Scan(&c.ClientID, &c.GUID, &c.RedirectURI, &c.Scope, &c.Nonce, &c.CodeChallenge, &c.AuthTime, &c.ACR, &c.AMR, &c.Used, &c.ExpiresAt)
+	return c, err
+}
+
+// ConsumeAuthorizationCode marks the code as used and reports whether this
+// call was the one that did it.
+func (db *PGXDatabase) ConsumeAuthorizationCode(ctx context.Context, hash string) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		"UPDATE authorization_codes SET used=TRUE WHERE code_hash=$1 AND used=FALSE AND tenant_id=$2",
+		hash, db.tenant,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (db *PGXDatabase) GetUser(ctx context.Context, guid int) (models.User, error) {
+	u := models.User{GUID: guid}
+	var email *string
+	err := db.pool.QueryRow(ctx,
+		"SELECT email, email_verified, name, given_name, family_name, updated_at FROM users WHERE guid=$1 AND tenant_id=$2",
+		guid, db.tenant,
+	).Scan(&email, &u.EmailVerified, &u.Name, &u.GivenName, &u.FamilyName, &u.UpdatedAt)
+	if email != nil {
+		u.Email = *email
+	}
+	return u, err
+}
+
+// UseJTI records a one-time token identifier until it expires and reports
+// whether it was seen for the first time, which makes replays detectable.
+func (db *PGXDatabase) UseJTI(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	tag, err := db.pool.Exec(ctx,
+		"INSERT INTO used_jtis(jti, expires_at) VALUES($1, $2) ON CONFLICT (jti) DO NOTHING",
+		jti, expiresAt,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
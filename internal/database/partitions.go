@@ -0,0 +1,150 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"time"
+)
+
+// partitionBound formats the start of a day as a partition bound.
+const partitionBound = "2006-01-02 15:04:05-07"
+
+// TokensPartitioned reports whether tokens is partitioned by creation time.
+func TokensPartitioned(ctx context.Context, pool DBPool) (bool, error) {
+	var kind string
+	err := pool.QueryRow(ctx, "SELECT relkind::text FROM pg_class WHERE oid = 'tokens'::regclass").Scan(&kind)
+	return kind == "p", err
+}
+
+// PartitionTokens turns tokens into a table partitioned by range of
+// created_at. The existing table is kept as the partition tokens_legacy,
+// which holds everything created before tomorrow (UTC); daily partitions
+// from then on are made by CreateTokenPartitions. It reports false when
+// tokens was already partitioned. Sessions can not be issued while the
+// existing rows are checked against the partition bounds.
+func PartitionTokens(ctx context.Context, pool DBPool) (bool, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", int64(migrationLockID)); err != nil {
+		return false, err
+	}
+	partitioned, err := TokensPartitioned(ctx, tx)
+	if err != nil || partitioned {
+		return false, err
+	}
+	tomorrow := startOfDay(time.Now()).AddDate(0, 0, 1)
+	for _, stmt := range []string{
+		"ALTER TABLE tokens RENAME TO tokens_legacy",
+		"ALTER INDEX tokens_pkey RENAME TO tokens_legacy_pkey",
+		"ALTER INDEX idx_tokens_guid RENAME TO idx_tokens_legacy_guid",
+		"ALTER INDEX idx_tokens_retention RENAME TO idx_tokens_legacy_retention",
+		`CREATE TABLE tokens (
+			LIKE tokens_legacy INCLUDING DEFAULTS INCLUDING CONSTRAINTS,
+			PRIMARY KEY (id, created_at)
+		) PARTITION BY RANGE (created_at)`,
+		"CREATE INDEX idx_tokens_guid ON tokens(tenant_id, guid)",
+		"CREATE INDEX idx_tokens_retention ON tokens(status, status_changed_at) WHERE status <> 'unused'",
+		"ALTER TABLE tokens ATTACH PARTITION tokens_legacy FOR VALUES FROM (MINVALUE) TO ('" + tomorrow.Format(partitionBound) + "')",
+	} {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit(ctx)
+}
+
+// CreateTokenPartitions makes sure tokens has a daily partition for each of
+// the days days starting today (UTC) and returns the names of the ones it
+// created. Days already covered, e.g. by tokens_legacy, are skipped.
+func CreateTokenPartitions(ctx context.Context, pool DBPool, days int) ([]string, error) {
+	existing := map[string]bool{}
+	rows, err := pool.Query(ctx, "SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = 'tokens'::regclass")
+	if err != nil {
+		return nil, err
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		existing[name] = true
+	}
+
+	var created []string
+	day := startOfDay(time.Now())
+	for i := 0; i < days; i, day = i+1, day.AddDate(0, 0, 1) {
+		name := "tokens_p" + day.Format("20060102")
+		if existing[name] {
+			continue
+		}
+		_, err := pool.Exec(ctx, "CREATE TABLE IF NOT EXISTS "+name+" PARTITION OF tokens FOR VALUES FROM ('"+
+			day.Format(partitionBound)+"') TO ('"+day.AddDate(0, 0, 1).Format(partitionBound)+"')")
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "42P17" {
+			// Overlaps a partition with other bounds.
+			continue
+		}
+		if err != nil {
+			return created, err
+		}
+		created = append(created, name)
+	}
+	return created, nil
+}
+
+// DropTokenPartitions drops the partitions of tokens that only hold sessions
+// created before before, or detaches them into tables of their own when
+// detach is set. It returns the names of the partitions removed. Partitions
+// still holding an unused session, whose refresh token is valid, are kept
+// until it is refreshed or revoked; finding out scans the partition.
+func DropTokenPartitions(ctx context.Context, pool DBPool, before time.Time, detach bool) ([]string, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT name FROM (
+			SELECT c.relname AS name,
+				(regexp_match(pg_get_expr(c.relpartbound, c.oid), 'TO \(''([^'']+)''\)'))[1]::timestamptz AS upper
+			FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+			WHERE i.inhparent = 'tokens'::regclass
+		) p WHERE upper <= $1 ORDER BY upper`,
+		before,
+	)
+	if err != nil {
+		return nil, err
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	var dropped []string
+	for _, name := range names {
+		// Sessions can not become unused again, so none turns up between
+		// the check and the drop.
+		var unused bool
+		if err := pool.QueryRow(ctx,
+			"SELECT EXISTS (SELECT 1 FROM "+pgx.Identifier{name}.Sanitize()+" WHERE status='unused')",
+		).Scan(&unused); err != nil {
+			return dropped, err
+		}
+		if unused {
+			continue
+		}
+		stmt := "DROP TABLE " + pgx.Identifier{name}.Sanitize()
+		if detach {
+			stmt = "ALTER TABLE tokens DETACH PARTITION " + pgx.Identifier{name}.Sanitize()
+		}
+		if _, err := pool.Exec(ctx, stmt); err != nil {
+			return dropped, err
+		}
+		dropped = append(dropped, name)
+	}
+	return dropped, nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// Replicas are read-only standbys of the primary that session status
+// lookups are spread over. A replica lags behind the primary, so it is only
+// asked once it has replayed the latest revocation known to this process;
+// until then, and whenever it misses the session or fails, the primary
+// answers instead.
+type Replicas struct {
+	pools []DBPool
+	next  atomic.Uint64
+	lsn   atomic.Uint64 // WAL position replicas must have replayed
+}
+
+// NewReplicas spreads reads over pools in turn.
+func NewReplicas(pools ...DBPool) *Replicas {
+	return &Replicas{pools: pools}
+}
+
+// pick returns the replica to read from next, nil when there are none.
+func (r *Replicas) pick() DBPool {
+	if r == nil || len(r.pools) == 0 {
+		return nil
+	}
+	return r.pools[(r.next.Add(1)-1)%uint64(len(r.pools))]
+}
+
+// minLSN is the WAL position a replica must have replayed to be read from.
+func (r *Replicas) minLSN() string {
+	lsn := r.lsn.Load()
+	return fmt.Sprintf("%X/%X", lsn>>32, uint32(lsn))
+}
+
+// Observe makes replicas wait for everything committed on primary so far,
+// e.g. a revocation just made by this or another instance.
+func (r *Replicas) Observe(ctx context.Context, primary DBPool) error {
+	if r == nil {
+		return nil
+	}
+	var s string
+	if err := primary.QueryRow(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&s); err != nil {
+		return err
+	}
+	var hi, lo uint32
+	if _, err := fmt.Sscanf(s, "%X/%X", &hi, &lo); err != nil {
+		return fmt.Errorf("Invalid WAL position %q", s)
+	}
+	lsn := uint64(hi)<<32 | uint64(lo)
+	for {
+		cur := r.lsn.Load()
+		if cur >= lsn || r.lsn.CompareAndSwap(cur, lsn) {
+			return nil
+		}
+	}
+}
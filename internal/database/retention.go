@@ -0,0 +1,59 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// retentionLockID is the advisory lock held during a retention pass, so that
+// only one instance purges at a time.
+const retentionLockID = migrationLockID + 1
+
+// tokenArchiveColumns are copied from tokens to tokens_archive.
+const tokenArchiveColumns = "id, tenant_id, guid, refresh_hash, status, auth_time, acr, amr, client_id, scope, audience, act, jkt, x5t, created_at, status_changed_at"
+
+// LockRetention takes the retention lock unless another instance holds it.
+// The lock lives in a transaction of its own, so the purges can commit batch
+// by batch while it is held; release gives it up.
+func LockRetention(ctx context.Context, pool DBPool) (release func(), ok bool, err error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	release = func() { tx.Rollback(context.Background()) }
+	if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1)", int64(retentionLockID)).Scan(&ok); err != nil || !ok {
+		release()
+		return nil, false, err
+	}
+	return release, true, nil
+}
+
+// PurgeTokens deletes up to limit sessions of every tenant that have had
+// status since before, moving them to tokens_archive when archive is set.
+// It returns the number of sessions purged; fewer than limit means none are
+// left. Rows locked by a concurrent refresh or revocation are skipped.
+func PurgeTokens(ctx context.Context, pool DBPool, status string, before time.Time, limit int, archive bool) (int, error) {
+	batch := `SELECT id, created_at FROM tokens WHERE status=$1 AND status_changed_at < $2 ORDER BY status_changed_at LIMIT $3 FOR UPDATE SKIP LOCKED`
+	query := "DELETE FROM tokens WHERE (id, created_at) IN (" + batch + ")"
+	if archive {
+		query = `WITH purged AS (DELETE FROM tokens WHERE (id, created_at) IN (` + batch + `) RETURNING ` + tokenArchiveColumns + `)
+		INSERT INTO tokens_archive(` + tokenArchiveColumns + `) SELECT ` + tokenArchiveColumns + ` FROM purged`
+	}
+	tag, err := pool.Exec(ctx, query, status, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// PurgeUsedJTIs deletes up to limit JWT ids that expired before before.
+func PurgeUsedJTIs(ctx context.Context, pool DBPool, before time.Time, limit int) (int, error) {
+	tag, err := pool.Exec(ctx,
+		"DELETE FROM used_jtis WHERE jti IN (SELECT jti FROM used_jtis WHERE expires_at < $1 LIMIT $2 FOR UPDATE SKIP LOCKED)",
+		before, limit,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
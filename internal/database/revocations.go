@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v5"
+)
+
+// RevocationChannel is the Postgres channel revocations and other session
+// status changes are announced on, so that other instances can drop what
+// they cached about the sessions.
+const RevocationChannel = "token_revocations"
+
+// Revocation is the payload of a notification on RevocationChannel: every
+// session of GUID was blocked, or the status of the single session ID
+// changed when GUID is 0.
+type Revocation struct {
+	Tenant string `json:"tenant"`
+	GUID   int    `json:"guid,omitempty"`
+	ID     int    `json:"id,omitempty"`
+}
+
+// notifyRevocation announces r. Inside a transaction the notification is
+// only sent on commit, together with the revocation itself.
+func notifyRevocation(ctx context.Context, pool DBPool, r Revocation) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = pool.Exec(ctx, "SELECT pg_notify($1, $2)", RevocationChannel, string(payload))
+	return err
+}
+
+// ListenRevocations subscribes conn to RevocationChannel.
+func ListenRevocations(ctx context.Context, conn *pgx.Conn) error {
+	_, err := conn.Exec(ctx, "LISTEN "+RevocationChannel)
+	return err
+}
+
+// WaitRevocation blocks until a revocation is announced on a connection
+// subscribed with ListenRevocations. Malformed payloads are skipped.
+func WaitRevocation(ctx context.Context, conn *pgx.Conn) (Revocation, error) {
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return Revocation{}, err
+		}
+		var r Revocation
+		if n.Channel == RevocationChannel && json.Unmarshal([]byte(n.Payload), &r) == nil {
+			return r, nil
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"context"
+)
+
+type RoleStore interface {
+	SaveRole(ctx context.Context, role string, permissions []string) error
+	AssignRole(ctx context.Context, guid int, role string) error
+	RevokeRole(ctx context.Context, guid int, role string) error
+	GetUserRoles(ctx context.Context, guid int) (roles, permissions []string, err error)
+}
+
+// SaveRole creates role or replaces its permissions. Unknown permissions are
+// created on the way.
+func (db *PGXDatabase) SaveRole(ctx context.Context, role string, permissions []string) error {
+	if _, err := db.pool.Exec(ctx,
+		"INSERT INTO roles(tenant_id, name) VALUES($1, $2) ON CONFLICT (tenant_id, name) DO UPDATE SET updated_at=now()",
+		db.tenant, role,
+	); err != nil {
+		return err
+	}
+	if _, err := db.pool.Exec(ctx,
+		"INSERT INTO permissions(tenant_id, name) SELECT $1, unnest($2::text[]) ON CONFLICT (tenant_id, name) DO NOTHING",
+		db.tenant, permissions,
+	); err != nil {
+		return err
+	}
+	if _, err := db.pool.Exec(ctx,
+		"DELETE FROM role_permissions WHERE tenant_id=$1 AND role=$2 AND permission <> ALL($3::text[])",
+		db.tenant, role, permissions,
+	); err != nil {
+		return err
+	}
+	_, err := db.pool.Exec(ctx,
+		"INSERT INTO role_permissions(tenant_id, role, permission) SELECT $1, $2, unnest($3::text[]) ON CONFLICT DO NOTHING",
+		db.tenant, role, permissions,
+	)
+	return err
+}
+
+func (db *PGXDatabase) AssignRole(ctx context.Context, guid int, role string) error {
+	_, err := db.pool.Exec(ctx,
+		"INSERT INTO user_roles(tenant_id, guid, role) VALUES($1, $2, $3) ON CONFLICT DO NOTHING",
+		db.tenant, guid, role,
+	)
+	return err
+}
+
+func (db *PGXDatabase) RevokeRole(ctx context.Context, guid int, role string) error {
+	_, err := db.pool.Exec(ctx,
+		"DELETE FROM user_roles WHERE tenant_id=$1 AND guid=$2 AND role=$3",
+		db.tenant, guid, role,
+	)
+	return err
+}
+
+// GetUserRoles returns the roles assigned to the user and the union of their
+// permissions, both sorted.
+func (db *PGXDatabase) GetUserRoles(ctx context.Context, guid int) ([]string, []string, error) {
+	var roles, permissions []string
+	err := db.pool.QueryRow(ctx,
+		`SELECT COALESCE(array_agg(DISTINCT ur.role ORDER BY ur.role), '{}'),
+			COALESCE(array_agg(DISTINCT rp.permission ORDER BY rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+		FROM user_roles ur LEFT JOIN role_permissions rp ON rp.tenant_id=ur.tenant_id AND rp.role=ur.role
+		WHERE ur.tenant_id=$1 AND ur.guid=$2`,
+		db.tenant, guid,
+	).Scan(&roles, &permissions)
+	return roles, permissions, err
+}
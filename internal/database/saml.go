@@ -0,0 +1,37 @@
+package database
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+	"time"
+)
+
+// SAMLStore shares the login states and linked identities of the OpenID
+// Connect federation; SAML providers use the key saml:{id} there.
+type SAMLStore interface {
+	FederationStore
+	SaveSAMLProvider(ctx context.Context, p models.SAMLProvider) error
+	GetSAMLProvider(ctx context.Context, id string) (models.SAMLProvider, error)
+	UseJTI(ctx context.Context, jti string, expiresAt time.Time) (bool, error)
+}
+
+func (db *PGXDatabase) SaveSAMLProvider(ctx context.Context, p models.SAMLProvider) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO saml_providers(tenant_id, id, entity_id, sso_url, certificate, attributes, link_by_email)
+		VALUES($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (tenant_id, id) DO UPDATE
+		SET entity_id=EXCLUDED.entity_id, sso_url=EXCLUDED.sso_url, certificate=EXCLUDED.certificate,
+			attributes=EXCLUDED.attributes, link_by_email=EXCLUDED.link_by_email`,
+		db.tenant, p.ID, p.EntityID, p.SSOURL, p.Certificate, p.Attributes, p.LinkByEmail,
+	)
+	return err
+}
+
+func (db *PGXDatabase) GetSAMLProvider(ctx context.Context, id string) (models.SAMLProvider, error) {
+	var p models.SAMLProvider
+	err := db.pool.QueryRow(ctx,
+		"SELECT id, entity_id, sso_url, certificate, attributes, link_by_email, created_at FROM saml_providers WHERE id=$1 AND tenant_id=$2",
+		id, db.tenant,
+	).Scan(&p.ID, &p.EntityID, &p.SSOURL, &p.Certificate, &p.Attributes, &p.LinkByEmail, &p.CreatedAt)
+	return p, err
+}
@@ -0,0 +1,379 @@
+package database
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	_ "modernc.org/sqlite"
+	"net/url"
+	"time"
+)
+
+// sqliteMigrations create the tables behind Database. Each one runs once, in
+// order; PRAGMA user_version counts those already applied. Times are stored
+// as Unix microseconds and arrays and act as JSON.
+var sqliteMigrations = []string{
+	`CREATE TABLE tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id TEXT NOT NULL DEFAULT 'default',
+		guid INTEGER NOT NULL,
+		refresh_hash TEXT,
+		status TEXT NOT NULL CHECK (status IN ('unused', 'used', 'blocked')),
+		auth_time INTEGER NOT NULL,
+		acr TEXT NOT NULL DEFAULT '0',
+		amr TEXT NOT NULL DEFAULT '[]',
+		client_id TEXT NOT NULL DEFAULT '',
+		scope TEXT NOT NULL DEFAULT '',
+		audience TEXT NOT NULL DEFAULT '[]',
+		act TEXT,
+		jkt TEXT NOT NULL DEFAULT '',
+		x5t TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX idx_tokens_guid ON tokens(tenant_id, guid);
+	CREATE TABLE used_jtis (
+		jti TEXT PRIMARY KEY,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX idx_used_jtis_expires_at ON used_jtis(expires_at);
+	CREATE TABLE roles (
+		tenant_id TEXT NOT NULL DEFAULT 'default',
+		name TEXT NOT NULL,
+		PRIMARY KEY (tenant_id, name)
+	);
+	CREATE TABLE permissions (
+		tenant_id TEXT NOT NULL DEFAULT 'default',
+		name TEXT NOT NULL,
+		PRIMARY KEY (tenant_id, name)
+	);
+	CREATE TABLE role_permissions (
+		tenant_id TEXT NOT NULL DEFAULT 'default',
+		role TEXT NOT NULL,
+		permission TEXT NOT NULL,
+		PRIMARY KEY (tenant_id, role, permission),
+		FOREIGN KEY (tenant_id, role) REFERENCES roles(tenant_id, name) ON DELETE CASCADE,
+		FOREIGN KEY (tenant_id, permission) REFERENCES permissions(tenant_id, name) ON DELETE CASCADE
+	);
+	CREATE TABLE user_roles (
+		tenant_id TEXT NOT NULL DEFAULT 'default',
+		guid INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		PRIMARY KEY (tenant_id, guid, role),
+		FOREIGN KEY (tenant_id, role) REFERENCES roles(tenant_id, name) ON DELETE CASCADE
+	);`,
+}
+
+// SQLiteDatabase implements Database on SQLite for single-node deployments.
+// It follows PGXDatabase: missing rows are pgx.ErrNoRows and a session is
+// only rotated by a conditional update, so concurrent refreshes of the same
+// token can not both succeed.
+type SQLiteDatabase struct {
+	db     *sql.DB
+	tenant string
+}
+
+// OpenSQLite opens the database file at path with the pure-Go driver
+// modernc.org/sqlite, in WAL mode and with foreign keys on, and applies the
+// migrations. Transactions start with BEGIN IMMEDIATE, taking the write lock
+// up front, and wait up to five seconds for it.
+func OpenSQLite(ctx context.Context, path string) (*SQLiteDatabase, error) {
+	params := url.Values{}
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Set("_txlock", "immediate")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	s := NewSQLiteDatabase(db)
+	if err := s.Migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSQLiteDatabase uses db as it is; see OpenSQLite for the settings it
+// needs.
+func NewSQLiteDatabase(db *sql.DB) *SQLiteDatabase {
+	return &SQLiteDatabase{db: db, tenant: DefaultTenant}
+}
+
+// ForTenant returns a view of the same database restricted to tenant.
+func (db *SQLiteDatabase) ForTenant(tenant string) *SQLiteDatabase {
+	return &SQLiteDatabase{db: db.db, tenant: tenant}
+}
+
+func (db *SQLiteDatabase) Close() error {
+	return db.db.Close()
+}
+
+// Migrate applies the migrations the database has not seen yet, each in its
+// own transaction.
+func (db *SQLiteDatabase) Migrate(ctx context.Context) error {
+	var version int
+	if err := db.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("SQLite migration %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteExecer is satisfied by *sql.DB and *sql.Tx.
+type sqliteExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (db *SQLiteDatabase) InsertToken(ctx context.Context, rec models.TokenRecord) (int, error) {
+	return db.insertToken(ctx, db.db, rec)
+}
+
+func (db *SQLiteDatabase) insertToken(ctx context.Context, ex sqliteExecer, rec models.TokenRecord) (int, error) {
+	amr, err := json.Marshal(nonNil(rec.AMR))
+	if err != nil {
+		return 0, err
+	}
+	audience, err := json.Marshal(nonNil(rec.Audience))
+	if err != nil {
+		return 0, err
+	}
+	var act sql.NullString
+	if rec.Act != nil {
+		data, err := json.Marshal(rec.Act)
+		if err != nil {
+			return 0, err
+		}
+		act = sql.NullString{String: string(data), Valid: true}
+	}
+	res, err := ex.ExecContext(ctx,
+		`INSERT INTO tokens(tenant_id, guid, refresh_hash, status, auth_time, acr, amr, client_id, scope, audience, act, jkt, x5t)
+		VALUES(?, ?, ?, COALESCE(NULLIF(?, ''), 'unused'), ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		db.tenant, rec.GUID, rec.RefreshHash, rec.Status, rec.AuthTime.Round(time.Microsecond).UnixMicro(), rec.ACR, string(amr), rec.ClientID, rec.Scope, string(audience), act, rec.JKT, rec.X5T,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// RotateRefresh marks the session id used and inserts next in its place in
+// one immediate transaction. SQLite lets one writer in at a time and the
+// update only matches an unused session, so of several concurrent rotations
+// exactly one succeeds; the others get ErrRefreshNotUnused.
+func (db *SQLiteDatabase) RotateRefresh(ctx context.Context, id int, next models.TokenRecord) (int, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		"UPDATE tokens SET status='used' WHERE id=? AND status='unused' AND tenant_id=?",
+		id, db.tenant,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n != 1 {
+		return 0, ErrRefreshNotUnused
+	}
+	newID, err := db.insertToken(ctx, tx, next)
+	if err != nil {
+		return 0, err
+	}
+	return newID, tx.Commit()
+}
+
+func (db *SQLiteDatabase) GetRefresh(ctx context.Context, id int) (string, string, error) {
+	var hash sql.NullString
+	var status string
+	err := db.db.QueryRowContext(ctx,
+		"SELECT refresh_hash, status FROM tokens WHERE id=? AND tenant_id=?",
+		id, db.tenant,
+	).Scan(&hash, &status)
+	return hash.String, status, sqliteErr(err)
+}
+
+func (db *SQLiteDatabase) GetToken(ctx context.Context, id int) (models.TokenRecord, error) {
+	rec := models.TokenRecord{ID: id}
+	var hash, act sql.NullString
+	var authTime int64
+	var amr, audience string
+	err := db.db.QueryRowContext(ctx,
+		"SELECT guid, refresh_hash, status, auth_time, acr, amr, client_id, scope, audience, act, jkt, x5t FROM tokens WHERE id=? AND tenant_id=?",
+		id, db.tenant,
+	).Scan(&rec.GUID, &hash, &rec.Status, &authTime, &rec.ACR, &amr, &rec.ClientID, &rec.Scope, &audience, &act, &rec.JKT, &rec.X5T)
+	if err != nil {
+		return rec, sqliteErr(err)
+	}
+	rec.RefreshHash = hash.String
+	rec.AuthTime = time.UnixMicro(authTime)
+	if err := json.Unmarshal([]byte(amr), &rec.AMR); err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal([]byte(audience), &rec.Audience); err != nil {
+		return rec, err
+	}
+	if act.Valid {
+		if err := json.Unmarshal([]byte(act.String), &rec.Act); err != nil {
+			return rec, err
+		}
+	}
+	return rec, nil
+}
+
+func (db *SQLiteDatabase) InvalidateAllRefreshForGUID(ctx context.Context, guid int) error {
+	_, err := db.db.ExecContext(ctx,
+		"UPDATE tokens SET status='blocked' WHERE guid=? AND tenant_id=?",
+		guid, db.tenant,
+	)
+	return err
+}
+
+// UseJTI records jti in the used_jtis table, which is shared by all tenants.
+// Expired entries are dropped on the way.
+func (db *SQLiteDatabase) UseJTI(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM used_jtis WHERE expires_at < ?", time.Now().UnixMicro()); err != nil {
+		return false, err
+	}
+	res, err := db.db.ExecContext(ctx,
+		"INSERT INTO used_jtis(jti, expires_at) VALUES(?, ?) ON CONFLICT (jti) DO NOTHING",
+		jti, expiresAt.UnixMicro(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// SaveRole creates the role or replaces its permissions.
+func (db *SQLiteDatabase) SaveRole(ctx context.Context, role string, permissions []string) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO roles(tenant_id, name) VALUES(?, ?) ON CONFLICT (tenant_id, name) DO NOTHING",
+		db.tenant, role,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM role_permissions WHERE tenant_id=? AND role=?",
+		db.tenant, role,
+	); err != nil {
+		return err
+	}
+	for _, p := range permissions {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO permissions(tenant_id, name) VALUES(?, ?) ON CONFLICT (tenant_id, name) DO NOTHING",
+			db.tenant, p,
+		); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO role_permissions(tenant_id, role, permission) VALUES(?, ?, ?) ON CONFLICT DO NOTHING",
+			db.tenant, role, p,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteDatabase) AssignRole(ctx context.Context, guid int, role string) error {
+	_, err := db.db.ExecContext(ctx,
+		"INSERT INTO user_roles(tenant_id, guid, role) VALUES(?, ?, ?) ON CONFLICT DO NOTHING",
+		db.tenant, guid, role,
+	)
+	return err
+}
+
+func (db *SQLiteDatabase) RevokeRole(ctx context.Context, guid int, role string) error {
+	_, err := db.db.ExecContext(ctx,
+		"DELETE FROM user_roles WHERE tenant_id=? AND guid=? AND role=?",
+		db.tenant, guid, role,
+	)
+	return err
+}
+
+// GetUserRoles returns the roles assigned to the user and the union of their
+// permissions, both sorted.
+func (db *SQLiteDatabase) GetUserRoles(ctx context.Context, guid int) ([]string, []string, error) {
+	roles, err := db.queryStrings(ctx,
+		"SELECT role FROM user_roles WHERE tenant_id=? AND guid=? ORDER BY role",
+		db.tenant, guid,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	permissions, err := db.queryStrings(ctx,
+		`SELECT DISTINCT rp.permission
+		FROM user_roles ur JOIN role_permissions rp ON rp.tenant_id=ur.tenant_id AND rp.role=ur.role
+		WHERE ur.tenant_id=? AND ur.guid=? ORDER BY rp.permission`,
+		db.tenant, guid,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return roles, permissions, nil
+}
+
+func (db *SQLiteDatabase) queryStrings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// sqliteErr reports a missing row as pgx.ErrNoRows, which callers of
+// Database check for.
+func sqliteErr(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return pgx.ErrNoRows
+	}
+	return err
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
@@ -0,0 +1,27 @@
+package database_test
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/database/dbtest"
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSQLiteDatabase(t *testing.T) {
+	db, err := database.OpenSQLite(context.Background(), filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	n := 0
+	err = dbtest.TestDatabase(func() database.Database {
+		n++
+		return db.ForTenant("dbtest-" + strconv.Itoa(n))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// TenantStore manages the tenants themselves and is not restricted to one.
+type TenantStore interface {
+	SaveTenant(ctx context.Context, t models.Tenant) error
+	GetTenant(ctx context.Context, id string) (models.Tenant, error)
+	ListTenants(ctx context.Context) ([]models.Tenant, error)
+	AddWebhook(ctx context.Context, w models.WebhookSubscription) error
+	ListWebhooks(ctx context.Context) ([]models.WebhookSubscription, error)
+}
+
+const tenantColumns = "id, name, hosts, issuer, secret, signing_key, access_token_ttl_seconds, require_dpop, require_dpop_nonce, created_at"
+
+func (db *PGXDatabase) SaveTenant(ctx context.Context, t models.Tenant) error {
+	_, err := db.pool.Exec(ctx,
+		`INSERT INTO tenants(id, name, hosts, issuer, secret, signing_key, access_token_ttl_seconds, require_dpop, require_dpop_nonce)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE
+		SET name=EXCLUDED.name, hosts=EXCLUDED.hosts, issuer=EXCLUDED.issuer, access_token_ttl_seconds=EXCLUDED.access_token_ttl_seconds,
+			require_dpop=EXCLUDED.require_dpop, require_dpop_nonce=EXCLUDED.require_dpop_nonce`,
+		t.ID, t.Name, t.Hosts, t.Issuer, t.Secret, t.SigningKey, int(t.AccessTokenTTL.Seconds()), t.RequireDPoP, t.RequireDPoPNonce,
+	)
+	return err
+}
+
+func (db *PGXDatabase) GetTenant(ctx context.Context, id string) (models.Tenant, error) {
+	return scanTenant(db.pool.QueryRow(ctx, "SELECT "+tenantColumns+" FROM tenants WHERE id=$1", id))
+}
+
+func (db *PGXDatabase) ListTenants(ctx context.Context) ([]models.Tenant, error) {
+	rows, err := db.pool.Query(ctx, "SELECT "+tenantColumns+" FROM tenants ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tenants []models.Tenant
+	for rows.Next() {
+		t, err := scanTenant(rows)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+func scanTenant(row pgx.Row) (models.Tenant, error) {
+	var t models.Tenant
+	var ttl int
+	err := row.Scan(&t.ID, &t.Name, &t.Hosts, &t.Issuer, &t.Secret, &t.SigningKey, &ttl, &t.RequireDPoP, &t.RequireDPoPNonce, &t.CreatedAt)
+	t.AccessTokenTTL = time.Duration(ttl) * time.Second
+	return t, err
+}
+
+func (db *PGXDatabase) AddWebhook(ctx context.Context, w models.WebhookSubscription) error {
+	_, err := db.pool.Exec(ctx,
+		"INSERT INTO webhook_subscriptions(tenant_id, url, events) VALUES($1, $2, $3)",
+		w.TenantID, w.URL, w.Events,
+	)
+	return err
+}
+
+func (db *PGXDatabase) ListWebhooks(ctx context.Context) ([]models.WebhookSubscription, error) {
+	rows, err := db.pool.Query(ctx, "SELECT id, tenant_id, url, events FROM webhook_subscriptions ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hooks []models.WebhookSubscription
+	for rows.Next() {
+		var w models.WebhookSubscription
+		if err := rows.Scan(&w.ID, &w.TenantID, &w.URL, &w.Events); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, w)
+	}
+	return hooks, rows.Err()
+}
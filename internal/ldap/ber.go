@@ -0,0 +1,168 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// BER identifier octets used by LDAP (RFC 4511). Only single-octet tags occur.
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	classApplication = 0x40
+	classContext     = 0x80
+	constructed      = 0x20
+)
+
+// maxPacketSize bounds what a server can make us allocate.
+const maxPacketSize = 16 << 20
+
+// packet is a BER element: either primitive with a value or constructed
+// with children.
+type packet struct {
+	tag      byte
+	value    []byte
+	children []*packet
+}
+
+func (p *packet) constructed() bool { return p.tag&constructed != 0 }
+
+func newSequence(tag byte, children ...*packet) *packet {
+	return &packet{tag: tag | constructed, children: children}
+}
+
+func newString(tag byte, s string) *packet {
+	return &packet{tag: tag, value: []byte(s)}
+}
+
+func newInteger(tag byte, n int) *packet {
+	// Minimal two's complement encoding.
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		if (n >= -128 && n < 128) || len(b) == 8 {
+			break
+		}
+		n >>= 8
+	}
+	return &packet{tag: tag, value: b}
+}
+
+func newBoolean(v bool) *packet {
+	if v {
+		return &packet{tag: tagBoolean, value: []byte{0xff}}
+	}
+	return &packet{tag: tagBoolean, value: []byte{0}}
+}
+
+func (p *packet) add(children ...*packet) *packet {
+	p.children = append(p.children, children...)
+	return p
+}
+
+func (p *packet) bytes() []byte {
+	content := p.value
+	if p.constructed() {
+		content = nil
+		for _, c := range p.children {
+			content = append(content, c.bytes()...)
+		}
+	}
+	out := []byte{p.tag}
+	n := len(content)
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	default:
+		var l []byte
+		for ; n > 0; n >>= 8 {
+			l = append([]byte{byte(n)}, l...)
+		}
+		out = append(append(out, 0x80|byte(len(l))), l...)
+	}
+	return append(out, content...)
+}
+
+func (p *packet) int() int {
+	n := 0
+	for i, b := range p.value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+func (p *packet) string() string { return string(p.value) }
+
+func (p *packet) child(i int) *packet {
+	if i < len(p.children) {
+		return p.children[i]
+	}
+	return &packet{}
+}
+
+// readPacket reads one BER element from r.
+func readPacket(r *bufio.Reader) (*packet, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n := int(first)
+	if first&0x80 != 0 {
+		octets := int(first & 0x7f)
+		if octets == 0 || octets > 4 {
+			return nil, errors.New("ldap: unsupported BER length")
+		}
+		n = 0
+		for i := 0; i < octets; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > maxPacketSize {
+		return nil, errors.New("ldap: packet too large")
+	}
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return parsePacket(tag, content)
+}
+
+func parsePacket(tag byte, content []byte) (*packet, error) {
+	p := &packet{tag: tag}
+	if tag&constructed == 0 {
+		p.value = content
+		return p, nil
+	}
+	r := bufio.NewReader(bytes.NewReader(content))
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			return p, nil
+		}
+		child, err := readPacket(r)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		p.children = append(p.children, child)
+	}
+}
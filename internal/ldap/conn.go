@@ -0,0 +1,305 @@
+// Package ldap is a small LDAPv3 client (RFC 4511) covering what directory
+// authentication needs: simple binds, searches, LDAPS and StartTLS.
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol operations.
+const (
+	opBindRequest      = classApplication | constructed | 0
+	opBindResponse     = classApplication | constructed | 1
+	opUnbindRequest    = classApplication | 2
+	opSearchRequest    = classApplication | constructed | 3
+	opSearchEntry      = classApplication | constructed | 4
+	opSearchDone       = classApplication | constructed | 5
+	opSearchReference  = classApplication | constructed | 19
+	opExtendedRequest  = classApplication | constructed | 23
+	opExtendedResponse = classApplication | constructed | 24
+)
+
+// Result codes.
+const (
+	ResultSuccess            = 0
+	ResultInvalidCredentials = 49
+)
+
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// Search scopes.
+const (
+	ScopeBaseObject   = 0
+	ScopeSingleLevel  = 1
+	ScopeWholeSubtree = 2
+)
+
+// Error is a result code other than success returned by the server.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// IsInvalidCredentials reports whether err is a failed bind.
+func IsInvalidCredentials(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == ResultInvalidCredentials
+}
+
+// Conn is a connection to a directory server. Operations run one at a time.
+type Conn struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	lastID  int
+}
+
+// Dial connects to an ldap:// or ldaps:// URL. Every operation must finish
+// within timeout.
+func Dial(rawURL string, tlsConfig *tls.Config, timeout time.Duration) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: timeout}
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, serverTLSConfig(tlsConfig, u.Hostname()))
+	default:
+		return nil, errors.New("ldap: URL scheme must be ldap or ldaps")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn, timeout), nil
+}
+
+// NewConn wraps an established connection.
+func NewConn(conn net.Conn, timeout time.Duration) *Conn {
+	return &Conn{conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+}
+
+// StartTLS upgrades a plain connection to TLS (RFC 4511 4.14).
+func (c *Conn) StartTLS(tlsConfig *tls.Config, serverName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	op := newSequence(opExtendedRequest, newString(classContext|0, startTLSOID))
+	resp, err := c.roundTrip(op, opExtendedResponse)
+	if err != nil {
+		return err
+	}
+	if err := result(resp); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, serverTLSConfig(tlsConfig, serverName))
+	tlsConn.SetDeadline(time.Now().Add(c.timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+	return nil
+}
+
+// Bind authenticates as dn with a simple bind. An empty password would be an
+// unauthenticated bind, which servers accept for any dn, so it is refused.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return &Error{Code: ResultInvalidCredentials, Message: "empty password"}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	op := newSequence(opBindRequest,
+		newInteger(tagInteger, 3),
+		newString(tagOctetString, dn),
+		newString(classContext|0, password),
+	)
+	resp, err := c.roundTrip(op, opBindResponse)
+	if err != nil {
+		return err
+	}
+	return result(resp)
+}
+
+// SearchRequest describes a search. Attributes lists the attributes to
+// return, all user attributes when empty.
+type SearchRequest struct {
+	BaseDN     string
+	Scope      int
+	Filter     string
+	Attributes []string
+	SizeLimit  int
+}
+
+// Entry is a search result.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the first value of the attribute, matched case-insensitively.
+func (e Entry) Get(name string) string {
+	if v := e.GetAll(name); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// GetAll returns every value of the attribute, matched case-insensitively.
+func (e Entry) GetAll(name string) []string {
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Search runs req and collects the entries. Referrals are ignored.
+func (c *Conn) Search(req SearchRequest) ([]Entry, error) {
+	filter, err := compileFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	attrs := newSequence(tagSequence)
+	for _, a := range req.Attributes {
+		attrs.add(newString(tagOctetString, a))
+	}
+	op := newSequence(opSearchRequest,
+		newString(tagOctetString, req.BaseDN),
+		newInteger(tagEnumerated, req.Scope),
+		newInteger(tagEnumerated, 0), // never dereference aliases
+		newInteger(tagInteger, req.SizeLimit),
+		newInteger(tagInteger, int(c.timeout.Seconds())),
+		newBoolean(false),
+		filter,
+		attrs,
+	)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, err := c.send(op)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for {
+		msg, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.tag {
+		case opSearchEntry:
+			entry := Entry{DN: msg.child(0).string(), Attributes: map[string][]string{}}
+			for _, attr := range msg.child(1).children {
+				var values []string
+				for _, v := range attr.child(1).children {
+					values = append(values, v.string())
+				}
+				entry.Attributes[attr.child(0).string()] = values
+			}
+			entries = append(entries, entry)
+		case opSearchReference:
+		case opSearchDone:
+			return entries, result(msg)
+		default:
+			return nil, errors.New("ldap: unexpected response to search")
+		}
+	}
+}
+
+// Close sends an unbind request and closes the connection.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.send(&packet{tag: opUnbindRequest})
+	return c.conn.Close()
+}
+
+func (c *Conn) roundTrip(op *packet, want byte) (*packet, error) {
+	id, err := c.send(op)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.receive(id)
+	if err != nil {
+		return nil, err
+	}
+	if resp.tag != want {
+		return nil, errors.New("ldap: unexpected response")
+	}
+	return resp, nil
+}
+
+func (c *Conn) send(op *packet) (int, error) {
+	c.lastID++
+	msg := newSequence(tagSequence, newInteger(tagInteger, c.lastID), op)
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(msg.bytes())
+	return c.lastID, err
+}
+
+// receive reads the next message for id and returns its protocol op.
+func (c *Conn) receive(id int) (*packet, error) {
+	for {
+		msg, err := readPacket(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if msg.tag != tagSequence|constructed || len(msg.children) < 2 {
+			return nil, errors.New("ldap: malformed message")
+		}
+		switch msg.child(0).int() {
+		case id:
+			return msg.child(1), nil
+		case 0:
+			// Unsolicited notification, e.g. notice of disconnection.
+			return nil, errors.New("ldap: server closed the connection")
+		}
+	}
+}
+
+// result converts the LDAPResult at the start of resp into an error.
+func result(resp *packet) error {
+	code := resp.child(0).int()
+	if code == ResultSuccess {
+		return nil
+	}
+	return &Error{Code: code, Message: resp.child(2).string()}
+}
+
+func serverTLSConfig(cfg *tls.Config, serverName string) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	cfg = cfg.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = serverName
+	}
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	return cfg
+}
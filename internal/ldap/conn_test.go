@@ -0,0 +1,158 @@
+package ldap_test
+
+import (
+	"GoAuthentication/internal/ldap"
+	"GoAuthentication/internal/ldap/ldaptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var directory = []ldaptest.Entry{
+	{DN: "ou=people,dc=example,dc=com"},
+	{
+		DN:       "uid=alice,ou=people,dc=example,dc=com",
+		Password: "wonderland",
+		Attributes: map[string][]string{
+			"uid":      {"alice"},
+			"mail":     {"alice@example.com"},
+			"cn":       {"Alice Liddell"},
+			"memberOf": {"cn=admins,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"},
+		},
+	},
+	{
+		DN:         "uid=bob,ou=people,dc=example,dc=com",
+		Password:   "builder",
+		Attributes: map[string][]string{"uid": {"bob"}, "mail": {"bob@example.com"}},
+	},
+}
+
+func dial(t *testing.T, s *ldaptest.Server) *ldap.Conn {
+	t.Helper()
+	conn, err := ldap.Dial(s.URL, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestBind(t *testing.T) {
+	s := ldaptest.NewServer(t, directory...)
+	conn := dial(t, s)
+
+	if err := conn.Bind("uid=alice,ou=people,dc=example,dc=com", "wonderland"); err != nil {
+		t.Fatalf("valid bind: %v", err)
+	}
+	err := conn.Bind("uid=alice,ou=people,dc=example,dc=com", "looking-glass")
+	if !ldap.IsInvalidCredentials(err) {
+		t.Fatalf("wrong password: %v, want invalid credentials", err)
+	}
+	err = conn.Bind("uid=nobody,ou=people,dc=example,dc=com", "wonderland")
+	if !ldap.IsInvalidCredentials(err) {
+		t.Fatalf("unknown DN: %v, want invalid credentials", err)
+	}
+}
+
+func TestBindRefusesEmptyPassword(t *testing.T) {
+	s := ldaptest.NewServer(t, directory...)
+	conn := dial(t, s)
+
+	err := conn.Bind("uid=alice,ou=people,dc=example,dc=com", "")
+	if !ldap.IsInvalidCredentials(err) {
+		t.Fatalf("empty password: %v, want invalid credentials", err)
+	}
+	// The server would have taken it as an anonymous bind.
+	if binds := s.Binds(); len(binds) != 0 {
+		t.Fatalf("empty password reached the server: %+v", binds)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s := ldaptest.NewServer(t, directory...)
+	conn := dial(t, s)
+
+	entries, err := conn.Search(ldap.SearchRequest{
+		BaseDN:     "ou=people,dc=example,dc=com",
+		Scope:      ldap.ScopeWholeSubtree,
+		Filter:     "(&(uid=alice)(mail=*))",
+		Attributes: []string{"mail", "memberOf"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.DN != "uid=alice,ou=people,dc=example,dc=com" || e.Get("MAIL") != "alice@example.com" || e.Get("cn") != "" {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if got := e.GetAll("memberof"); len(got) != 2 {
+		t.Fatalf("memberOf = %v", got)
+	}
+
+	entries, err = conn.Search(ldap.SearchRequest{
+		BaseDN: "ou=people,dc=example,dc=com",
+		Scope:  ldap.ScopeSingleLevel,
+		Filter: "(|(uid=a*)(mail=*@example.com))",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("substring search got %d entries, want 2", len(entries))
+	}
+}
+
+func TestSearchSizeLimit(t *testing.T) {
+	s := ldaptest.NewServer(t, directory...)
+	conn := dial(t, s)
+
+	_, err := conn.Search(ldap.SearchRequest{
+		BaseDN:    "ou=people,dc=example,dc=com",
+		Scope:     ldap.ScopeSingleLevel,
+		Filter:    "(uid=*)",
+		SizeLimit: 1,
+	})
+	if err == nil {
+		t.Fatal("search beyond the size limit succeeded")
+	}
+}
+
+func TestSearchEscapedFilter(t *testing.T) {
+	s := ldaptest.NewServer(t, directory...)
+	conn := dial(t, s)
+
+	for _, input := range []string{"*", "alice)(uid=*", "*)(|(uid=*", `\2a`} {
+		entries, err := conn.Search(ldap.SearchRequest{
+			BaseDN: "ou=people,dc=example,dc=com",
+			Scope:  ldap.ScopeWholeSubtree,
+			Filter: "(uid=" + ldap.EscapeFilter(input) + ")",
+		})
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("%q matched %d entries", input, len(entries))
+		}
+	}
+	want := []string{`(uid=\2a)`, `(uid=alice\29\28uid=\2a)`, `(uid=\2a\29\28|\28uid=\2a)`, `(uid=\5c2a)`}
+	if got := s.Filters(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("server saw filters %q, want %q", got, want)
+	}
+}
+
+func TestSearchRejectsMalformedFilter(t *testing.T) {
+	s := ldaptest.NewServer(t, directory...)
+	conn := dial(t, s)
+
+	for _, filter := range []string{"uid=alice", "(uid=alice", "(uid=alice))", "(=alice)", `(uid=\zz)`, "(uid:dn:=alice)"} {
+		if _, err := conn.Search(ldap.SearchRequest{BaseDN: "dc=example,dc=com", Filter: filter}); err == nil {
+			t.Errorf("filter %q was accepted", filter)
+		}
+	}
+	if got := s.Filters(); len(got) != 0 {
+		t.Fatalf("malformed filters reached the server: %q", got)
+	}
+}
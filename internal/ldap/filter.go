@@ -0,0 +1,168 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Filter choices of a SearchRequest.
+const (
+	filterAnd         = classContext | constructed | 0
+	filterOr          = classContext | constructed | 1
+	filterNot         = classContext | constructed | 2
+	filterEquality    = classContext | constructed | 3
+	filterSubstrings  = classContext | constructed | 4
+	filterGreaterOrEq = classContext | constructed | 5
+	filterLessOrEq    = classContext | constructed | 6
+	filterPresent     = classContext | 7
+	filterApprox      = classContext | constructed | 8
+)
+
+// EscapeFilter escapes a value for use inside a search filter (RFC 4515),
+// so that user input cannot change the filter's structure.
+func EscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			b.WriteString(`\` + hex.EncodeToString([]byte{c}))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// compileFilter turns the string form of a filter into its BER encoding.
+// Extensible matches are not supported.
+func compileFilter(s string) (*packet, error) {
+	p, rest, err := parseFilter(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, errors.New("ldap: trailing data in filter")
+	}
+	return p, nil
+}
+
+func parseFilter(s string) (*packet, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", errors.New("ldap: filter must start with (")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", errors.New("ldap: unterminated filter")
+	}
+	var p *packet
+	switch s[0] {
+	case '&', '|':
+		p = newSequence(filterAnd)
+		if s[0] == '|' {
+			p = newSequence(filterOr)
+		}
+		s = s[1:]
+		for strings.HasPrefix(s, "(") {
+			child, rest, err := parseFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			p.add(child)
+			s = rest
+		}
+	case '!':
+		child, rest, err := parseFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		p, s = newSequence(filterNot, child), rest
+	default:
+		end := strings.IndexByte(s, ')')
+		if end < 0 {
+			return nil, "", errors.New("ldap: unterminated filter")
+		}
+		item, err := parseItem(s[:end])
+		if err != nil {
+			return nil, "", err
+		}
+		p, s = item, s[end:]
+	}
+	if !strings.HasPrefix(s, ")") {
+		return nil, "", errors.New("ldap: unterminated filter")
+	}
+	return p, s[1:], nil
+}
+
+func parseItem(s string) (*packet, error) {
+	eq := strings.IndexByte(s, '=')
+	if eq <= 0 {
+		return nil, errors.New("ldap: invalid filter item")
+	}
+	attr, value := s[:eq], s[eq+1:]
+	tag := byte(filterEquality)
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = filterGreaterOrEq, attr[:len(attr)-1]
+	case '<':
+		tag, attr = filterLessOrEq, attr[:len(attr)-1]
+	case '~':
+		tag, attr = filterApprox, attr[:len(attr)-1]
+	case ':':
+		return nil, errors.New("ldap: extensible match filters are not supported")
+	}
+	if attr == "" {
+		return nil, errors.New("ldap: invalid filter item")
+	}
+
+	if tag == filterEquality && value == "*" {
+		return newString(filterPresent, attr), nil
+	}
+	if tag == filterEquality && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		subs := newSequence(tagSequence)
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			v, err := unescapeFilter(part)
+			if err != nil {
+				return nil, err
+			}
+			kind := byte(classContext | 1) // any
+			switch i {
+			case 0:
+				kind = classContext | 0 // initial
+			case len(parts) - 1:
+				kind = classContext | 2 // final
+			}
+			subs.add(newString(kind, v))
+		}
+		return newSequence(filterSubstrings, newString(tagOctetString, attr), subs), nil
+	}
+	v, err := unescapeFilter(value)
+	if err != nil {
+		return nil, err
+	}
+	return newSequence(tag, newString(tagOctetString, attr), newString(tagOctetString, v)), nil
+}
+
+func unescapeFilter(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", errors.New("ldap: invalid escape in filter")
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", errors.New("ldap: invalid escape in filter")
+		}
+		b.Write(c)
+		i += 2
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,462 @@
+// Package ldaptest runs an in-memory directory server for tests. It speaks
+// enough LDAPv3 for simple binds and searches, and decodes the protocol on
+// its own so that it checks the client's encoding rather than sharing it.
+package ldaptest
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Result codes the server returns.
+const (
+	resultSuccess            = 0
+	resultProtocolError      = 2
+	resultSizeLimitExceeded  = 4
+	resultNoSuchObject       = 32
+	resultInvalidCredentials = 49
+)
+
+// Entry is a directory entry. Binding as DN succeeds with Password; an entry
+// without a password can not bind.
+type Entry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// Server is a directory listening on a loopback port.
+type Server struct {
+	URL string
+
+	ln      net.Listener
+	entries []Entry
+
+	mu      sync.Mutex
+	binds   []Bind
+	filters []string
+}
+
+// Bind is a bind request the server received.
+type Bind struct {
+	DN       string
+	Password string
+	OK       bool
+}
+
+// NewServer starts a server holding entries and stops it when the test ends.
+// Like real directories it accepts anonymous binds, i.e. any DN with an
+// empty password.
+func NewServer(t testing.TB, entries ...Entry) *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{URL: "ldap://" + ln.Addr().String(), ln: ln, entries: entries}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+// Binds returns the bind requests received so far.
+func (s *Server) Binds() []Bind {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Bind(nil), s.binds...)
+}
+
+// Filters returns the search filters received so far, in their string form
+// with every value escaped.
+func (s *Server) Filters() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.filters...)
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := readElement(r)
+		if err != nil || len(msg.children) < 2 {
+			return
+		}
+		id, op := msg.children[0], msg.children[1]
+		var replies []*element
+		switch op.tag {
+		case 0x60: // bind request
+			replies = []*element{s.bind(op)}
+		case 0x42: // unbind request
+			return
+		case 0x63: // search request
+			replies = s.search(op)
+		case 0x77: // extended request, StartTLS included
+			replies = []*element{result(0x78, resultProtocolError, "unsupported extended operation")}
+		default:
+			return
+		}
+		for _, reply := range replies {
+			out := &element{tag: 0x30, children: []*element{id, reply}}
+			if _, err := conn.Write(out.bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) bind(op *element) *element {
+	dn, password := op.child(1).string(), op.child(2).string()
+	ok := password == ""
+	if e, found := s.entry(dn); found && e.Password != "" && e.Password == password {
+		ok = true
+	}
+	s.mu.Lock()
+	s.binds = append(s.binds, Bind{DN: dn, Password: password, OK: ok})
+	s.mu.Unlock()
+	if !ok {
+		return result(0x61, resultInvalidCredentials, "invalid credentials")
+	}
+	return result(0x61, resultSuccess, "")
+}
+
+func (s *Server) search(op *element) []*element {
+	base, scope, sizeLimit := op.child(0).string(), op.child(1).int(), op.child(3).int()
+	filter := op.child(6)
+	var attrs []string
+	for _, a := range op.child(7).children {
+		attrs = append(attrs, a.string())
+	}
+	s.mu.Lock()
+	s.filters = append(s.filters, filterString(filter))
+	s.mu.Unlock()
+
+	if _, ok := s.entry(base); !ok && !s.hasChildren(base) {
+		return []*element{result(0x65, resultNoSuchObject, "no such object")}
+	}
+	var replies []*element
+	for _, e := range s.entries {
+		if !inScope(e.DN, base, scope) || !matches(filter, e) {
+			continue
+		}
+		if sizeLimit > 0 && len(replies) == sizeLimit {
+			return append(replies, result(0x65, resultSizeLimitExceeded, "size limit exceeded"))
+		}
+		replies = append(replies, searchEntry(e, attrs))
+	}
+	return append(replies, result(0x65, resultSuccess, ""))
+}
+
+func (s *Server) entry(dn string) (Entry, bool) {
+	for _, e := range s.entries {
+		if strings.EqualFold(e.DN, dn) {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+func (s *Server) hasChildren(dn string) bool {
+	for _, e := range s.entries {
+		if inScope(e.DN, dn, 2) {
+			return true
+		}
+	}
+	return false
+}
+
+// inScope reports whether dn is within scope of base: 0 the base itself,
+// 1 its children, 2 the whole subtree.
+func inScope(dn, base string, scope int) bool {
+	dn, base = strings.ToLower(dn), strings.ToLower(base)
+	if dn == base {
+		return scope != 1
+	}
+	if base != "" && !strings.HasSuffix(dn, ","+base) {
+		return false
+	}
+	switch scope {
+	case 1:
+		rest := strings.TrimSuffix(dn, ","+base)
+		return !strings.Contains(rest, ",")
+	case 2:
+		return true
+	}
+	return false
+}
+
+func searchEntry(e Entry, attrs []string) *element {
+	list := &element{tag: 0x30}
+	for name, values := range e.Attributes {
+		if len(attrs) > 0 && !containsFold(attrs, name) {
+			continue
+		}
+		set := &element{tag: 0x31}
+		for _, v := range values {
+			set.children = append(set.children, primitive(0x04, v))
+		}
+		list.children = append(list.children, &element{tag: 0x30, children: []*element{primitive(0x04, name), set}})
+	}
+	return &element{tag: 0x64, children: []*element{primitive(0x04, e.DN), list}}
+}
+
+// matches evaluates a BER encoded filter against e.
+func matches(f *element, e Entry) bool {
+	switch f.tag {
+	case 0xa0: // and
+		for _, c := range f.children {
+			if !matches(c, e) {
+				return false
+			}
+		}
+		return true
+	case 0xa1: // or
+		for _, c := range f.children {
+			if matches(c, e) {
+				return true
+			}
+		}
+		return false
+	case 0xa2: // not
+		return !matches(f.child(0), e)
+	case 0x87: // present
+		return len(values(e, f.string())) > 0
+	case 0xa3, 0xa8: // equality, approximate
+		for _, v := range values(e, f.child(0).string()) {
+			if strings.EqualFold(v, f.child(1).string()) {
+				return true
+			}
+		}
+		return false
+	case 0xa4: // substrings
+		for _, v := range values(e, f.child(0).string()) {
+			if matchSubstrings(strings.ToLower(v), f.child(1).children) {
+				return true
+			}
+		}
+		return false
+	case 0xa5, 0xa6: // greater or equal, less or equal
+		for _, v := range values(e, f.child(0).string()) {
+			if c := strings.Compare(v, f.child(1).string()); c == 0 || (c > 0) == (f.tag == 0xa5) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func matchSubstrings(v string, subs []*element) bool {
+	for _, sub := range subs {
+		part := strings.ToLower(sub.string())
+		switch sub.tag {
+		case 0x80: // initial
+			if !strings.HasPrefix(v, part) {
+				return false
+			}
+			v = v[len(part):]
+		case 0x81: // any
+			i := strings.Index(v, part)
+			if i < 0 {
+				return false
+			}
+			v = v[i+len(part):]
+		case 0x82: // final
+			if !strings.HasSuffix(v, part) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func values(e Entry, name string) []string {
+	if strings.EqualFold(name, "objectClass") && len(e.Attributes["objectClass"]) == 0 {
+		return []string{"top"}
+	}
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// filterString renders a BER encoded filter in the RFC 4515 string form.
+func filterString(f *element) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	switch f.tag {
+	case 0xa0, 0xa1, 0xa2:
+		b.WriteByte("&|!"[f.tag-0xa0])
+		for _, c := range f.children {
+			b.WriteString(filterString(c))
+		}
+	case 0x87:
+		b.WriteString(f.string() + "=*")
+	case 0xa3, 0xa5, 0xa6, 0xa8:
+		op := map[byte]string{0xa3: "=", 0xa5: ">=", 0xa6: "<=", 0xa8: "~="}[f.tag]
+		b.WriteString(f.child(0).string() + op + escape(f.child(1).string()))
+	case 0xa4:
+		b.WriteString(f.child(0).string() + "=")
+		subs := f.child(1).children
+		if len(subs) > 0 && subs[0].tag != 0x80 {
+			b.WriteByte('*')
+		}
+		for i, sub := range subs {
+			b.WriteString(escape(sub.string()))
+			if sub.tag != 0x82 || i < len(subs)-1 {
+				b.WriteByte('*')
+			}
+		}
+	default:
+		b.WriteString("?")
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			b.WriteString(`\` + hex.EncodeToString([]byte{c}))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// result builds an LDAPResult with the given protocol op tag.
+func result(tag byte, code int, message string) *element {
+	return &element{tag: tag, children: []*element{integer(0x0a, code), primitive(0x04, ""), primitive(0x04, message)}}
+}
+
+// element is a BER element. Constructed elements have bit 0x20 in the tag.
+type element struct {
+	tag      byte
+	value    []byte
+	children []*element
+}
+
+func primitive(tag byte, s string) *element { return &element{tag: tag, value: []byte(s)} }
+
+func integer(tag byte, n int) *element {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		if n >= -128 && n < 128 {
+			break
+		}
+		n >>= 8
+	}
+	return &element{tag: tag, value: b}
+}
+
+func (e *element) child(i int) *element {
+	if i < len(e.children) {
+		return e.children[i]
+	}
+	return &element{}
+}
+
+func (e *element) string() string { return string(e.value) }
+
+func (e *element) int() int {
+	n := 0
+	for i, b := range e.value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+func (e *element) bytes() []byte {
+	content := e.value
+	if e.tag&0x20 != 0 {
+		content = nil
+		for _, c := range e.children {
+			content = append(content, c.bytes()...)
+		}
+	}
+	out := []byte{e.tag}
+	if n := len(content); n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, content...)
+}
+
+func readElement(r *bufio.Reader) (*element, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n := int(first)
+	if first&0x80 != 0 {
+		if first&0x7f == 0 || first&0x7f > 4 {
+			return nil, errors.New("ldaptest: unsupported BER length")
+		}
+		n = 0
+		for i := 0; i < int(first&0x7f); i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	e := &element{tag: tag}
+	if tag&0x20 == 0 {
+		e.value = content
+		return e, nil
+	}
+	cr := bufio.NewReader(strings.NewReader(string(content)))
+	for {
+		if _, err := cr.Peek(1); err == io.EOF {
+			return e, nil
+		}
+		child, err := readElement(cr)
+		if err != nil {
+			return nil, err
+		}
+		e.children = append(e.children, child)
+	}
+}
@@ -0,0 +1,120 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a minimal SMTP server that records the last message it got.
+type fakeSMTP struct {
+	ln       net.Listener
+	silent   bool // accept connections but never answer
+	messages chan string
+}
+
+func newFakeSMTP(t *testing.T, silent bool) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln, silent: silent, messages: make(chan string, 1)}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTP) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+	if s.silent {
+		time.Sleep(5 * time.Second)
+		return
+	}
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 fake ESMTP")
+	var data strings.Builder
+	inData := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if inData {
+			if line == ".\r\n" {
+				inData = false
+				s.messages <- data.String()
+				reply("250 queued")
+				continue
+			}
+			data.WriteString(line)
+			continue
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 fake")
+		case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+			reply("250 ok")
+		case cmd == "DATA":
+			inData = true
+			reply("354 go ahead")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown")
+		}
+	}
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	s := newFakeSMTP(t, false)
+	host, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	m := NewSMTPMailer(host, port, "", "", "auth@example.com")
+
+	err := m.Send(context.Background(), Message{To: "user@example.com", Subject: "Your code", Body: "123456\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-s.messages:
+		for _, want := range []string{"From: auth@example.com", "To: user@example.com", "Subject: Your code", "123456"} {
+			if !strings.Contains(got, want) {
+				t.Errorf("message lacks %q:\n%s", want, got)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message delivered")
+	}
+}
+
+func TestSMTPMailerSendHonoursContext(t *testing.T) {
+	s := newFakeSMTP(t, true)
+	host, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	m := NewSMTPMailer(host, port, "", "", "auth@example.com")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := m.Send(ctx, Message{To: "user@example.com", Subject: "Your code", Body: "123456"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Send returned %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Send took %v after the context expired", elapsed)
+	}
+}
@@ -1,9 +1,13 @@
 package models
 
-import "time"
+import (
+	"crypto/x509"
+	"time"
+)
 
 type Request struct {
-	GUID int `json:"guid" binding:"required" example:"1"`
+	GUID  int    `json:"guid" binding:"required" example:"1"`
+	Scope string `json:"scope,omitempty" example:"invoices:read"`
 }
 
 type Response struct {
@@ -19,10 +23,21 @@ type TokenRecord struct {
 	RefreshHash string
 	Status      string
 	CreatedAt   time.Time
+	AuthTime    time.Time
+	ACR         string
+	AMR         []string
+	ClientID    string
+	Scope       string
+	Audience    []string
+	Act         map[string]interface{}
+	JKT         string
+	X5T         string
 }
 
 type CurrentUserResponse struct {
-	GUID int `json:"guid" binding:"required" example:"1"`
+	GUID  int      `json:"guid" binding:"required" example:"1"`
+	Scope string   `json:"scope" example:"invoices:read invoices:write"`
+	Roles []string `json:"roles" example:"accountant"`
 }
 
 type IPChangeRequest struct {
@@ -31,3 +46,352 @@ type IPChangeRequest struct {
 	NewIP    string    `json:"new_ip" binding:"required" example:"203.0.113.42"`
 	DateTime time.Time `json:"datetime" binding:"required" example:"2025-05-03T14:25:00Z"`
 }
+
+type LoginCode struct {
+	ID        int
+	Email     string
+	GUID      int
+	CodeHash  string
+	LinkHash  string
+	Attempts  int
+	Used      bool
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+type EmailLoginRequest struct {
+	Email string `json:"email" binding:"required" example:"user@example.com"`
+}
+
+type EmailVerifyRequest struct {
+	Email string `json:"email" binding:"required" example:"user@example.com"`
+	Code  string `json:"code" binding:"required" example:"123456"`
+}
+
+type PasswordLoginRequest struct {
+	Username string `json:"username" binding:"required" example:"jdoe"`
+	Password string `json:"password" binding:"required" example:"secret"`
+}
+
+type StepUpRequest struct {
+	Code string `json:"code" binding:"required" example:"123456"`
+}
+
+type Client struct {
+	ID             string
+	SecretHash     string
+	Name           string
+	RedirectURIs   []string
+	Scopes         []string
+	GrantTypes     []string
+	AuthMethod     string
+	JWKS           string
+	TLSSubjectDN   string
+	CertThumbprint string
+	DPoPBound      bool
+	CertBound      bool
+	CreatedAt      time.Time
+}
+
+type ClientRegistration struct {
+	Name           string
+	RedirectURIs   []string
+	Scopes         []string
+	GrantTypes     []string
+	AuthMethod     string
+	JWKS           string
+	TLSSubjectDN   string
+	CertThumbprint string
+	DPoPBound      bool
+	CertBound      bool
+}
+
+// AuthorizationCode keeps the redirect_uri sent to /authorize as is, empty
+// when the client relied on its only registered URI.
+type AuthorizationCode struct {
+	CodeHash      string
+	ClientID      string
+	GUID          int
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	AuthTime      time.Time
+	ACR           string
+	AMR           []string
+	Used          bool
+	ExpiresAt     time.Time
+}
+
+type AuthorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Prompt              string
+	MaxAge              string
+	Consent             string
+}
+
+type ConsentPrompt struct {
+	ClientID   string   `json:"client_id" example:"c2f1a0e4b7d94f0e"`
+	ClientName string   `json:"client_name" example:"Web shop"`
+	Scopes     []string `json:"scopes" example:"openid,profile"`
+}
+
+type TokenRequest struct {
+	GrantType    string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	RefreshToken string
+	Scope        string
+	DeviceCode   string
+	ClientID     string
+	ClientSecret string
+	DPoP         string
+
+	// Token and TokenTypeHint are the parameters of an introspection request.
+	Token         string
+	TokenTypeHint string
+
+	SubjectToken       string
+	SubjectTokenType   string
+	ActorToken         string
+	ActorTokenType     string
+	RequestedTokenType string
+	Audience           []string
+
+	ClientAssertionType string
+	ClientAssertion     string
+	ClientCert          *x509.Certificate
+	ClientCertVerified  bool
+}
+
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token" example:"eyJhbGciOiJIUzUxMiIsInR5cCI6IkpXVCJ9..."`
+	TokenType    string `json:"token_type" example:"Bearer"`
+	ExpiresIn    int    `json:"expires_in" example:"86400"`
+	RefreshToken string `json:"refresh_token,omitempty" example:"42.2nNAhnaawM5P1z8vKMXk9jvkSuuqUjoMWWEV1w/TqnM="`
+	Scope        string `json:"scope,omitempty" example:"openid profile"`
+	IDToken      string `json:"id_token,omitempty" example:"eyJhbGciOiJSUzI1NiIsImtpZCI6Ii4uLiJ9..."`
+
+	IssuedTokenType string `json:"issued_token_type,omitempty" example:"urn:ietf:params:oauth:token-type:access_token"`
+}
+
+// IntrospectionResponse is the RFC 7662 answer about a token. Inactive
+// tokens only report active=false.
+type IntrospectionResponse struct {
+	Active    bool                   `json:"active" example:"true"`
+	Scope     string                 `json:"scope,omitempty" example:"openid invoices:read"`
+	ClientID  string                 `json:"client_id,omitempty" example:"3f2a..."`
+	Sub       string                 `json:"sub,omitempty" example:"1"`
+	TokenType string                 `json:"token_type,omitempty" example:"Bearer"`
+	Exp       int64                  `json:"exp,omitempty" example:"1746396981"`
+	Iat       int64                  `json:"iat,omitempty" example:"1746310581"`
+	Aud       []string               `json:"aud,omitempty"`
+	Roles     []string               `json:"roles,omitempty" example:"accountant"`
+	ACR       string                 `json:"acr,omitempty" example:"1"`
+	AuthTime  int64                  `json:"auth_time,omitempty" example:"1746310581"`
+	Act       map[string]interface{} `json:"act,omitempty"`
+	Cnf       map[string]string      `json:"cnf,omitempty"`
+}
+
+type OAuthErrorResponse struct {
+	Error            string `json:"error" example:"invalid_grant"`
+	ErrorDescription string `json:"error_description,omitempty" example:"Invalid authorization code"`
+}
+
+type User struct {
+	GUID          int
+	Email         string
+	EmailVerified bool
+	Name          string
+	GivenName     string
+	FamilyName    string
+	UpdatedAt     time.Time
+}
+
+type UserInfoResponse struct {
+	Sub           string `json:"sub" example:"1"`
+	Name          string `json:"name,omitempty" example:"Jane Doe"`
+	GivenName     string `json:"given_name,omitempty" example:"Jane"`
+	FamilyName    string `json:"family_name,omitempty" example:"Doe"`
+	UpdatedAt     int64  `json:"updated_at,omitempty" example:"1746396981"`
+	Email         string `json:"email,omitempty" example:"jane@example.com"`
+	EmailVerified *bool  `json:"email_verified,omitempty" example:"true"`
+}
+
+type OpenIDConfiguration struct {
+	Issuer                                     string   `json:"issuer"`
+	AuthorizationEndpoint                      string   `json:"authorization_endpoint"`
+	TokenEndpoint                              string   `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint                string   `json:"device_authorization_endpoint"`
+	UserinfoEndpoint                           string   `json:"userinfo_endpoint"`
+	JWKSURI                                    string   `json:"jwks_uri"`
+	ScopesSupported                            []string `json:"scopes_supported"`
+	ResponseTypesSupported                     []string `json:"response_types_supported"`
+	ResponseModesSupported                     []string `json:"response_modes_supported"`
+	GrantTypesSupported                        []string `json:"grant_types_supported"`
+	SubjectTypesSupported                      []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported           []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported"`
+	TokenEndpointAuthSigningAlgValuesSupported []string `json:"token_endpoint_auth_signing_alg_values_supported"`
+	ClaimsSupported                            []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported"`
+	ACRValuesSupported                         []string `json:"acr_values_supported"`
+	AuthorizationResponseISSParameterSupported bool     `json:"authorization_response_iss_parameter_supported"`
+	DPoPSigningAlgValuesSupported              []string `json:"dpop_signing_alg_values_supported"`
+	TLSClientCertificateBoundAccessTokens      bool     `json:"tls_client_certificate_bound_access_tokens"`
+	IntrospectionEndpoint                      string   `json:"introspection_endpoint"`
+}
+
+type DeviceCode struct {
+	DeviceCodeHash string
+	UserCode       string
+	ClientID       string
+	Scope          string
+	Status         string
+	GUID           int
+	AuthTime       time.Time
+	ACR            string
+	AMR            []string
+	Interval       int
+	LastPolledAt   time.Time
+	ExpiresAt      time.Time
+}
+
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code" example:"GmRhmhcxhwAzkoEqiMEg_DnyEysNkuNhszIySk9eS"`
+	UserCode                string `json:"user_code" example:"WDJB-MJHT"`
+	VerificationURI         string `json:"verification_uri" example:"https://auth.example.com/device"`
+	VerificationURIComplete string `json:"verification_uri_complete" example:"https://auth.example.com/device?user_code=WDJB-MJHT"`
+	ExpiresIn               int    `json:"expires_in" example:"600"`
+	Interval                int    `json:"interval" example:"5"`
+}
+
+type DeviceInfo struct {
+	UserCode   string   `json:"user_code" example:"WDJB-MJHT"`
+	ClientID   string   `json:"client_id" example:"c2f1a0e4b7d94f0e"`
+	ClientName string   `json:"client_name" example:"Smart TV"`
+	Scopes     []string `json:"scopes" example:"openid,profile"`
+}
+
+type DeviceVerificationRequest struct {
+	UserCode string `json:"user_code" binding:"required" example:"WDJB-MJHT"`
+	Action   string `json:"action" binding:"required" example:"approve"`
+}
+
+type ExchangePolicy struct {
+	ClientID      string
+	Audiences     []string
+	Scopes        []string
+	Impersonation bool
+}
+
+type AuditEvent struct {
+	ID        int64
+	Event     string
+	GUID      int
+	ClientID  string
+	Details   map[string]interface{}
+	CreatedAt time.Time
+}
+
+// Tenant is a product hosted on the deployment. It is reached through one
+// of its Hosts or the /t/{id}/ path prefix and has its own keys and policies.
+type Tenant struct {
+	ID               string
+	Name             string
+	Hosts            []string
+	Issuer           string
+	Secret           string
+	SigningKey       string
+	AccessTokenTTL   time.Duration
+	RequireDPoP      bool
+	RequireDPoPNonce bool
+	CreatedAt        time.Time
+}
+
+// WebhookSubscription delivers Events of a tenant to URL, every event when
+// Events is empty.
+type WebhookSubscription struct {
+	ID       int
+	TenantID string
+	URL      string
+	Events   []string
+}
+
+// IdentityProvider is an upstream OpenID Connect provider users can sign in
+// with. Its endpoints and keys are discovered from Issuer.
+type IdentityProvider struct {
+	ID           string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	CreatedAt    time.Time
+}
+
+// FederationState remembers an authorization request sent upstream until the
+// user comes back with its state.
+type FederationState struct {
+	StateHash    string
+	ProviderID   string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
+// SAMLProvider is an upstream SAML 2.0 identity provider. Attributes maps
+// user claims (email, name, given_name, family_name) to SAML attribute names.
+type SAMLProvider struct {
+	ID          string
+	EntityID    string
+	SSOURL      string
+	Certificate string
+	Attributes  map[string]string
+	LinkByEmail bool
+	CreatedAt   time.Time
+}
+
+// APIKey is a long-lived credential of a user or, when ClientID is set, of
+// a client. Only the hash of its secret is stored. Zero times mean never.
+type APIKey struct {
+	ID         string
+	GUID       int
+	ClientID   string
+	Name       string
+	Scopes     []string
+	SecretHash string
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+	CreatedAt  time.Time
+}
+
+type APIKeyRequest struct {
+	Name      string `json:"name" example:"CI pipeline"`
+	Scope     string `json:"scope" example:"orders:read"`
+	ExpiresIn int    `json:"expires_in,omitempty" example:"7776000"`
+}
+
+// APIKeyInfo describes a key. Key is only returned when it is created.
+type APIKeyInfo struct {
+	ID         string     `json:"id" example:"3f9a1c0b7e2d"`
+	Key        string     `json:"key,omitempty" example:"gak_3f9a1c0b7e2d_Vd0qg8yR2m5ZkF1xJ7tW4cN9bH6pL3sA0eU8iO2yQ5r"`
+	Name       string     `json:"name" example:"CI pipeline"`
+	Scope      string     `json:"scope" example:"orders:read"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type APIKeyExchangeRequest struct {
+	APIKey string `json:"api_key" binding:"required" example:"gak_3f9a1c0b7e2d_Vd0qg8yR2m5ZkF1xJ7tW4cN9bH6pL3sA0eU8iO2yQ5r"`
+}
@@ -0,0 +1,216 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+const (
+	DSigNamespace = "http://www.w3.org/2000/09/xmldsig#"
+
+	algExcC14N     = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algEnveloped   = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	algSHA256      = "http://www.w3.org/2001/04/xmlenc#sha256"
+	algSHA512      = "http://www.w3.org/2001/04/xmlenc#sha512"
+	algRSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	algRSASHA512   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	algECDSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+)
+
+var digestMethods = map[string]crypto.Hash{
+	algSHA256: crypto.SHA256,
+	algSHA512: crypto.SHA512,
+}
+
+var signatureMethods = map[string]crypto.Hash{
+	algRSASHA256:   crypto.SHA256,
+	algRSASHA512:   crypto.SHA512,
+	algECDSASHA256: crypto.SHA256,
+}
+
+// Verify checks the enveloped signature of el: a ds:Signature child whose
+// single reference points at el's ID attribute. Only Exclusive XML
+// Canonicalization and SHA-256 or stronger are accepted. Callers must read
+// data from el itself afterwards, never from elsewhere in the document, so
+// that unsigned content cannot be slipped in next to the signed element.
+func Verify(el *Element, cert *x509.Certificate) error {
+	sigs := el.ChildElements(DSigNamespace, "Signature")
+	if len(sigs) != 1 {
+		return errors.New("saml: element must carry exactly one signature")
+	}
+	sig := sigs[0]
+	signedInfo := sig.Child(DSigNamespace, "SignedInfo")
+	if signedInfo == nil {
+		return errors.New("saml: signature has no SignedInfo")
+	}
+
+	c14n := signedInfo.Child(DSigNamespace, "CanonicalizationMethod")
+	if c14n == nil || c14n.Attr("Algorithm") != algExcC14N {
+		return errors.New("saml: unsupported canonicalization method")
+	}
+	method := signedInfo.Child(DSigNamespace, "SignatureMethod")
+	if method == nil {
+		return errors.New("saml: signature has no SignatureMethod")
+	}
+	hash, ok := signatureMethods[method.Attr("Algorithm")]
+	if !ok {
+		return errors.New("saml: unsupported signature method")
+	}
+
+	refs := signedInfo.ChildElements(DSigNamespace, "Reference")
+	if len(refs) != 1 {
+		return errors.New("saml: signature must have exactly one reference")
+	}
+	ref := refs[0]
+	if id := el.Attr("ID"); id == "" || ref.Attr("URI") != "#"+id {
+		return errors.New("saml: signature does not reference the signed element")
+	}
+	var inclusive []string
+	if transforms := ref.Child(DSigNamespace, "Transforms"); transforms != nil {
+		for _, t := range transforms.ChildElements(DSigNamespace, "Transform") {
+			switch t.Attr("Algorithm") {
+			case algEnveloped:
+			case algExcC14N:
+				inclusive = inclusivePrefixes(t)
+			default:
+				return errors.New("saml: unsupported transform")
+			}
+		}
+	}
+	digestMethod := ref.Child(DSigNamespace, "DigestMethod")
+	if digestMethod == nil {
+		return errors.New("saml: reference has no DigestMethod")
+	}
+	digestHash, ok := digestMethods[digestMethod.Attr("Algorithm")]
+	if !ok {
+		return errors.New("saml: unsupported digest method")
+	}
+	digestValue := ref.Child(DSigNamespace, "DigestValue")
+	if digestValue == nil {
+		return errors.New("saml: reference has no DigestValue")
+	}
+	want, err := decodeBase64(digestValue.Text())
+	if err != nil {
+		return err
+	}
+	h := digestHash.New()
+	h.Write(Canonicalize(el, inclusive, sig))
+	if subtle.ConstantTimeCompare(h.Sum(nil), want) != 1 {
+		return errors.New("saml: digest mismatch")
+	}
+
+	value := sig.Child(DSigNamespace, "SignatureValue")
+	if value == nil {
+		return errors.New("saml: signature has no SignatureValue")
+	}
+	signature, err := decodeBase64(value.Text())
+	if err != nil {
+		return err
+	}
+	h = hash.New()
+	h.Write(Canonicalize(signedInfo, inclusivePrefixes(c14n), nil))
+	digest := h.Sum(nil)
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if method.Attr("Algorithm") == algECDSASHA256 {
+			return errors.New("saml: signature method does not match the key")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, signature); err != nil {
+			return errors.New("saml: invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		// XML signatures carry r and s concatenated, not ASN.1.
+		if method.Attr("Algorithm") != algECDSASHA256 || len(signature)%2 != 0 {
+			return errors.New("saml: signature method does not match the key")
+		}
+		r := new(big.Int).SetBytes(signature[:len(signature)/2])
+		s := new(big.Int).SetBytes(signature[len(signature)/2:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("saml: invalid signature")
+		}
+	default:
+		return errors.New("saml: unsupported key type")
+	}
+	return nil
+}
+
+// Sign adds an enveloped RSA-SHA256 signature to el, after its Issuer child
+// as SAML requires. It is what an identity provider does and lets assertions
+// be produced with locally generated keys.
+func Sign(el *Element, key *rsa.PrivateKey, cert *x509.Certificate) error {
+	id := el.Attr("ID")
+	if id == "" {
+		return errors.New("saml: element has no ID")
+	}
+	ds := func(local string, attrs ...xml.Attr) *Element {
+		return &Element{Prefix: "ds", Local: local, Attrs: attrs}
+	}
+	alg := func(v string) xml.Attr { return xml.Attr{Name: xml.Name{Local: "Algorithm"}, Value: v} }
+
+	sig := ds("Signature", xml.Attr{Name: xml.Name{Space: "xmlns", Local: "ds"}, Value: DSigNamespace})
+	signedInfo := sig.add(ds("SignedInfo"))
+	signedInfo.add(ds("CanonicalizationMethod", alg(algExcC14N)))
+	signedInfo.add(ds("SignatureMethod", alg(algRSASHA256)))
+	ref := signedInfo.add(ds("Reference", xml.Attr{Name: xml.Name{Local: "URI"}, Value: "#" + id}))
+	transforms := ref.add(ds("Transforms"))
+	transforms.add(ds("Transform", alg(algEnveloped)))
+	transforms.add(ds("Transform", alg(algExcC14N)))
+	ref.add(ds("DigestMethod", alg(algSHA256)))
+	digestValue := ref.add(ds("DigestValue"))
+	signatureValue := sig.add(ds("SignatureValue"))
+	sig.add(ds("KeyInfo")).add(ds("X509Data")).add(ds("X509Certificate")).Children = []interface{}{
+		charData(base64.StdEncoding.EncodeToString(cert.Raw)),
+	}
+
+	// Place the signature, then digest the element without it.
+	pos := 0
+	for i, c := range el.Children {
+		if c, ok := c.(*Element); ok && c.Local == "Issuer" {
+			pos = i + 1
+		}
+	}
+	sig.Parent = el
+	el.Children = append(el.Children[:pos], append([]interface{}{sig}, el.Children[pos:]...)...)
+
+	h := crypto.SHA256.New()
+	h.Write(Canonicalize(el, nil, sig))
+	digestValue.Children = []interface{}{charData(base64.StdEncoding.EncodeToString(h.Sum(nil)))}
+
+	h = crypto.SHA256.New()
+	h.Write(Canonicalize(signedInfo, nil, nil))
+	value, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		return err
+	}
+	signatureValue.Children = []interface{}{charData(base64.StdEncoding.EncodeToString(value))}
+	return nil
+}
+
+func (el *Element) add(child *Element) *Element {
+	child.Parent = el
+	el.Children = append(el.Children, child)
+	return child
+}
+
+// inclusivePrefixes reads the InclusiveNamespaces PrefixList of an
+// Exclusive Canonicalization method or transform.
+func inclusivePrefixes(method *Element) []string {
+	if in := method.Child(algExcC14N, "InclusiveNamespaces"); in != nil {
+		return strings.Fields(in.Attr("PrefixList"))
+	}
+	return nil
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
@@ -0,0 +1,251 @@
+// Package saml implements the parts of SAML 2.0 a service provider needs:
+// AuthnRequests for the HTTP-Redirect binding, SP metadata and signed
+// Responses received through the HTTP-POST binding.
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"time"
+)
+
+const (
+	ProtocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	AssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	MetadataNamespace  = "urn:oasis:names:tc:SAML:2.0:metadata"
+
+	BindingHTTPPost     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	BindingHTTPRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+
+	NameIDFormatPersistent = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	NameIDFormatEmail      = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+
+	StatusSuccess      = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	ConfirmationBearer = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+// AuthnRequest asks the identity provider to authenticate the user.
+type AuthnRequest struct {
+	XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string   `xml:",attr"`
+	Version                     string   `xml:",attr"`
+	IssueInstant                string   `xml:",attr"`
+	Destination                 string   `xml:",attr"`
+	ProtocolBinding             string   `xml:",attr"`
+	AssertionConsumerServiceURL string   `xml:",attr"`
+	Issuer                      Issuer
+	NameIDPolicy                NameIDPolicy
+}
+
+type Issuer struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Value   string   `xml:",chardata"`
+}
+
+type NameIDPolicy struct {
+	XMLName     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+	Format      string   `xml:",attr"`
+	AllowCreate bool     `xml:",attr"`
+}
+
+// NewAuthnRequest builds a request from entityID whose response is to be
+// posted to acsURL.
+func NewAuthnRequest(id, entityID, acsURL, destination string, now time.Time) AuthnRequest {
+	return AuthnRequest{
+		ID:                          id,
+		Version:                     "2.0",
+		IssueInstant:                now.UTC().Format(time.RFC3339),
+		Destination:                 destination,
+		ProtocolBinding:             BindingHTTPPost,
+		AssertionConsumerServiceURL: acsURL,
+		Issuer:                      Issuer{Value: entityID},
+		NameIDPolicy:                NameIDPolicy{Format: NameIDFormatPersistent, AllowCreate: true},
+	}
+}
+
+// RedirectValue encodes the request for the SAMLRequest query parameter of
+// the HTTP-Redirect binding: DEFLATE, then base64.
+func (r AuthnRequest) RedirectValue() (string, error) {
+	data, err := xml.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// EntityDescriptor is the metadata of a service provider.
+type EntityDescriptor struct {
+	XMLName         xml.Name        `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID        string          `xml:"entityID,attr"`
+	SPSSODescriptor SPSSODescriptor `xml:"urn:oasis:names:tc:SAML:2.0:metadata SPSSODescriptor"`
+}
+
+type SPSSODescriptor struct {
+	ProtocolSupportEnumeration string                     `xml:"protocolSupportEnumeration,attr"`
+	AuthnRequestsSigned        bool                       `xml:"AuthnRequestsSigned,attr"`
+	WantAssertionsSigned       bool                       `xml:"WantAssertionsSigned,attr"`
+	NameIDFormats              []string                   `xml:"urn:oasis:names:tc:SAML:2.0:metadata NameIDFormat"`
+	AssertionConsumerServices  []AssertionConsumerService `xml:"urn:oasis:names:tc:SAML:2.0:metadata AssertionConsumerService"`
+}
+
+type AssertionConsumerService struct {
+	Binding   string `xml:"Binding,attr"`
+	Location  string `xml:"Location,attr"`
+	Index     int    `xml:"index,attr"`
+	IsDefault bool   `xml:"isDefault,attr"`
+}
+
+// NewMetadata describes a service provider that receives signed assertions
+// at acsURL through the HTTP-POST binding.
+func NewMetadata(entityID, acsURL string) EntityDescriptor {
+	return EntityDescriptor{
+		EntityID: entityID,
+		SPSSODescriptor: SPSSODescriptor{
+			ProtocolSupportEnumeration: ProtocolNamespace,
+			WantAssertionsSigned:       true,
+			NameIDFormats:              []string{NameIDFormatPersistent, NameIDFormatEmail},
+			AssertionConsumerServices: []AssertionConsumerService{
+				{Binding: BindingHTTPPost, Location: acsURL, Index: 0, IsDefault: true},
+			},
+		},
+	}
+}
+
+// Response is a samlp:Response whose assertion signature, or its own, has
+// been verified.
+type Response struct {
+	ID           string
+	InResponseTo string
+	Destination  string
+	Issuer       string
+	Status       string
+	Assertion    Assertion
+}
+
+// Assertion holds the statements of a saml:Assertion.
+type Assertion struct {
+	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	ID           string    `xml:"ID,attr"`
+	IssueInstant time.Time `xml:"IssueInstant,attr"`
+	Issuer       string    `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Subject      struct {
+		NameID struct {
+			Format string `xml:"Format,attr"`
+			Value  string `xml:",chardata"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+		Confirmations []SubjectConfirmation `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmation"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
+	Conditions *struct {
+		NotBefore    time.Time `xml:"NotBefore,attr"`
+		NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+		Audiences    []struct {
+			Audience []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Audience"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:assertion AudienceRestriction"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Conditions"`
+	AuthnStatement *struct {
+		AuthnInstant time.Time `xml:"AuthnInstant,attr"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnStatement"`
+	AttributeStatements []struct {
+		Attributes []Attribute `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeStatement"`
+}
+
+type SubjectConfirmation struct {
+	Method string `xml:"Method,attr"`
+	Data   struct {
+		NotBefore    time.Time `xml:"NotBefore,attr"`
+		NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+		Recipient    string    `xml:"Recipient,attr"`
+		InResponseTo string    `xml:"InResponseTo,attr"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmationData"`
+}
+
+type Attribute struct {
+	Name         string   `xml:"Name,attr"`
+	FriendlyName string   `xml:"FriendlyName,attr"`
+	Values       []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeValue"`
+}
+
+// Attribute returns the first value of the attribute called name, matched
+// against both Name and FriendlyName.
+func (a Assertion) Attribute(name string) string {
+	for _, st := range a.AttributeStatements {
+		for _, attr := range st.Attributes {
+			if (attr.Name == name || attr.FriendlyName == name) && len(attr.Values) > 0 {
+				return attr.Values[0]
+			}
+		}
+	}
+	return ""
+}
+
+// ParseResponse decodes the SAMLResponse form value of the HTTP-POST
+// binding and verifies it with cert. Either the Response or its single
+// Assertion must be signed, and the Assertion is always read from the signed
+// tree. The Response's own attributes are only trustworthy when the Response
+// is signed, so checks should use the assertion's subject confirmation.
+// Encrypted assertions are not supported.
+func ParseResponse(samlResponse string, cert *x509.Certificate) (*Response, error) {
+	data, err := decodeBase64(samlResponse)
+	if err != nil {
+		return nil, err
+	}
+	root, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if !root.Is(ProtocolNamespace, "Response") {
+		return nil, errors.New("saml: not a Response")
+	}
+	resp := &Response{
+		ID:           root.Attr("ID"),
+		InResponseTo: root.Attr("InResponseTo"),
+		Destination:  root.Attr("Destination"),
+	}
+	if issuer := root.Child(AssertionNamespace, "Issuer"); issuer != nil {
+		resp.Issuer = issuer.Text()
+	}
+	if status := root.Child(ProtocolNamespace, "Status"); status != nil {
+		if code := status.Child(ProtocolNamespace, "StatusCode"); code != nil {
+			resp.Status = code.Attr("Value")
+		}
+	}
+	if resp.Status != StatusSuccess {
+		return resp, errors.New("saml: the identity provider did not authenticate the user: " + resp.Status)
+	}
+	if len(root.ChildElements(AssertionNamespace, "EncryptedAssertion")) > 0 {
+		return nil, errors.New("saml: encrypted assertions are not supported")
+	}
+	assertions := root.ChildElements(AssertionNamespace, "Assertion")
+	if len(assertions) != 1 {
+		return nil, errors.New("saml: response must contain exactly one assertion")
+	}
+	assertion := assertions[0]
+
+	if len(root.ChildElements(DSigNamespace, "Signature")) > 0 {
+		if err := Verify(root, cert); err != nil {
+			return nil, err
+		}
+	} else if err := Verify(assertion, cert); err != nil {
+		return nil, err
+	}
+	if err := xml.Unmarshal(Canonicalize(assertion, nil, nil), &resp.Assertion); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,215 @@
+package saml_test
+
+import (
+	"GoAuthentication/internal/saml"
+	"GoAuthentication/internal/saml/samltest"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	idpEntityID = "https://idp.example.com/metadata"
+	spEntityID  = "https://sp.example.com/saml/corp/metadata"
+	acsURL      = "https://sp.example.com/saml/corp/acs"
+	requestID   = "_request"
+)
+
+var idp *samltest.IdP
+
+func testIdP(t *testing.T) *samltest.IdP {
+	if idp == nil {
+		idp = samltest.NewIdP(t, idpEntityID)
+	}
+	return idp
+}
+
+func assertion(subject string) samltest.Assertion {
+	return samltest.Assertion{
+		Subject:      subject,
+		InResponseTo: requestID,
+		Audience:     spEntityID,
+		Recipient:    acsURL,
+		Attributes:   map[string]string{"email": subject + "@example.com"},
+	}
+}
+
+// decode returns the document behind a SAMLResponse value.
+func decode(t *testing.T, samlResponse string) string {
+	data, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func encode(doc string) string {
+	return base64.StdEncoding.EncodeToString([]byte(doc))
+}
+
+// element serializes the first element called local of a Response built
+// for a, signed if sign is set.
+func element(t *testing.T, a samltest.Assertion, local string, sign bool) string {
+	root := testIdP(t).Response(t, a)
+	el := root.Child(saml.AssertionNamespace, local)
+	if sign {
+		testIdP(t).Sign(t, el)
+	}
+	return string(saml.Canonicalize(el, nil, nil))
+}
+
+// response wraps children in a successful Response from the identity
+// provider.
+func response(children ...string) string {
+	return `<samlp:Response xmlns:samlp="` + saml.ProtocolNamespace + `" xmlns:saml="` + saml.AssertionNamespace +
+		`" ID="_response" Version="2.0" Destination="` + acsURL + `">` +
+		`<saml:Issuer>` + idpEntityID + `</saml:Issuer>` +
+		`<samlp:Status><samlp:StatusCode Value="` + saml.StatusSuccess + `"></samlp:StatusCode></samlp:Status>` +
+		strings.Join(children, "") + `</samlp:Response>`
+}
+
+func TestParseResponse(t *testing.T) {
+	resp, err := saml.ParseResponse(testIdP(t).SignedResponse(t, assertion("alice")), testIdP(t).Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := resp.Assertion
+	if resp.Issuer != idpEntityID || resp.Destination != acsURL || resp.InResponseTo != requestID {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if a.Issuer != idpEntityID || a.Subject.NameID.Value != "alice" || a.Attribute("email") != "alice@example.com" {
+		t.Fatalf("unexpected assertion %+v", a)
+	}
+	if a.Conditions == nil || len(a.Conditions.Audiences) != 1 || a.Conditions.Audiences[0].Audience[0] != spEntityID {
+		t.Fatalf("unexpected conditions %+v", a.Conditions)
+	}
+	if len(a.Subject.Confirmations) != 1 || a.Subject.Confirmations[0].Data.Recipient != acsURL {
+		t.Fatalf("unexpected confirmations %+v", a.Subject.Confirmations)
+	}
+	if time.Until(a.Conditions.NotOnOrAfter) < 4*time.Minute {
+		t.Fatalf("NotOnOrAfter %v", a.Conditions.NotOnOrAfter)
+	}
+}
+
+func TestParseResponseSignedResponse(t *testing.T) {
+	root := testIdP(t).Response(t, assertion("alice"))
+	testIdP(t).Sign(t, root)
+	resp, err := saml.ParseResponse(samltest.Encode(root), testIdP(t).Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Assertion.Subject.NameID.Value != "alice" {
+		t.Fatalf("unexpected assertion %+v", resp.Assertion)
+	}
+
+	// Every part of a signed Response is covered, its attributes included.
+	doc := strings.Replace(decode(t, samltest.Encode(root)), `Destination="`+acsURL, `Destination="https://evil.example.com/acs`, 1)
+	if _, err := saml.ParseResponse(encode(doc), testIdP(t).Cert); err == nil {
+		t.Fatal("changed Destination was accepted")
+	}
+}
+
+func TestParseResponseUnsigned(t *testing.T) {
+	if _, err := saml.ParseResponse(samltest.Encode(testIdP(t).Response(t, assertion("alice"))), testIdP(t).Cert); err == nil {
+		t.Fatal("unsigned response was accepted")
+	}
+}
+
+func TestParseResponseOtherKey(t *testing.T) {
+	other := samltest.NewIdP(t, idpEntityID)
+	if _, err := saml.ParseResponse(other.SignedResponse(t, assertion("alice")), testIdP(t).Cert); err == nil {
+		t.Fatal("response signed with another key was accepted")
+	}
+}
+
+func TestParseResponseTampered(t *testing.T) {
+	doc := decode(t, testIdP(t).SignedResponse(t, assertion("alice")))
+	for _, tc := range []struct{ name, old, new string }{
+		{"subject", ">alice</saml:NameID>", ">mallory</saml:NameID>"},
+		{"attribute value", ">alice@example.com<", ">mallory@example.com<"},
+		{"audience", ">" + spEntityID + "<", ">https://other.example.com/metadata<"},
+		{"recipient", `Recipient="` + acsURL, `Recipient="https://evil.example.com/acs`},
+		{"in response to", `InResponseTo="` + requestID + `" NotOnOrAfter`, `InResponseTo="_other" NotOnOrAfter`},
+		{"not on or after", `NotOnOrAfter="` + time.Now().UTC().Format("2006"), `NotOnOrAfter="2999`},
+		{"added attribute", `ID="_assertion" IssueInstant`, `Extra="1" ID="_assertion" IssueInstant`},
+		{"removed statement", `<saml:AttributeStatement><saml:Attribute Name="email"><saml:AttributeValue>alice@example.com</saml:AttributeValue></saml:Attribute></saml:AttributeStatement>`, ""},
+		{"assertion id", `ID="_assertion"`, `ID="_other"`},
+		{"signature value", "<ds:SignatureValue>", "<ds:SignatureValue>AAAA"},
+		{"digest method", "xmlenc#sha256", "xmldsig#sha1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if !strings.Contains(doc, tc.old) {
+				t.Fatalf("%q not found in %s", tc.old, doc)
+			}
+			tampered := strings.Replace(doc, tc.old, tc.new, 1)
+			if _, err := saml.ParseResponse(encode(tampered), testIdP(t).Cert); err == nil {
+				t.Fatal("tampered response was accepted")
+			}
+		})
+	}
+}
+
+func TestParseResponseSignatureWrapping(t *testing.T) {
+	signed := element(t, assertion("alice"), "Assertion", true)
+	forged := assertion("mallory")
+	forged.ID = "_forged"
+	evil := element(t, forged, "Assertion", false)
+	// A forged assertion under the signed one's ID.
+	evilSameID := element(t, assertion("mallory"), "Assertion", false)
+	signature := signed[strings.Index(signed, "<ds:Signature") : strings.Index(signed, "</ds:Signature>")+len("</ds:Signature>")]
+	issuerEnd := strings.Index(evilSameID, "</saml:Issuer>") + len("</saml:Issuer>")
+	evilWithSignature := evilSameID[:issuerEnd] + signature + evilSameID[issuerEnd:]
+
+	for _, tc := range []struct{ name, doc string }{
+		{"second assertion", response(signed, evil)},
+		{"second assertion first", response(evil, signed)},
+		{"signed assertion hidden in extensions", response(`<samlp:Extensions>`+signed+`</samlp:Extensions>`, evil)},
+		{"signed assertion nested in the forged one", response(strings.Replace(evil, "</saml:Assertion>", signed+"</saml:Assertion>", 1))},
+		{"signature copied onto a forged assertion", response(evilWithSignature)},
+		{"signed assertion in an advice", response(strings.Replace(evil, "</saml:Assertion>", "<saml:Advice>"+signed+"</saml:Advice></saml:Assertion>", 1))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := saml.ParseResponse(encode(tc.doc), testIdP(t).Cert)
+			if err == nil {
+				t.Fatalf("wrapped response was accepted for %q", resp.Assertion.Subject.NameID.Value)
+			}
+		})
+	}
+
+	// The same signed assertion alone is fine.
+	if _, err := saml.ParseResponse(encode(response(signed)), testIdP(t).Cert); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseResponseComments(t *testing.T) {
+	doc := decode(t, testIdP(t).SignedResponse(t, assertion("alice.admin")))
+	// Comments are not signed, so they must not cut the subject short.
+	doc = strings.Replace(doc, ">alice.admin<", ">alice<!-- -->.admin<", 1)
+	resp, err := saml.ParseResponse(encode(doc), testIdP(t).Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Assertion.Subject.NameID.Value; got != "alice.admin" {
+		t.Fatalf("NameID read as %q", got)
+	}
+}
+
+func TestParseResponseRejects(t *testing.T) {
+	signed := element(t, assertion("alice"), "Assertion", true)
+	for _, tc := range []struct{ name, doc string }{
+		{"failed status", strings.Replace(response(signed), saml.StatusSuccess, "urn:oasis:names:tc:SAML:2.0:status:Requester", 1)},
+		{"no assertion", response()},
+		{"encrypted assertion", response(`<saml:EncryptedAssertion></saml:EncryptedAssertion>`)},
+		{"not a response", signed},
+		{"DTD", `<!DOCTYPE r [<!ENTITY x "alice">]>` + response(signed)},
+		{"undeclared prefix", strings.Replace(response(signed), `xmlns:samlp="`+saml.ProtocolNamespace+`" `, "", 1)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := saml.ParseResponse(encode(tc.doc), testIdP(t).Cert); err == nil {
+				t.Fatal("response was accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Package samltest plays a SAML identity provider for tests. Its Responses
+// are signed with saml.Sign and a key generated on the spot.
+package samltest
+
+import (
+	"GoAuthentication/internal/saml"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// IdP is an identity provider with a self-signed certificate.
+type IdP struct {
+	EntityID string
+	Key      *rsa.PrivateKey
+	Cert     *x509.Certificate
+}
+
+func NewIdP(t testing.TB, entityID string) *IdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: entityID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &IdP{EntityID: entityID, Key: key, Cert: cert}
+}
+
+// CertificatePEM is the certificate as a service provider is configured
+// with it.
+func (idp *IdP) CertificatePEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: idp.Cert.Raw}))
+}
+
+// Assertion describes a successful Response with a single assertion.
+type Assertion struct {
+	ID           string // _assertion when empty
+	Subject      string
+	NameIDFormat string // persistent when empty
+	InResponseTo string
+	Audience     string
+	Recipient    string    // the ACS URL, also the Response's Destination
+	NotOnOrAfter time.Time // five minutes from now when zero
+	Attributes   map[string]string
+}
+
+// Response builds the unsigned Response document.
+func (idp *IdP) Response(t testing.TB, a Assertion) *saml.Element {
+	now := time.Now().UTC()
+	if a.ID == "" {
+		a.ID = "_assertion"
+	}
+	if a.NameIDFormat == "" {
+		a.NameIDFormat = saml.NameIDFormatPersistent
+	}
+	if a.NotOnOrAfter.IsZero() {
+		a.NotOnOrAfter = now.Add(5 * time.Minute)
+	}
+	ts := func(t time.Time) string { return t.UTC().Format(time.RFC3339) }
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<samlp:Response xmlns:samlp="%s" xmlns:saml="%s" ID="_response" Version="2.0" IssueInstant="%s" Destination="%s" InResponseTo="%s">`,
+		saml.ProtocolNamespace, saml.AssertionNamespace, ts(now), escape(a.Recipient), escape(a.InResponseTo))
+	fmt.Fprintf(&b, `<saml:Issuer>%s</saml:Issuer>`, escape(idp.EntityID))
+	fmt.Fprintf(&b, `<samlp:Status><samlp:StatusCode Value="%s"/></samlp:Status>`, saml.StatusSuccess)
+	fmt.Fprintf(&b, `<saml:Assertion ID="%s" Version="2.0" IssueInstant="%s">`, escape(a.ID), ts(now))
+	fmt.Fprintf(&b, `<saml:Issuer>%s</saml:Issuer>`, escape(idp.EntityID))
+	fmt.Fprintf(&b, `<saml:Subject><saml:NameID Format="%s">%s</saml:NameID>`, escape(a.NameIDFormat), escape(a.Subject))
+	fmt.Fprintf(&b, `<saml:SubjectConfirmation Method="%s"><saml:SubjectConfirmationData NotOnOrAfter="%s" Recipient="%s" InResponseTo="%s"/></saml:SubjectConfirmation>`,
+		saml.ConfirmationBearer, ts(a.NotOnOrAfter), escape(a.Recipient), escape(a.InResponseTo))
+	b.WriteString(`</saml:Subject>`)
+	fmt.Fprintf(&b, `<saml:Conditions NotBefore="%s" NotOnOrAfter="%s"><saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction></saml:Conditions>`,
+		ts(now.Add(-time.Minute)), ts(a.NotOnOrAfter), escape(a.Audience))
+	fmt.Fprintf(&b, `<saml:AuthnStatement AuthnInstant="%s"/>`, ts(now))
+	if len(a.Attributes) > 0 {
+		names := make([]string, 0, len(a.Attributes))
+		for name := range a.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		b.WriteString(`<saml:AttributeStatement>`)
+		for _, name := range names {
+			fmt.Fprintf(&b, `<saml:Attribute Name="%s"><saml:AttributeValue>%s</saml:AttributeValue></saml:Attribute>`, escape(name), escape(a.Attributes[name]))
+		}
+		b.WriteString(`</saml:AttributeStatement>`)
+	}
+	b.WriteString(`</saml:Assertion></samlp:Response>`)
+
+	root, err := saml.Parse([]byte(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// Sign adds an enveloped signature to el, the Response or its assertion.
+func (idp *IdP) Sign(t testing.TB, el *saml.Element) {
+	if err := saml.Sign(el, idp.Key, idp.Cert); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// SignedResponse is the SAMLResponse form value of a Response whose
+// assertion is signed.
+func (idp *IdP) SignedResponse(t testing.TB, a Assertion) string {
+	root := idp.Response(t, a)
+	idp.Sign(t, root.Child(saml.AssertionNamespace, "Assertion"))
+	return Encode(root)
+}
+
+// Encode serializes a document as the SAMLResponse form value.
+func Encode(root *saml.Element) string {
+	return base64.StdEncoding.EncodeToString(saml.Canonicalize(root, nil, nil))
+}
+
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
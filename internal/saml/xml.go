@@ -0,0 +1,265 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Element is a parsed XML element that keeps namespace prefixes and
+// declarations exactly as written, which signature verification needs.
+type Element struct {
+	Prefix   string
+	Local    string
+	Attrs    []xml.Attr // Name.Space holds the prefix, "xmlns" for declarations
+	Children []interface{}
+	Parent   *Element
+}
+
+// charData is the text between elements, with entities already decoded.
+type charData string
+
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// Parse reads a document and returns its root element. Comments and
+// processing instructions are dropped; DTDs are rejected.
+func Parse(data []byte) (*Element, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root, cur *Element
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			el := &Element{Prefix: t.Name.Space, Local: t.Name.Local, Attrs: append([]xml.Attr(nil), t.Attr...), Parent: cur}
+			if cur != nil {
+				cur.Children = append(cur.Children, el)
+			} else if root != nil {
+				return nil, errors.New("saml: more than one root element")
+			} else {
+				root = el
+			}
+			cur = el
+		case xml.EndElement:
+			if cur == nil || cur.Prefix != t.Name.Space || cur.Local != t.Name.Local {
+				return nil, errors.New("saml: mismatched end element")
+			}
+			cur = cur.Parent
+		case xml.CharData:
+			if cur != nil {
+				cur.Children = append(cur.Children, charData(t))
+			}
+		case xml.Directive:
+			return nil, errors.New("saml: DTDs are not allowed")
+		}
+	}
+	if root == nil || cur != nil {
+		return nil, errors.New("saml: incomplete document")
+	}
+	for _, el := range root.descendants() {
+		if _, ok := el.lookupNamespace(el.Prefix); !ok && el.Prefix != "" {
+			return nil, errors.New("saml: undeclared namespace prefix " + el.Prefix)
+		}
+	}
+	return root, nil
+}
+
+// Namespace is the namespace URI of the element.
+func (el *Element) Namespace() string {
+	uri, _ := el.lookupNamespace(el.Prefix)
+	return uri
+}
+
+// Is reports whether the element has the given namespace and local name.
+func (el *Element) Is(namespace, local string) bool {
+	return el.Local == local && el.Namespace() == namespace
+}
+
+// Attr returns the value of an attribute without a prefix.
+func (el *Element) Attr(name string) string {
+	for _, a := range el.Attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Child returns the first child element with the given name.
+func (el *Element) Child(namespace, local string) *Element {
+	for _, c := range el.ChildElements(namespace, local) {
+		return c
+	}
+	return nil
+}
+
+// ChildElements returns the child elements with the given name.
+func (el *Element) ChildElements(namespace, local string) []*Element {
+	var out []*Element
+	for _, c := range el.Children {
+		if c, ok := c.(*Element); ok && c.Is(namespace, local) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Text returns the concatenated text content of the element.
+func (el *Element) Text() string {
+	var b strings.Builder
+	for _, c := range el.Children {
+		switch c := c.(type) {
+		case charData:
+			b.WriteString(string(c))
+		case *Element:
+			b.WriteString(c.Text())
+		}
+	}
+	return b.String()
+}
+
+func (el *Element) descendants() []*Element {
+	out := []*Element{el}
+	for _, c := range el.Children {
+		if c, ok := c.(*Element); ok {
+			out = append(out, c.descendants()...)
+		}
+	}
+	return out
+}
+
+// attrNamespace resolves the prefix of an attribute. Unprefixed attributes
+// are in no namespace, whatever the default namespace is.
+func (el *Element) attrNamespace(a xml.Attr) string {
+	if a.Name.Space == "" {
+		return ""
+	}
+	uri, _ := el.lookupNamespace(a.Name.Space)
+	return uri
+}
+
+func (el *Element) lookupNamespace(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return xmlNamespace, true
+	}
+	for e := el; e != nil; e = e.Parent {
+		for _, a := range e.Attrs {
+			if (prefix == "" && a.Name.Space == "" && a.Name.Local == "xmlns") || (a.Name.Space == "xmlns" && a.Name.Local == prefix) {
+				return a.Value, true
+			}
+		}
+	}
+	return "", prefix == ""
+}
+
+// Canonicalize serializes el with Exclusive XML Canonicalization 1.0 without
+// comments. Prefixes in inclusive are treated as visibly utilized ("#default"
+// names the default namespace). exclude, if set, is left out together with
+// its subtree, which is how the enveloped signature transform is applied.
+func Canonicalize(el *Element, inclusive []string, exclude *Element) []byte {
+	c := &canonicalizer{inclusive: inclusive, exclude: exclude}
+	c.element(el, map[string]string{})
+	return c.buf.Bytes()
+}
+
+type canonicalizer struct {
+	buf       bytes.Buffer
+	inclusive []string
+	exclude   *Element
+}
+
+func (c *canonicalizer) element(el *Element, rendered map[string]string) {
+	name := el.Local
+	if el.Prefix != "" {
+		name = el.Prefix + ":" + el.Local
+	}
+
+	utilized := map[string]bool{el.Prefix: true}
+	var attrs []xml.Attr
+	for _, a := range el.Attrs {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			continue
+		}
+		if a.Name.Space != "" && a.Name.Space != "xml" {
+			utilized[a.Name.Space] = true
+		}
+		attrs = append(attrs, a)
+	}
+	for _, p := range c.inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		if _, ok := el.lookupNamespace(p); ok {
+			utilized[p] = true
+		}
+	}
+
+	var prefixes []string
+	next := map[string]string{}
+	for p, uri := range rendered {
+		next[p] = uri
+	}
+	for p := range utilized {
+		uri, ok := el.lookupNamespace(p)
+		// An unrendered default namespace counts as empty, so xmlns="" is
+		// only written to undo a default declared by an output ancestor.
+		if !ok || p == "xml" || rendered[p] == uri {
+			continue
+		}
+		next[p] = uri
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	sort.SliceStable(attrs, func(i, j int) bool {
+		ni, nj := el.attrNamespace(attrs[i]), el.attrNamespace(attrs[j])
+		if ni != nj {
+			return ni < nj
+		}
+		return attrs[i].Name.Local < attrs[j].Name.Local
+	})
+
+	c.buf.WriteString("<" + name)
+	for _, p := range prefixes {
+		if p == "" {
+			c.buf.WriteString(` xmlns="`)
+		} else {
+			c.buf.WriteString(" xmlns:" + p + `="`)
+		}
+		c.buf.WriteString(escapeAttr(next[p]) + `"`)
+	}
+	for _, a := range attrs {
+		an := a.Name.Local
+		if a.Name.Space != "" {
+			an = a.Name.Space + ":" + an
+		}
+		c.buf.WriteString(" " + an + `="` + escapeAttr(a.Value) + `"`)
+	}
+	c.buf.WriteString(">")
+	for _, child := range el.Children {
+		switch child := child.(type) {
+		case charData:
+			c.buf.WriteString(escapeText(string(child)))
+		case *Element:
+			if child != c.exclude {
+				c.element(child, next)
+			}
+		}
+	}
+	c.buf.WriteString("</" + name + ">")
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+func escapeText(s string) string { return textEscaper.Replace(s) }
+func escapeAttr(s string) string { return attrEscaper.Replace(s) }
@@ -0,0 +1,311 @@
+package services
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/models"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// apiKeyPrefix starts every key so that leaked keys are easy to spot.
+	apiKeyPrefix = "gak_"
+	// Access tokens obtained with an API key are short-lived, like machine
+	// tokens, so revoking the key takes effect quickly.
+	apiKeyTokenTTL = 15 * time.Minute
+	// apiKeyMethod is the amr of tokens obtained with an API key.
+	apiKeyMethod = "apikey"
+)
+
+var ErrInvalidAPIKey = errors.New("Invalid API key")
+
+type APIKeyInterface interface {
+	CreateKey(access AccessRequest, req models.APIKeyRequest) (*models.APIKeyInfo, int, error)
+	ListKeys(access AccessRequest) ([]models.APIKeyInfo, int, error)
+	RevokeKey(access AccessRequest, id string) (int, error)
+	Exchange(key, ip, ua string, proof Proof) (*models.OAuthTokenResponse, int, error)
+}
+
+// APIKeyService manages API keys, static credentials for integrations that
+// cannot refresh tokens. Keys are never accepted by protected endpoints
+// directly; they are exchanged for short-lived access tokens first.
+type APIKeyService struct {
+	db     database.APIKeyStore
+	tokens *Service
+}
+
+func NewAPIKeyService(db database.APIKeyStore, tokens *Service) *APIKeyService {
+	return &APIKeyService{db: db, tokens: tokens}
+}
+
+// CreateKey creates a key for the user of the access token. The key may only
+// carry scopes the token has, all of them when none are requested. Tokens of
+// third-party clients, impersonators and API keys can not create keys.
+func (s *APIKeyService) CreateKey(access AccessRequest, req models.APIKeyRequest) (*models.APIKeyInfo, int, error) {
+	info, err := s.tokens.CheckAccess(access)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	if info.ClientID != "" || info.Act != nil || isSubset([]string{apiKeyMethod}, info.AMR) {
+		return nil, http.StatusForbidden, errors.New("API keys can only be created in a first-party session")
+	}
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		scopes = strings.Fields(info.Scope)
+	}
+	if len(scopes) == 0 {
+		return nil, http.StatusBadRequest, errors.New("At least one scope is required")
+	}
+	if !info.HasScope(scopes...) {
+		return nil, http.StatusForbidden, ErrInsufficientScope
+	}
+	if req.ExpiresIn < 0 {
+		return nil, http.StatusBadRequest, errors.New("expires_in must not be negative")
+	}
+
+	key := models.APIKey{GUID: info.GUID, Name: req.Name, Scopes: scopes}
+	if req.ExpiresIn > 0 {
+		key.ExpiresAt = time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+	}
+	created, err := s.create(key)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return created, http.StatusCreated, nil
+}
+
+// CreateClientKey creates a key for a client, limited to the client's
+// scopes when it is registered with any.
+func (s *APIKeyService) CreateClientKey(clientID, name string, scopes []string, ttl time.Duration) (*models.APIKeyInfo, error) {
+	client, err := s.db.GetClient(context.Background(), clientID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errors.New("Unknown client")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	} else if len(client.Scopes) > 0 && !isSubset(scopes, client.Scopes) {
+		return nil, errors.New("The client may not use this scope")
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("At least one scope is required")
+	}
+	key := models.APIKey{ClientID: client.ID, Name: name, Scopes: scopes}
+	if ttl > 0 {
+		key.ExpiresAt = time.Now().Add(ttl)
+	}
+	return s.create(key)
+}
+
+func (s *APIKeyService) create(key models.APIKey) (*models.APIKeyInfo, error) {
+	id := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	key.ID = hex.EncodeToString(id)
+	raw := base64.RawURLEncoding.EncodeToString(secret)
+	key.SecretHash = sha256Hex(raw)
+	key.CreatedAt = time.Now()
+
+	ctx := context.Background()
+	if err := s.db.InsertAPIKey(ctx, key); err != nil {
+		return nil, err
+	}
+	err := s.db.InsertAuditEvent(ctx, models.AuditEvent{
+		Event:    "api_key_created",
+		GUID:     key.GUID,
+		ClientID: key.ClientID,
+		Details:  map[string]interface{}{"key_id": key.ID, "scope": strings.Join(key.Scopes, " ")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := apiKeyInfo(key)
+	info.Key = apiKeyPrefix + key.ID + "_" + raw
+	return &info, nil
+}
+
+// ListKeys returns the keys of the user of the access token.
+func (s *APIKeyService) ListKeys(access AccessRequest) ([]models.APIKeyInfo, int, error) {
+	info, err := s.tokens.CheckAccess(access)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	keys, err := s.db.ListAPIKeys(context.Background(), info.GUID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	list := make([]models.APIKeyInfo, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, apiKeyInfo(k))
+	}
+	return list, http.StatusOK, nil
+}
+
+// RevokeKey revokes one of the keys of the user of the access token. Access
+// tokens already obtained with it stay valid until they expire.
+func (s *APIKeyService) RevokeKey(access AccessRequest, id string) (int, error) {
+	info, err := s.tokens.CheckAccess(access)
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+	ctx := context.Background()
+	key, err := s.db.GetAPIKey(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && (key.ClientID != "" || key.GUID != info.GUID)) {
+		return http.StatusNotFound, errors.New("API key not found")
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := s.revoke(ctx, key); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusNoContent, nil
+}
+
+// RevokeAnyKey revokes a key of any owner.
+func (s *APIKeyService) RevokeAnyKey(id string) error {
+	ctx := context.Background()
+	key, err := s.db.GetAPIKey(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errors.New("API key not found")
+	}
+	if err != nil {
+		return err
+	}
+	return s.revoke(ctx, key)
+}
+
+func (s *APIKeyService) revoke(ctx context.Context, key models.APIKey) error {
+	revoked, err := s.db.RevokeAPIKey(ctx, key.ID)
+	if err != nil || !revoked {
+		return err
+	}
+	return s.db.InsertAuditEvent(ctx, models.AuditEvent{
+		Event:    "api_key_revoked",
+		GUID:     key.GUID,
+		ClientID: key.ClientID,
+		Details:  map[string]interface{}{"key_id": key.ID},
+	})
+}
+
+// Exchange turns an API key into an access token without a refresh token.
+// User keys get a regular session token carrying the key's scopes, as far as
+// the user's roles still grant them; client keys get a machine token.
+func (s *APIKeyService) Exchange(raw, ip, ua string, proof Proof) (*models.OAuthTokenResponse, int, error) {
+	ctx := context.Background()
+	key, err := s.authenticate(ctx, raw)
+	if errors.Is(err, ErrInvalidAPIKey) {
+		return nil, http.StatusUnauthorized, err
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if err := s.db.TouchAPIKey(ctx, key.ID, time.Now()); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if key.ClientID != "" {
+		client, err := s.db.GetClient(ctx, key.ClientID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, http.StatusUnauthorized, ErrInvalidAPIKey
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		scopes := key.Scopes
+		if len(client.Scopes) > 0 {
+			scopes = intersect(scopes, client.Scopes)
+		}
+		scope := strings.Join(scopes, " ")
+		token, err := s.tokens.issueClientToken(client.ID, scope, proof.CertThumbprint)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return &models.OAuthTokenResponse{
+			AccessToken: token,
+			TokenType:   "Bearer",
+			ExpiresIn:   int(clientTokenTTL.Seconds()),
+			Scope:       scope,
+		}, http.StatusOK, nil
+	}
+
+	rec := models.TokenRecord{
+		GUID:      key.GUID,
+		IP:        ip,
+		UserAgent: ua,
+		AuthTime:  time.Now(),
+		ACR:       ACRNone,
+		AMR:       []string{apiKeyMethod},
+		Scope:     strings.Join(key.Scopes, " "),
+	}
+	if err := s.tokens.bind(&rec, proof); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	pair, err := s.tokens.issueAccess(rec, apiKeyTokenTTL)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return &models.OAuthTokenResponse{
+		AccessToken: pair.Access,
+		TokenType:   tokenType(rec),
+		ExpiresIn:   int(apiKeyTokenTTL.Seconds()),
+		Scope:       pair.Scope,
+	}, http.StatusOK, nil
+}
+
+// authenticate returns the stored key for raw if it is valid, unexpired and
+// not revoked. Every failure looks the same to the caller.
+func (s *APIKeyService) authenticate(ctx context.Context, raw string) (models.APIKey, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(raw, apiKeyPrefix), "_")
+	if !strings.HasPrefix(raw, apiKeyPrefix) || !ok || id == "" || secret == "" {
+		return models.APIKey{}, ErrInvalidAPIKey
+	}
+	key, err := s.db.GetAPIKey(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.APIKey{}, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return models.APIKey{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(sha256Hex(secret)), []byte(key.SecretHash)) != 1 {
+		return models.APIKey{}, ErrInvalidAPIKey
+	}
+	if !key.RevokedAt.IsZero() || (!key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt)) {
+		return models.APIKey{}, ErrInvalidAPIKey
+	}
+	return key, nil
+}
+
+func apiKeyInfo(k models.APIKey) models.APIKeyInfo {
+	info := models.APIKeyInfo{
+		ID:        k.ID,
+		Name:      k.Name,
+		Scope:     strings.Join(k.Scopes, " "),
+		CreatedAt: k.CreatedAt,
+	}
+	if !k.ExpiresAt.IsZero() {
+		info.ExpiresAt = &k.ExpiresAt
+	}
+	if !k.LastUsedAt.IsZero() {
+		info.LastUsedAt = &k.LastUsedAt
+	}
+	if !k.RevokedAt.IsZero() {
+		info.RevokedAt = &k.RevokedAt
+	}
+	return info
+}
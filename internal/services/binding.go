@@ -0,0 +1,120 @@
+package services
+
+import (
+	"GoAuthentication/internal/models"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrCertificateBinding = errors.New("Token is bound to a different client certificate")
+
+// TokenPolicy decides how long access tokens live and which
+// proof-of-possession the service demands.
+type TokenPolicy struct {
+	// AccessTokenTTL defaults to 24 hours.
+	AccessTokenTTL time.Duration
+	// RequireDPoP rejects plain bearer tokens and refuses to issue tokens
+	// without a DPoP proof. Otherwise DPoP is used when the client sends it.
+	RequireDPoP bool
+	// RequireDPoPNonce makes every proof carry a nonce issued by the server.
+	RequireDPoPNonce bool
+	// RefreshPepper keys the hashes of refresh tokens. It defaults to the
+	// signing secret; changing it invalidates all refresh tokens.
+	RefreshPepper string
+	// Revocations, when set, caches whether sessions are revoked for access
+	// token checks.
+	Revocations RevocationCache
+}
+
+// SessionTokenTTL is the longest time an access token backed by a session
+// stays valid under the policy, including the short-lived tokens of API keys
+// and token exchanges. Sessions must be kept at least that long.
+func (p TokenPolicy) SessionTokenTTL() time.Duration {
+	ttl := p.AccessTokenTTL
+	if ttl <= 0 {
+		ttl = defaultAccessTokenTTL
+	}
+	return max(ttl, apiKeyTokenTTL, exchangedTokenTTL)
+}
+
+// Proof is the proof-of-possession material sent with a request: a DPoP
+// proof JWT together with the method and URL it must be bound to, and the
+// thumbprint of the TLS client certificate of the connection.
+type Proof struct {
+	DPoP           string
+	Method         string
+	URL            string
+	CertThumbprint string
+}
+
+// bind ties rec to the keys the client proved possession of at issuance: the
+// DPoP key and the TLS client certificate (RFC 8705). A session that is
+// already bound only accepts the same keys again.
+func (s *Service) bind(rec *models.TokenRecord, proof Proof) error {
+	if rec.X5T != "" && rec.X5T != proof.CertThumbprint {
+		return ErrCertificateBinding
+	}
+	rec.X5T = proof.CertThumbprint
+
+	if proof.DPoP == "" {
+		if rec.JKT != "" {
+			return fmt.Errorf("%w: the session is bound to a DPoP key", ErrInvalidDPoPProof)
+		}
+		if s.policy.RequireDPoP {
+			return fmt.Errorf("%w: a DPoP proof is required", ErrInvalidDPoPProof)
+		}
+		return nil
+	}
+	jkt, err := s.verifyDPoP(proof, "")
+	if err != nil {
+		return err
+	}
+	if rec.JKT != "" && rec.JKT != jkt {
+		return fmt.Errorf("%w: the proof is signed with a different key", ErrInvalidDPoPProof)
+	}
+	rec.JKT = jkt
+	return nil
+}
+
+// checkBinding verifies that the presenter of an access token holds the keys
+// named in its cnf claim. scheme is the Authorization scheme it came with.
+func (s *Service) checkBinding(cnf map[string]interface{}, scheme, token string, proof Proof) error {
+	if x5t, _ := cnf["x5t#S256"].(string); x5t != "" && x5t != proof.CertThumbprint {
+		return ErrCertificateBinding
+	}
+	jkt, _ := cnf["jkt"].(string)
+	switch {
+	case jkt != "":
+		if scheme != "DPoP" || proof.DPoP == "" {
+			return fmt.Errorf("%w: the token is bound to a DPoP key", ErrInvalidDPoPProof)
+		}
+		proofJKT, err := s.verifyDPoP(proof, token)
+		if err != nil {
+			return err
+		}
+		if proofJKT != jkt {
+			return fmt.Errorf("%w: the proof is signed with a different key", ErrInvalidDPoPProof)
+		}
+	case scheme == "DPoP":
+		return errors.New("Token is not DPoP bound")
+	case s.policy.RequireDPoP:
+		return fmt.Errorf("%w: bearer tokens are not accepted", ErrInvalidDPoPProof)
+	}
+	return nil
+}
+
+// confirmation builds the cnf claim for a session bound by bind.
+func confirmation(rec models.TokenRecord) map[string]string {
+	cnf := map[string]string{}
+	if rec.JKT != "" {
+		cnf["jkt"] = rec.JKT
+	}
+	if rec.X5T != "" {
+		cnf["x5t#S256"] = rec.X5T
+	}
+	if len(cnf) == 0 {
+		return nil
+	}
+	return cnf
+}
@@ -0,0 +1,311 @@
+package services
+
+import (
+	"GoAuthentication/internal/jwk"
+	"GoAuthentication/internal/models"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	clientTokenTTL         = 15 * time.Minute
+	jwtBearerAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+// Client authentication methods at the token endpoint.
+const (
+	AuthMethodNone          = "none"
+	AuthMethodSecretBasic   = "client_secret_basic"
+	AuthMethodSecretPost    = "client_secret_post"
+	AuthMethodPrivateKeyJWT = "private_key_jwt"
+	AuthMethodTLS           = "tls_client_auth"
+	AuthMethodSelfSignedTLS = "self_signed_tls_client_auth"
+)
+
+var supportedGrantTypes = []string{"authorization_code", "refresh_token", "client_credentials", deviceCodeGrantType, tokenExchangeGrantType}
+
+type ClientAccessInfo struct {
+	ClientID string
+	Scope    string
+}
+
+// RegisterClient adds a client to the registry. Public clients (SPAs, mobile
+// apps) use the "none" method and must rely on PKCE alone; a secret is only
+// generated for the client_secret_* methods.
+func (s *OAuthService) RegisterClient(reg models.ClientRegistration) (string, string, error) {
+	if reg.AuthMethod == "" {
+		reg.AuthMethod = AuthMethodSecretBasic
+	}
+	if len(reg.GrantTypes) == 0 {
+		reg.GrantTypes = []string{"authorization_code", "refresh_token"}
+	}
+	if !isSubset(reg.GrantTypes, supportedGrantTypes) {
+		return "", "", errors.New("Unsupported grant type")
+	}
+	if isSubset([]string{"authorization_code"}, reg.GrantTypes) && len(reg.RedirectURIs) == 0 {
+		return "", "", errors.New("At least one redirect URI is required")
+	}
+	for _, uri := range reg.RedirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			return "", "", err
+		}
+	}
+	switch reg.AuthMethod {
+	case AuthMethodNone:
+		if isSubset([]string{"client_credentials"}, reg.GrantTypes) || isSubset([]string{tokenExchangeGrantType}, reg.GrantTypes) {
+			return "", "", errors.New("Public clients cannot use client_credentials or token exchange")
+		}
+	case AuthMethodSecretBasic, AuthMethodSecretPost:
+	case AuthMethodPrivateKeyJWT:
+		set, err := jwk.ParseSet([]byte(reg.JWKS))
+		if err != nil || len(set.Keys) == 0 {
+			return "", "", errors.New("private_key_jwt requires a JWK Set with at least one key")
+		}
+	case AuthMethodTLS:
+		if reg.TLSSubjectDN == "" {
+			return "", "", errors.New("tls_client_auth requires the certificate subject DN")
+		}
+	case AuthMethodSelfSignedTLS:
+		if reg.CertThumbprint == "" {
+			return "", "", errors.New("self_signed_tls_client_auth requires the certificate")
+		}
+	default:
+		return "", "", errors.New("Unsupported authentication method")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	client := models.Client{
+		ID:             hex.EncodeToString(id),
+		Name:           reg.Name,
+		RedirectURIs:   reg.RedirectURIs,
+		Scopes:         reg.Scopes,
+		GrantTypes:     reg.GrantTypes,
+		AuthMethod:     reg.AuthMethod,
+		JWKS:           reg.JWKS,
+		TLSSubjectDN:   reg.TLSSubjectDN,
+		CertThumbprint: reg.CertThumbprint,
+		DPoPBound:      reg.DPoPBound,
+		CertBound:      reg.CertBound,
+	}
+	if client.RedirectURIs == nil {
+		client.RedirectURIs = []string{}
+	}
+	if client.Scopes == nil {
+		client.Scopes = []string{}
+	}
+
+	var secret string
+	if reg.AuthMethod == AuthMethodSecretBasic || reg.AuthMethod == AuthMethodSecretPost {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return "", "", err
+		}
+		secret = base64.RawURLEncoding.EncodeToString(raw)
+		hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		if err != nil {
+			return "", "", err
+		}
+		client.SecretHash = string(hash)
+	}
+
+	if err := s.db.InsertClient(context.Background(), client); err != nil {
+		return "", "", err
+	}
+	return client.ID, secret, nil
+}
+
+// authenticateClient checks the credentials the client presented at the
+// token endpoint against its registered authentication method.
+func (s *OAuthService) authenticateClient(ctx context.Context, req models.TokenRequest) (models.Client, *OAuthError) {
+	failed := oauthError(http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+	clientID := req.ClientID
+	if req.ClientAssertionType != "" {
+		if req.ClientAssertionType != jwtBearerAssertionType {
+			return models.Client{}, failed
+		}
+		// client_id is optional with private_key_jwt, the assertion names it.
+		claims := jwt.MapClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(req.ClientAssertion, claims); err != nil {
+			return models.Client{}, failed
+		}
+		sub, _ := claims.GetSubject()
+		if clientID == "" {
+			clientID = sub
+		} else if sub != clientID {
+			return models.Client{}, failed
+		}
+	}
+
+	client, err := s.db.GetClient(ctx, clientID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return client, failed
+	}
+	if err != nil {
+		return client, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+
+	switch client.AuthMethod {
+	case AuthMethodNone:
+		return client, nil
+	case AuthMethodSecretBasic, AuthMethodSecretPost:
+		if req.ClientSecret != "" && bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(req.ClientSecret)) == nil {
+			return client, nil
+		}
+	case AuthMethodPrivateKeyJWT:
+		if req.ClientAssertionType != "" {
+			if err := s.verifyClientAssertion(ctx, client, req.ClientAssertion); err == nil {
+				return client, nil
+			}
+		}
+	case AuthMethodTLS:
+		if req.ClientCert != nil && req.ClientCertVerified && req.ClientCert.Subject.String() == client.TLSSubjectDN {
+			return client, nil
+		}
+	case AuthMethodSelfSignedTLS:
+		if req.ClientCert != nil && CertificateThumbprint(req.ClientCert) == client.CertThumbprint {
+			return client, nil
+		}
+	}
+	return client, failed
+}
+
+// verifyClientAssertion checks a private_key_jwt assertion (RFC 7523): signed
+// with one of the client's keys, issued by and about the client, addressed
+// to this server and never seen before.
+func (s *OAuthService) verifyClientAssertion(ctx context.Context, client models.Client, assertion string) error {
+	set, err := jwk.ParseSet([]byte(client.JWKS))
+	if err != nil {
+		return err
+	}
+	token, err := jwt.Parse(assertion, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		for _, key := range set.Keys {
+			if kid == "" || key.Kid == kid {
+				return key.PublicKey()
+			}
+		}
+		return nil, errors.New("Unknown signing key")
+	},
+		jwt.WithValidMethods([]string{"RS256", "PS256", "ES256"}),
+		jwt.WithIssuer(client.ID),
+		jwt.WithSubject(client.ID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || !token.Valid {
+		return errors.New("Invalid client assertion")
+	}
+	claims := token.Claims.(jwt.MapClaims)
+
+	aud, _ := claims.GetAudience()
+	if !isSubset([]string{s.issuer + "/token"}, aud) && !isSubset([]string{s.issuer}, aud) {
+		return errors.New("Client assertion has the wrong audience")
+	}
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims.GetExpirationTime()
+	if jti == "" {
+		return errors.New("Client assertion has no jti")
+	}
+	fresh, err := s.db.UseJTI(ctx, "client_assertion:"+client.ID+":"+jti, exp.Time)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return errors.New("Client assertion replayed")
+	}
+	return nil
+}
+
+// clientCredentials issues a short-lived machine token without a refresh
+// token. Its scope is limited to what the client is registered for.
+func (s *OAuthService) clientCredentials(client models.Client, req models.TokenRequest) (*models.OAuthTokenResponse, error) {
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	} else if !isSubset(scopes, client.Scopes) {
+		return nil, oauthError(http.StatusBadRequest, "invalid_scope", "The client may not request this scope")
+	}
+	scope := strings.Join(scopes, " ")
+
+	token, err := s.tokens.issueClientToken(client.ID, scope, s.tokenProof(req).CertThumbprint)
+	if err != nil {
+		return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	return &models.OAuthTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(clientTokenTTL.Seconds()),
+		Scope:       scope,
+	}, nil
+}
+
+// issueClientToken signs a token of type "client". It represents the client
+// itself rather than a user, has no session row and is therefore rejected by
+// ValidateAccess. A non-empty x5t binds it to the client's TLS certificate.
+func (s *Service) issueClientToken(clientID, scope, x5t string) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"type":      "client",
+		"sub":       clientID,
+		"client_id": clientID,
+		"scope":     scope,
+		"iat":       now.Unix(),
+		"exp":       now.Add(clientTokenTTL).Unix(),
+		"jti":       hex.EncodeToString(jti),
+	}
+	if x5t != "" {
+		claims["cnf"] = map[string]string{"x5t#S256": x5t}
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+	return token.SignedString([]byte(s.secret))
+}
+
+// CheckClientAccess validates a machine token issued by the
+// client_credentials grant, including its certificate binding.
+func (s *Service) CheckClientAccess(access AccessRequest) (*ClientAccessInfo, error) {
+	parts := strings.SplitN(access.Authorization, " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return nil, errors.New("Invalid Authorization header")
+	}
+	claims, err := s.parseToken(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if claims["type"] != "client" {
+		return nil, errors.New("Not a client token")
+	}
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	if x5t, _ := cnf["x5t#S256"].(string); x5t != "" && x5t != access.Proof.CertThumbprint {
+		return nil, ErrCertificateBinding
+	}
+	clientID, _ := claims["client_id"].(string)
+	scope, _ := claims["scope"].(string)
+	if !isSubset(strings.Fields(access.Scope), strings.Fields(scope)) {
+		return nil, ErrInsufficientScope
+	}
+	return &ClientAccessInfo{ClientID: clientID, Scope: scope}, nil
+}
+
+// CertificateThumbprint is the base64url SHA-256 hash of the DER encoded
+// certificate, as used by x5t#S256.
+func CertificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeTTL       = 10 * time.Minute
+	devicePollInterval  = 5
+	// deviceCodeMaxFailures wrong user codes within deviceCodeTTL lock the
+	// user out of the verification page, so that codes cannot be guessed.
+	deviceCodeMaxFailures = 5
+	// userCodeAlphabet has no vowels or lookalike characters, see RFC 8628
+	// section 6.1.
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+// DeviceAuthorization starts the device flow (RFC 8628) for a client that
+// cannot open a browser itself.
+func (s *OAuthService) DeviceAuthorization(req models.TokenRequest) (*models.DeviceAuthorizationResponse, error) {
+	ctx := context.Background()
+	client, oerr := s.authenticateClient(ctx, req)
+	if oerr != nil {
+		return nil, oerr
+	}
+	if !isSubset([]string{deviceCodeGrantType}, client.GrantTypes) {
+		return nil, oauthError(http.StatusBadRequest, "unauthorized_client", "The client may not use the device flow")
+	}
+	scopes := strings.Fields(req.Scope)
+	if len(client.Scopes) > 0 && !isSubset(scopes, client.Scopes) {
+		return nil, oauthError(http.StatusBadRequest, "invalid_scope", "The client may not request this scope")
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	deviceCode := base64.RawURLEncoding.EncodeToString(raw)
+	userCode, err := randomUserCode()
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.InsertDeviceCode(ctx, models.DeviceCode{
+		DeviceCodeHash: sha256Hex(deviceCode),
+		UserCode:       userCode,
+		ClientID:       client.ID,
+		Scope:          strings.Join(scopes, " "),
+		Interval:       devicePollInterval,
+		ExpiresAt:      time.Now().Add(deviceCodeTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	display := formatUserCode(userCode)
+	return &models.DeviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                display,
+		VerificationURI:         s.issuer + "/device",
+		VerificationURIComplete: s.issuer + "/device?user_code=" + url.QueryEscape(display),
+		ExpiresIn:               int(deviceCodeTTL.Seconds()),
+		Interval:                devicePollInterval,
+	}, nil
+}
+
+// DeviceInfo describes a pending user code to the signed-in user so that the
+// verification page can ask them to confirm it.
+func (s *OAuthService) DeviceInfo(access AccessRequest, userCode string) (*models.DeviceInfo, error) {
+	info, err := s.tokens.CheckAccess(access)
+	if err != nil {
+		return nil, accessError(err, "login_required")
+	}
+	code, client, err := s.pendingDeviceCode(context.Background(), info.GUID, userCode)
+	if err != nil {
+		return nil, err
+	}
+	return &models.DeviceInfo{
+		UserCode:   formatUserCode(code.UserCode),
+		ClientID:   client.ID,
+		ClientName: client.Name,
+		Scopes:     strings.Fields(code.Scope),
+	}, nil
+}
+
+// VerifyDevice lets the signed-in user approve or deny a user code. Approval
+// also counts as consent for the requested scopes.
+func (s *OAuthService) VerifyDevice(access AccessRequest, userCode, action string) error {
+	info, err := s.tokens.CheckAccess(access)
+	if err != nil {
+		return accessError(err, "login_required")
+	}
+	ctx := context.Background()
+	code, client, err := s.pendingDeviceCode(ctx, info.GUID, userCode)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	switch action {
+	case "approve":
+		if err := s.db.SaveConsent(ctx, info.GUID, client.ID, strings.Fields(code.Scope)); err != nil {
+			return err
+		}
+		ok, err = s.db.ApproveDeviceCode(ctx, code.UserCode, info.GUID, info.AuthTime, info.ACR, info.AMR)
+	case "deny":
+		ok, err = s.db.DenyDeviceCode(ctx, code.UserCode)
+	default:
+		return oauthError(http.StatusBadRequest, "invalid_request", "action must be approve or deny")
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return oauthError(http.StatusBadRequest, "invalid_grant", "Unknown or expired user code")
+	}
+	return nil
+}
+
+// pendingDeviceCode looks up a user code entered by the user guid. Wrong
+// codes are counted against the user, and once deviceCodeMaxFailures of them
+// were entered within deviceCodeTTL no code is looked up at all.
+func (s *OAuthService) pendingDeviceCode(ctx context.Context, guid int, userCode string) (models.DeviceCode, models.Client, error) {
+	failures, err := s.db.CountDeviceCodeFailuresSince(ctx, guid, time.Now().Add(-deviceCodeTTL))
+	if err != nil {
+		return models.DeviceCode{}, models.Client{}, err
+	}
+	if failures >= deviceCodeMaxFailures {
+		return models.DeviceCode{}, models.Client{}, oauthError(http.StatusTooManyRequests, "slow_down", "Too many wrong user codes, try again later")
+	}
+
+	code, err := s.db.GetDeviceCodeByUserCode(ctx, normalizeUserCode(userCode))
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return code, models.Client{}, err
+	}
+	if err != nil || code.Status != "pending" || time.Now().After(code.ExpiresAt) {
+		if err := s.db.RecordDeviceCodeFailure(ctx, guid); err != nil {
+			return code, models.Client{}, err
+		}
+		return code, models.Client{}, oauthError(http.StatusBadRequest, "invalid_grant", "Unknown or expired user code")
+	}
+	client, err := s.db.GetClient(ctx, code.ClientID)
+	return code, client, err
+}
+
+// deviceCode is the token endpoint side of the device flow. Clients polling
+// faster than the advertised interval get slow_down and a longer interval.
+func (s *OAuthService) deviceCode(ctx context.Context, client models.Client, req models.TokenRequest, ip, ua string) (*models.OAuthTokenResponse, error) {
+	hash := sha256Hex(req.DeviceCode)
+	code, err := s.db.GetDeviceCode(ctx, hash)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && code.ClientID != client.ID) {
+		return nil, oauthError(http.StatusBadRequest, "invalid_grant", "Unknown device code")
+	}
+	if err != nil {
+		return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	now := time.Now()
+	if now.After(code.ExpiresAt) {
+		return nil, oauthError(http.StatusBadRequest, "expired_token", "The device code has expired")
+	}
+
+	interval := code.Interval
+	tooFast := !code.LastPolledAt.IsZero() && now.Before(code.LastPolledAt.Add(time.Duration(code.Interval)*time.Second))
+	if tooFast {
+		interval += 5
+	}
+	if err := s.db.RecordDevicePoll(ctx, hash, now, interval); err != nil {
+		return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	if tooFast {
+		return nil, oauthError(http.StatusBadRequest, "slow_down", "Polling too frequently")
+	}
+
+	switch code.Status {
+	case "pending":
+		return nil, oauthError(http.StatusBadRequest, "authorization_pending", "The user has not approved the device yet")
+	case "denied":
+		return nil, oauthError(http.StatusBadRequest, "access_denied", "The user denied the request")
+	case "approved":
+	default:
+		return nil, oauthError(http.StatusBadRequest, "invalid_grant", "The device code was already used")
+	}
+	rec := models.TokenRecord{
+		GUID:      code.GUID,
+		IP:        ip,
+		UserAgent: ua,
+		AuthTime:  code.AuthTime,
+		ACR:       code.ACR,
+		AMR:       code.AMR,
+		ClientID:  client.ID,
+		Scope:     code.Scope,
+	}
+	if err := s.tokens.bind(&rec, s.tokenProof(req)); err != nil {
+		return nil, bindError(err)
+	}
+	ok, err := s.db.ConsumeDeviceCode(ctx, hash)
+	if err != nil {
+		return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	if !ok {
+		return nil, oauthError(http.StatusBadRequest, "invalid_grant", "The device code was already used")
+	}
+
+	pair, err := s.tokens.issue(rec)
+	if err != nil {
+		return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	return s.tokenResponse(pair, rec, "")
+}
+
+func randomUserCode() (string, error) {
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	b := make([]byte, 8)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// normalizeUserCode makes user input like "wdjb mjht" match the stored
+// "WDJBMJHT".
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
+
+func formatUserCode(code string) string {
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"GoAuthentication/internal/jwk"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	dpopProofWindow = time.Minute
+	dpopNonceTTL    = 5 * time.Minute
+)
+
+var ErrInvalidDPoPProof = errors.New("Invalid DPoP proof")
+
+// DPoPNonceError asks the client to repeat the request with a proof that
+// carries Nonce (RFC 9449 section 8).
+type DPoPNonceError struct {
+	Nonce string
+}
+
+func (e *DPoPNonceError) Error() string {
+	return "DPoP nonce required"
+}
+
+// verifyDPoP checks a DPoP proof JWT and returns the thumbprint of its key.
+// accessToken is set when the proof accompanies an access token and must
+// then be bound to it through the ath claim.
+func (s *Service) verifyDPoP(proof Proof, accessToken string) (string, error) {
+	var key jwk.Key
+	token, err := jwt.Parse(proof.DPoP, func(t *jwt.Token) (interface{}, error) {
+		if t.Header["typ"] != "dpop+jwt" {
+			return nil, errors.New("Wrong typ")
+		}
+		raw, ok := t.Header["jwk"].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Missing jwk")
+		}
+		if _, private := raw["d"]; private {
+			return nil, errors.New("jwk contains a private key")
+		}
+		b, _ := json.Marshal(raw)
+		if err := json.Unmarshal(b, &key); err != nil {
+			return nil, err
+		}
+		return key.PublicKey()
+	}, jwt.WithValidMethods([]string{"RS256", "PS256", "ES256"}))
+	if err != nil || !token.Valid {
+		return "", ErrInvalidDPoPProof
+	}
+	claims := token.Claims.(jwt.MapClaims)
+
+	htm, _ := claims["htm"].(string)
+	htu, _ := claims["htu"].(string)
+	if htm != proof.Method || !sameURL(htu, proof.URL) {
+		return "", fmt.Errorf("%w: htm or htu does not match the request", ErrInvalidDPoPProof)
+	}
+	iat, err := claims.GetIssuedAt()
+	if err != nil || iat == nil || time.Since(iat.Time) > dpopProofWindow || time.Until(iat.Time) > dpopProofWindow {
+		return "", fmt.Errorf("%w: iat is outside the accepted window", ErrInvalidDPoPProof)
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if claims["ath"] != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return "", fmt.Errorf("%w: ath does not match the access token", ErrInvalidDPoPProof)
+		}
+	}
+	if s.policy.RequireDPoPNonce {
+		nonce, _ := claims["nonce"].(string)
+		if !s.validDPoPNonce(nonce) {
+			return "", &DPoPNonceError{Nonce: s.DPoPNonce()}
+		}
+	}
+
+	jkt, err := key.Thumbprint()
+	if err != nil {
+		return "", ErrInvalidDPoPProof
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return "", fmt.Errorf("%w: missing jti", ErrInvalidDPoPProof)
+	}
+	fresh, err := s.db.UseJTI(context.Background(), "dpop:"+jkt+":"+jti, iat.Add(2*dpopProofWindow))
+	if err != nil {
+		return "", err
+	}
+	if !fresh {
+		return "", fmt.Errorf("%w: jti was already used", ErrInvalidDPoPProof)
+	}
+	return jkt, nil
+}
+
+// DPoPNonce returns a nonce for DPoP proofs. Nonces are stateless: the issue
+// time followed by a truncated HMAC over it, so any instance sharing the
+// secret accepts them for dpopNonceTTL.
+func (s *Service) DPoPNonce() string {
+	return s.dpopNonceAt(time.Now().Unix())
+}
+
+func (s *Service) dpopNonceAt(unix int64) string {
+	b := make([]byte, 8, 24)
+	binary.BigEndian.PutUint64(b, uint64(unix))
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	mac.Write([]byte("dpop-nonce:"))
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(append(b, mac.Sum(nil)[:16]...))
+}
+
+func (s *Service) validDPoPNonce(nonce string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 24 {
+		return false
+	}
+	unix := int64(binary.BigEndian.Uint64(b[:8]))
+	if !hmac.Equal([]byte(nonce), []byte(s.dpopNonceAt(unix))) {
+		return false
+	}
+	age := time.Since(time.Unix(unix, 0))
+	return age >= -dpopProofWindow && age <= dpopNonceTTL
+}
+
+// sameURL compares htu with the request URL ignoring query and fragment, as
+// RFC 9449 section 4.3 requires.
+func sameURL(a, b string) bool {
+	ua, err1 := url.Parse(a)
+	ub, err2 := url.Parse(b)
+	if err1 != nil || err2 != nil || a == "" {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host) && ua.EscapedPath() == ub.EscapedPath()
+}
@@ -0,0 +1,306 @@
+package services
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/mail"
+	"GoAuthentication/internal/models"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"math/big"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	loginCodeTTL         = 10 * time.Minute
+	loginCodeMaxAttempts = 5
+	loginCodeRateLimit   = 5
+	loginCodeRateWindow  = 15 * time.Minute
+)
+
+type EmailLoginInterface interface {
+	SendLoginEmail(email string) (status int, err error)
+	VerifyLoginCode(email, code, ip, ua string, proof Proof) (access, refresh string, status int, err error)
+	VerifyLoginLink(token, ip, ua string, proof Proof) (access, refresh string, status int, err error)
+	SendStepUpCode(access AccessRequest) (status int, err error)
+	StepUp(access AccessRequest, code, ip, ua string) (accessJWT, refresh string, status int, err error)
+}
+
+type EmailLoginService struct {
+	db        database.EmailLoginStore
+	tokens    *Service
+	mailer    mail.Mailer
+	secret    string
+	publicURL string
+}
+
+func NewEmailLoginService(db database.EmailLoginStore, tokens *Service, mailer mail.Mailer, secret string, publicURL string) *EmailLoginService {
+	return &EmailLoginService{db: db, tokens: tokens, mailer: mailer, secret: secret, publicURL: publicURL}
+}
+
+// SendLoginEmail mails a one-time code and magic link to a known address.
+// Unknown addresses get the same response so that the endpoint cannot be used
+// to enumerate users.
+func (s *EmailLoginService) SendLoginEmail(email string) (int, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	ctx := context.Background()
+
+	if status, err := s.checkRate(ctx, email); err != nil {
+		return status, err
+	}
+
+	guid, err := s.db.GetUserByEmail(ctx, email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return http.StatusAccepted, nil
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	code, link, err := s.createCode(ctx, email, guid)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	msg := mail.Message{
+		To:      email,
+		Subject: "Your login code",
+		Body: fmt.Sprintf("Your login code is %s\n\nOr sign in with this link:\n%s/login/email/verify?token=%s\n\nThe code and the link expire in %d minutes and can be used once.\n",
+			code, strings.TrimRight(s.publicURL, "/"), url.QueryEscape(link), int(loginCodeTTL.Minutes())),
+	}
+	if err := s.mailer.Send(ctx, msg); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusAccepted, nil
+}
+
+func (s *EmailLoginService) VerifyLoginCode(email, code, ip, ua string, proof Proof) (string, string, int, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return "", "", http.StatusBadRequest, err
+	}
+	ctx := context.Background()
+
+	lc, status, err := s.checkCode(ctx, email, code)
+	if err != nil {
+		return "", "", status, err
+	}
+	return s.redeem(ctx, lc, "otp", ip, ua, proof)
+}
+
+func (s *EmailLoginService) VerifyLoginLink(token, ip, ua string, proof Proof) (string, string, int, error) {
+	ctx := context.Background()
+	lc, err := s.db.GetLoginCodeByLink(ctx, s.hash("link", token))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", http.StatusUnauthorized, errors.New("Invalid or expired link")
+	}
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	if lc.Used || time.Now().After(lc.ExpiresAt) {
+		return "", "", http.StatusUnauthorized, errors.New("Invalid or expired link")
+	}
+	return s.redeem(ctx, lc, "email", ip, ua, proof)
+}
+
+// SendStepUpCode mails a one-time code to the address of the user behind the
+// access token. Unlike a login email it carries no magic link, because the
+// code has to be redeemed within the existing session.
+func (s *EmailLoginService) SendStepUpCode(access AccessRequest) (int, error) {
+	info, err := s.tokens.CheckAccess(access)
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+	ctx := context.Background()
+
+	email, err := s.db.GetUserEmail(ctx, info.GUID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return http.StatusBadRequest, errors.New("No email address on file")
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if status, err := s.checkRate(ctx, email); err != nil {
+		return status, err
+	}
+
+	code, _, err := s.createCode(ctx, email, info.GUID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	msg := mail.Message{
+		To:      email,
+		Subject: "Confirm it's you",
+		Body: fmt.Sprintf("Your confirmation code is %s\n\nIt expires in %d minutes and can be used once.\n",
+			code, int(loginCodeTTL.Minutes())),
+	}
+	if err := s.mailer.Send(ctx, msg); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusAccepted, nil
+}
+
+// StepUp verifies an emailed code for the user behind the access token and
+// upgrades the current session instead of starting a new login.
+func (s *EmailLoginService) StepUp(access AccessRequest, code, ip, ua string) (string, string, int, error) {
+	info, err := s.tokens.CheckAccess(access)
+	if err != nil {
+		return "", "", http.StatusUnauthorized, err
+	}
+	ctx := context.Background()
+
+	email, err := s.db.GetUserEmail(ctx, info.GUID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", http.StatusBadRequest, errors.New("No email address on file")
+	}
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	lc, status, err := s.checkCode(ctx, email, code)
+	if err != nil {
+		return "", "", status, err
+	}
+	if lc.GUID != info.GUID {
+		return "", "", http.StatusUnauthorized, errors.New("Invalid or expired code")
+	}
+	if status, err := s.consume(ctx, lc); err != nil {
+		return "", "", status, err
+	}
+	return s.tokens.stepUp(info, "otp", ip, ua)
+}
+
+func (s *EmailLoginService) checkRate(ctx context.Context, email string) (int, error) {
+	sent, err := s.db.CountLoginCodesSince(ctx, email, time.Now().Add(-loginCodeRateWindow))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if sent >= loginCodeRateLimit {
+		return http.StatusTooManyRequests, errors.New("Too many login emails requested, try again later")
+	}
+	return http.StatusOK, nil
+}
+
+func (s *EmailLoginService) createCode(ctx context.Context, email string, guid int) (code, link string, err error) {
+	code, err = randomDigits(6)
+	if err != nil {
+		return "", "", err
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	link = base64.RawURLEncoding.EncodeToString(raw)
+
+	err = s.db.InsertLoginCode(ctx, models.LoginCode{
+		Email:     email,
+		GUID:      guid,
+		CodeHash:  s.hash("code", email+":"+code),
+		LinkHash:  s.hash("link", link),
+		ExpiresAt: time.Now().Add(loginCodeTTL),
+	})
+	return code, link, err
+}
+
+// checkCode matches code against the latest code sent to email. Every
+// attempt is counted before the comparison, so that the six digits cannot be
+// brute-forced, not even by parallel guesses.
+func (s *EmailLoginService) checkCode(ctx context.Context, email, code string) (models.LoginCode, int, error) {
+	lc, err := s.db.GetLatestLoginCode(ctx, email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return lc, http.StatusUnauthorized, errors.New("Invalid or expired code")
+	}
+	if err != nil {
+		return lc, http.StatusInternalServerError, err
+	}
+	if lc.Used || time.Now().After(lc.ExpiresAt) {
+		return lc, http.StatusUnauthorized, errors.New("Invalid or expired code")
+	}
+	ok, err := s.db.UseLoginCodeAttempt(ctx, lc.ID, loginCodeMaxAttempts)
+	if err != nil {
+		return lc, http.StatusInternalServerError, err
+	}
+	if !ok {
+		return lc, http.StatusTooManyRequests, errors.New("Too many attempts, request a new code")
+	}
+	if !hmac.Equal([]byte(lc.CodeHash), []byte(s.hash("code", email+":"+code))) {
+		return lc, http.StatusUnauthorized, errors.New("Invalid or expired code")
+	}
+	return lc, http.StatusOK, nil
+}
+
+func (s *EmailLoginService) consume(ctx context.Context, lc models.LoginCode) (int, error) {
+	ok, err := s.db.ConsumeLoginCode(ctx, lc.ID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !ok {
+		return http.StatusUnauthorized, errors.New("Code already used")
+	}
+	return http.StatusOK, nil
+}
+
+func (s *EmailLoginService) redeem(ctx context.Context, lc models.LoginCode, method, ip, ua string, proof Proof) (string, string, int, error) {
+	rec := models.TokenRecord{
+		GUID:      lc.GUID,
+		IP:        ip,
+		UserAgent: ua,
+		AuthTime:  time.Now(),
+		ACR:       ACRSingle,
+		AMR:       []string{method},
+	}
+	// The proof is checked first so that a bad one does not burn the code.
+	if err := s.tokens.bind(&rec, proof); err != nil {
+		return "", "", http.StatusBadRequest, err
+	}
+	if status, err := s.consume(ctx, lc); err != nil {
+		return "", "", status, err
+	}
+	if err := s.db.MarkEmailVerified(ctx, lc.GUID); err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	pair, err := s.tokens.issue(rec)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	return pair.Access, pair.Refresh, http.StatusOK, nil
+}
+
+// hash keys codes and links with the server secret: six digits are far too
+// few to be stored with a plain digest.
+func (s *EmailLoginService) hash(kind, value string) string {
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	mac.Write([]byte("login-" + kind + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func normalizeEmail(email string) (string, error) {
+	addr, err := netmail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || addr.Address != strings.TrimSpace(email) {
+		return "", errors.New("Invalid email address")
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+func randomDigits(n int) (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < n; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	v, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", n, v), nil
+}
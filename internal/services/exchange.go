@@ -0,0 +1,207 @@
+package services
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+	// guidTokenType names the impersonated user directly by guid. It is only
+	// accepted together with an actor token of a user allowed to impersonate.
+	guidTokenType     = "urn:goauthentication:params:oauth:token-type:guid"
+	exchangedTokenTTL = 15 * time.Minute
+)
+
+// SetExchangePolicy replaces what a client may obtain through token exchange.
+func (s *OAuthService) SetExchangePolicy(p models.ExchangePolicy) error {
+	if p.Audiences == nil {
+		p.Audiences = []string{}
+	}
+	if p.Scopes == nil {
+		p.Scopes = []string{}
+	}
+	return s.db.SaveExchangePolicy(context.Background(), p)
+}
+
+// GrantImpersonation lets the user actorGUID impersonate subjectGUID, or any
+// user when subjectGUID is 0.
+func (s *OAuthService) GrantImpersonation(actorGUID, subjectGUID int) error {
+	return s.db.GrantImpersonation(context.Background(), actorGUID, subjectGUID)
+}
+
+// tokenExchange implements RFC 8693. A service exchanges a user's access
+// token for a narrower one addressed to another audience, or support staff
+// present their own token as actor_token to act as a user. Either way the
+// new token names the acting party in the act claim, nesting the act claim
+// of the subject token so the whole delegation chain stays visible.
+func (s *OAuthService) tokenExchange(ctx context.Context, client models.Client, req models.TokenRequest, ip, ua string) (*models.OAuthTokenResponse, error) {
+	policy, err := s.db.GetExchangePolicy(ctx, client.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, oauthError(http.StatusBadRequest, "unauthorized_client", "The client has no token exchange policy")
+	}
+	if err != nil {
+		return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	if req.RequestedTokenType != "" && req.RequestedTokenType != accessTokenType {
+		return nil, oauthError(http.StatusBadRequest, "invalid_request", "Only access tokens can be requested")
+	}
+	if len(req.Audience) == 0 {
+		return nil, oauthError(http.StatusBadRequest, "invalid_request", "audience is required")
+	}
+	if !isSubset(req.Audience, policy.Audiences) {
+		return nil, oauthError(http.StatusBadRequest, "invalid_target", "The client may not obtain tokens for this audience")
+	}
+
+	var actor *AccessInfo
+	if req.ActorToken != "" {
+		if req.ActorTokenType != accessTokenType {
+			return nil, oauthError(http.StatusBadRequest, "invalid_request", "Unsupported actor_token_type")
+		}
+		actor, err = s.tokens.CheckAccess(AccessRequest{Authorization: "Bearer " + req.ActorToken, Audience: client.ID})
+		if err != nil {
+			return nil, oauthError(http.StatusBadRequest, "invalid_grant", "Invalid actor token: "+err.Error())
+		}
+	}
+
+	var subject *AccessInfo
+	impersonation := false
+	switch req.SubjectTokenType {
+	case accessTokenType:
+		subject, err = s.tokens.CheckAccess(AccessRequest{Authorization: "Bearer " + req.SubjectToken, Audience: client.ID})
+		if err != nil {
+			return nil, oauthError(http.StatusBadRequest, "invalid_grant", "Invalid subject token: "+err.Error())
+		}
+	case guidTokenType:
+		subject, err = s.impersonate(ctx, policy, actor, req.SubjectToken)
+		if err != nil {
+			return nil, err
+		}
+		impersonation = true
+	default:
+		return nil, oauthError(http.StatusBadRequest, "invalid_request", "Unsupported subject_token_type")
+	}
+
+	// Downscoping: the new token never carries more than both the policy and
+	// the subject token allow. First-party subject tokens have no scope limit.
+	allowed := policy.Scopes
+	if subject.ClientID != "" {
+		allowed = intersect(allowed, strings.Fields(subject.Scope))
+	}
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		scopes = allowed
+	} else if !isSubset(scopes, allowed) {
+		return nil, oauthError(http.StatusBadRequest, "invalid_scope", "The requested scope exceeds what the subject token and policy allow")
+	}
+
+	act := map[string]interface{}{"client_id": client.ID}
+	if actor != nil {
+		act = map[string]interface{}{"sub": strconv.Itoa(actor.GUID), "client_id": client.ID}
+	}
+	if subject.Act != nil {
+		act["act"] = subject.Act
+	}
+
+	rec := models.TokenRecord{
+		GUID:      subject.GUID,
+		IP:        ip,
+		UserAgent: ua,
+		AuthTime:  subject.AuthTime,
+		ACR:       subject.ACR,
+		AMR:       subject.AMR,
+		ClientID:  client.ID,
+		Scope:     strings.Join(scopes, " "),
+		Audience:  req.Audience,
+		Act:       act,
+	}
+	if err := s.tokens.bind(&rec, s.tokenProof(req)); err != nil {
+		return nil, bindError(err)
+	}
+	pair, err := s.tokens.issueAccess(rec, exchangedTokenTTL)
+	if err != nil {
+		return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+
+	details := map[string]interface{}{
+		"token_id":      pair.ID,
+		"audience":      rec.Audience,
+		"scope":         pair.Scope,
+		"act":           act,
+		"impersonation": impersonation,
+	}
+	if subject.ID != 0 {
+		details["subject_token_id"] = subject.ID
+	}
+	err = s.db.InsertAuditEvent(ctx, models.AuditEvent{
+		Event:    "token_exchange",
+		GUID:     subject.GUID,
+		ClientID: client.ID,
+		Details:  details,
+	})
+	if err != nil {
+		return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+
+	return &models.OAuthTokenResponse{
+		AccessToken:     pair.Access,
+		TokenType:       tokenType(rec),
+		ExpiresIn:       int(exchangedTokenTTL.Seconds()),
+		Scope:           pair.Scope,
+		IssuedTokenType: accessTokenType,
+	}, nil
+}
+
+// impersonate resolves a guid subject token. The actor authenticates the
+// request; the session takes the actor's authentication context since the
+// impersonated user did not sign in.
+func (s *OAuthService) impersonate(ctx context.Context, policy models.ExchangePolicy, actor *AccessInfo, subjectToken string) (*AccessInfo, error) {
+	if !policy.Impersonation {
+		return nil, oauthError(http.StatusBadRequest, "unauthorized_client", "The client may not impersonate users")
+	}
+	if actor == nil {
+		return nil, oauthError(http.StatusBadRequest, "invalid_request", "Impersonation requires an actor_token")
+	}
+	guid, err := strconv.Atoi(subjectToken)
+	if err != nil || guid <= 0 {
+		return nil, oauthError(http.StatusBadRequest, "invalid_grant", "Invalid subject")
+	}
+	allowed, err := s.db.CanImpersonate(ctx, actor.GUID, guid)
+	if err != nil {
+		return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	if !allowed {
+		return nil, oauthError(http.StatusBadRequest, "invalid_grant", "The actor may not impersonate this user")
+	}
+	if _, err := s.db.GetUser(ctx, guid); errors.Is(err, pgx.ErrNoRows) {
+		return nil, oauthError(http.StatusBadRequest, "invalid_grant", "Unknown subject")
+	} else if err != nil {
+		return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	return &AccessInfo{
+		GUID:     guid,
+		AuthTime: actor.AuthTime,
+		ACR:      actor.ACR,
+		AMR:      actor.AMR,
+		ClientID: actor.ClientID,
+		Scope:    actor.Scope,
+		Act:      actor.Act,
+	}, nil
+}
+
+func intersect(a, b []string) []string {
+	out := []string{}
+	for _, v := range a {
+		if isSubset([]string{v}, b) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
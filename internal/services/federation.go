@@ -0,0 +1,406 @@
+package services
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/jwk"
+	"GoAuthentication/internal/models"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	federationStateTTL = 10 * time.Minute
+	// Upstream discovery documents and keys are cached this long. An ID token
+	// signed with an unknown key refreshes the keys earlier.
+	upstreamMetadataTTL = time.Hour
+)
+
+var defaultFederationScopes = []string{"openid", "email", "profile"}
+
+type FederationInterface interface {
+	StartLogin(providerID string) (redirect string, status int, err error)
+	CompleteLogin(providerID, code, state, ip, ua string, proof Proof) (access, refresh string, status int, err error)
+}
+
+// FederationService signs users in with upstream OpenID Connect providers.
+// This server is the relying party: it runs the authorization code flow
+// with PKCE against the provider, verifies the returned ID token and then
+// starts a session of its own for the linked local user.
+type FederationService struct {
+	db     database.FederationStore
+	tokens *Service
+	issuer string
+	client *http.Client
+
+	mu       sync.Mutex
+	upstream map[string]*upstreamMetadata
+}
+
+type upstreamMetadata struct {
+	config    models.OpenIDConfiguration
+	keys      jwk.Set
+	fetchedAt time.Time
+}
+
+func NewFederationService(db database.FederationStore, tokens *Service, issuer string, client *http.Client) *FederationService {
+	return &FederationService{
+		db:       db,
+		tokens:   tokens,
+		issuer:   strings.TrimRight(issuer, "/"),
+		client:   client,
+		upstream: map[string]*upstreamMetadata{},
+	}
+}
+
+// SaveProvider registers an upstream provider or replaces its settings. The
+// provider must redirect back to CallbackURL(p.ID).
+func (s *FederationService) SaveProvider(p models.IdentityProvider) error {
+	if p.ID == "" || p.Issuer == "" || p.ClientID == "" {
+		return errors.New("Provider id, issuer and client id are required")
+	}
+	if strings.ContainsAny(p.ID, ":/") {
+		return errors.New("Provider id must not contain : or /")
+	}
+	if len(p.Scopes) == 0 {
+		p.Scopes = defaultFederationScopes
+	}
+	if !isSubset([]string{"openid"}, p.Scopes) {
+		p.Scopes = append([]string{"openid"}, p.Scopes...)
+	}
+	return s.db.SaveIdentityProvider(context.Background(), p)
+}
+
+// CallbackURL is the redirect URI to register with the provider.
+func (s *FederationService) CallbackURL(providerID string) string {
+	return s.issuer + "/federation/" + url.PathEscape(providerID) + "/callback"
+}
+
+// StartLogin remembers a fresh state, nonce and PKCE verifier and returns
+// the provider's authorization URL to send the browser to.
+func (s *FederationService) StartLogin(providerID string) (string, int, error) {
+	ctx := context.Background()
+	provider, status, err := s.provider(ctx, providerID)
+	if err != nil {
+		return "", status, err
+	}
+	meta, err := s.metadata(ctx, provider.Issuer, false)
+	if err != nil {
+		return "", http.StatusBadGateway, err
+	}
+
+	var values [3]string
+	for i := range values {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return "", http.StatusInternalServerError, err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+	err = s.db.InsertFederationState(ctx, models.FederationState{
+		StateHash:    sha256Hex(state),
+		ProviderID:   provider.ID,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(federationStateTTL),
+	})
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.ClientID},
+		"redirect_uri":          {s.CallbackURL(provider.ID)},
+		"scope":                 {strings.Join(provider.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.config.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.config.AuthorizationEndpoint + sep + query.Encode(), http.StatusFound, nil
+}
+
+// CompleteLogin handles the provider's redirect back: it redeems the code,
+// verifies the ID token, links the upstream account to a local user and
+// returns a token pair for that user.
+func (s *FederationService) CompleteLogin(providerID, code, state, ip, ua string, proof Proof) (string, string, int, error) {
+	ctx := context.Background()
+	if code == "" || state == "" {
+		return "", "", http.StatusBadRequest, errors.New("code and state are required")
+	}
+	provider, status, err := s.provider(ctx, providerID)
+	if err != nil {
+		return "", "", status, err
+	}
+	rec := models.TokenRecord{
+		IP:        ip,
+		UserAgent: ua,
+		AuthTime:  time.Now(),
+		ACR:       ACRSingle,
+		AMR:       []string{"fed"},
+	}
+	// The proof is checked first so that a bad one does not burn the state.
+	if err := s.tokens.bind(&rec, proof); err != nil {
+		return "", "", http.StatusBadRequest, err
+	}
+
+	st, err := s.db.ConsumeFederationState(ctx, sha256Hex(state))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", http.StatusBadRequest, errors.New("Invalid or expired state")
+	}
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	if st.ProviderID != provider.ID || time.Now().After(st.ExpiresAt) {
+		return "", "", http.StatusBadRequest, errors.New("Invalid or expired state")
+	}
+
+	meta, err := s.metadata(ctx, provider.Issuer, false)
+	if err != nil {
+		return "", "", http.StatusBadGateway, err
+	}
+	idToken, status, err := s.redeemCode(ctx, provider, meta, code, st.CodeVerifier)
+	if err != nil {
+		return "", "", status, err
+	}
+	claims, err := s.verifyIDToken(ctx, provider, idToken, st.Nonce)
+	if err != nil {
+		return "", "", http.StatusUnauthorized, err
+	}
+
+	guid, err := s.linkUser(ctx, provider, claims)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	rec.GUID = guid
+	pair, err := s.tokens.issue(rec)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	return pair.Access, pair.Refresh, http.StatusOK, nil
+}
+
+func (s *FederationService) provider(ctx context.Context, id string) (models.IdentityProvider, int, error) {
+	p, err := s.db.GetIdentityProvider(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return p, http.StatusNotFound, errors.New("Unknown identity provider")
+	}
+	if err != nil {
+		return p, http.StatusInternalServerError, err
+	}
+	return p, http.StatusOK, nil
+}
+
+// redeemCode exchanges the authorization code at the provider's token
+// endpoint, authenticating with client_secret_basic, and returns the ID token.
+func (s *FederationService) redeemCode(ctx context.Context, p models.IdentityProvider, meta *upstreamMetadata, code, verifier string) (string, int, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {s.CallbackURL(p.ID)},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", http.StatusBadGateway, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", http.StatusBadGateway, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", http.StatusBadGateway, fmt.Errorf("Invalid token response from the identity provider: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", http.StatusUnauthorized, fmt.Errorf("The identity provider rejected the code: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", http.StatusBadGateway, errors.New("The identity provider returned no ID token")
+	}
+	return body.IDToken, http.StatusOK, nil
+}
+
+// verifyIDToken checks the ID token as OpenID Connect Core 3.1.3.7 asks: a
+// signature by one of the provider's keys, the issuer, our client id as
+// audience, the expiry and the nonce of our request.
+func (s *FederationService) verifyIDToken(ctx context.Context, p models.IdentityProvider, idToken, nonce string) (jwt.MapClaims, error) {
+	keyfunc := func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		for _, refresh := range []bool{false, true} {
+			meta, err := s.metadata(ctx, p.Issuer, refresh)
+			if err != nil {
+				return nil, err
+			}
+			for _, key := range meta.keys.Keys {
+				if (kid == "" || key.Kid == kid) && key.Use != "enc" {
+					return key.PublicKey()
+				}
+			}
+		}
+		return nil, errors.New("Unknown signing key")
+	}
+	token, err := jwt.Parse(idToken, keyfunc,
+		jwt.WithValidMethods([]string{"RS256", "PS256", "ES256"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || !token.Valid {
+		return nil, errors.New("Invalid ID token from the identity provider")
+	}
+	claims := token.Claims.(jwt.MapClaims)
+
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.ClientID {
+			return nil, errors.New("ID token was issued to another client")
+		}
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	if sub, _ := claims.GetSubject(); sub == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// linkUser links the account behind an ID token to a local user, trusting
+// the address only if the provider verified it.
+func (s *FederationService) linkUser(ctx context.Context, p models.IdentityProvider, claims jwt.MapClaims) (int, error) {
+	sub, _ := claims.GetSubject()
+	user := models.User{}
+	user.Email, _ = claims["email"].(string)
+	user.Name, _ = claims["name"].(string)
+	user.GivenName, _ = claims["given_name"].(string)
+	user.FamilyName, _ = claims["family_name"].(string)
+	return linkExternalUser(ctx, s.db, p.ID, sub, user, emailVerified(claims))
+}
+
+// linkExternalUser finds the local user of an upstream account. Accounts
+// seen before keep their user. A new account is linked to the user with the
+// same address if the address can be trusted, otherwise a new user is
+// created from the upstream profile.
+func linkExternalUser(ctx context.Context, db database.FederationStore, provider, subject string, user models.User, trustEmail bool) (int, error) {
+	guid, err := db.GetExternalIdentity(ctx, provider, subject)
+	if err == nil {
+		return guid, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, err
+	}
+
+	email, err := normalizeEmail(user.Email)
+	user.Email, user.EmailVerified = "", false
+	if err == nil && trustEmail {
+		user.Email, user.EmailVerified = email, true
+		guid, err = db.GetUserByEmail(ctx, email)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return 0, err
+		}
+	}
+	if guid == 0 {
+		if guid, err = db.CreateUser(ctx, user); err != nil {
+			return 0, err
+		}
+	}
+
+	linked, err := db.LinkExternalIdentity(ctx, provider, subject, guid)
+	if err != nil {
+		return 0, err
+	}
+	if linked == guid {
+		err = db.InsertAuditEvent(ctx, models.AuditEvent{
+			Event:   "external_identity_linked",
+			GUID:    guid,
+			Details: map[string]interface{}{"provider": provider, "subject": subject},
+		})
+	}
+	return linked, err
+}
+
+// emailVerified reads email_verified, which some providers send as a string.
+func emailVerified(claims jwt.MapClaims) bool {
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// metadata returns the provider's discovery document and keys, fetching
+// them when they are missing, stale or refresh is set.
+func (s *FederationService) metadata(ctx context.Context, issuer string, refresh bool) (*upstreamMetadata, error) {
+	s.mu.Lock()
+	meta := s.upstream[issuer]
+	s.mu.Unlock()
+	if meta != nil && !refresh && time.Since(meta.fetchedAt) < upstreamMetadataTTL {
+		return meta, nil
+	}
+
+	meta = &upstreamMetadata{fetchedAt: time.Now()}
+	if err := s.fetchJSON(ctx, strings.TrimRight(issuer, "/")+"/.well-known/openid-configuration", &meta.config); err != nil {
+		return nil, err
+	}
+	if meta.config.Issuer != issuer {
+		return nil, errors.New("The identity provider's discovery document names another issuer")
+	}
+	if meta.config.AuthorizationEndpoint == "" || meta.config.TokenEndpoint == "" || meta.config.JWKSURI == "" {
+		return nil, errors.New("The identity provider's discovery document is incomplete")
+	}
+	if err := s.fetchJSON(ctx, meta.config.JWKSURI, &meta.keys); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.upstream[issuer] = meta
+	s.mu.Unlock()
+	return meta, nil
+}
+
+func (s *FederationService) fetchJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
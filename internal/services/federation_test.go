@@ -0,0 +1,300 @@
+package services
+
+import (
+	"GoAuthentication/internal/jwk"
+	"GoAuthentication/internal/models"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testOIDCProvider is an upstream OpenID Connect provider serving discovery,
+// its keys and a token endpoint that hands out ID tokens registered with
+// issue.
+type testOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]testCode
+}
+
+type testCode struct {
+	idToken   string
+	challenge string
+}
+
+const (
+	testClientID     = "sp-client"
+	testClientSecret = "sp-secret"
+	testCallbackURL  = "https://auth.example.com/federation/upstream/callback"
+)
+
+var testOIDCKey struct {
+	once sync.Once
+	key  *rsa.PrivateKey
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	testOIDCKey.once.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		testOIDCKey.key = key
+	})
+	p := &testOIDCProvider{key: testOIDCKey.key, codes: map[string]testCode{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(models.OpenIDConfiguration{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		key, err := jwk.FromPublicKey(&p.key.PublicKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		key.Kid, key.Use, key.Alg = "k1", "sig", "RS256"
+		json.NewEncoder(w).Encode(jwk.Set{Keys: []jwk.Key{key}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		p.mu.Lock()
+		code, ok := p.codes[r.PostFormValue("code")]
+		delete(p.codes, r.PostFormValue("code"))
+		p.mu.Unlock()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if id != testClientID || secret != testClientSecret || !ok ||
+			r.PostFormValue("grant_type") != "authorization_code" ||
+			r.PostFormValue("redirect_uri") != testCallbackURL ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "upstream", "id_token": code.idToken})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// claims are the ID token claims of a valid login answering nonce.
+func (p *testOIDCProvider) claims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            p.URL,
+		"sub":            "upstream-alice",
+		"aud":            testClientID,
+		"exp":            time.Now().Add(5 * time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}
+}
+
+func (p *testOIDCProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// login runs a login through the provider, which answers with the ID token
+// built by idToken from the nonce of the request.
+func (p *testOIDCProvider) login(t *testing.T, s *FederationService, idToken func(nonce string) string) (string, int, error) {
+	redirect, status, err := s.StartLogin("upstream")
+	if err != nil || status != http.StatusFound {
+		t.Fatalf("start login: %d %v", status, err)
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("client_id") != testClientID || q.Get("redirect_uri") != testCallbackURL || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization request %s", redirect)
+	}
+	p.mu.Lock()
+	p.codes["code-1"] = testCode{idToken: idToken(q.Get("nonce")), challenge: q.Get("code_challenge")}
+	p.mu.Unlock()
+	access, _, status, err := s.CompleteLogin("upstream", "code-1", q.Get("state"), "", "", Proof{})
+	return access, status, err
+}
+
+func newTestFederation(t *testing.T) (*FederationService, *federationStore, *testOIDCProvider) {
+	p := newTestOIDCProvider(t)
+	db := newFederationStore()
+	s := NewFederationService(db, NewService(db.MemoryDatabase, "secret", nil, TokenPolicy{}), "https://auth.example.com/", p.Client())
+	err := s.SaveProvider(models.IdentityProvider{ID: "upstream", Issuer: p.URL, ClientID: testClientID, ClientSecret: testClientSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, db, p
+}
+
+func TestFederationCompleteLogin(t *testing.T) {
+	s, db, p := newTestFederation(t)
+	access, status, err := p.login(t, s, func(nonce string) string { return p.sign(t, p.claims(nonce)) })
+	if err != nil || status != http.StatusOK || access == "" {
+		t.Fatalf("login: %d %v", status, err)
+	}
+	guid := db.linked("upstream", "upstream-alice")
+	if u := db.users[guid]; guid == 0 || u.Email != "alice@example.com" || !u.EmailVerified || u.Name != "Alice" {
+		t.Fatalf("linked user %d %+v", guid, u)
+	}
+
+	// The account keeps its user on the next login.
+	if _, status, err := p.login(t, s, func(nonce string) string { return p.sign(t, p.claims(nonce)) }); status != http.StatusOK {
+		t.Fatalf("second login: %d %v", status, err)
+	}
+	if again := db.linked("upstream", "upstream-alice"); again != guid || len(db.users) != 1 {
+		t.Fatalf("second login linked user %d of %d, want %d", again, len(db.users), guid)
+	}
+}
+
+func TestFederationRejectsIDToken(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		idToken func(p *testOIDCProvider, t *testing.T, claims jwt.MapClaims) string
+	}{
+		{"wrong nonce", func(p *testOIDCProvider, t *testing.T, c jwt.MapClaims) string {
+			c["nonce"] = "replayed"
+			return p.sign(t, c)
+		}},
+		{"no nonce", func(p *testOIDCProvider, t *testing.T, c jwt.MapClaims) string {
+			delete(c, "nonce")
+			return p.sign(t, c)
+		}},
+		{"wrong issuer", func(p *testOIDCProvider, t *testing.T, c jwt.MapClaims) string {
+			c["iss"] = "https://evil.example.com"
+			return p.sign(t, c)
+		}},
+		{"wrong audience", func(p *testOIDCProvider, t *testing.T, c jwt.MapClaims) string {
+			c["aud"] = "other-client"
+			return p.sign(t, c)
+		}},
+		{"shared audience without azp", func(p *testOIDCProvider, t *testing.T, c jwt.MapClaims) string {
+			c["aud"] = []string{testClientID, "other-client"}
+			return p.sign(t, c)
+		}},
+		{"expired", func(p *testOIDCProvider, t *testing.T, c jwt.MapClaims) string {
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+			return p.sign(t, c)
+		}},
+		{"no expiry", func(p *testOIDCProvider, t *testing.T, c jwt.MapClaims) string {
+			delete(c, "exp")
+			return p.sign(t, c)
+		}},
+		{"no subject", func(p *testOIDCProvider, t *testing.T, c jwt.MapClaims) string {
+			delete(c, "sub")
+			return p.sign(t, c)
+		}},
+		{"alg none", func(p *testOIDCProvider, t *testing.T, c jwt.MapClaims) string {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodNone, c).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return signed
+		}},
+		{"alg HS256 keyed with the public key", func(p *testOIDCProvider, t *testing.T, c jwt.MapClaims) string {
+			key, _ := jwk.FromPublicKey(&p.key.PublicKey)
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, c)
+			token.Header["kid"] = "k1"
+			signed, _ := token.SignedString([]byte(key.N))
+			return signed
+		}},
+		{"other key", func(p *testOIDCProvider, t *testing.T, c jwt.MapClaims) string {
+			other, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+			token.Header["kid"] = "k1"
+			signed, _ := token.SignedString(other)
+			return signed
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, db, p := newTestFederation(t)
+			access, status, err := p.login(t, s, func(nonce string) string { return tc.idToken(p, t, p.claims(nonce)) })
+			if status != http.StatusUnauthorized || err == nil || access != "" {
+				t.Fatalf("got %d %v, want 401", status, err)
+			}
+			if len(db.users) != 0 {
+				t.Fatal("rejected ID token created a user")
+			}
+		})
+	}
+}
+
+func TestFederationRejectsState(t *testing.T) {
+	s, _, p := newTestFederation(t)
+	p.login(t, s, func(nonce string) string { return p.sign(t, p.claims(nonce)) })
+	if _, _, status, _ := s.CompleteLogin("upstream", "code-1", "forged", "", "", Proof{}); status != http.StatusBadRequest {
+		t.Fatalf("unknown state: status %d", status)
+	}
+	if _, _, status, _ := s.CompleteLogin("missing", "code-1", "forged", "", "", Proof{}); status != http.StatusNotFound {
+		t.Fatalf("unknown provider: status %d", status)
+	}
+}
+
+func TestFederationLinksByVerifiedEmailOnly(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		verified interface{}
+		link     bool
+	}{
+		{"verified", true, true},
+		{"verified as a string", "true", true},
+		{"unverified", false, false},
+		{"unverified as a string", "false", false},
+		{"not stated", nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, db, p := newTestFederation(t)
+			existing, err := db.CreateUser(context.Background(), models.User{Email: "alice@example.com", EmailVerified: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, status, err := p.login(t, s, func(nonce string) string {
+				c := p.claims(nonce)
+				if tc.verified == nil {
+					delete(c, "email_verified")
+				} else {
+					c["email_verified"] = tc.verified
+				}
+				return p.sign(t, c)
+			})
+			if status != http.StatusOK {
+				t.Fatalf("login: %d %v", status, err)
+			}
+			guid := db.linked("upstream", "upstream-alice")
+			if (guid == existing) != tc.link {
+				t.Fatalf("linked to user %d, existing user is %d", guid, existing)
+			}
+			if !tc.link {
+				// The new user does not claim the address either.
+				if u := db.users[guid]; u.Email != "" || u.EmailVerified {
+					t.Fatalf("new user %+v took the unverified address", u)
+				}
+			}
+		})
+	}
+}
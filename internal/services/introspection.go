@@ -0,0 +1,128 @@
+package services
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Introspect implements RFC 7662 for resource servers that cannot check
+// tokens themselves. Any confidential client may ask about access tokens;
+// refresh tokens are only disclosed to the client they were issued to.
+// Proof-of-possession is not verified here, cnf tells the caller which key
+// or certificate to expect.
+func (s *OAuthService) Introspect(req models.TokenRequest) (*models.IntrospectionResponse, error) {
+	client, oerr := s.authenticateClient(context.Background(), req)
+	if oerr != nil {
+		return nil, oerr
+	}
+	if client.AuthMethod == AuthMethodNone {
+		return nil, oauthError(http.StatusUnauthorized, "invalid_client", "Public clients may not introspect tokens")
+	}
+	if req.Token == "" {
+		return nil, oauthError(http.StatusBadRequest, "invalid_request", "token is required")
+	}
+	// JWTs and "<id>.<secret>" refresh tokens are told apart without
+	// token_type_hint.
+	if strings.Count(req.Token, ".") == 1 {
+		resp, err := s.tokens.introspectRefresh(client.ID, req.Token)
+		if err != nil {
+			return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+		}
+		return resp, nil
+	}
+	return s.tokens.introspectAccess(req.Token), nil
+}
+
+// introspectAccess describes a user access token or a client token. Invalid,
+// expired and revoked tokens are all just inactive.
+func (s *Service) introspectAccess(tokenStr string) *models.IntrospectionResponse {
+	claims, err := s.parseToken(tokenStr)
+	if err != nil {
+		return &models.IntrospectionResponse{}
+	}
+	resp := &models.IntrospectionResponse{Active: true, TokenType: "Bearer"}
+	switch claims["type"] {
+	case "access":
+		if _, err := s.accessClaims(tokenStr); err != nil {
+			return &models.IntrospectionResponse{}
+		}
+		guid, _ := claims["guid"].(float64)
+		authTime, _ := claims["auth_time"].(float64)
+		resp.Sub = strconv.Itoa(int(guid))
+		resp.AuthTime = int64(authTime)
+		resp.ACR, _ = claims["acr"].(string)
+		resp.Roles = stringsClaim(claims["roles"])
+		resp.Aud, _ = claims.GetAudience()
+		resp.Act, _ = claims["act"].(map[string]interface{})
+	case "client":
+		resp.Sub, _ = claims["sub"].(string)
+	default:
+		return &models.IntrospectionResponse{}
+	}
+	resp.Scope, _ = claims["scope"].(string)
+	resp.ClientID, _ = claims["client_id"].(string)
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		resp.Exp = exp.Unix()
+	}
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		resp.Iat = iat.Unix()
+	}
+	resp.Cnf = confirmationClaim(claims)
+	if resp.Cnf["jkt"] != "" {
+		resp.TokenType = "DPoP"
+	}
+	return resp
+}
+
+// introspectRefresh describes an OAuth refresh token of clientID that can
+// still be redeemed.
+func (s *Service) introspectRefresh(clientID, token string) (*models.IntrospectionResponse, error) {
+	idStr, secret, _ := strings.Cut(token, ".")
+	id, err := strconv.Atoi(idStr)
+	raw, b64err := base64.StdEncoding.DecodeString(secret)
+	if err != nil || b64err != nil {
+		return &models.IntrospectionResponse{}, nil
+	}
+	rec, err := s.db.GetToken(context.Background(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &models.IntrospectionResponse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rec.ClientID != clientID || rec.Status != "unused" || !s.checkRefresh(rec.RefreshHash, raw) {
+		return &models.IntrospectionResponse{}, nil
+	}
+	return &models.IntrospectionResponse{
+		Active:   true,
+		Scope:    rec.Scope,
+		ClientID: rec.ClientID,
+		Sub:      strconv.Itoa(rec.GUID),
+		Aud:      rec.Audience,
+		ACR:      rec.ACR,
+		AuthTime: rec.AuthTime.Unix(),
+		Act:      rec.Act,
+		Cnf:      confirmation(rec),
+	}, nil
+}
+
+func confirmationClaim(claims jwt.MapClaims) map[string]string {
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	if len(cnf) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(cnf))
+	for k, v := range cnf {
+		if s, ok := v.(string); ok {
+			out[k] = s
+		}
+	}
+	return out
+}
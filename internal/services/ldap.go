@@ -0,0 +1,178 @@
+package services
+
+import (
+	"GoAuthentication/internal/ldap"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Directory lookups (DN, attributes, groups) are reused this long. The
+	// password is still checked with a bind on every login.
+	ldapCacheTTL = time.Minute
+	ldapTimeout  = 10 * time.Second
+)
+
+// LDAPConfig describes a directory. Filters may use {username} and {dn},
+// which are escaped before they are substituted.
+type LDAPConfig struct {
+	URL      string // ldap:// or ldaps://
+	StartTLS bool
+	TLS      *tls.Config
+
+	// BindDN and BindPassword are the service account that looks users up.
+	// Without them the lookup binds anonymously.
+	BindDN       string
+	BindPassword string
+
+	UserBaseDN string
+	UserFilter string // (uid={username}) by default, (sAMAccountName={username}) for AD
+
+	// GroupBaseDN enables group searches in addition to memberOf.
+	GroupBaseDN string
+	GroupFilter string // (member={dn}) by default
+}
+
+// LDAPAuthenticator verifies passwords by binding to the directory as the
+// user (Active Directory included). Group memberships come from memberOf
+// and, if configured, a group search.
+type LDAPAuthenticator struct {
+	cfg LDAPConfig
+
+	mu    sync.Mutex
+	cache map[string]ldapLookup
+}
+
+type ldapLookup struct {
+	user      DirectoryUser
+	fetchedAt time.Time
+}
+
+var ldapAttributes = []string{"mail", "displayName", "cn", "givenName", "sn", "memberOf"}
+
+func NewLDAPAuthenticator(cfg LDAPConfig) *LDAPAuthenticator {
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = "(uid={username})"
+	}
+	if cfg.GroupFilter == "" {
+		cfg.GroupFilter = "(member={dn})"
+	}
+	return &LDAPAuthenticator{cfg: cfg, cache: map[string]ldapLookup{}}
+}
+
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, username, password string) (DirectoryUser, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || password == "" {
+		return DirectoryUser{}, ErrInvalidCredentials
+	}
+	conn, err := a.dial()
+	if err != nil {
+		return DirectoryUser{}, err
+	}
+	defer conn.Close()
+
+	user, err := a.lookup(conn, username)
+	if err != nil {
+		return DirectoryUser{}, err
+	}
+	if err := conn.Bind(user.ID, password); ldap.IsInvalidCredentials(err) {
+		return DirectoryUser{}, ErrInvalidCredentials
+	} else if err != nil {
+		return DirectoryUser{}, err
+	}
+	return user, nil
+}
+
+func (a *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.Dial(a.cfg.URL, a.cfg.TLS, ldapTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if a.cfg.StartTLS {
+		u, err := url.Parse(a.cfg.URL)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := conn.StartTLS(a.cfg.TLS, u.Hostname()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// lookup finds the user's entry and groups with the service account, or
+// returns a recent result for the same username.
+func (a *LDAPAuthenticator) lookup(conn *ldap.Conn, username string) (DirectoryUser, error) {
+	key := strings.ToLower(username)
+	a.mu.Lock()
+	cached, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < ldapCacheTTL {
+		return cached.user, nil
+	}
+
+	if a.cfg.BindDN != "" {
+		if err := conn.Bind(a.cfg.BindDN, a.cfg.BindPassword); err != nil {
+			return DirectoryUser{}, err
+		}
+	}
+	entries, err := conn.Search(ldap.SearchRequest{
+		BaseDN:     a.cfg.UserBaseDN,
+		Scope:      ldap.ScopeWholeSubtree,
+		Filter:     strings.ReplaceAll(a.cfg.UserFilter, "{username}", ldap.EscapeFilter(username)),
+		Attributes: ldapAttributes,
+		SizeLimit:  2,
+	})
+	if err != nil {
+		return DirectoryUser{}, err
+	}
+	if len(entries) == 0 {
+		return DirectoryUser{}, ErrInvalidCredentials
+	}
+	if len(entries) > 1 {
+		return DirectoryUser{}, errors.New("The user filter matches more than one directory entry")
+	}
+	e := entries[0]
+	user := DirectoryUser{
+		ID:         e.DN,
+		Email:      e.Get("mail"),
+		Name:       e.Get("displayName"),
+		GivenName:  e.Get("givenName"),
+		FamilyName: e.Get("sn"),
+		Groups:     e.GetAll("memberOf"),
+	}
+	if user.Name == "" {
+		user.Name = e.Get("cn")
+	}
+	if a.cfg.GroupBaseDN != "" {
+		groups, err := conn.Search(ldap.SearchRequest{
+			BaseDN:     a.cfg.GroupBaseDN,
+			Scope:      ldap.ScopeWholeSubtree,
+			Filter:     strings.ReplaceAll(a.cfg.GroupFilter, "{dn}", ldap.EscapeFilter(e.DN)),
+			Attributes: []string{"cn"},
+		})
+		if err != nil {
+			return DirectoryUser{}, err
+		}
+		for _, g := range groups {
+			user.Groups = append(user.Groups, g.DN)
+		}
+	}
+
+	a.mu.Lock()
+	for k, v := range a.cache {
+		if time.Since(v.fetchedAt) >= ldapCacheTTL {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = ldapLookup{user: user, fetchedAt: time.Now()}
+	a.mu.Unlock()
+	return user, nil
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"GoAuthentication/internal/ldap/ldaptest"
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+const (
+	ldapServiceDN = "cn=auth,dc=example,dc=com"
+	ldapAliceDN   = "uid=alice,ou=people,dc=example,dc=com"
+	ldapAdminsDN  = "cn=admins,ou=groups,dc=example,dc=com"
+	ldapOpsDN     = "cn=ops,ou=groups,dc=example,dc=com"
+)
+
+var ldapDirectory = []ldaptest.Entry{
+	{DN: ldapServiceDN, Password: "service"},
+	{
+		DN:       ldapAliceDN,
+		Password: "wonderland",
+		Attributes: map[string][]string{
+			"uid":         {"alice"},
+			"mail":        {"Alice@Example.com"},
+			"cn":          {"Alice Liddell"},
+			"givenName":   {"Alice"},
+			"sn":          {"Liddell"},
+			"memberOf":    {ldapAdminsDN},
+			"objectClass": {"person"},
+		},
+	},
+	{
+		DN:         "uid=bob,ou=people,dc=example,dc=com",
+		Password:   "builder",
+		Attributes: map[string][]string{"uid": {"bob"}, "objectClass": {"person"}},
+	},
+	{
+		DN:         ldapOpsDN,
+		Attributes: map[string][]string{"cn": {"ops"}, "member": {ldapAliceDN}},
+	},
+}
+
+func newTestLDAP(t *testing.T) (*ldaptest.Server, *LDAPAuthenticator) {
+	s := ldaptest.NewServer(t, ldapDirectory...)
+	return s, NewLDAPAuthenticator(LDAPConfig{
+		URL:          s.URL,
+		BindDN:       ldapServiceDN,
+		BindPassword: "service",
+		UserBaseDN:   "ou=people,dc=example,dc=com",
+		UserFilter:   "(&(objectClass=person)(uid={username}))",
+		GroupBaseDN:  "ou=groups,dc=example,dc=com",
+	})
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	s, auth := newTestLDAP(t)
+
+	user, err := auth.Authenticate(context.Background(), " alice ", "wonderland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DirectoryUser{
+		ID:         ldapAliceDN,
+		Email:      "Alice@Example.com",
+		Name:       "Alice Liddell",
+		GivenName:  "Alice",
+		FamilyName: "Liddell",
+		Groups:     []string{ldapAdminsDN, ldapOpsDN},
+	}
+	if !reflect.DeepEqual(user, want) {
+		t.Fatalf("got %+v, want %+v", user, want)
+	}
+	binds := s.Binds()
+	if len(binds) != 2 || binds[0].DN != ldapServiceDN || binds[1].DN != ldapAliceDN || !binds[1].OK {
+		t.Fatalf("unexpected binds %+v", binds)
+	}
+	wantFilters := []string{
+		"(&(objectClass=person)(uid=alice))",
+		"(member=" + ldapAliceDN + ")",
+	}
+	if got := s.Filters(); !reflect.DeepEqual(got, wantFilters) {
+		t.Fatalf("filters %q, want %q", got, wantFilters)
+	}
+}
+
+func TestLDAPAuthenticateRejects(t *testing.T) {
+	for _, tc := range []struct{ name, username, password string }{
+		{"wrong password", "alice", "looking-glass"},
+		{"unknown user", "carol", "wonderland"},
+		{"other user's password", "alice", "builder"},
+		{"no username", " ", "wonderland"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, auth := newTestLDAP(t)
+			_, err := auth.Authenticate(context.Background(), tc.username, tc.password)
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("got %v, want ErrInvalidCredentials", err)
+			}
+		})
+	}
+}
+
+func TestLDAPAuthenticateEmptyPassword(t *testing.T) {
+	s, auth := newTestLDAP(t)
+
+	// The directory takes a bind without a password as anonymous and would
+	// report success.
+	_, err := auth.Authenticate(context.Background(), "alice", "")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("got %v, want ErrInvalidCredentials", err)
+	}
+	for _, b := range s.Binds() {
+		if b.Password == "" {
+			t.Fatalf("anonymous bind as %q reached the directory", b.DN)
+		}
+	}
+}
+
+func TestLDAPAuthenticateFilterInjection(t *testing.T) {
+	for _, tc := range []struct{ username, filter string }{
+		{"*", `(&(objectClass=person)(uid=\2a))`},
+		{"alice)(uid=*", `(&(objectClass=person)(uid=alice\29\28uid=\2a))`},
+		{"*)(|(objectClass=*", `(&(objectClass=person)(uid=\2a\29\28|\28objectClass=\2a))`},
+		{`alice\`, `(&(objectClass=person)(uid=alice\5c))`},
+	} {
+		t.Run(tc.username, func(t *testing.T) {
+			s, auth := newTestLDAP(t)
+			// Any password of a matched entry would do.
+			for _, password := range []string{"wonderland", "builder"} {
+				_, err := auth.Authenticate(context.Background(), tc.username, password)
+				if !errors.Is(err, ErrInvalidCredentials) {
+					t.Fatalf("password %q: got %v, want ErrInvalidCredentials", password, err)
+				}
+			}
+			if got := s.Filters(); len(got) == 0 || got[0] != tc.filter {
+				t.Fatalf("directory saw %q, want %q", got, tc.filter)
+			}
+		})
+	}
+}
+
+func TestPasswordLoginMapsGroupsToRoles(t *testing.T) {
+	ctx := context.Background()
+	_, auth := newTestLDAP(t)
+	db := newFederationStore()
+	for _, role := range []string{"admin", "operator", "auditor", "support"} {
+		if err := db.SaveRole(ctx, role, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groupRoles := map[string]string{
+		"CN=Admins,OU=Groups,DC=Example,DC=Com":   "admin",
+		ldapOpsDN:                                 "operator",
+		"cn=auditors,ou=groups,dc=example,dc=com": "auditor",
+	}
+	s := NewPasswordLoginService(db, NewService(db.MemoryDatabase, "secret", nil, TokenPolicy{}), auth, groupRoles)
+
+	access, _, status, err := s.Login("alice", "wonderland", "127.0.0.1", "test", Proof{})
+	if err != nil || status != http.StatusOK || access == "" {
+		t.Fatalf("login: %d %v", status, err)
+	}
+	guid := db.linked(ldapProvider, ldapAliceDN)
+	if guid == 0 {
+		t.Fatal("directory account was not linked")
+	}
+	if u := db.users[guid]; u.Email != "alice@example.com" || !u.EmailVerified {
+		t.Fatalf("linked user %+v", u)
+	}
+	roles, _, _ := db.GetUserRoles(ctx, guid)
+	if want := []string{"admin", "operator"}; !reflect.DeepEqual(roles, want) {
+		t.Fatalf("roles %v, want %v", roles, want)
+	}
+
+	// Mapped roles follow the groups; roles assigned by hand stay.
+	for _, role := range []string{"auditor", "support"} {
+		if err := db.AssignRole(ctx, guid, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auth.cfg.GroupBaseDN = ""
+	auth.cache = map[string]ldapLookup{}
+	if _, _, status, err := s.Login("alice", "wonderland", "127.0.0.1", "test", Proof{}); err != nil {
+		t.Fatalf("second login: %d %v", status, err)
+	}
+	if again := db.linked(ldapProvider, ldapAliceDN); again != guid {
+		t.Fatalf("second login linked user %d, want %d", again, guid)
+	}
+	roles, _, _ = db.GetUserRoles(ctx, guid)
+	if want := []string{"admin", "support"}; !reflect.DeepEqual(roles, want) {
+		t.Fatalf("roles %v, want %v", roles, want)
+	}
+}
+
+func TestPasswordLoginStatus(t *testing.T) {
+	_, auth := newTestLDAP(t)
+	db := newFederationStore()
+	s := NewPasswordLoginService(db, NewService(db.MemoryDatabase, "secret", nil, TokenPolicy{}), auth, nil)
+
+	if _, _, status, _ := s.Login("alice", "looking-glass", "", "", Proof{}); status != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d", status)
+	}
+	auth.cfg.URL = "ldap://127.0.0.1:1"
+	if _, _, status, _ := s.Login("bob", "builder", "", "", Proof{}); status != http.StatusBadGateway {
+		t.Fatalf("directory down: status %d", status)
+	}
+	unconfigured := NewPasswordLoginService(db, NewService(db.MemoryDatabase, "secret", nil, TokenPolicy{}), nil, nil)
+	if _, _, status, _ := unconfigured.Login("alice", "wonderland", "", "", Proof{}); status != http.StatusNotFound {
+		t.Fatalf("no directory: status %d", status)
+	}
+}
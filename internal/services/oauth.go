@@ -0,0 +1,503 @@
+package services
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/jwk"
+	"GoAuthentication/internal/models"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const authorizationCodeTTL = time.Minute
+
+var ErrNotUserSession = errors.New("Only a session the user signed in to may authorize clients")
+
+// OAuthError is an error response as defined in RFC 6749 section 5.2.
+// DPoPNonce is sent as the DPoP-Nonce header with use_dpop_nonce.
+type OAuthError struct {
+	Code        string
+	Description string
+	Status      int
+	DPoPNonce   string
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func oauthError(status int, code, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description, Status: status}
+}
+
+// AuthorizeResult is either a redirect back to the client, carrying a code or
+// an error, or a consent prompt the user has to answer first.
+type AuthorizeResult struct {
+	Redirect string
+	Consent  *models.ConsentPrompt
+}
+
+type OAuthInterface interface {
+	Authorize(access AccessRequest, req models.AuthorizeRequest) (*AuthorizeResult, error)
+	Token(req models.TokenRequest, ip, ua string) (*models.OAuthTokenResponse, error)
+	RegisterClient(reg models.ClientRegistration) (clientID, secret string, err error)
+	Discovery() models.OpenIDConfiguration
+	JWKS() jwk.Set
+	UserInfo(access AccessRequest) (*models.UserInfoResponse, error)
+	DeviceAuthorization(req models.TokenRequest) (*models.DeviceAuthorizationResponse, error)
+	DeviceInfo(access AccessRequest, userCode string) (*models.DeviceInfo, error)
+	VerifyDevice(access AccessRequest, userCode, action string) error
+	SetExchangePolicy(p models.ExchangePolicy) error
+	GrantImpersonation(actorGUID, subjectGUID int) error
+	Introspect(req models.TokenRequest) (*models.IntrospectionResponse, error)
+}
+
+type OAuthService struct {
+	db         database.OAuthStore
+	tokens     *Service
+	issuer     string
+	signingKey *rsa.PrivateKey
+	keyID      string
+}
+
+// NewOAuthService creates the authorization server. signingKey signs OpenID
+// Connect ID tokens; access tokens keep using the shared HS512 secret.
+func NewOAuthService(db database.OAuthStore, tokens *Service, issuer string, signingKey *rsa.PrivateKey) *OAuthService {
+	key, _ := jwk.FromPublicKey(&signingKey.PublicKey)
+	kid, _ := key.Thumbprint()
+	return &OAuthService{db: db, tokens: tokens, issuer: issuer, signingKey: signingKey, keyID: kid}
+}
+
+// Authorize handles the authorization endpoint for the code flow with PKCE.
+// Errors about the client or its redirect URI are returned as *OAuthError and
+// must be shown to the user; everything else goes back to the client.
+func (s *OAuthService) Authorize(access AccessRequest, req models.AuthorizeRequest) (*AuthorizeResult, error) {
+	ctx := context.Background()
+	client, err := s.db.GetClient(ctx, req.ClientID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, oauthError(http.StatusBadRequest, "invalid_request", "Unknown client")
+	}
+	if err != nil {
+		return nil, err
+	}
+	redirectURI, ok := matchRedirectURI(client, req.RedirectURI)
+	if !ok || !isSubset([]string{"authorization_code"}, client.GrantTypes) {
+		return nil, oauthError(http.StatusBadRequest, "invalid_request", "Redirect URI is not registered for this client")
+	}
+	fail := func(code, description string) (*AuthorizeResult, error) {
+		return &AuthorizeResult{Redirect: s.redirect(redirectURI, url.Values{
+			"error":             {code},
+			"error_description": {description},
+		}, req.State)}, nil
+	}
+
+	if req.ResponseType != "code" {
+		return fail("unsupported_response_type", "Only the code response type is supported")
+	}
+	if req.CodeChallenge == "" {
+		return fail("invalid_request", "PKCE code_challenge is required")
+	}
+	if req.CodeChallengeMethod != "S256" {
+		return fail("invalid_request", "Only the S256 code_challenge_method is supported")
+	}
+	scopes := strings.Fields(req.Scope)
+	if len(client.Scopes) > 0 && !isSubset(scopes, client.Scopes) {
+		return fail("invalid_scope", "The client may not request this scope")
+	}
+
+	if req.MaxAge != "" {
+		maxAge, err := strconv.Atoi(req.MaxAge)
+		if err != nil || maxAge < 0 {
+			return fail("invalid_request", "Invalid max_age")
+		}
+		// auth_time is truncated to whole seconds.
+		access.MaxAge = time.Duration(maxAge)*time.Second + time.Second
+	}
+	info, err := s.userSession(access)
+	if err != nil {
+		if req.Prompt == "none" {
+			return fail("login_required", "The user is not signed in")
+		}
+		return nil, accessError(err, "login_required")
+	}
+	// Scopes backed by permissions the user does not have are dropped
+	// rather than refused, so the client learns the outcome from the token
+	// response. A session limited to a scope grants no more than that.
+	scopes, err = s.tokens.grantableScopes(ctx, info.GUID, scopes)
+	if err != nil {
+		return nil, err
+	}
+	if info.Scope != "" {
+		scopes = intersect(scopes, append(strings.Fields(info.Scope), identityScopes...))
+	}
+
+	switch req.Consent {
+	case "deny":
+		return fail("access_denied", "The user denied the request")
+	case "approve":
+		if err := s.db.SaveConsent(ctx, info.GUID, client.ID, scopes); err != nil {
+			return nil, err
+		}
+	default:
+		granted, err := s.db.GetConsent(ctx, info.GUID, client.ID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+		if req.Prompt == "consent" || err != nil || !isSubset(scopes, granted) {
+			if req.Prompt == "none" {
+				return fail("consent_required", "The user has not approved this client")
+			}
+			return &AuthorizeResult{Consent: &models.ConsentPrompt{
+				ClientID:   client.ID,
+				ClientName: client.Name,
+				Scopes:     scopes,
+			}}, nil
+		}
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	code := base64.RawURLEncoding.EncodeToString(raw)
+	err = s.db.InsertAuthorizationCode(ctx, models.AuthorizationCode{
+		CodeHash:      sha256Hex(code),
+		ClientID:      client.ID,
+		GUID:          info.GUID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         strings.Join(scopes, " "),
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		AuthTime:      info.AuthTime,
+		ACR:           info.ACR,
+		AMR:           info.AMR,
+		ExpiresAt:     time.Now().Add(authorizationCodeTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &AuthorizeResult{Redirect: s.redirect(redirectURI, url.Values{"code": {code}}, req.State)}, nil
+}
+
+// userSession checks that access is a session the user signed in to, the
+// only kind that may authorize clients. Tokens of /create and API keys
+// authenticate nobody, and tokens issued to a client or by a token exchange
+// would turn into a wider grant.
+func (s *OAuthService) userSession(access AccessRequest) (*AccessInfo, error) {
+	if access.MinACR == "" {
+		access.MinACR = ACRSingle
+	}
+	info, err := s.tokens.CheckAccess(access)
+	if err != nil {
+		return nil, err
+	}
+	if info.ClientID != "" || info.Act != nil || len(info.Audience) > 0 {
+		return nil, ErrNotUserSession
+	}
+	return info, nil
+}
+
+// Token handles the token endpoint. Failures are always *OAuthError.
+func (s *OAuthService) Token(req models.TokenRequest, ip, ua string) (*models.OAuthTokenResponse, error) {
+	ctx := context.Background()
+	client, oerr := s.authenticateClient(ctx, req)
+	if oerr != nil {
+		return nil, oerr
+	}
+	if client.DPoPBound && req.DPoP == "" && req.GrantType != "client_credentials" {
+		return nil, oauthError(http.StatusBadRequest, "invalid_dpop_proof", "The client must use DPoP")
+	}
+	if client.CertBound && req.ClientCert == nil {
+		return nil, oauthError(http.StatusBadRequest, "invalid_request", "The client must present its TLS certificate")
+	}
+
+	switch req.GrantType {
+	case "authorization_code", "refresh_token", "client_credentials", deviceCodeGrantType, tokenExchangeGrantType:
+		if !isSubset([]string{req.GrantType}, client.GrantTypes) {
+			return nil, oauthError(http.StatusBadRequest, "unauthorized_client", "The client may not use this grant type")
+		}
+	default:
+		return nil, oauthError(http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type")
+	}
+
+	switch req.GrantType {
+	case "authorization_code":
+		return s.exchangeCode(ctx, client, req, ip, ua)
+	case "refresh_token":
+		return s.refresh(client, req, ip, ua)
+	case deviceCodeGrantType:
+		return s.deviceCode(ctx, client, req, ip, ua)
+	case tokenExchangeGrantType:
+		return s.tokenExchange(ctx, client, req, ip, ua)
+	default:
+		return s.clientCredentials(client, req)
+	}
+}
+
+func (s *OAuthService) exchangeCode(ctx context.Context, client models.Client, req models.TokenRequest, ip, ua string) (*models.OAuthTokenResponse, error) {
+	invalid := oauthError(http.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+	hash := sha256Hex(req.Code)
+	code, err := s.db.GetAuthorizationCode(ctx, hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	if code.Used || time.Now().After(code.ExpiresAt) || code.ClientID != client.ID {
+		return nil, invalid
+	}
+	// RFC 6749 section 4.1.3: redirect_uri must repeat the one sent to
+	// /authorize, and only if one was sent.
+	if code.RedirectURI != "" && code.RedirectURI != req.RedirectURI {
+		return nil, invalid
+	}
+	if _, ok := matchRedirectURI(client, req.RedirectURI); code.RedirectURI == "" && req.RedirectURI != "" && !ok {
+		return nil, invalid
+	}
+	if !verifyPKCE(req.CodeVerifier, code.CodeChallenge) {
+		return nil, oauthError(http.StatusBadRequest, "invalid_grant", "PKCE verification failed")
+	}
+	rec := models.TokenRecord{
+		GUID:      code.GUID,
+		IP:        ip,
+		UserAgent: ua,
+		AuthTime:  code.AuthTime,
+		ACR:       code.ACR,
+		AMR:       code.AMR,
+		ClientID:  client.ID,
+		Scope:     code.Scope,
+	}
+	if err := s.tokens.bind(&rec, s.tokenProof(req)); err != nil {
+		return nil, bindError(err)
+	}
+	ok, err := s.db.ConsumeAuthorizationCode(ctx, hash)
+	if err != nil {
+		return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	if !ok {
+		return nil, invalid
+	}
+
+	pair, err := s.tokens.issue(rec)
+	if err != nil {
+		return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	return s.tokenResponse(pair, rec, code.Nonce)
+}
+
+func (s *OAuthService) refresh(client models.Client, req models.TokenRequest, ip, ua string) (*models.OAuthTokenResponse, error) {
+	pair, rec, status, err := s.tokens.refreshForClient(req.RefreshToken, client.ID, req.Scope, ip, ua, s.tokenProof(req))
+	if err != nil {
+		if errors.Is(err, ErrInvalidDPoPProof) || errors.As(err, new(*DPoPNonceError)) {
+			return nil, bindError(err)
+		}
+		if status == http.StatusInternalServerError {
+			return nil, oauthError(status, "server_error", err.Error())
+		}
+		if status == http.StatusForbidden {
+			return nil, oauthError(http.StatusBadRequest, "invalid_scope", err.Error())
+		}
+		return nil, oauthError(http.StatusBadRequest, "invalid_grant", err.Error())
+	}
+	return s.tokenResponse(pair, rec, "")
+}
+
+// refreshForClient rotates an OAuth refresh token of the form "<id>.<secret>"
+// that was issued to clientID, optionally narrowing its scope. Unlike
+// RefreshTokens it does not need the access token and does not pin the
+// User-Agent.
+func (s *Service) refreshForClient(refreshToken, clientID, scope, ip, ua string, proof Proof) (tokenPair, models.TokenRecord, int, error) {
+	idStr, secret, ok := strings.Cut(refreshToken, ".")
+	id, err := strconv.Atoi(idStr)
+	raw, b64err := base64.StdEncoding.DecodeString(secret)
+	if !ok || err != nil || b64err != nil {
+		return tokenPair{}, models.TokenRecord{}, http.StatusBadRequest, errors.New("Malformed refresh token")
+	}
+
+	rec, err := s.db.GetToken(context.Background(), id)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && rec.ClientID != clientID) {
+		return tokenPair{}, rec, http.StatusBadRequest, errors.New("Invalid refresh token")
+	}
+	if err != nil {
+		return tokenPair{}, rec, http.StatusInternalServerError, err
+	}
+
+	next := models.TokenRecord{
+		GUID:      rec.GUID,
+		IP:        ip,
+		UserAgent: ua,
+		AuthTime:  rec.AuthTime,
+		ACR:       rec.ACR,
+		AMR:       rec.AMR,
+		ClientID:  rec.ClientID,
+		Scope:     rec.Scope,
+		Audience:  rec.Audience,
+		Act:       rec.Act,
+		JKT:       rec.JKT,
+		X5T:       rec.X5T,
+	}
+	if scope != "" {
+		if !isSubset(strings.Fields(scope), strings.Fields(rec.Scope)) {
+			return tokenPair{}, rec, http.StatusForbidden, errors.New("Requested scope exceeds the original grant")
+		}
+		next.Scope = strings.Join(strings.Fields(scope), " ")
+	}
+	if err := s.bind(&next, proof); err != nil {
+		return tokenPair{}, rec, http.StatusBadRequest, err
+	}
+
+	pair, status, err := s.rotate(rec, raw, next)
+	return pair, next, status, err
+}
+
+func (s *OAuthService) redirect(redirectURI string, params url.Values, state string) string {
+	u, _ := url.Parse(redirectURI)
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if state != "" {
+		q.Set("state", state)
+	}
+	q.Set("iss", s.issuer)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// tokenResponse formats an issued pair and adds an ID token when the session
+// was granted the openid scope.
+func (s *OAuthService) tokenResponse(pair tokenPair, rec models.TokenRecord, nonce string) (*models.OAuthTokenResponse, error) {
+	resp := &models.OAuthTokenResponse{
+		AccessToken:  pair.Access,
+		TokenType:    tokenType(rec),
+		ExpiresIn:    int(s.tokens.policy.AccessTokenTTL.Seconds()),
+		RefreshToken: strconv.Itoa(pair.ID) + "." + pair.Refresh,
+		Scope:        pair.Scope,
+	}
+	if hasOpenIDScope(pair.Scope) {
+		idToken, err := s.idToken(rec, nonce, pair.Access)
+		if err != nil {
+			return nil, oauthError(http.StatusInternalServerError, "server_error", err.Error())
+		}
+		resp.IDToken = idToken
+	}
+	return resp, nil
+}
+
+// tokenProof is the proof-of-possession sent to the token endpoint. DPoP
+// proofs are always bound to a POST to issuer/token.
+func (s *OAuthService) tokenProof(req models.TokenRequest) Proof {
+	proof := Proof{DPoP: req.DPoP, Method: http.MethodPost, URL: s.issuer + "/token"}
+	if req.ClientCert != nil {
+		proof.CertThumbprint = CertificateThumbprint(req.ClientCert)
+	}
+	return proof
+}
+
+// bindError reports a failed DPoP check at the token endpoint.
+func bindError(err error) *OAuthError {
+	var nonceErr *DPoPNonceError
+	if errors.As(err, &nonceErr) {
+		oerr := oauthError(http.StatusBadRequest, "use_dpop_nonce", "Resend the request with the nonce from DPoP-Nonce")
+		oerr.DPoPNonce = nonceErr.Nonce
+		return oerr
+	}
+	if errors.Is(err, ErrInvalidDPoPProof) {
+		return oauthError(http.StatusBadRequest, "invalid_dpop_proof", err.Error())
+	}
+	if errors.Is(err, ErrCertificateBinding) {
+		return oauthError(http.StatusBadRequest, "invalid_grant", err.Error())
+	}
+	return oauthError(http.StatusInternalServerError, "server_error", err.Error())
+}
+
+// accessError reports a rejected access token with code, or with the DPoP
+// error when the token failed its proof-of-possession check.
+func accessError(err error, code string) *OAuthError {
+	if errors.Is(err, ErrInvalidDPoPProof) || errors.As(err, new(*DPoPNonceError)) {
+		oerr := bindError(err)
+		oerr.Status = http.StatusUnauthorized
+		return oerr
+	}
+	return oauthError(http.StatusUnauthorized, code, err.Error())
+}
+
+func tokenType(rec models.TokenRecord) string {
+	if rec.JKT != "" {
+		return "DPoP"
+	}
+	return "Bearer"
+}
+
+// matchRedirectURI requires an exact match with a registered URI. A client
+// with a single registered URI may omit it from the request.
+func matchRedirectURI(client models.Client, requested string) (string, bool) {
+	if requested == "" && len(client.RedirectURIs) == 1 {
+		return client.RedirectURIs[0], true
+	}
+	for _, uri := range client.RedirectURIs {
+		if uri == requested {
+			return uri, true
+		}
+	}
+	return "", false
+}
+
+// validateRedirectURI accepts https URIs, plain http only on loopback (RFC
+// 8252) and private-use schemes of native apps. Fragments are forbidden.
+func validateRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return errors.New("Invalid redirect URI: " + uri)
+	}
+	if u.Scheme == "http" {
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return errors.New("Plain http redirect URIs are only allowed for loopback: " + uri)
+		}
+	}
+	return nil
+}
+
+func verifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func sha256Hex(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func isSubset(values, of []string) bool {
+	for _, v := range values {
+		found := false
+		for _, o := range of {
+			if v == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
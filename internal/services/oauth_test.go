@@ -0,0 +1,356 @@
+package services
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// oauthStore adds clients, consents, authorization and device codes to
+// federationStore.
+type oauthStore struct {
+	*federationStore
+	clients  map[string]models.Client
+	consents map[string][]string // client id + " " + guid
+	codes    map[string]models.AuthorizationCode
+	devices  map[string]models.DeviceCode
+	failures map[int][]time.Time // wrong user codes by guid
+}
+
+func (s *oauthStore) InsertClient(ctx context.Context, c models.Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c.ID] = c
+	return nil
+}
+
+func (s *oauthStore) GetClient(ctx context.Context, id string) (models.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[id]
+	if !ok {
+		return c, pgx.ErrNoRows
+	}
+	return c, nil
+}
+
+func consentKey(guid int, clientID string) string {
+	return clientID + " " + strconv.Itoa(guid)
+}
+
+func (s *oauthStore) GetConsent(ctx context.Context, guid int, clientID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scopes, ok := s.consents[consentKey(guid, clientID)]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return scopes, nil
+}
+
+func (s *oauthStore) SaveConsent(ctx context.Context, guid int, clientID string, scopes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.consents[consentKey(guid, clientID)] = scopes
+	return nil
+}
+
+func (s *oauthStore) InsertAuthorizationCode(ctx context.Context, c models.AuthorizationCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[c.CodeHash] = c
+	return nil
+}
+
+func (s *oauthStore) GetAuthorizationCode(ctx context.Context, hash string) (models.AuthorizationCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.codes[hash]
+	if !ok {
+		return c, pgx.ErrNoRows
+	}
+	return c, nil
+}
+
+func (s *oauthStore) ConsumeAuthorizationCode(ctx context.Context, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.codes[hash]
+	if !ok || c.Used {
+		return false, nil
+	}
+	c.Used = true
+	s.codes[hash] = c
+	return true, nil
+}
+
+func (s *oauthStore) GetUser(ctx context.Context, guid int) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[guid]
+	if !ok {
+		return u, pgx.ErrNoRows
+	}
+	return u, nil
+}
+
+func (s *oauthStore) InsertDeviceCode(ctx context.Context, c models.DeviceCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.Status = "pending"
+	s.devices[c.DeviceCodeHash] = c
+	return nil
+}
+
+func (s *oauthStore) GetDeviceCode(ctx context.Context, hash string) (models.DeviceCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.devices[hash]
+	if !ok {
+		return c, pgx.ErrNoRows
+	}
+	return c, nil
+}
+
+func (s *oauthStore) GetDeviceCodeByUserCode(ctx context.Context, userCode string) (models.DeviceCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.devices {
+		if c.UserCode == userCode {
+			return c, nil
+		}
+	}
+	return models.DeviceCode{}, pgx.ErrNoRows
+}
+
+func (s *oauthStore) RecordDevicePoll(ctx context.Context, hash string, at time.Time, interval int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.devices[hash]
+	c.LastPolledAt, c.Interval = at, interval
+	s.devices[hash] = c
+	return nil
+}
+
+// setDeviceStatus moves the code with userCode from status from to to.
+func (s *oauthStore) setDeviceStatus(userCode, from, to string, change func(c *models.DeviceCode)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, c := range s.devices {
+		if c.UserCode == userCode && c.Status == from && time.Now().Before(c.ExpiresAt) {
+			c.Status = to
+			if change != nil {
+				change(&c)
+			}
+			s.devices[hash] = c
+			return true
+		}
+	}
+	return false
+}
+
+func (s *oauthStore) ApproveDeviceCode(ctx context.Context, userCode string, guid int, authTime time.Time, acr string, amr []string) (bool, error) {
+	return s.setDeviceStatus(userCode, "pending", "approved", func(c *models.DeviceCode) {
+		c.GUID, c.AuthTime, c.ACR, c.AMR = guid, authTime, acr, amr
+	}), nil
+}
+
+func (s *oauthStore) DenyDeviceCode(ctx context.Context, userCode string) (bool, error) {
+	return s.setDeviceStatus(userCode, "pending", "denied", nil), nil
+}
+
+func (s *oauthStore) ConsumeDeviceCode(ctx context.Context, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.devices[hash]
+	if !ok || c.Status != "approved" {
+		return false, nil
+	}
+	c.Status = "consumed"
+	s.devices[hash] = c
+	return true, nil
+}
+
+func (s *oauthStore) CountDeviceCodeFailuresSince(ctx context.Context, guid int, since time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, at := range s.failures[guid] {
+		if !at.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *oauthStore) RecordDeviceCodeFailure(ctx context.Context, guid int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[guid] = append(s.failures[guid], time.Now())
+	return nil
+}
+
+func (s *oauthStore) GetExchangePolicy(ctx context.Context, clientID string) (models.ExchangePolicy, error) {
+	return models.ExchangePolicy{}, pgx.ErrNoRows
+}
+
+func (s *oauthStore) SaveExchangePolicy(ctx context.Context, p models.ExchangePolicy) error {
+	return errors.New("Not supported")
+}
+
+func (s *oauthStore) GrantImpersonation(ctx context.Context, actorGUID, subjectGUID int) error {
+	return errors.New("Not supported")
+}
+
+func (s *oauthStore) CanImpersonate(ctx context.Context, actorGUID, subjectGUID int) (bool, error) {
+	return false, nil
+}
+
+var testSigningKey struct {
+	once sync.Once
+	key  *rsa.PrivateKey
+}
+
+const (
+	testUser        = 7
+	testRedirectURI = "https://app.example.com/callback"
+)
+
+// newTestOAuth returns an authorization server with the client "app" and
+// user testUser, whose role grants orders:read and orders:write.
+func newTestOAuth(t *testing.T) (*OAuthService, *oauthStore) {
+	testSigningKey.once.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		testSigningKey.key = key
+	})
+	db := &oauthStore{
+		federationStore: newFederationStore(),
+		clients:         map[string]models.Client{},
+		consents:        map[string][]string{},
+		codes:           map[string]models.AuthorizationCode{},
+		devices:         map[string]models.DeviceCode{},
+		failures:        map[int][]time.Time{},
+	}
+	ctx := context.Background()
+	db.users[testUser] = models.User{GUID: testUser}
+	if err := db.SaveRole(ctx, "clerk", []string{"orders:read", "orders:write"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AssignRole(ctx, testUser, "clerk"); err != nil {
+		t.Fatal(err)
+	}
+	db.clients["app"] = models.Client{
+		ID:           "app",
+		Name:         "App",
+		RedirectURIs: []string{testRedirectURI},
+		GrantTypes:   []string{"authorization_code", deviceCodeGrantType},
+		AuthMethod:   "none",
+	}
+	tokens := NewService(db.MemoryDatabase, "secret", nil, TokenPolicy{})
+	return NewOAuthService(db, tokens, "https://auth.example.com", testSigningKey.key), db
+}
+
+// bearer issues a session of testUser described by rec.
+func bearer(t *testing.T, s *OAuthService, rec models.TokenRecord) AccessRequest {
+	rec.GUID = testUser
+	rec.AuthTime = time.Now()
+	pair, err := s.tokens.issue(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return AccessRequest{Authorization: "Bearer " + pair.Access}
+}
+
+func TestAuthorizeOnlyForUserSessions(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		rec   models.TokenRecord
+		scope string // of the code, empty when refused
+	}{
+		{name: "signed-in session", rec: models.TokenRecord{ACR: ACRSingle}, scope: "openid orders:read orders:write"},
+		{name: "session limited to a scope", rec: models.TokenRecord{ACR: ACRSingle, Scope: "orders:read"}, scope: "openid orders:read"},
+		{name: "client token with a narrow scope", rec: models.TokenRecord{ACR: ACRSingle, ClientID: "other", Scope: "orders:read"}},
+		{name: "exchanged token", rec: models.TokenRecord{ACR: ACRSingle, Act: map[string]interface{}{"client_id": "other"}}},
+		{name: "/create token", rec: models.TokenRecord{ACR: ACRNone}},
+		{name: "API key token", rec: models.TokenRecord{ACR: ACRNone, AMR: []string{apiKeyMethod}, Scope: "orders:read"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, db := newTestOAuth(t)
+			res, err := s.Authorize(bearer(t, s, tc.rec), models.AuthorizeRequest{
+				ResponseType:        "code",
+				ClientID:            "app",
+				RedirectURI:         testRedirectURI,
+				Scope:               "openid orders:read orders:write",
+				CodeChallenge:       "challenge",
+				CodeChallengeMethod: "S256",
+				Consent:             "approve",
+			})
+			if tc.scope == "" {
+				var oerr *OAuthError
+				if !errors.As(err, &oerr) || oerr.Status != http.StatusUnauthorized {
+					t.Fatalf("got %+v, %v, want login_required", res, err)
+				}
+				if len(db.codes) != 0 || len(db.consents) != 0 {
+					t.Fatal("refused request left a code or consent behind")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(res.Redirect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, ok := db.codes[sha256Hex(u.Query().Get("code"))]
+			if !ok || code.Scope != tc.scope {
+				t.Fatalf("code %+v from %s, want scope %q", code, res.Redirect, tc.scope)
+			}
+		})
+	}
+}
+
+func TestVerifyDeviceLimitsWrongUserCodes(t *testing.T) {
+	s, db := newTestOAuth(t)
+	resp, err := s.DeviceAuthorization(models.TokenRequest{ClientID: "app", Scope: "orders:read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	access := bearer(t, s, models.TokenRecord{ACR: ACRSingle})
+
+	for i := 0; i < deviceCodeMaxFailures; i++ {
+		var oerr *OAuthError
+		err := s.VerifyDevice(access, "BCDF-GHJK", "approve")
+		if !errors.As(err, &oerr) || oerr.Status != http.StatusBadRequest {
+			t.Fatalf("guess %d: got %v, want invalid_grant", i, err)
+		}
+	}
+	var oerr *OAuthError
+	if _, err := s.DeviceInfo(access, resp.UserCode); !errors.As(err, &oerr) || oerr.Status != http.StatusTooManyRequests {
+		t.Fatalf("got %v after %d wrong codes, want too many requests", err, deviceCodeMaxFailures)
+	}
+	if err := s.VerifyDevice(access, resp.UserCode, "approve"); !errors.As(err, &oerr) || oerr.Status != http.StatusTooManyRequests {
+		t.Fatalf("got %v after %d wrong codes, want too many requests", err, deviceCodeMaxFailures)
+	}
+
+	// The lockout lasts as long as a device code lives.
+	db.failures[testUser] = []time.Time{time.Now().Add(-deviceCodeTTL - time.Second)}
+	if err := s.VerifyDevice(access, resp.UserCode, "approve"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := db.GetDeviceCodeByUserCode(context.Background(), normalizeUserCode(resp.UserCode)); err != nil || c.Status != "approved" {
+		t.Fatalf("got %+v, %v, want an approved code", c, err)
+	}
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"GoAuthentication/internal/jwk"
+	"GoAuthentication/internal/models"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const idTokenTTL = time.Hour
+
+// Discovery returns the OpenID Provider metadata served at
+// /.well-known/openid-configuration.
+func (s *OAuthService) Discovery() models.OpenIDConfiguration {
+	return models.OpenIDConfiguration{
+		Issuer:                           s.issuer,
+		AuthorizationEndpoint:            s.issuer + "/authorize",
+		TokenEndpoint:                    s.issuer + "/token",
+		UserinfoEndpoint:                 s.issuer + "/userinfo",
+		JWKSURI:                          s.issuer + "/.well-known/jwks.json",
+		ScopesSupported:                  []string{"openid", "profile", "email"},
+		ResponseTypesSupported:           []string{"code"},
+		ResponseModesSupported:           []string{"query"},
+		GrantTypesSupported:              supportedGrantTypes,
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: []string{
+			AuthMethodSecretBasic, AuthMethodSecretPost, AuthMethodPrivateKeyJWT,
+			AuthMethodTLS, AuthMethodSelfSignedTLS, AuthMethodNone,
+		},
+		TokenEndpointAuthSigningAlgValuesSupported: []string{"RS256", "PS256", "ES256"},
+		ClaimsSupported: []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "acr", "amr", "at_hash",
+			"name", "given_name", "family_name", "updated_at", "email", "email_verified",
+		},
+		CodeChallengeMethodsSupported:              []string{"S256"},
+		ACRValuesSupported:                         []string{ACRNone, ACRSingle, ACRStepUp},
+		AuthorizationResponseISSParameterSupported: true,
+		DPoPSigningAlgValuesSupported:              []string{"RS256", "PS256", "ES256"},
+		TLSClientCertificateBoundAccessTokens:      true,
+		IntrospectionEndpoint:                      s.issuer + "/introspect",
+	}
+}
+
+func (s *OAuthService) JWKS() jwk.Set {
+	key, _ := jwk.FromPublicKey(&s.signingKey.PublicKey)
+	key.Kid = s.keyID
+	key.Use = "sig"
+	key.Alg = "RS256"
+	return jwk.Set{Keys: []jwk.Key{key}}
+}
+
+// UserInfo returns the claims of the user behind the access token that its
+// scope allows. Tokens issued outside of OAuth (by /create or the email
+// login) belong to first-party apps and see every claim.
+func (s *OAuthService) UserInfo(access AccessRequest) (*models.UserInfoResponse, error) {
+	info, err := s.tokens.CheckAccess(access)
+	if err != nil {
+		return nil, accessError(err, "invalid_token")
+	}
+	scopes := strings.Fields(info.Scope)
+	firstParty := info.ClientID == ""
+	if !firstParty && !isSubset([]string{"openid"}, scopes) {
+		return nil, oauthError(http.StatusForbidden, "insufficient_scope", "The openid scope is required")
+	}
+
+	user, err := s.db.GetUser(context.Background(), info.GUID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	resp := &models.UserInfoResponse{Sub: strconv.Itoa(info.GUID)}
+	if firstParty || isSubset([]string{"profile"}, scopes) {
+		resp.Name = user.Name
+		resp.GivenName = user.GivenName
+		resp.FamilyName = user.FamilyName
+		if !user.UpdatedAt.IsZero() {
+			resp.UpdatedAt = user.UpdatedAt.Unix()
+		}
+	}
+	if (firstParty || isSubset([]string{"email"}, scopes)) && user.Email != "" {
+		resp.Email = user.Email
+		resp.EmailVerified = &user.EmailVerified
+	}
+	return resp, nil
+}
+
+// idToken signs an OpenID Connect ID token for a session issued to the client
+// together with accessToken.
+func (s *OAuthService) idToken(rec models.TokenRecord, nonce, accessToken string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       s.issuer,
+		"sub":       strconv.Itoa(rec.GUID),
+		"aud":       rec.ClientID,
+		"azp":       rec.ClientID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(idTokenTTL).Unix(),
+		"auth_time": rec.AuthTime.Unix(),
+		"acr":       rec.ACR,
+		"amr":       rec.AMR,
+		"at_hash":   atHash(accessToken),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = s.keyID
+	return token.SignedString(s.signingKey)
+}
+
+// atHash is the base64url encoded left half of the SHA-256 hash of the
+// access token, as required for RS256 ID tokens.
+func atHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+func hasOpenIDScope(scope string) bool {
+	return isSubset([]string{"openid"}, strings.Fields(scope))
+}
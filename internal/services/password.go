@@ -0,0 +1,128 @@
+package services
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/models"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ldapProvider is the provider key of directory accounts among the linked
+// external identities.
+const ldapProvider = "ldap"
+
+var ErrInvalidCredentials = errors.New("Invalid username or password")
+
+// Authenticator verifies a username and password against a user directory.
+// It returns ErrInvalidCredentials when they do not match.
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (DirectoryUser, error)
+}
+
+// DirectoryUser is an account of a user directory. ID identifies it for
+// good, e.g. its DN.
+type DirectoryUser struct {
+	ID         string
+	Email      string
+	Name       string
+	GivenName  string
+	FamilyName string
+	Groups     []string
+}
+
+type PasswordLoginInterface interface {
+	Login(username, password, ip, ua string, proof Proof) (access, refresh string, status int, err error)
+}
+
+// PasswordLoginService signs users in with the password of a directory
+// account. The account is linked to a local user, whose roles follow the
+// directory groups listed in groupRoles.
+type PasswordLoginService struct {
+	db         database.PasswordLoginStore
+	tokens     *Service
+	auth       Authenticator
+	groupRoles map[string]string
+}
+
+// NewPasswordLoginService creates the service; auth may be nil when no
+// directory is configured. groupRoles maps group DNs to role names.
+func NewPasswordLoginService(db database.PasswordLoginStore, tokens *Service, auth Authenticator, groupRoles map[string]string) *PasswordLoginService {
+	return &PasswordLoginService{db: db, tokens: tokens, auth: auth, groupRoles: groupRoles}
+}
+
+func (s *PasswordLoginService) Login(username, password, ip, ua string, proof Proof) (string, string, int, error) {
+	if s.auth == nil {
+		return "", "", http.StatusNotFound, errors.New("Password login is not configured")
+	}
+	ctx := context.Background()
+	rec := models.TokenRecord{
+		IP:        ip,
+		UserAgent: ua,
+		AuthTime:  time.Now(),
+		ACR:       ACRSingle,
+		AMR:       []string{"pwd"},
+	}
+	if err := s.tokens.bind(&rec, proof); err != nil {
+		return "", "", http.StatusBadRequest, err
+	}
+
+	account, err := s.auth.Authenticate(ctx, username, password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		return "", "", http.StatusUnauthorized, err
+	}
+	if err != nil {
+		return "", "", http.StatusBadGateway, err
+	}
+	user := models.User{
+		Email:      account.Email,
+		Name:       account.Name,
+		GivenName:  account.GivenName,
+		FamilyName: account.FamilyName,
+	}
+	// The directory belongs to the deployment, so its addresses are trusted.
+	guid, err := linkExternalUser(ctx, s.db, ldapProvider, account.ID, user, true)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	if err := s.syncRoles(ctx, guid, account.Groups); err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+
+	rec.GUID = guid
+	pair, err := s.tokens.issue(rec)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	return pair.Access, pair.Refresh, http.StatusOK, nil
+}
+
+// syncRoles assigns the roles mapped from the user's groups and revokes the
+// mapped roles the user has lost. Roles assigned by hand are left alone.
+func (s *PasswordLoginService) syncRoles(ctx context.Context, guid int, groups []string) error {
+	granted := map[string]bool{}
+	for group, role := range s.groupRoles {
+		if _, ok := granted[role]; !ok {
+			granted[role] = false
+		}
+		for _, g := range groups {
+			if strings.EqualFold(g, group) {
+				granted[role] = true
+			}
+		}
+	}
+	for role, member := range granted {
+		var err error
+		if member {
+			err = s.db.AssignRole(ctx, guid, role)
+		} else {
+			err = s.db.RevokeRole(ctx, guid, role)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// refreshHashV1 prefixes refresh hashes made with hashRefresh. Sessions
+// issued before it hold bcrypt hashes ("$2a$..."), which are still accepted
+// and replaced by the new scheme when the session is rotated.
+const refreshHashV1 = "h1$"
+
+// hashRefresh keys the refresh secret with the pepper. Refresh secrets are 32
+// random bytes, so a fast keyed digest is as good as a slow password hash
+// and keeps /create and /refresh cheap.
+func (s *Service) hashRefresh(raw []byte) string {
+	mac := hmac.New(sha256.New, []byte(s.pepper))
+	mac.Write([]byte("refresh:"))
+	mac.Write(raw)
+	return refreshHashV1 + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkRefresh reports whether raw matches a stored hash of either scheme.
+func (s *Service) checkRefresh(hash string, raw []byte) bool {
+	if strings.HasPrefix(hash, refreshHashV1) {
+		return hmac.Equal([]byte(hash), []byte(s.hashRefresh(raw)))
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), raw) == nil
+}
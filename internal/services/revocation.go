@@ -0,0 +1,279 @@
+package services
+
+import (
+	"GoAuthentication/internal/database"
+	"container/list"
+	"context"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RevocationCache remembers whether sessions are revoked, so that checking
+// an access token does not cost a database round trip. Sessions found
+// active are cached too, for at most the cache's TTL: a revocation that
+// reaches the cache is visible at once, any other one within the TTL.
+type RevocationCache interface {
+	// Revoked reports the cached state of session id; ok is false on a miss.
+	Revoked(ctx context.Context, id int) (revoked, ok bool, err error)
+	// Store caches the state of session id of user guid read from the
+	// database. An active state never replaces a revoked one.
+	Store(ctx context.Context, id, guid int, revoked bool) error
+	// RevokeUser marks every cached session of guid revoked.
+	RevokeUser(ctx context.Context, guid int) error
+}
+
+// sessionRevoked looks the session up in the cache before the database and
+// caches what the database says.
+func (s *Service) sessionRevoked(ctx context.Context, id, guid int) (bool, error) {
+	cache := s.policy.Revocations
+	if cache != nil {
+		if revoked, ok, err := cache.Revoked(ctx, id); err == nil && ok {
+			return revoked, nil
+		}
+	}
+	_, status, err := s.db.GetRefresh(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	revoked := status == "blocked"
+	if cache != nil {
+		// A failing cache only costs the next lookup a round trip.
+		cache.Store(ctx, id, guid, revoked)
+	}
+	return revoked, nil
+}
+
+// revokeUser blocks every session of guid, in the database first. A cache
+// error is still returned, since cached sessions stay usable until they
+// expire.
+func (s *Service) revokeUser(ctx context.Context, guid int) error {
+	if err := s.db.InvalidateAllRefreshForGUID(ctx, guid); err != nil {
+		return err
+	}
+	if s.policy.Revocations == nil {
+		return nil
+	}
+	return s.policy.Revocations.RevokeUser(ctx, guid)
+}
+
+// LRURevocationCache keeps the most recently used sessions in memory. By
+// itself it only sees revocations made by this process; see
+// app.ListenRevocations for the others.
+type LRURevocationCache struct {
+	state  *lruState
+	tenant string
+}
+
+type lruState struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // of *lruEntry, most recently used first
+	entries map[lruKey]*list.Element
+	users   map[lruUser]map[int]bool // sessions cached per user
+}
+
+type lruKey struct {
+	tenant string
+	id     int
+}
+
+type lruUser struct {
+	tenant string
+	guid   int
+}
+
+type lruEntry struct {
+	key     lruKey
+	guid    int
+	revoked bool
+	expires time.Time
+}
+
+// NewLRURevocationCache caches up to size sessions for ttl each.
+func NewLRURevocationCache(size int, ttl time.Duration) *LRURevocationCache {
+	return &LRURevocationCache{
+		state: &lruState{
+			size:    size,
+			ttl:     ttl,
+			order:   list.New(),
+			entries: map[lruKey]*list.Element{},
+			users:   map[lruUser]map[int]bool{},
+		},
+		tenant: database.DefaultTenant,
+	}
+}
+
+// ForTenant returns a view of the same cache restricted to tenant.
+func (c *LRURevocationCache) ForTenant(tenant string) *LRURevocationCache {
+	return &LRURevocationCache{state: c.state, tenant: tenant}
+}
+
+func (c *LRURevocationCache) Revoked(ctx context.Context, id int) (bool, bool, error) {
+	st := c.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	el, ok := st.entries[lruKey{c.tenant, id}]
+	if !ok {
+		return false, false, nil
+	}
+	e := el.Value.(*lruEntry)
+	if time.Now().After(e.expires) {
+		st.remove(el)
+		return false, false, nil
+	}
+	st.order.MoveToFront(el)
+	return e.revoked, true, nil
+}
+
+func (c *LRURevocationCache) Store(ctx context.Context, id, guid int, revoked bool) error {
+	st := c.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := lruKey{c.tenant, id}
+	if el, ok := st.entries[key]; ok {
+		e := el.Value.(*lruEntry)
+		if e.revoked && !revoked {
+			return nil
+		}
+		e.revoked = revoked
+		e.expires = time.Now().Add(st.ttl)
+		st.order.MoveToFront(el)
+		return nil
+	}
+	st.entries[key] = st.order.PushFront(&lruEntry{key: key, guid: guid, revoked: revoked, expires: time.Now().Add(st.ttl)})
+	user := lruUser{c.tenant, guid}
+	if st.users[user] == nil {
+		st.users[user] = map[int]bool{}
+	}
+	st.users[user][id] = true
+	for st.order.Len() > st.size {
+		st.remove(st.order.Back())
+	}
+	return nil
+}
+
+func (c *LRURevocationCache) RevokeUser(ctx context.Context, guid int) error {
+	st := c.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for id := range st.users[lruUser{c.tenant, guid}] {
+		e := st.entries[lruKey{c.tenant, id}].Value.(*lruEntry)
+		e.revoked = true
+		e.expires = time.Now().Add(st.ttl)
+	}
+	return nil
+}
+
+// EvictUser forgets the cached sessions of guid, so that they are read from
+// the database again.
+func (c *LRURevocationCache) EvictUser(guid int) {
+	st := c.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for id := range st.users[lruUser{c.tenant, guid}] {
+		st.remove(st.entries[lruKey{c.tenant, id}])
+	}
+}
+
+// EvictSession forgets the cached state of session id.
+func (c *LRURevocationCache) EvictSession(id int) {
+	st := c.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if el, ok := st.entries[lruKey{c.tenant, id}]; ok {
+		st.remove(el)
+	}
+}
+
+// Clear forgets every cached session of every tenant.
+func (c *LRURevocationCache) Clear() {
+	st := c.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.order.Init()
+	st.entries = map[lruKey]*list.Element{}
+	st.users = map[lruUser]map[int]bool{}
+}
+
+func (st *lruState) remove(el *list.Element) {
+	e := st.order.Remove(el).(*lruEntry)
+	delete(st.entries, e.key)
+	user := lruUser{e.key.tenant, e.guid}
+	delete(st.users[user], e.key.id)
+	if len(st.users[user]) == 0 {
+		delete(st.users, user)
+	}
+}
+
+// RedisRevocationCache shares cached sessions between instances, so that a
+// revocation made by one of them is seen by all. Sessions are kept under
+// <prefix><tenant>:session:<id> and the sessions cached for a user in the
+// set <prefix><tenant>:user:<guid>.
+type RedisRevocationCache struct {
+	client redis.UniversalClient
+	prefix string
+	tenant string
+	ttl    time.Duration
+}
+
+// NewRedisRevocationCache caches sessions in Redis for ttl each.
+func NewRedisRevocationCache(client redis.UniversalClient, prefix string, ttl time.Duration) *RedisRevocationCache {
+	return &RedisRevocationCache{client: client, prefix: prefix, tenant: database.DefaultTenant, ttl: ttl}
+}
+
+// ForTenant returns a view of the same cache restricted to tenant.
+func (c *RedisRevocationCache) ForTenant(tenant string) *RedisRevocationCache {
+	return &RedisRevocationCache{client: c.client, prefix: c.prefix, tenant: tenant, ttl: c.ttl}
+}
+
+func (c *RedisRevocationCache) sessionKey(id int) string {
+	return c.prefix + c.tenant + ":session:" + strconv.Itoa(id)
+}
+
+func (c *RedisRevocationCache) userKey(guid int) string {
+	return c.prefix + c.tenant + ":user:" + strconv.Itoa(guid)
+}
+
+func (c *RedisRevocationCache) Revoked(ctx context.Context, id int) (bool, bool, error) {
+	v, err := c.client.Get(ctx, c.sessionKey(id)).Result()
+	if err == redis.Nil {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return v == "1", true, nil
+}
+
+// Store only sets an active state if the session is not cached yet, so it
+// can not undo a concurrent RevokeUser.
+func (c *RedisRevocationCache) Store(ctx context.Context, id, guid int, revoked bool) error {
+	_, err := c.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		if revoked {
+			p.Set(ctx, c.sessionKey(id), "1", c.ttl)
+		} else {
+			p.SetNX(ctx, c.sessionKey(id), "0", c.ttl)
+		}
+		p.SAdd(ctx, c.userKey(guid), id)
+		p.Expire(ctx, c.userKey(guid), c.ttl)
+		return nil
+	})
+	return err
+}
+
+func (c *RedisRevocationCache) RevokeUser(ctx context.Context, guid int) error {
+	ids, err := c.client.SMembers(ctx, c.userKey(guid)).Result()
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	_, err = c.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, id := range ids {
+			p.Set(ctx, c.prefix+c.tenant+":session:"+id, "1", c.ttl)
+		}
+		return nil
+	})
+	return err
+}
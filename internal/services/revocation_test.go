@@ -0,0 +1,186 @@
+package services
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/models"
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+const testCacheTTL = time.Minute
+
+// revocationCaches returns an LRU cache and a Redis cache backed by an
+// in-process Redis, together with a way to let ttl pass for each.
+func revocationCaches(t *testing.T) map[string]struct {
+	cache   RevocationCache
+	advance func(time.Duration)
+} {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	lru := NewLRURevocationCache(100, testCacheTTL)
+	return map[string]struct {
+		cache   RevocationCache
+		advance func(time.Duration)
+	}{
+		"lru": {lru, func(d time.Duration) {
+			// Entries expire by the wall clock; age them instead of sleeping.
+			lru.state.mu.Lock()
+			defer lru.state.mu.Unlock()
+			for el := lru.state.order.Front(); el != nil; el = el.Next() {
+				el.Value.(*lruEntry).expires = el.Value.(*lruEntry).expires.Add(-d)
+			}
+		}},
+		"redis": {NewRedisRevocationCache(client, "test:", testCacheTTL), mr.FastForward},
+	}
+}
+
+func wantCached(t *testing.T, cache RevocationCache, id int, wantRevoked, wantOK bool) {
+	t.Helper()
+	revoked, ok, err := cache.Revoked(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked != wantRevoked || ok != wantOK {
+		t.Fatalf("session %d: revoked %v, cached %v; want %v, %v", id, revoked, ok, wantRevoked, wantOK)
+	}
+}
+
+func TestRevocationCacheStore(t *testing.T) {
+	ctx := context.Background()
+	for name, c := range revocationCaches(t) {
+		t.Run(name, func(t *testing.T) {
+			wantCached(t, c.cache, 1, false, false)
+			if err := c.cache.Store(ctx, 1, 7, false); err != nil {
+				t.Fatal(err)
+			}
+			wantCached(t, c.cache, 1, false, true)
+			if err := c.cache.Store(ctx, 2, 7, true); err != nil {
+				t.Fatal(err)
+			}
+			wantCached(t, c.cache, 2, true, true)
+			// An active state read late must not undo a revocation.
+			if err := c.cache.Store(ctx, 2, 7, false); err != nil {
+				t.Fatal(err)
+			}
+			wantCached(t, c.cache, 2, true, true)
+		})
+	}
+}
+
+func TestRevocationCacheRevokeUser(t *testing.T) {
+	ctx := context.Background()
+	for name, c := range revocationCaches(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, s := range []struct{ id, guid int }{{1, 7}, {2, 7}, {3, 8}} {
+				if err := c.cache.Store(ctx, s.id, s.guid, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.cache.RevokeUser(ctx, 7); err != nil {
+				t.Fatal(err)
+			}
+			wantCached(t, c.cache, 1, true, true)
+			wantCached(t, c.cache, 2, true, true)
+			wantCached(t, c.cache, 3, false, true)
+			if err := c.cache.RevokeUser(ctx, 9); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRevocationCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	for name, c := range revocationCaches(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := c.cache.Store(ctx, 1, 7, false); err != nil {
+				t.Fatal(err)
+			}
+			c.advance(testCacheTTL / 2)
+			wantCached(t, c.cache, 1, false, true)
+			c.advance(testCacheTTL)
+			wantCached(t, c.cache, 1, false, false)
+		})
+	}
+}
+
+// cachedService issues a session of user 7 with cache in front of an
+// in-memory database.
+func cachedService(t *testing.T, cache RevocationCache) (*Service, *database.MemoryDatabase, int) {
+	db := database.NewMemoryDatabase()
+	id, err := db.InsertToken(context.Background(), models.TokenRecord{GUID: 7, AuthTime: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewService(db, "secret", nil, TokenPolicy{Revocations: cache}), db, id
+}
+
+func TestSessionRevokedWriteThrough(t *testing.T) {
+	ctx := context.Background()
+	for name, c := range revocationCaches(t) {
+		t.Run(name, func(t *testing.T) {
+			s, _, id := cachedService(t, c.cache)
+			if revoked, err := s.sessionRevoked(ctx, id, 7); err != nil || revoked {
+				t.Fatalf("fresh session: revoked %v, %v", revoked, err)
+			}
+			wantCached(t, c.cache, id, false, true)
+			if err := s.revokeUser(ctx, 7); err != nil {
+				t.Fatal(err)
+			}
+			wantCached(t, c.cache, id, true, true)
+			if revoked, err := s.sessionRevoked(ctx, id, 7); err != nil || !revoked {
+				t.Fatalf("after logout: revoked %v, %v", revoked, err)
+			}
+		})
+	}
+}
+
+func TestSessionRevokedNegativeCaching(t *testing.T) {
+	ctx := context.Background()
+	for name, c := range revocationCaches(t) {
+		t.Run(name, func(t *testing.T) {
+			s, db, id := cachedService(t, c.cache)
+			if revoked, err := s.sessionRevoked(ctx, id, 7); err != nil || revoked {
+				t.Fatalf("fresh session: revoked %v, %v", revoked, err)
+			}
+			// Revoked behind the cache's back: the active state is served
+			// until it expires.
+			if err := db.InvalidateAllRefreshForGUID(ctx, 7); err != nil {
+				t.Fatal(err)
+			}
+			if revoked, err := s.sessionRevoked(ctx, id, 7); err != nil || revoked {
+				t.Fatalf("within the TTL: revoked %v, %v", revoked, err)
+			}
+			c.advance(2 * testCacheTTL)
+			if revoked, err := s.sessionRevoked(ctx, id, 7); err != nil || !revoked {
+				t.Fatalf("after the TTL: revoked %v, %v", revoked, err)
+			}
+		})
+	}
+}
+
+func TestSessionRevokedRedisUnavailable(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	defer client.Close()
+	cache := NewRedisRevocationCache(client, "test:", testCacheTTL)
+	s, _, id := cachedService(t, cache)
+	mr.Close()
+
+	if revoked, err := s.sessionRevoked(ctx, id, 7); err != nil || revoked {
+		t.Fatalf("fresh session: revoked %v, %v", revoked, err)
+	}
+	// The database is revoked even though the cache can not be told.
+	if err := s.revokeUser(ctx, 7); err == nil {
+		t.Fatal("revokeUser hid the cache failure")
+	}
+	if revoked, err := s.sessionRevoked(ctx, id, 7); err != nil || !revoked {
+		t.Fatalf("after logout: revoked %v, %v", revoked, err)
+	}
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"GoAuthentication/internal/models"
+	"context"
+	"errors"
+	"strings"
+)
+
+// identityScopes only select OpenID Connect claims and are not permissions,
+// so every user may grant them.
+var identityScopes = []string{"openid", "profile", "email"}
+
+var ErrInsufficientScope = errors.New("Insufficient scope")
+
+// HasScope reports whether the token was granted every one of scopes.
+func (i *AccessInfo) HasScope(scopes ...string) bool {
+	return isSubset(scopes, strings.Fields(i.Scope))
+}
+
+// SaveRole creates a role or replaces its permissions.
+func (s *Service) SaveRole(role string, permissions []string) error {
+	if role == "" {
+		return errors.New("Role name is required")
+	}
+	if permissions == nil {
+		permissions = []string{}
+	}
+	return s.db.SaveRole(context.Background(), role, permissions)
+}
+
+// AssignRole grants the user a role. Tokens pick it up when they are issued
+// or refreshed next.
+func (s *Service) AssignRole(guid int, role string) error {
+	return s.db.AssignRole(context.Background(), guid, role)
+}
+
+// RevokeRole takes a role away. Access tokens issued before keep their scope
+// until they expire; refreshing them drops it.
+func (s *Service) RevokeRole(guid int, role string) error {
+	return s.db.RevokeRole(context.Background(), guid, role)
+}
+
+// grantedScope returns the scope a token for rec may actually carry and the
+// user's roles. Requested scopes are intersected with the identity scopes
+// and the permissions of the user's roles; first-party sessions that did not
+// ask for a scope get every permission. Sessions of /create authenticate
+// nobody, so they get neither permissions nor roles; API keys keep the
+// scopes they were created with.
+func (s *Service) grantedScope(ctx context.Context, rec models.TokenRecord) (string, []string, error) {
+	if rec.ACR == ACRNone && !isSubset([]string{apiKeyMethod}, rec.AMR) {
+		return strings.Join(intersect(strings.Fields(rec.Scope), identityScopes), " "), []string{}, nil
+	}
+	roles, permissions, err := s.db.GetUserRoles(ctx, rec.GUID)
+	if err != nil {
+		return "", nil, err
+	}
+	if roles == nil {
+		roles = []string{}
+	}
+	if rec.Scope == "" && rec.ClientID == "" {
+		return strings.Join(permissions, " "), roles, nil
+	}
+	return strings.Join(intersect(strings.Fields(rec.Scope), grantable(permissions)), " "), roles, nil
+}
+
+// grantableScopes drops the scopes the user could not grant from a request.
+func (s *Service) grantableScopes(ctx context.Context, guid int, scopes []string) ([]string, error) {
+	_, permissions, err := s.db.GetUserRoles(ctx, guid)
+	if err != nil {
+		return nil, err
+	}
+	return intersect(scopes, grantable(permissions)), nil
+}
+
+func grantable(permissions []string) []string {
+	return append(append([]string(nil), identityScopes...), permissions...)
+}
@@ -0,0 +1,298 @@
+package services
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/models"
+	"GoAuthentication/internal/saml"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// samlClockSkew is how far the identity provider's clock may be off.
+const samlClockSkew = 2 * time.Minute
+
+// defaultSAMLAttributes name the attributes user claims are read from when
+// the provider does not map them.
+var defaultSAMLAttributes = map[string]string{
+	"email":       "email",
+	"name":        "name",
+	"given_name":  "given_name",
+	"family_name": "family_name",
+}
+
+type SAMLInterface interface {
+	Metadata(providerID string) (metadata []byte, status int, err error)
+	StartLogin(providerID string) (redirect string, status int, err error)
+	CompleteLogin(providerID, samlResponse, relayState, ip, ua string, proof Proof) (access, refresh string, status int, err error)
+}
+
+// SAMLService signs users in with SAML 2.0 identity providers. This server
+// is the service provider: it sends AuthnRequests with the HTTP-Redirect
+// binding and accepts signed assertions posted back to its assertion
+// consumer service. Only logins it started are accepted.
+type SAMLService struct {
+	db     database.SAMLStore
+	tokens *Service
+	issuer string
+}
+
+func NewSAMLService(db database.SAMLStore, tokens *Service, issuer string) *SAMLService {
+	return &SAMLService{db: db, tokens: tokens, issuer: strings.TrimRight(issuer, "/")}
+}
+
+// SaveProvider registers a SAML identity provider or replaces its settings.
+func (s *SAMLService) SaveProvider(p models.SAMLProvider) error {
+	if p.ID == "" || p.EntityID == "" || p.SSOURL == "" {
+		return errors.New("Provider id, entity id and SSO URL are required")
+	}
+	if strings.ContainsAny(p.ID, ":/") {
+		return errors.New("Provider id must not contain : or /")
+	}
+	if _, err := parseCertificate(p.Certificate); err != nil {
+		return err
+	}
+	if p.Attributes == nil {
+		p.Attributes = map[string]string{}
+	}
+	return s.db.SaveSAMLProvider(context.Background(), p)
+}
+
+// EntityID is the entity id of this service provider towards providerID,
+// which is also the URL of its metadata.
+func (s *SAMLService) EntityID(providerID string) string {
+	return s.issuer + "/saml/" + url.PathEscape(providerID) + "/metadata"
+}
+
+// ACSURL is the assertion consumer service for providerID.
+func (s *SAMLService) ACSURL(providerID string) string {
+	return s.issuer + "/saml/" + url.PathEscape(providerID) + "/acs"
+}
+
+// Metadata returns the SP metadata to import into the identity provider.
+func (s *SAMLService) Metadata(providerID string) ([]byte, int, error) {
+	p, status, err := s.provider(context.Background(), providerID)
+	if err != nil {
+		return nil, status, err
+	}
+	data, err := xml.MarshalIndent(saml.NewMetadata(s.EntityID(p.ID), s.ACSURL(p.ID)), "", "  ")
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return append([]byte(xml.Header), data...), http.StatusOK, nil
+}
+
+// StartLogin remembers the id of a new AuthnRequest under a fresh RelayState
+// and returns the provider's SSO URL carrying both.
+func (s *SAMLService) StartLogin(providerID string) (string, int, error) {
+	ctx := context.Background()
+	p, status, err := s.provider(ctx, providerID)
+	if err != nil {
+		return "", status, err
+	}
+	raw := make([]byte, 48)
+	if _, err := rand.Read(raw); err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	// Request ids must be XML names, so they may not start with a digit.
+	requestID := "_" + hex.EncodeToString(raw[:16])
+	relayState := base64.RawURLEncoding.EncodeToString(raw[16:])
+
+	err = s.db.InsertFederationState(ctx, models.FederationState{
+		StateHash:  sha256Hex(relayState),
+		ProviderID: samlProviderKey(p.ID),
+		Nonce:      requestID,
+		ExpiresAt:  time.Now().Add(federationStateTTL),
+	})
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+
+	request, err := saml.NewAuthnRequest(requestID, s.EntityID(p.ID), s.ACSURL(p.ID), p.SSOURL, time.Now()).RedirectValue()
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	query := url.Values{"SAMLRequest": {request}, "RelayState": {relayState}}
+	sep := "?"
+	if strings.Contains(p.SSOURL, "?") {
+		sep = "&"
+	}
+	return p.SSOURL + sep + query.Encode(), http.StatusFound, nil
+}
+
+// CompleteLogin verifies a SAMLResponse posted to the assertion consumer
+// service, links the asserted subject to a local user and returns a token
+// pair for that user.
+func (s *SAMLService) CompleteLogin(providerID, samlResponse, relayState, ip, ua string, proof Proof) (string, string, int, error) {
+	ctx := context.Background()
+	if samlResponse == "" || relayState == "" {
+		return "", "", http.StatusBadRequest, errors.New("SAMLResponse and RelayState are required")
+	}
+	p, status, err := s.provider(ctx, providerID)
+	if err != nil {
+		return "", "", status, err
+	}
+	rec := models.TokenRecord{
+		IP:        ip,
+		UserAgent: ua,
+		AuthTime:  time.Now(),
+		ACR:       ACRSingle,
+		AMR:       []string{"fed"},
+	}
+	// The proof is checked first so that a bad one does not burn the state.
+	if err := s.tokens.bind(&rec, proof); err != nil {
+		return "", "", http.StatusBadRequest, err
+	}
+
+	st, err := s.db.ConsumeFederationState(ctx, sha256Hex(relayState))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", http.StatusBadRequest, errors.New("Invalid or expired RelayState")
+	}
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	if st.ProviderID != samlProviderKey(p.ID) || time.Now().After(st.ExpiresAt) {
+		return "", "", http.StatusBadRequest, errors.New("Invalid or expired RelayState")
+	}
+
+	cert, err := parseCertificate(p.Certificate)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	resp, err := saml.ParseResponse(samlResponse, cert)
+	if err != nil {
+		return "", "", http.StatusUnauthorized, err
+	}
+	expires, err := s.checkAssertion(p, resp, st.Nonce)
+	if err != nil {
+		return "", "", http.StatusUnauthorized, err
+	}
+	a := resp.Assertion
+	fresh, err := s.db.UseJTI(ctx, "saml:"+p.ID+":"+a.ID, expires)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	if !fresh {
+		return "", "", http.StatusUnauthorized, errors.New("Assertion replayed")
+	}
+
+	guid, err := linkExternalUser(ctx, s.db, samlProviderKey(p.ID), a.Subject.NameID.Value, s.user(p, a), p.LinkByEmail)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	rec.GUID = guid
+	if a.AuthnStatement != nil && !a.AuthnStatement.AuthnInstant.IsZero() && a.AuthnStatement.AuthnInstant.Before(rec.AuthTime) {
+		rec.AuthTime = a.AuthnStatement.AuthnInstant
+	}
+	pair, err := s.tokens.issue(rec)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	return pair.Access, pair.Refresh, http.StatusOK, nil
+}
+
+// checkAssertion applies the checks of the Web Browser SSO profile (SAML
+// Profiles 4.1.4.3): the issuer, an audience restriction naming us, the
+// validity window and a bearer confirmation for our ACS that answers the
+// request we sent. It returns when the assertion stops being usable.
+func (s *SAMLService) checkAssertion(p models.SAMLProvider, resp *saml.Response, requestID string) (time.Time, error) {
+	a := resp.Assertion
+	now := time.Now()
+	if a.Issuer != p.EntityID || (resp.Issuer != "" && resp.Issuer != p.EntityID) {
+		return time.Time{}, errors.New("Assertion was issued by another identity provider")
+	}
+	if resp.Destination != "" && resp.Destination != s.ACSURL(p.ID) {
+		return time.Time{}, errors.New("Response is addressed to another service")
+	}
+	if a.Subject.NameID.Value == "" {
+		return time.Time{}, errors.New("Assertion has no subject")
+	}
+
+	c := a.Conditions
+	if c == nil || len(c.Audiences) == 0 {
+		return time.Time{}, errors.New("Assertion has no audience restriction")
+	}
+	for _, restriction := range c.Audiences {
+		if !isSubset([]string{s.EntityID(p.ID)}, restriction.Audience) {
+			return time.Time{}, errors.New("Assertion is addressed to another service")
+		}
+	}
+	if !c.NotBefore.IsZero() && now.Add(samlClockSkew).Before(c.NotBefore) {
+		return time.Time{}, errors.New("Assertion is not valid yet")
+	}
+	if !c.NotOnOrAfter.IsZero() && !now.Add(-samlClockSkew).Before(c.NotOnOrAfter) {
+		return time.Time{}, errors.New("Assertion has expired")
+	}
+
+	for _, sc := range a.Subject.Confirmations {
+		d := sc.Data
+		if sc.Method != saml.ConfirmationBearer || d.Recipient != s.ACSURL(p.ID) || d.InResponseTo != requestID {
+			continue
+		}
+		if d.NotOnOrAfter.IsZero() || !now.Add(-samlClockSkew).Before(d.NotOnOrAfter) {
+			continue
+		}
+		if !d.NotBefore.IsZero() && now.Add(samlClockSkew).Before(d.NotBefore) {
+			continue
+		}
+		return d.NotOnOrAfter.Add(samlClockSkew), nil
+	}
+	return time.Time{}, errors.New("Assertion has no valid bearer confirmation for this login")
+}
+
+// user maps the assertion's attributes to a profile. The NameID doubles as
+// the address when it is in the email format.
+func (s *SAMLService) user(p models.SAMLProvider, a saml.Assertion) models.User {
+	attr := func(claim string) string {
+		name, ok := p.Attributes[claim]
+		if !ok {
+			name = defaultSAMLAttributes[claim]
+		}
+		return a.Attribute(name)
+	}
+	user := models.User{
+		Email:      attr("email"),
+		Name:       attr("name"),
+		GivenName:  attr("given_name"),
+		FamilyName: attr("family_name"),
+	}
+	if user.Email == "" && a.Subject.NameID.Format == saml.NameIDFormatEmail {
+		user.Email = a.Subject.NameID.Value
+	}
+	return user
+}
+
+func (s *SAMLService) provider(ctx context.Context, id string) (models.SAMLProvider, int, error) {
+	p, err := s.db.GetSAMLProvider(ctx, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return p, http.StatusNotFound, errors.New("Unknown identity provider")
+	}
+	if err != nil {
+		return p, http.StatusInternalServerError, err
+	}
+	return p, http.StatusOK, nil
+}
+
+// samlProviderKey keeps SAML providers apart from OpenID Connect providers
+// in the login states and linked identities they share.
+func samlProviderKey(id string) string {
+	return "saml:" + id
+}
+
+func parseCertificate(data string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("No PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"GoAuthentication/internal/models"
+	"GoAuthentication/internal/saml/samltest"
+	"context"
+	"github.com/jackc/pgx/v5"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// samlStore adds SAML providers to federationStore.
+type samlStore struct {
+	*federationStore
+	samlProviders map[string]models.SAMLProvider
+}
+
+func (s *samlStore) SaveSAMLProvider(ctx context.Context, p models.SAMLProvider) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samlProviders[p.ID] = p
+	return nil
+}
+
+func (s *samlStore) GetSAMLProvider(ctx context.Context, id string) (models.SAMLProvider, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.samlProviders[id]
+	if !ok {
+		return p, pgx.ErrNoRows
+	}
+	return p, nil
+}
+
+func newTestSAML(t *testing.T, idp *samltest.IdP) (*SAMLService, *samlStore) {
+	db := &samlStore{federationStore: newFederationStore(), samlProviders: map[string]models.SAMLProvider{}}
+	s := NewSAMLService(db, NewService(db.MemoryDatabase, "secret", nil, TokenPolicy{}), "https://auth.example.com/")
+	err := s.SaveProvider(models.SAMLProvider{
+		ID:          "corp",
+		EntityID:    idp.EntityID,
+		SSOURL:      "https://idp.example.com/sso",
+		Certificate: idp.CertificatePEM(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, db
+}
+
+// startSAMLLogin returns the RelayState and the AuthnRequest id of a new
+// login.
+func startSAMLLogin(t *testing.T, s *SAMLService, db *samlStore) (string, string) {
+	redirect, status, err := s.StartLogin("corp")
+	if err != nil || status != http.StatusFound {
+		t.Fatalf("start login: %d %v", status, err)
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayState := u.Query().Get("RelayState")
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return relayState, db.states[sha256Hex(relayState)].Nonce
+}
+
+func TestSAMLCompleteLogin(t *testing.T) {
+	idp := samltest.NewIdP(t, "https://idp.example.com/metadata")
+	other := *idp
+	other.EntityID = "https://other-idp.example.com/metadata"
+
+	for _, tc := range []struct {
+		name   string
+		change func(a *samltest.Assertion)
+		idp    *samltest.IdP
+		status int
+	}{
+		{name: "valid", status: http.StatusOK},
+		{name: "wrong audience", change: func(a *samltest.Assertion) { a.Audience = "https://other-sp.example.com/metadata" }},
+		{name: "wrong recipient", change: func(a *samltest.Assertion) { a.Recipient = "https://auth.example.com/saml/other/acs" }},
+		{name: "other request", change: func(a *samltest.Assertion) { a.InResponseTo = "_unsolicited" }},
+		{name: "unsolicited", change: func(a *samltest.Assertion) { a.InResponseTo = "" }},
+		{name: "expired", change: func(a *samltest.Assertion) { a.NotOnOrAfter = time.Now().Add(-samlClockSkew - time.Minute) }},
+		{name: "no subject", change: func(a *samltest.Assertion) { a.Subject = "" }},
+		{name: "other issuer", idp: &other},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, db := newTestSAML(t, idp)
+			relayState, requestID := startSAMLLogin(t, s, db)
+			a := samltest.Assertion{
+				Subject:      "alice",
+				InResponseTo: requestID,
+				Audience:     s.EntityID("corp"),
+				Recipient:    s.ACSURL("corp"),
+				Attributes:   map[string]string{"email": "alice@example.com", "name": "Alice"},
+			}
+			if tc.change != nil {
+				tc.change(&a)
+			}
+			signer := idp
+			if tc.idp != nil {
+				signer = tc.idp
+			}
+			if tc.status == 0 {
+				tc.status = http.StatusUnauthorized
+			}
+
+			access, _, status, err := s.CompleteLogin("corp", signer.SignedResponse(t, a), relayState, "", "", Proof{})
+			if status != tc.status {
+				t.Fatalf("status %d (%v), want %d", status, err, tc.status)
+			}
+			linked := db.linked(samlProviderKey("corp"), "alice")
+			if tc.status != http.StatusOK {
+				if linked != 0 || access != "" {
+					t.Fatal("rejected assertion signed the user in")
+				}
+				return
+			}
+			if linked == 0 {
+				t.Fatal("subject was not linked")
+			}
+			if u := db.users[linked]; u.Name != "Alice" || u.EmailVerified {
+				t.Fatalf("linked user %+v", u)
+			}
+		})
+	}
+}
+
+func TestSAMLCompleteLoginUnsigned(t *testing.T) {
+	idp := samltest.NewIdP(t, "https://idp.example.com/metadata")
+	s, db := newTestSAML(t, idp)
+	relayState, requestID := startSAMLLogin(t, s, db)
+	root := idp.Response(t, samltest.Assertion{
+		Subject:      "alice",
+		InResponseTo: requestID,
+		Audience:     s.EntityID("corp"),
+		Recipient:    s.ACSURL("corp"),
+	})
+	if _, _, status, _ := s.CompleteLogin("corp", samltest.Encode(root), relayState, "", "", Proof{}); status != http.StatusUnauthorized {
+		t.Fatalf("status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestSAMLCompleteLoginRelayState(t *testing.T) {
+	idp := samltest.NewIdP(t, "https://idp.example.com/metadata")
+	s, db := newTestSAML(t, idp)
+	relayState, requestID := startSAMLLogin(t, s, db)
+	response := idp.SignedResponse(t, samltest.Assertion{
+		Subject:      "alice",
+		InResponseTo: requestID,
+		Audience:     s.EntityID("corp"),
+		Recipient:    s.ACSURL("corp"),
+	})
+
+	if _, _, status, _ := s.CompleteLogin("corp", response, "forged", "", "", Proof{}); status != http.StatusBadRequest {
+		t.Fatalf("unknown RelayState: status %d", status)
+	}
+	if _, _, status, err := s.CompleteLogin("corp", response, relayState, "", "", Proof{}); status != http.StatusOK {
+		t.Fatalf("login: %d %v", status, err)
+	}
+	if _, _, status, _ := s.CompleteLogin("corp", response, relayState, "", "", Proof{}); status != http.StatusBadRequest {
+		t.Fatalf("replayed RelayState: status %d", status)
+	}
+}
@@ -3,43 +3,166 @@ package services
 import (
 	"GoAuthentication/internal/database"
 	"GoAuthentication/internal/models"
-	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jackc/pgx/v5"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// Authentication context class references. A higher level always satisfies a
+// lower one.
+const (
+	ACRNone   = "0" // tokens issued by /create without any user interaction
+	ACRSingle = "1" // one factor verified, e.g. an email code
+	ACRStepUp = "2" // an additional factor was re-verified during the session
+)
+
+const defaultAccessTokenTTL = 24 * time.Hour
+
+var ErrInsufficientAuthentication = errors.New("Insufficient user authentication")
+
 type ServiceInterface interface {
 	GenerateTokens(guid int, ip, ua string) (accessJWT, refreshBase64 string, err error)
-	RefreshTokens(accessBearer, refreshB64, ip, ua string) (newAccess, newRefresh string, status int, err error)
+	GenerateBoundTokens(guid int, scope, ip, ua string, proof Proof) (accessJWT, refreshBase64 string, err error)
+	RefreshTokens(accessBearer, refreshB64, ip, ua string, proof Proof) (newAccess, newRefresh string, status int, err error)
 	Logout(guid int) error
 	ValidateAccess(accessBearer string) (guid int, err error)
+	CheckAccess(req AccessRequest) (*AccessInfo, error)
+	CheckClientAccess(access AccessRequest) (*ClientAccessInfo, error)
+	DPoPNonce() string
+	SaveRole(role string, permissions []string) error
+	AssignRole(guid int, role string) error
+	RevokeRole(guid int, role string) error
+}
+
+// AccessRequest describes an access token presented to a protected endpoint
+// together with the authentication strength that endpoint demands. Tokens
+// restricted to an audience, such as those from a token exchange, are only
+// accepted when Audience names one of them. DPoP-bound tokens need Proof.
+// Scope lists the space separated scopes the token must have been granted.
+type AccessRequest struct {
+	Authorization string
+	MinACR        string
+	MaxAge        time.Duration
+	Audience      string
+	Scope         string
+	Proof         Proof
+}
+
+type AccessInfo struct {
+	ID       int
+	GUID     int
+	AuthTime time.Time
+	ACR      string
+	AMR      []string
+	ClientID string
+	Scope    string
+	Roles    []string
+	Audience []string
+	Act      map[string]interface{}
+	JKT      string
+	X5T      string
 }
 
 type Service struct {
-	db         database.Database
-	secret     string
-	webhookURL string
+	db       database.Database
+	secret   string
+	pepper   string
+	webhooks []models.WebhookSubscription
+	policy   TokenPolicy
 }
 
-func NewService(db database.Database, secret string, webhookURL string) *Service {
-	return &Service{db: db, secret: secret, webhookURL: webhookURL}
+func NewService(db database.Database, secret string, webhooks []models.WebhookSubscription, policy TokenPolicy) *Service {
+	if policy.AccessTokenTTL <= 0 {
+		policy.AccessTokenTTL = defaultAccessTokenTTL
+	}
+	pepper := policy.RefreshPepper
+	if pepper == "" {
+		pepper = secret
+	}
+	return &Service{db: db, secret: secret, pepper: pepper, webhooks: webhooks, policy: policy}
 }
 
 func (s *Service) ValidateAccess(accessBearer string) (int, error) {
-	parts := strings.SplitN(accessBearer, " ", 2)
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		return 0, errors.New("Invalid Authorization header")
+	info, err := s.CheckAccess(AccessRequest{Authorization: accessBearer})
+	if err != nil {
+		return 0, err
+	}
+	return info.GUID, nil
+}
+
+// CheckAccess validates the access token and, when the request asks for it,
+// that the user authenticated recently and strongly enough. A token that is
+// valid but too weak or too old fails with ErrInsufficientAuthentication,
+// one lacking a required scope with ErrInsufficientScope. Tokens bound to a
+// DPoP key must come with the DPoP scheme and a proof signed by that key,
+// certificate-bound tokens the same TLS client certificate they were issued
+// to.
+func (s *Service) CheckAccess(req AccessRequest) (*AccessInfo, error) {
+	parts := strings.SplitN(req.Authorization, " ", 2)
+	if len(parts) != 2 || (parts[0] != "Bearer" && parts[0] != "DPoP") {
+		return nil, errors.New("Invalid Authorization header")
 	}
 	tokenStr := parts[1]
+	claims, err := s.accessClaims(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	idFloat, _ := claims["id"].(float64)
+	id := int(idFloat)
+	guidFloat, _ := claims["guid"].(float64)
+	authTime, _ := claims["auth_time"].(float64)
+	acr, _ := claims["acr"].(string)
+	clientID, _ := claims["client_id"].(string)
+	scope, _ := claims["scope"].(string)
+	audience, _ := claims.GetAudience()
+	act, _ := claims["act"].(map[string]interface{})
+	if len(audience) > 0 && !isSubset([]string{req.Audience}, audience) {
+		return nil, errors.New("Token is not meant for this audience")
+	}
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	if err := s.checkBinding(cnf, parts[0], tokenStr, req.Proof); err != nil {
+		return nil, err
+	}
+	jkt, _ := cnf["jkt"].(string)
+	x5t, _ := cnf["x5t#S256"].(string)
+	info := &AccessInfo{
+		ID:       id,
+		GUID:     int(guidFloat),
+		AuthTime: time.Unix(int64(authTime), 0),
+		ACR:      acr,
+		AMR:      stringsClaim(claims["amr"]),
+		ClientID: clientID,
+		Scope:    scope,
+		Roles:    stringsClaim(claims["roles"]),
+		Audience: audience,
+		Act:      act,
+		JKT:      jkt,
+		X5T:      x5t,
+	}
+
+	if req.MinACR != "" && acrLevel(info.ACR) < acrLevel(req.MinACR) {
+		return nil, ErrInsufficientAuthentication
+	}
+	if req.MaxAge > 0 && time.Since(info.AuthTime) > req.MaxAge {
+		return nil, ErrInsufficientAuthentication
+	}
+	if req.Scope != "" && !info.HasScope(strings.Fields(req.Scope)...) {
+		return nil, ErrInsufficientScope
+	}
+	return info, nil
+}
 
+// parseToken verifies the signature and expiry of a token signed with the
+// shared secret.
+func (s *Service) parseToken(tokenStr string) (jwt.MapClaims, error) {
 	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
 		if t.Method != jwt.SigningMethodHS512 {
 			return nil, errors.New("Unexpected signing method")
@@ -47,134 +170,325 @@ func (s *Service) ValidateAccess(accessBearer string) (int, error) {
 		return []byte(s.secret), nil
 	})
 	if err != nil || !token.Valid {
-		return 0, errors.New("Invalid access token")
+		return nil, errors.New("Invalid access token")
 	}
-	claims := token.Claims.(jwt.MapClaims)
+	return token.Claims.(jwt.MapClaims), nil
+}
 
+// accessClaims returns the claims of a valid user access token whose
+// session has not been revoked.
+func (s *Service) accessClaims(tokenStr string) (jwt.MapClaims, error) {
+	claims, err := s.parseToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
 	if claims["type"] != "access" {
-		return 0, errors.New("Not an access token")
+		return nil, errors.New("Not an access token")
 	}
-
-	idFloat, _ := claims["id"].(float64)
-	id := int(idFloat)
-	_, status, err := s.db.GetRefresh(context.Background(), id)
+	id, _ := claims["id"].(float64)
+	guid, _ := claims["guid"].(float64)
+	revoked, err := s.sessionRevoked(context.Background(), int(id), int(guid))
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	if status == "blocked" {
-		return 0, errors.New("Token revoked")
+	if revoked {
+		return nil, errors.New("Token revoked")
 	}
-
-	guidFloat, _ := claims["guid"].(float64)
-	return int(guidFloat), nil
+	return claims, nil
 }
 
 func (s *Service) GenerateTokens(guid int, ip, ua string) (accessJWT, refreshBase64 string, err error) {
-	id, err := s.db.InsertToken(context.Background(), guid)
-	if err != nil {
+	return s.GenerateBoundTokens(guid, "", ip, ua, Proof{})
+}
+
+// GenerateBoundTokens is GenerateTokens for clients that ask for a scope or
+// may send a DPoP proof; the session is then bound to the proof's key. Only
+// identity scopes are granted, since nobody signed in.
+func (s *Service) GenerateBoundTokens(guid int, scope, ip, ua string, proof Proof) (accessJWT, refreshBase64 string, err error) {
+	rec := models.TokenRecord{
+		GUID:      guid,
+		IP:        ip,
+		UserAgent: ua,
+		AuthTime:  time.Now(),
+		ACR:       ACRNone,
+		Scope:     strings.Join(strings.Fields(scope), " "),
+	}
+	if err := s.bind(&rec, proof); err != nil {
 		return "", "", err
 	}
+	pair, err := s.issue(rec)
+	return pair.Access, pair.Refresh, err
+}
 
-	claims := jwt.MapClaims{
-		"guid": guid,
-		"exp":  time.Now().Add(24 * time.Hour).Unix(),
-		"ip":   ip,
-		"ua":   ua,
-		"id":   id,
-		"type": "access",
+// tokenPair is an issued session. Scope is what the access token was
+// actually granted, which can be less than the session asked for.
+type tokenPair struct {
+	ID      int
+	Access  string
+	Refresh string
+	Scope   string
+}
+
+// issue creates a new session row for rec and signs a token pair for it.
+// rec carries the authentication context and the requested scope, which
+// refreshes keep unchanged; roles and permissions are looked up every time.
+func (s *Service) issue(rec models.TokenRecord) (tokenPair, error) {
+	return s.issueSession(rec, s.policy.AccessTokenTTL, 0)
+}
+
+// issueAccess creates a session that is never refreshed and signs its access
+// token valid for ttl. The session is stored as used, so retention purges it
+// like a refreshed one, and the pair comes without a refresh token.
+func (s *Service) issueAccess(rec models.TokenRecord, ttl time.Duration) (tokenPair, error) {
+	rec.Status = "used"
+	pair, err := s.issueSession(rec, ttl, 0)
+	pair.Refresh = ""
+	return pair, err
+}
+
+// issueSession stores the session rec and signs its token pair. A non-zero
+// replaces is the session being rotated: it is consumed in the same
+// transaction, and database.ErrRefreshNotUnused means someone else got there
+// first.
+func (s *Service) issueSession(rec models.TokenRecord, ttl time.Duration, replaces int) (tokenPair, error) {
+	if rec.AMR == nil {
+		rec.AMR = []string{}
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
-	accessJWT, err = token.SignedString([]byte(s.secret))
+	if rec.Audience == nil {
+		rec.Audience = []string{}
+	}
+	ctx := context.Background()
+	scope, roles, err := s.grantedScope(ctx, rec)
 	if err != nil {
-		return "", "", err
+		return tokenPair{}, err
 	}
 
 	raw := make([]byte, 32)
 	if _, err := rand.Read(raw); err != nil {
-		return "", "", err
+		return tokenPair{}, err
 	}
-	refreshBase64 = base64.StdEncoding.EncodeToString(raw)
+	rec.RefreshHash = s.hashRefresh(raw)
 
-	hash, err := bcrypt.GenerateFromPassword(raw, bcrypt.DefaultCost)
+	var id int
+	if replaces != 0 {
+		id, err = s.db.RotateRefresh(ctx, replaces, rec)
+	} else {
+		id, err = s.db.InsertToken(ctx, rec)
+	}
 	if err != nil {
-		return "", "", err
+		return tokenPair{}, err
 	}
-	if err := s.db.StoreRefresh(context.Background(), id, string(hash)); err != nil {
-		return "", "", err
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"guid":      rec.GUID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(ttl).Unix(),
+		"ip":        rec.IP,
+		"ua":        rec.UserAgent,
+		"id":        id,
+		"type":      "access",
+		"auth_time": rec.AuthTime.Unix(),
+		"acr":       rec.ACR,
+		"amr":       rec.AMR,
+		"scope":     scope,
+		"roles":     roles,
+	}
+	if rec.ClientID != "" {
+		claims["client_id"] = rec.ClientID
+	}
+	if len(rec.Audience) > 0 {
+		claims["aud"] = rec.Audience
+	}
+	if rec.Act != nil {
+		claims["act"] = rec.Act
+	}
+	if cnf := confirmation(rec); cnf != nil {
+		claims["cnf"] = cnf
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+	accessJWT, err := token.SignedString([]byte(s.secret))
+	if err != nil {
+		return tokenPair{}, err
+	}
+	refreshBase64 := base64.StdEncoding.EncodeToString(raw)
+	return tokenPair{ID: id, Access: accessJWT, Refresh: refreshBase64, Scope: scope}, nil
+}
+
+// rotate redeems the refresh secret raw of the session rec and issues next in
+// its place. Concurrent rotations of the same session are decided by the
+// database, so only one of them gets a new pair. The returned status is
+// meant for the HTTP response.
+func (s *Service) rotate(rec models.TokenRecord, raw []byte, next models.TokenRecord) (tokenPair, int, error) {
+	if rec.Status != "unused" {
+		return tokenPair{}, http.StatusBadRequest, database.ErrRefreshNotUnused
+	}
+	if !s.checkRefresh(rec.RefreshHash, raw) {
+		return tokenPair{}, http.StatusUnauthorized, errors.New("Invalid refresh token")
 	}
 
-	return accessJWT, refreshBase64, nil
+	pair, err := s.issueSession(next, s.policy.AccessTokenTTL, rec.ID)
+	if errors.Is(err, database.ErrRefreshNotUnused) {
+		return tokenPair{}, http.StatusBadRequest, err
+	}
+	if err != nil {
+		return tokenPair{}, http.StatusInternalServerError, err
+	}
+	return pair, http.StatusOK, nil
 }
 
-func (s *Service) RefreshTokens(accessBearer, refreshB64, ip, ua string) (newAccess, newRefresh string, status int, err error) {
+func (s *Service) RefreshTokens(accessBearer, refreshB64, ip, ua string, proof Proof) (newAccess, newRefresh string, status int, err error) {
 	parts := strings.SplitN(accessBearer, " ", 2)
 	if len(parts) != 2 {
 		return "", "", http.StatusBadRequest, errors.New("Invalid Authorization header")
 	}
-	tokenStr := parts[1]
-	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		if t.Method != jwt.SigningMethodHS512 {
-			return nil, errors.New("Unexpected signing method")
-		}
-		return []byte(s.secret), nil
-	})
-	if err != nil || !token.Valid {
-		return "", "", http.StatusUnauthorized, errors.New("Invalid access token")
+	claims, err := s.parseToken(parts[1])
+	if err != nil {
+		return "", "", http.StatusUnauthorized, err
 	}
-	claims := token.Claims.(jwt.MapClaims)
-
 	if claims["type"] != "access" {
 		return "", "", http.StatusBadRequest, errors.New("Not an access token")
 	}
-	id := int(claims["id"].(float64))
-	origUA := claims["ua"].(string)
-	origIP := claims["ip"].(string)
-	guid := int(claims["guid"].(float64))
+	rawID, okID := claims["id"].(float64)
+	rawGUID, okGUID := claims["guid"].(float64)
+	origUA, okUA := claims["ua"].(string)
+	origIP, okIP := claims["ip"].(string)
+	if !okID || !okGUID || !okUA || !okIP {
+		return "", "", http.StatusUnauthorized, errors.New("Invalid access token")
+	}
+	id, guid := int(rawID), int(rawGUID)
 
 	if ua != origUA {
-		s.db.InvalidateAllRefreshForGUID(context.Background(), guid)
+		s.revokeUser(context.Background(), guid)
 		return "", "", http.StatusUnauthorized, errors.New("User-Agent mismatch — you have been logged out")
 	}
 
-	storedHash, statusDB, err := s.db.GetRefresh(context.Background(), id)
+	rec, err := s.db.GetToken(context.Background(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Used and blocked sessions are purged after a while.
+		return "", "", http.StatusUnauthorized, errors.New("Session not found")
+	}
 	if err != nil {
 		return "", "", http.StatusInternalServerError, err
 	}
-	if statusDB != "unused" {
-		return "", "", http.StatusBadRequest, errors.New("Refresh token already used or blocked")
-	}
 
 	raw, err := base64.StdEncoding.DecodeString(refreshB64)
 	if err != nil {
 		return "", "", http.StatusBadRequest, errors.New("Invalid base64")
 	}
-	if bcrypt.CompareHashAndPassword([]byte(storedHash), raw) != nil {
-		return "", "", http.StatusUnauthorized, errors.New("Invalid refresh token")
+
+	next := models.TokenRecord{
+		GUID:      guid,
+		IP:        ip,
+		UserAgent: ua,
+		AuthTime:  rec.AuthTime,
+		ACR:       rec.ACR,
+		AMR:       rec.AMR,
+		ClientID:  rec.ClientID,
+		Scope:     rec.Scope,
+		Audience:  rec.Audience,
+		Act:       rec.Act,
+		JKT:       rec.JKT,
+		X5T:       rec.X5T,
+	}
+	if err := s.bind(&next, proof); err != nil {
+		return "", "", http.StatusUnauthorized, err
+	}
+	pair, status, err := s.rotate(rec, raw, next)
+	if err != nil {
+		return "", "", status, err
 	}
 
 	if ip != origIP {
-		go func() {
-			payload := models.IPChangeRequest{
-				GUID:     guid,
-				FromIP:   origIP,
-				NewIP:    ip,
-				DateTime: time.Now().UTC(),
-			}
-			b, _ := json.Marshal(payload)
-			http.Post(s.webhookURL, "application/json", bytes.NewReader(b))
-		}()
+		s.notify(WebhookIPChange, models.IPChangeRequest{
+			GUID:     guid,
+			FromIP:   origIP,
+			NewIP:    ip,
+			DateTime: time.Now().UTC(),
+		})
 	}
 
-	s.db.MarkRefreshUsed(context.Background(), id)
+	return pair.Access, pair.Refresh, http.StatusOK, nil
+}
 
-	access, refresh, genErr := s.GenerateTokens(guid, ip, ua)
-	if genErr != nil {
-		return "", "", http.StatusInternalServerError, genErr
+// stepUp replaces the session behind info with a new one whose
+// authentication time is now and which records the freshly verified method.
+// The old pair stops working just like after a refresh.
+func (s *Service) stepUp(info *AccessInfo, method, ip, ua string) (string, string, int, error) {
+	rec, err := s.db.GetToken(context.Background(), info.ID)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	sessionUsed := errors.New("Session already refreshed or blocked")
+	if rec.Status != "unused" {
+		return "", "", http.StatusBadRequest, sessionUsed
 	}
 
-	return access, refresh, http.StatusOK, nil
+	acr := ACRSingle
+	amr := appendUnique(rec.AMR, method)
+	if acrLevel(rec.ACR) >= acrLevel(ACRSingle) {
+		acr = ACRStepUp
+		amr = appendUnique(amr, "mfa")
+	}
+	pair, err := s.issueSession(models.TokenRecord{
+		GUID:      rec.GUID,
+		IP:        ip,
+		UserAgent: ua,
+		AuthTime:  time.Now(),
+		ACR:       acr,
+		AMR:       amr,
+		ClientID:  rec.ClientID,
+		Scope:     rec.Scope,
+		Audience:  rec.Audience,
+		Act:       rec.Act,
+		JKT:       rec.JKT,
+		X5T:       rec.X5T,
+	}, s.policy.AccessTokenTTL, info.ID)
+	if errors.Is(err, database.ErrRefreshNotUnused) {
+		return "", "", http.StatusBadRequest, sessionUsed
+	}
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	return pair.Access, pair.Refresh, http.StatusOK, nil
 }
 
 func (s *Service) Logout(guid int) error {
-	return s.db.InvalidateAllRefreshForGUID(context.Background(), guid)
+	return s.revokeUser(context.Background(), guid)
+}
+
+func acrLevel(acr string) int {
+	n, err := strconv.Atoi(acr)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func appendUnique(list []string, values ...string) []string {
+	out := append([]string(nil), list...)
+	for _, v := range values {
+		found := false
+		for _, have := range out {
+			if have == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func stringsClaim(v interface{}) []string {
+	list, _ := v.([]interface{})
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
 }
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/models"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIssueAccessStoresUsedSession(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewMemoryDatabase()
+	s := NewService(db, "secret", nil, TokenPolicy{})
+
+	pair, err := s.issueAccess(models.TokenRecord{GUID: 7, AuthTime: time.Now()}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair.Access == "" || pair.Refresh != "" {
+		t.Fatalf("got access %q and refresh %q, want an access token only", pair.Access, pair.Refresh)
+	}
+	// Retention purges used sessions; unused ones would be kept forever.
+	if _, status, err := db.GetRefresh(ctx, pair.ID); err != nil || status != "used" {
+		t.Fatalf("session is %q (%v), want used", status, err)
+	}
+	if revoked, err := s.sessionRevoked(ctx, pair.ID, 7); err != nil || revoked {
+		t.Fatalf("fresh access token: revoked %v, %v", revoked, err)
+	}
+	if err := s.revokeUser(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := s.sessionRevoked(ctx, pair.ID, 7); err != nil || !revoked {
+		t.Fatalf("after logout: revoked %v, %v", revoked, err)
+	}
+
+	pair, err = s.issue(models.TokenRecord{GUID: 7, AuthTime: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status, _ := db.GetRefresh(ctx, pair.ID); pair.Refresh == "" || status != "unused" {
+		t.Fatalf("refreshable session is %q with refresh %q", status, pair.Refresh)
+	}
+}
+
+func TestCreatedTokensCarryNoPermissions(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewMemoryDatabase()
+	if err := db.SaveRole(ctx, "admin", []string{"users:delete"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AssignRole(ctx, 7, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(db, "secret", nil, TokenPolicy{})
+
+	for _, scope := range []string{"", "openid users:delete"} {
+		access, refresh, err := s.GenerateBoundTokens(7, scope, "", "", Proof{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := s.CheckAccess(AccessRequest{Authorization: "Bearer " + access})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.HasScope("users:delete") || len(info.Roles) != 0 {
+			t.Fatalf("/create token with scope %q got scope %q and roles %v", scope, info.Scope, info.Roles)
+		}
+		// Nor does refreshing it.
+		access, _, _, err = s.RefreshTokens("Bearer "+access, refresh, "", "", Proof{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info, err = s.CheckAccess(AccessRequest{Authorization: "Bearer " + access}); err != nil || info.HasScope("users:delete") {
+			t.Fatalf("refreshed /create token: %+v, %v", info, err)
+		}
+	}
+
+	// A user who signed in gets their permissions.
+	pair, err := s.issue(models.TokenRecord{GUID: 7, ACR: ACRSingle, AuthTime: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.CheckAccess(AccessRequest{Authorization: "Bearer " + pair.Access})
+	if err != nil || !info.HasScope("users:delete") || len(info.Roles) != 1 {
+		t.Fatalf("signed-in session: %+v, %v", info, err)
+	}
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"GoAuthentication/internal/database"
+	"GoAuthentication/internal/models"
+	"context"
+	"github.com/jackc/pgx/v5"
+	"strings"
+	"sync"
+)
+
+// federationStore keeps users, external identities and upstream providers in
+// memory on top of a MemoryDatabase, which has tokens and roles only. Like
+// the Postgres store, missing rows are pgx.ErrNoRows.
+type federationStore struct {
+	*database.MemoryDatabase
+
+	mu         sync.Mutex
+	providers  map[string]models.IdentityProvider
+	states     map[string]models.FederationState
+	identities map[string]int // provider + " " + subject -> guid
+	users      map[int]models.User
+	events     []models.AuditEvent
+}
+
+func newFederationStore() *federationStore {
+	return &federationStore{
+		MemoryDatabase: database.NewMemoryDatabase(),
+		providers:      map[string]models.IdentityProvider{},
+		states:         map[string]models.FederationState{},
+		identities:     map[string]int{},
+		users:          map[int]models.User{},
+	}
+}
+
+func (s *federationStore) InsertAuditEvent(ctx context.Context, e models.AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *federationStore) SaveIdentityProvider(ctx context.Context, p models.IdentityProvider) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.providers[p.ID] = p
+	return nil
+}
+
+func (s *federationStore) GetIdentityProvider(ctx context.Context, id string) (models.IdentityProvider, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.providers[id]
+	if !ok {
+		return p, pgx.ErrNoRows
+	}
+	return p, nil
+}
+
+func (s *federationStore) InsertFederationState(ctx context.Context, st models.FederationState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[st.StateHash] = st
+	return nil
+}
+
+func (s *federationStore) ConsumeFederationState(ctx context.Context, stateHash string) (models.FederationState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.states[stateHash]
+	if !ok {
+		return st, pgx.ErrNoRows
+	}
+	delete(s.states, stateHash)
+	return st, nil
+}
+
+func (s *federationStore) GetExternalIdentity(ctx context.Context, providerID, subject string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	guid, ok := s.identities[providerID+" "+subject]
+	if !ok {
+		return 0, pgx.ErrNoRows
+	}
+	return guid, nil
+}
+
+func (s *federationStore) LinkExternalIdentity(ctx context.Context, providerID, subject string, guid int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := providerID + " " + subject
+	if linked, ok := s.identities[key]; ok {
+		return linked, nil
+	}
+	s.identities[key] = guid
+	return guid, nil
+}
+
+func (s *federationStore) GetUserByEmail(ctx context.Context, email string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for guid, u := range s.users {
+		if u.Email != "" && strings.EqualFold(u.Email, email) {
+			return guid, nil
+		}
+	}
+	return 0, pgx.ErrNoRows
+}
+
+func (s *federationStore) CreateUser(ctx context.Context, u models.User) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u.GUID = len(s.users) + 1
+	s.users[u.GUID] = u
+	return u.GUID, nil
+}
+
+// linked returns the user linked to the subject of provider, or 0.
+func (s *federationStore) linked(providerID, subject string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.identities[providerID+" "+subject]
+}
@@ -0,0 +1,37 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// Webhook events.
+const (
+	WebhookIPChange = "ip_change" // a session was refreshed from a new IP
+)
+
+// notify posts payload to every subscription for event in the background.
+func (s *Service) notify(event string, payload interface{}) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	for _, hook := range s.webhooks {
+		if len(hook.Events) > 0 && !isSubset([]string{event}, hook.Events) {
+			continue
+		}
+		go func(url string) {
+			req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+			if err != nil {
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Webhook-Event", event)
+			resp, err := http.DefaultClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}(hook.URL)
+	}
+}
@@ -0,0 +1,139 @@
+package rest
+
+import (
+	"GoAuthentication/internal/models"
+	"GoAuthentication/internal/services"
+	"encoding/json"
+	"net/http"
+)
+
+type APIKeyHandler struct {
+	service services.APIKeyInterface
+}
+
+func NewAPIKeyHandler(s services.APIKeyInterface) *APIKeyHandler {
+	return &APIKeyHandler{service: s}
+}
+
+// CreateKey godoc
+// @Summary      Create an API key
+// @Description  Create a long-lived API key for the current user. It carries the requested scopes, which must be granted to the access token, or all of the token's scopes. The key is only shown in this response
+// @Tags         apikeys
+// @Accept       json
+// @Produce      json
+// @Param        Authorization  header  string                true  "Bearer access token"
+// @Param        req            body    models.APIKeyRequest  true  "Name, scope and lifetime in seconds (0 never expires)"
+// @Success      201  {object}  models.APIKeyInfo  "The new key"
+// @Failure      400  {object}  string             "Bad Request"
+// @Failure      401  {object}  string             "Unauthorized"
+// @Failure      403  {object}  string             "Forbidden"
+// @Failure      500  {object}  string             "Internal Server Error"
+// @Router       /apikeys [post]
+func (h *APIKeyHandler) CreateKey(w http.ResponseWriter, r *http.Request) {
+	var req models.APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	access := accessRequest(r)
+	key, status, err := h.service.CreateKey(access, req)
+	if err != nil {
+		if status == http.StatusUnauthorized {
+			writeAccessError(w, err, access)
+			return
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(key)
+}
+
+// ListKeys godoc
+// @Summary      List API keys
+// @Description  List the current user's API keys, revoked ones included. Secrets are never returned
+// @Tags         apikeys
+// @Produce      json
+// @Param        Authorization  header  string  true  "Bearer access token"
+// @Success      200  {array}   models.APIKeyInfo  "Keys, newest first"
+// @Failure      401  {object}  string             "Unauthorized"
+// @Failure      500  {object}  string             "Internal Server Error"
+// @Router       /apikeys [get]
+func (h *APIKeyHandler) ListKeys(w http.ResponseWriter, r *http.Request) {
+	access := accessRequest(r)
+	keys, status, err := h.service.ListKeys(access)
+	if err != nil {
+		if status == http.StatusUnauthorized {
+			writeAccessError(w, err, access)
+			return
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// RevokeKey godoc
+// @Summary      Revoke an API key
+// @Description  Revoke one of the current user's API keys. Access tokens already obtained with it expire within 15 minutes
+// @Tags         apikeys
+// @Param        Authorization  header  string  true  "Bearer access token"
+// @Param        id             path    string  true  "Key id"
+// @Success      204  "Revoked"
+// @Failure      401  {object}  string  "Unauthorized"
+// @Failure      404  {object}  string  "Not Found"
+// @Failure      500  {object}  string  "Internal Server Error"
+// @Router       /apikeys/{id} [delete]
+func (h *APIKeyHandler) RevokeKey(w http.ResponseWriter, r *http.Request) {
+	access := accessRequest(r)
+	status, err := h.service.RevokeKey(access, r.PathValue("id"))
+	if err != nil {
+		if status == http.StatusUnauthorized {
+			writeAccessError(w, err, access)
+			return
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// Exchange godoc
+// @Summary      Exchange an API key for an access token
+// @Description  Return a short-lived access token without a refresh token. User keys give a user token limited to the key's scopes and the user's current roles, client keys a client token
+// @Tags         apikeys
+// @Accept       json
+// @Produce      json
+// @Param        req   body    models.APIKeyExchangeRequest  true   "API key"
+// @Param        DPoP  header  string                        false  "DPoP proof JWT to bind a user token to a key"
+// @Success      200  {object}  models.OAuthTokenResponse  "Access token"
+// @Failure      400  {object}  string                     "Bad Request"
+// @Failure      401  {object}  string                     "Unauthorized"
+// @Failure      500  {object}  string                     "Internal Server Error"
+// @Router       /apikeys/token [post]
+func (h *APIKeyHandler) Exchange(w http.ResponseWriter, r *http.Request) {
+	var req models.APIKeyExchangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip, err := clientIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ua := r.Header.Get("User-Agent")
+
+	resp, status, err := h.service.Exchange(req.APIKey, ip, ua, requestProof(r))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if err != nil {
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
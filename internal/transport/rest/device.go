@@ -0,0 +1,85 @@
+package rest
+
+import (
+	"GoAuthentication/internal/models"
+	"encoding/json"
+	"net/http"
+)
+
+// DeviceAuthorization godoc
+// @Summary      Start the device authorization flow
+// @Description  RFC 8628. The device shows user_code and verification_uri to the user and polls /token with grant_type=urn:ietf:params:oauth:grant-type:device_code no more often than every interval seconds. Client authentication works as on /token
+// @Tags         oauth
+// @Accept       x-www-form-urlencoded
+// @Produce      json
+// @Param        client_id      formData  string  false  "Client identifier"
+// @Param        client_secret  formData  string  false  "Client secret"
+// @Param        scope          formData  string  false  "Space separated scopes"
+// @Success      200  {object}  models.DeviceAuthorizationResponse  "Device and user codes"
+// @Failure      400  {object}  models.OAuthErrorResponse           "Bad Request"
+// @Failure      401  {object}  models.OAuthErrorResponse           "Client authentication failed"
+// @Failure      500  {object}  string                              "Internal Server Error"
+// @Router       /device_authorization [post]
+func (h *OAuthHandler) DeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := h.service.DeviceAuthorization(tokenRequest(r))
+	w.Header().Set("Cache-Control", "no-store")
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// DeviceInfo godoc
+// @Summary      Describe a device user code
+// @Description  Used by the verification page to show the signed-in user which client is asking for which scopes
+// @Tags         oauth
+// @Produce      json
+// @Param        Authorization  header  string  true  "Bearer access token of the signed-in user"
+// @Param        user_code      query   string  true  "User code shown on the device"
+// @Success      200  {object}  models.DeviceInfo          "Pending request"
+// @Failure      400  {object}  models.OAuthErrorResponse  "Unknown or expired user code"
+// @Failure      401  {object}  models.OAuthErrorResponse  "Login required"
+// @Failure      429  {object}  models.OAuthErrorResponse  "Too many wrong user codes"
+// @Failure      500  {object}  string                     "Internal Server Error"
+// @Router       /device [get]
+func (h *OAuthHandler) DeviceInfo(w http.ResponseWriter, r *http.Request) {
+	info, err := h.service.DeviceInfo(accessRequest(r), r.URL.Query().Get("user_code"))
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// VerifyDevice godoc
+// @Summary      Approve or deny a device
+// @Description  Approval lets the polling device receive tokens for the signed-in user with the user's auth_time, acr and amr
+// @Tags         oauth
+// @Accept       json
+// @Param        Authorization  header  string                            true  "Bearer access token of the signed-in user"
+// @Param        request        body    models.DeviceVerificationRequest  true  "User code and action (approve or deny)"
+// @Success      204  "Decision recorded"
+// @Failure      400  {object}  models.OAuthErrorResponse  "Bad Request"
+// @Failure      401  {object}  models.OAuthErrorResponse  "Login required"
+// @Failure      429  {object}  models.OAuthErrorResponse  "Too many wrong user codes"
+// @Failure      500  {object}  string                     "Internal Server Error"
+// @Router       /device [post]
+func (h *OAuthHandler) VerifyDevice(w http.ResponseWriter, r *http.Request) {
+	var req models.DeviceVerificationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.service.VerifyDevice(accessRequest(r), req.UserCode, req.Action); err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
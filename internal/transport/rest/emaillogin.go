@@ -0,0 +1,199 @@
+package rest
+
+import (
+	"GoAuthentication/internal/models"
+	"GoAuthentication/internal/services"
+	"encoding/json"
+	"html/template"
+	"net/http"
+)
+
+type EmailLoginHandler struct {
+	service services.EmailLoginInterface
+}
+
+func NewEmailLoginHandler(s services.EmailLoginInterface) *EmailLoginHandler {
+	return &EmailLoginHandler{service: s}
+}
+
+// SendLoginEmail godoc
+// @Summary      Request a passwordless login email
+// @Description  Send a single-use 6-digit code and magic link to the given address. The response does not reveal whether the address is registered
+// @Tags         email
+// @Accept       json
+// @Param        req  body      models.EmailLoginRequest  true  "Email address"
+// @Success      202  {string}  string  "Accepted"
+// @Failure      400  {object}  string  "Bad Request"
+// @Failure      429  {object}  string  "Too Many Requests"
+// @Failure      500  {object}  string  "Internal Server Error"
+// @Router       /login/email [post]
+func (h *EmailLoginHandler) SendLoginEmail(w http.ResponseWriter, r *http.Request) {
+	var req models.EmailLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status, err := h.service.SendLoginEmail(req.Email)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// VerifyLoginCode godoc
+// @Summary      Exchange an email code for tokens
+// @Description  Verify the 6-digit code sent by /login/email and return a new pair of tokens
+// @Tags         email
+// @Accept       json
+// @Produce      json
+// @Param        req  body      models.EmailVerifyRequest  true  "Email address and code"
+// @Success      200  {object}  models.Response  "Newly generated tokens"
+// @Failure      400  {object}  string           "Bad Request"
+// @Failure      401  {object}  string           "Unauthorized"
+// @Failure      429  {object}  string           "Too Many Requests"
+// @Failure      500  {object}  string           "Internal Server Error"
+// @Router       /login/email/verify [post]
+func (h *EmailLoginHandler) VerifyLoginCode(w http.ResponseWriter, r *http.Request) {
+	var req models.EmailVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip, err := clientIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ua := r.Header.Get("User-Agent")
+
+	access, refresh, status, err := h.service.VerifyLoginCode(req.Email, req.Code, ip, ua, requestProof(r))
+	if err != nil {
+		writeError(w, err, status)
+		return
+	}
+	writeTokens(w, access, refresh)
+}
+
+// linkConfirmation asks the user to confirm a magic link with a POST, so
+// that mail scanners and prefetchers opening the link do not use it up.
+var linkConfirmation = template.Must(template.New("link").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in</title></head>
+<body>
+<form method="post" action="link">
+<input type="hidden" name="token" value="{{.}}">
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+// ConfirmLoginLink godoc
+// @Summary      Confirm a magic link
+// @Description  Landing page of the link sent by /login/email. It does not use the link up but asks the user to submit it to /login/email/link
+// @Tags         email
+// @Produce      html
+// @Param        token  query     string  true  "Link token"
+// @Success      200    {string}  string  "Confirmation page"
+// @Router       /login/email/verify [get]
+func (h *EmailLoginHandler) ConfirmLoginLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Frame-Options", "DENY")
+	linkConfirmation.Execute(w, r.URL.Query().Get("token"))
+}
+
+// VerifyLoginLink godoc
+// @Summary      Exchange a magic link for tokens
+// @Description  Redeem the single-use link sent by /login/email, as submitted by the page of GET /login/email/verify, and return a new pair of tokens
+// @Tags         email
+// @Accept       x-www-form-urlencoded
+// @Produce      json
+// @Param        token  formData  string  true  "Link token"
+// @Success      200  {object}  models.Response  "Newly generated tokens"
+// @Failure      400  {object}  string           "Bad Request"
+// @Failure      401  {object}  string           "Unauthorized"
+// @Failure      500  {object}  string           "Internal Server Error"
+// @Router       /login/email/link [post]
+func (h *EmailLoginHandler) VerifyLoginLink(w http.ResponseWriter, r *http.Request) {
+	ip, err := clientIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ua := r.Header.Get("User-Agent")
+
+	access, refresh, status, err := h.service.VerifyLoginLink(r.PostFormValue("token"), ip, ua, requestProof(r))
+	if err != nil {
+		writeError(w, err, status)
+		return
+	}
+	writeTokens(w, access, refresh)
+}
+
+// SendStepUpCode godoc
+// @Summary      Request a step-up code
+// @Description  Email a one-time code to the current user so the session can be upgraded with /stepup/email/verify
+// @Tags         email
+// @Param        Authorization  header  string  true  "Bearer access token"
+// @Success      202  {string}  string  "Accepted"
+// @Failure      400  {object}  string  "Bad Request"
+// @Failure      401  {object}  string  "Unauthorized"
+// @Failure      429  {object}  string  "Too Many Requests"
+// @Failure      500  {object}  string  "Internal Server Error"
+// @Router       /stepup/email [post]
+func (h *EmailLoginHandler) SendStepUpCode(w http.ResponseWriter, r *http.Request) {
+	req := accessRequest(r)
+	status, err := h.service.SendStepUpCode(req)
+	if err != nil {
+		if status == http.StatusUnauthorized {
+			writeAccessError(w, err, req)
+			return
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// StepUp godoc
+// @Summary      Step up the current session
+// @Description  Verify a code from /stepup/email and replace the current token pair with one carrying a fresh auth_time and a higher acr
+// @Tags         email
+// @Accept       json
+// @Produce      json
+// @Param        Authorization  header  string                true  "Bearer access token"
+// @Param        req            body    models.StepUpRequest  true  "Emailed code"
+// @Success      200  {object}  models.Response  "Upgraded tokens"
+// @Failure      400  {object}  string           "Bad Request"
+// @Failure      401  {object}  string           "Unauthorized"
+// @Failure      429  {object}  string           "Too Many Requests"
+// @Failure      500  {object}  string           "Internal Server Error"
+// @Router       /stepup/email/verify [post]
+func (h *EmailLoginHandler) StepUp(w http.ResponseWriter, r *http.Request) {
+	var req models.StepUpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip, err := clientIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ua := r.Header.Get("User-Agent")
+
+	access := accessRequest(r)
+	accessJWT, refresh, status, err := h.service.StepUp(access, req.Code, ip, ua)
+	if err != nil {
+		if status == http.StatusUnauthorized {
+			writeAccessError(w, err, access)
+			return
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeTokens(w, accessJWT, refresh)
+}
@@ -0,0 +1,69 @@
+package rest
+
+import (
+	"GoAuthentication/internal/services"
+	"net/http"
+)
+
+type FederationHandler struct {
+	service services.FederationInterface
+}
+
+func NewFederationHandler(s services.FederationInterface) *FederationHandler {
+	return &FederationHandler{service: s}
+}
+
+// StartLogin godoc
+// @Summary      Sign in with an upstream identity provider
+// @Description  Redirect the browser to the provider's authorization endpoint. It sends the user back to /federation/{provider}/callback
+// @Tags         federation
+// @Param        provider  path      string  true  "Identity provider id"
+// @Success      302       {string}  string  "Redirect to the identity provider"
+// @Failure      404       {object}  string  "Not Found"
+// @Failure      500       {object}  string  "Internal Server Error"
+// @Failure      502       {object}  string  "Bad Gateway"
+// @Router       /federation/{provider}/login [get]
+func (h *FederationHandler) StartLogin(w http.ResponseWriter, r *http.Request) {
+	redirect, status, err := h.service.StartLogin(r.PathValue("provider"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	http.Redirect(w, r, redirect, status)
+}
+
+// Callback godoc
+// @Summary      Finish signing in with an upstream identity provider
+// @Description  Redeem the provider's authorization code, verify its ID token, link the account to a local user and return a new pair of tokens
+// @Tags         federation
+// @Produce      json
+// @Param        provider  path      string  true  "Identity provider id"
+// @Param        code      query     string  true  "Authorization code"
+// @Param        state     query     string  true  "State of the login request"
+// @Success      200       {object}  models.Response  "Newly generated tokens"
+// @Failure      400       {object}  string           "Bad Request"
+// @Failure      401       {object}  string           "Unauthorized"
+// @Failure      404       {object}  string           "Not Found"
+// @Failure      500       {object}  string           "Internal Server Error"
+// @Failure      502       {object}  string           "Bad Gateway"
+// @Router       /federation/{provider}/callback [get]
+func (h *FederationHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		http.Error(w, "The identity provider refused the login: "+e, http.StatusUnauthorized)
+		return
+	}
+	ip, err := clientIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ua := r.Header.Get("User-Agent")
+
+	access, refresh, status, err := h.service.CompleteLogin(r.PathValue("provider"), query.Get("code"), query.Get("state"), ip, ua, requestProof(r))
+	if err != nil {
+		writeError(w, err, status)
+		return
+	}
+	writeTokens(w, access, refresh)
+}
@@ -4,8 +4,12 @@ import (
 	"GoAuthentication/internal/models"
 	"GoAuthentication/internal/services"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type Handler struct {
@@ -16,13 +20,134 @@ func NewHandler(s services.ServiceInterface) *Handler {
 	return &Handler{service: s}
 }
 
+func clientIP(r *http.Request) (string, error) {
+	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
+		return ip, nil
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	return ip, err
+}
+
+// requestProof collects the DPoP proof of r with the method and URL it has to
+// be bound to, and the TLS client certificate of the connection. Behind a
+// TLS terminating proxy X-Forwarded-Proto must be set.
+func requestProof(r *http.Request) services.Proof {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	proof := services.Proof{
+		DPoP:   r.Header.Get("DPoP"),
+		Method: r.Method,
+		URL:    scheme + "://" + r.Host + r.URL.Path,
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		proof.CertThumbprint = services.CertificateThumbprint(r.TLS.PeerCertificates[0])
+	}
+	return proof
+}
+
+func accessRequest(r *http.Request) services.AccessRequest {
+	return services.AccessRequest{
+		Authorization: r.Header.Get("Authorization"),
+		Proof:         requestProof(r),
+	}
+}
+
+// authScheme is the scheme used in challenges, matching the one the client
+// presented its token with.
+func authScheme(authorization string) string {
+	if strings.HasPrefix(authorization, "DPoP ") {
+		return "DPoP"
+	}
+	return "Bearer"
+}
+
+// RequireAuthentication wraps next so that it only runs for access tokens
+// with at least minACR whose user authenticated within maxAge. Weaker tokens
+// get the RFC 9470 challenge telling the client to step up.
+func RequireAuthentication(s services.ServiceInterface, minACR string, maxAge time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := accessRequest(r)
+		req.MinACR = minACR
+		req.MaxAge = maxAge
+		if _, err := s.CheckAccess(req); err != nil {
+			writeAccessError(w, err, req)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope wraps next so that it only runs for access tokens granted
+// every scope in the space separated list. Other valid tokens get 403 with
+// an insufficient_scope challenge.
+func RequireScope(s services.ServiceInterface, scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := accessRequest(r)
+		req.Scope = scope
+		if _, err := s.CheckAccess(req); err != nil {
+			writeAccessError(w, err, req)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAccessError(w http.ResponseWriter, err error, req services.AccessRequest) {
+	var nonceErr *services.DPoPNonceError
+	switch {
+	case errors.As(err, &nonceErr):
+		w.Header().Set("DPoP-Nonce", nonceErr.Nonce)
+		w.Header().Set("WWW-Authenticate", `DPoP error="use_dpop_nonce"`)
+	case errors.Is(err, services.ErrInvalidDPoPProof):
+		w.Header().Set("WWW-Authenticate", `DPoP error="invalid_dpop_proof"`)
+	case errors.Is(err, services.ErrCertificateBinding):
+		w.Header().Set("WWW-Authenticate", authScheme(req.Authorization)+` error="invalid_token"`)
+	case errors.Is(err, services.ErrInsufficientAuthentication):
+		challenge := authScheme(req.Authorization) + ` error="insufficient_user_authentication"`
+		if req.MinACR != "" {
+			challenge += fmt.Sprintf(`, acr_values="%s"`, req.MinACR)
+		}
+		if req.MaxAge > 0 {
+			challenge += fmt.Sprintf(`, max_age=%d`, int(req.MaxAge.Seconds()))
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+	case errors.Is(err, services.ErrInsufficientScope):
+		w.Header().Set("WWW-Authenticate", authScheme(req.Authorization)+fmt.Sprintf(` error="insufficient_scope", scope="%s"`, req.Scope))
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
+
+// writeError sends err with status. Rejected DPoP proofs are the client's
+// fault and answered with 400, adding a fresh nonce when one is required.
+func writeError(w http.ResponseWriter, err error, status int) {
+	var nonceErr *services.DPoPNonceError
+	if errors.As(err, &nonceErr) {
+		w.Header().Set("DPoP-Nonce", nonceErr.Nonce)
+		status = http.StatusBadRequest
+	} else if errors.Is(err, services.ErrInvalidDPoPProof) {
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func writeTokens(w http.ResponseWriter, access, refresh string) {
+	resp := models.Response{AccessToken: access, RefreshToken: refresh}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 // CreateTokens godoc
 // @Summary      Create access and refresh tokens
-// @Description  Generate a new pair of tokens (access JWT and refresh base64) for a given user GUID
+// @Description  Generate a new pair of tokens (access JWT and refresh base64) for a given user GUID. The scope is limited to the permissions of the user's roles, all of them when no scope is requested
 // @Tags         auth
 // @Accept       json
 // @Produce      json
-// @Param        req  body      models.Request  true  "Request body with user GUID"
+// @Param        req   body    models.Request  true   "Request body with user GUID and optional scope"
+// @Param        DPoP  header  string          false  "DPoP proof JWT to bind the tokens to a key"
 // @Success      200  {object}  models.Response  "Newly generated tokens"
 // @Failure      400  {object}  string           "Bad Request"
 // @Failure      500  {object}  string           "Internal Server Error"
@@ -34,26 +159,20 @@ func (h *Handler) CreateTokens(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		var err error
-		ip, _, err = net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+	ip, err := clientIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	ua := r.Header.Get("User-Agent")
 
-	access, refresh, err := h.service.GenerateTokens(req.GUID, ip, ua)
+	access, refresh, err := h.service.GenerateBoundTokens(req.GUID, req.Scope, ip, ua, requestProof(r))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	resp := models.Response{AccessToken: access, RefreshToken: refresh}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	writeTokens(w, access, refresh)
 }
 
 // RefreshTokens godoc
@@ -61,8 +180,9 @@ func (h *Handler) CreateTokens(w http.ResponseWriter, r *http.Request) {
 // @Description  Refresh an existing pair of tokens by providing valid access JWT and refresh token
 // @Tags         auth
 // @Produce      json
-// @Param        Authorization    header  string  true  "Bearer access token"
-// @Param        X-Refresh-Token  header  string  true  "Refresh token in base64"
+// @Param        Authorization    header  string  true   "Bearer access token"
+// @Param        X-Refresh-Token  header  string  true   "Refresh token in base64"
+// @Param        DPoP             header  string  false  "DPoP proof JWT, required for DPoP-bound sessions"
 // @Success      200  {object}  models.Response  "Newly refreshed tokens"
 // @Failure      400  {object}  string           "Bad Request"
 // @Failure      401  {object}  string           "Unauthorized"
@@ -71,45 +191,41 @@ func (h *Handler) CreateTokens(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) RefreshTokens(w http.ResponseWriter, r *http.Request) {
 	access := r.Header.Get("Authorization")
 	refresh := r.Header.Get("X-Refresh-Token")
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		var err error
-		ip, _, err = net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+	ip, err := clientIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	ua := r.Header.Get("User-Agent")
 
-	newAccess, newRefresh, status, err := h.service.RefreshTokens(access, refresh, ip, ua)
+	newAccess, newRefresh, status, err := h.service.RefreshTokens(access, refresh, ip, ua, requestProof(r))
 	if err != nil {
-		http.Error(w, err.Error(), status)
+		writeError(w, err, status)
 		return
 	}
 
-	resp := models.Response{AccessToken: newAccess, RefreshToken: newRefresh}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	writeTokens(w, newAccess, newRefresh)
 }
 
 // GetCurrentUser godoc
-// @Summary      Get current user GUID
-// @Description  Retrieve the GUID of the currently authenticated user
+// @Summary      Get current user GUID, scope and roles
+// @Description  Retrieve the GUID of the currently authenticated user with the scope and roles of the token. Deprecated in favour of /userinfo and /introspect
 // @Tags         auth
 // @Produce      json
-// @Param        Authorization  header  string  true  "Bearer access token"
+// @Param        Authorization  header  string  true   "Bearer or DPoP access token"
+// @Param        DPoP           header  string  false  "DPoP proof JWT for DPoP-bound tokens"
 // @Success      200  {object}  models.CurrentUserResponse  "User GUID"
 // @Failure      401  {object}  string                        "Unauthorized"
+// @Deprecated
 // @Router       /me [get]
 func (h *Handler) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
-	auth := r.Header.Get("Authorization")
-	guid, err := h.service.ValidateAccess(auth)
+	req := accessRequest(r)
+	info, err := h.service.CheckAccess(req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeAccessError(w, err, req)
 		return
 	}
-	resp := models.CurrentUserResponse{GUID: guid}
+	resp := models.CurrentUserResponse{GUID: info.GUID, Scope: info.Scope, Roles: info.Roles}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
@@ -125,13 +241,13 @@ func (h *Handler) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
 // @Failure      500  {object}  string             "Internal Server Error"
 // @Router       /logout [post]
 func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
-	auth := r.Header.Get("Authorization")
-	guid, err := h.service.ValidateAccess(auth)
+	req := accessRequest(r)
+	info, err := h.service.CheckAccess(req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeAccessError(w, err, req)
 		return
 	}
-	if err := h.service.Logout(guid); err != nil {
+	if err := h.service.Logout(info.GUID); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
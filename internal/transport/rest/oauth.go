@@ -0,0 +1,271 @@
+package rest
+
+import (
+	"GoAuthentication/internal/models"
+	"GoAuthentication/internal/services"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type OAuthHandler struct {
+	service services.OAuthInterface
+}
+
+func NewOAuthHandler(s services.OAuthInterface) *OAuthHandler {
+	return &OAuthHandler{service: s}
+}
+
+// Authorize godoc
+// @Summary      OAuth 2.0 authorization endpoint
+// @Description  Authorization code flow with mandatory PKCE (S256). The user is identified by their access token. Without a stored consent the endpoint answers with a consent prompt; repeat the request as POST with consent=approve or consent=deny. Otherwise the user agent is redirected to redirect_uri with code or error, state and iss
+// @Tags         oauth
+// @Produce      json
+// @Param        Authorization          header    string  false  "Bearer access token of the signed-in user"
+// @Param        response_type          query     string  true   "Must be code"
+// @Param        client_id              query     string  true   "Client identifier"
+// @Param        redirect_uri           query     string  false  "Registered redirect URI"
+// @Param        scope                  query     string  false  "Space separated scopes"
+// @Param        state                  query     string  false  "Opaque value returned to the client"
+// @Param        nonce                  query     string  false  "OpenID Connect nonce"
+// @Param        code_challenge         query     string  true   "PKCE challenge"
+// @Param        code_challenge_method  query     string  true   "Must be S256"
+// @Param        prompt                 query     string  false  "none or consent"
+// @Param        max_age                query     string  false  "Maximum authentication age in seconds"
+// @Param        consent                formData  string  false  "approve or deny"
+// @Success      200  {object}  models.ConsentPrompt       "Consent required"
+// @Success      302  {string}  string                     "Redirect to the client"
+// @Failure      400  {object}  models.OAuthErrorResponse  "Bad Request"
+// @Failure      401  {object}  models.OAuthErrorResponse  "Login required"
+// @Failure      500  {object}  string                     "Internal Server Error"
+// @Router       /authorize [get]
+// @Router       /authorize [post]
+func (h *OAuthHandler) Authorize(w http.ResponseWriter, r *http.Request) {
+	req := models.AuthorizeRequest{
+		ResponseType:        r.FormValue("response_type"),
+		ClientID:            r.FormValue("client_id"),
+		RedirectURI:         r.FormValue("redirect_uri"),
+		Scope:               r.FormValue("scope"),
+		State:               r.FormValue("state"),
+		Nonce:               r.FormValue("nonce"),
+		CodeChallenge:       r.FormValue("code_challenge"),
+		CodeChallengeMethod: r.FormValue("code_challenge_method"),
+		Prompt:              r.FormValue("prompt"),
+		MaxAge:              r.FormValue("max_age"),
+	}
+	if r.Method == http.MethodPost {
+		req.Consent = r.PostFormValue("consent")
+	}
+
+	result, err := h.service.Authorize(accessRequest(r), req)
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	if result.Consent != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result.Consent)
+		return
+	}
+	status := http.StatusFound
+	if r.Method == http.MethodPost {
+		status = http.StatusSeeOther
+	}
+	http.Redirect(w, r, result.Redirect, status)
+}
+
+// Token godoc
+// @Summary      OAuth 2.0 token endpoint
+// @Description  Supports the authorization_code, refresh_token, client_credentials, urn:ietf:params:oauth:grant-type:device_code and urn:ietf:params:oauth:grant-type:token-exchange grants. Confidential clients authenticate with client_secret_basic, client_secret_post, private_key_jwt or a TLS client certificate. client_credentials returns a short-lived token of type "client" without a refresh token. Token exchange returns a 15 minute access token restricted to the requested audience with an act claim naming the acting party
+// @Tags         oauth
+// @Accept       x-www-form-urlencoded
+// @Produce      json
+// @Param        grant_type             formData  string  true   "authorization_code, refresh_token, client_credentials, urn:ietf:params:oauth:grant-type:device_code or urn:ietf:params:oauth:grant-type:token-exchange"
+// @Param        code                   formData  string  false  "Authorization code"
+// @Param        redirect_uri           formData  string  false  "Redirect URI used in the authorization request"
+// @Param        code_verifier          formData  string  false  "PKCE verifier"
+// @Param        refresh_token          formData  string  false  "Refresh token"
+// @Param        scope                  formData  string  false  "Narrower scope for refresh_token"
+// @Param        device_code            formData  string  false  "Device code from /device_authorization"
+// @Param        subject_token          formData  string  false  "Token exchange: access token of the user, or their guid for impersonation"
+// @Param        subject_token_type     formData  string  false  "urn:ietf:params:oauth:token-type:access_token or urn:goauthentication:params:oauth:token-type:guid"
+// @Param        actor_token            formData  string  false  "Token exchange: access token of the acting user"
+// @Param        actor_token_type       formData  string  false  "urn:ietf:params:oauth:token-type:access_token"
+// @Param        requested_token_type   formData  string  false  "urn:ietf:params:oauth:token-type:access_token"
+// @Param        audience               formData  string  false  "Target audience of the exchanged token, may be repeated"
+// @Param        resource               formData  string  false  "Same as audience"
+// @Param        client_id              formData  string  false  "Client identifier"
+// @Param        client_secret          formData  string  false  "Client secret"
+// @Param        DPoP                   header    string  false  "DPoP proof JWT to bind the issued tokens to a key"
+// @Param        client_assertion_type  formData  string  false  "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+// @Param        client_assertion       formData  string  false  "Signed JWT for private_key_jwt"
+// @Success      200  {object}  models.OAuthTokenResponse  "Issued tokens"
+// @Failure      400  {object}  models.OAuthErrorResponse  "Bad Request"
+// @Failure      401  {object}  models.OAuthErrorResponse  "Client authentication failed"
+// @Failure      500  {object}  models.OAuthErrorResponse  "Internal Server Error"
+// @Router       /token [post]
+func (h *OAuthHandler) Token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := tokenRequest(r)
+	ip, err := clientIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ua := r.Header.Get("User-Agent")
+
+	resp, err := h.service.Token(req, ip, ua)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Introspect godoc
+// @Summary      OAuth 2.0 token introspection
+// @Description  RFC 7662. Confidential clients ask whether an access or refresh token is active and learn its scope, roles, subject and confirmation. Refresh tokens are only reported to the client they belong to
+// @Tags         oauth
+// @Accept       x-www-form-urlencoded
+// @Produce      json
+// @Param        token                  formData  string  true   "Access or refresh token"
+// @Param        token_type_hint        formData  string  false  "access_token or refresh_token, ignored"
+// @Param        client_id              formData  string  false  "Client identifier"
+// @Param        client_secret          formData  string  false  "Client secret"
+// @Param        client_assertion_type  formData  string  false  "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+// @Param        client_assertion       formData  string  false  "Signed JWT for private_key_jwt"
+// @Success      200  {object}  models.IntrospectionResponse  "Token state"
+// @Failure      400  {object}  models.OAuthErrorResponse     "Bad Request"
+// @Failure      401  {object}  models.OAuthErrorResponse     "Client authentication failed"
+// @Failure      500  {object}  models.OAuthErrorResponse     "Internal Server Error"
+// @Router       /introspect [post]
+func (h *OAuthHandler) Introspect(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := h.service.Introspect(tokenRequest(r))
+	w.Header().Set("Cache-Control", "no-store")
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// tokenRequest reads the token endpoint parameters and the client credentials
+// from a parsed form, Basic auth header or TLS connection.
+func tokenRequest(r *http.Request) models.TokenRequest {
+	req := models.TokenRequest{
+		GrantType:    r.PostFormValue("grant_type"),
+		Code:         r.PostFormValue("code"),
+		RedirectURI:  r.PostFormValue("redirect_uri"),
+		CodeVerifier: r.PostFormValue("code_verifier"),
+		RefreshToken: r.PostFormValue("refresh_token"),
+		Scope:        r.PostFormValue("scope"),
+		DeviceCode:   r.PostFormValue("device_code"),
+		ClientID:     r.PostFormValue("client_id"),
+		ClientSecret: r.PostFormValue("client_secret"),
+		DPoP:         r.Header.Get("DPoP"),
+
+		Token:         r.PostFormValue("token"),
+		TokenTypeHint: r.PostFormValue("token_type_hint"),
+
+		SubjectToken:       r.PostFormValue("subject_token"),
+		SubjectTokenType:   r.PostFormValue("subject_token_type"),
+		ActorToken:         r.PostFormValue("actor_token"),
+		ActorTokenType:     r.PostFormValue("actor_token_type"),
+		RequestedTokenType: r.PostFormValue("requested_token_type"),
+		Audience:           append(r.PostForm["audience"], r.PostForm["resource"]...),
+
+		ClientAssertionType: r.PostFormValue("client_assertion_type"),
+		ClientAssertion:     r.PostFormValue("client_assertion"),
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		req.ClientCert = r.TLS.PeerCertificates[0]
+		req.ClientCertVerified = len(r.TLS.VerifiedChains) > 0
+	}
+	if id, secret, ok := r.BasicAuth(); ok {
+		req.ClientID, _ = url.QueryUnescape(id)
+		req.ClientSecret, _ = url.QueryUnescape(secret)
+	}
+	return req
+}
+
+func writeOAuthError(w http.ResponseWriter, err error) {
+	var oerr *services.OAuthError
+	if !errors.As(err, &oerr) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if oerr.Code == "invalid_client" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+	}
+	if oerr.DPoPNonce != "" {
+		w.Header().Set("DPoP-Nonce", oerr.DPoPNonce)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(oerr.Status)
+	json.NewEncoder(w).Encode(models.OAuthErrorResponse{Error: oerr.Code, ErrorDescription: oerr.Description})
+}
+
+// UserInfo godoc
+// @Summary      OpenID Connect userinfo endpoint
+// @Description  Return the claims of the current user allowed by the token's scope (openid, profile, email). Supersedes /me
+// @Tags         oidc
+// @Produce      json
+// @Param        Authorization  header  string  true  "Bearer access token"
+// @Success      200  {object}  models.UserInfoResponse    "User claims"
+// @Failure      401  {object}  models.OAuthErrorResponse  "Unauthorized"
+// @Failure      403  {object}  models.OAuthErrorResponse  "Insufficient scope"
+// @Failure      500  {object}  string                     "Internal Server Error"
+// @Router       /userinfo [get]
+// @Router       /userinfo [post]
+func (h *OAuthHandler) UserInfo(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.service.UserInfo(accessRequest(r))
+	if err != nil {
+		var oerr *services.OAuthError
+		if errors.As(err, &oerr) {
+			scheme := authScheme(r.Header.Get("Authorization"))
+			if strings.HasPrefix(oerr.Code, "invalid_dpop") || oerr.Code == "use_dpop_nonce" {
+				scheme = "DPoP"
+			}
+			w.Header().Set("WWW-Authenticate", scheme+` error="`+oerr.Code+`"`)
+		}
+		writeOAuthError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Discovery godoc
+// @Summary      OpenID Provider metadata
+// @Tags         oidc
+// @Produce      json
+// @Success      200  {object}  models.OpenIDConfiguration  "Provider metadata"
+// @Router       /.well-known/openid-configuration [get]
+func (h *OAuthHandler) Discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.service.Discovery())
+}
+
+// JWKS godoc
+// @Summary      ID token signing keys
+// @Tags         oidc
+// @Produce      json
+// @Success      200  {object}  jwk.Set  "JSON Web Key Set"
+// @Router       /.well-known/jwks.json [get]
+func (h *OAuthHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.service.JWKS())
+}
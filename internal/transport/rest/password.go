@@ -0,0 +1,51 @@
+package rest
+
+import (
+	"GoAuthentication/internal/models"
+	"GoAuthentication/internal/services"
+	"encoding/json"
+	"net/http"
+)
+
+type PasswordLoginHandler struct {
+	service services.PasswordLoginInterface
+}
+
+func NewPasswordLoginHandler(s services.PasswordLoginInterface) *PasswordLoginHandler {
+	return &PasswordLoginHandler{service: s}
+}
+
+// Login godoc
+// @Summary      Log in with a directory password
+// @Description  Verify the username and password against the configured LDAP directory and return a new pair of tokens. Roles follow the user's directory groups
+// @Tags         password
+// @Accept       json
+// @Produce      json
+// @Param        req  body  models.PasswordLoginRequest  true  "Username and password"
+// @Success      200  {object}  models.Response  "Newly generated tokens"
+// @Failure      400  {object}  string           "Bad Request"
+// @Failure      401  {object}  string           "Unauthorized"
+// @Failure      404  {object}  string           "Not Found"
+// @Failure      500  {object}  string           "Internal Server Error"
+// @Failure      502  {object}  string           "Bad Gateway"
+// @Router       /login/password [post]
+func (h *PasswordLoginHandler) Login(w http.ResponseWriter, r *http.Request) {
+	var req models.PasswordLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip, err := clientIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ua := r.Header.Get("User-Agent")
+
+	access, refresh, status, err := h.service.Login(req.Username, req.Password, ip, ua, requestProof(r))
+	if err != nil {
+		writeError(w, err, status)
+		return
+	}
+	writeTokens(w, access, refresh)
+}
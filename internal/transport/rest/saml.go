@@ -0,0 +1,87 @@
+package rest
+
+import (
+	"GoAuthentication/internal/services"
+	"net/http"
+)
+
+type SAMLHandler struct {
+	service services.SAMLInterface
+}
+
+func NewSAMLHandler(s services.SAMLInterface) *SAMLHandler {
+	return &SAMLHandler{service: s}
+}
+
+// Metadata godoc
+// @Summary      SAML service provider metadata
+// @Description  Metadata to import into the SAML identity provider: entity id and assertion consumer service
+// @Tags         saml
+// @Produce      xml
+// @Param        provider  path      string  true  "Identity provider id"
+// @Success      200       {string}  string  "SAML metadata"
+// @Failure      404       {object}  string  "Not Found"
+// @Failure      500       {object}  string  "Internal Server Error"
+// @Router       /saml/{provider}/metadata [get]
+func (h *SAMLHandler) Metadata(w http.ResponseWriter, r *http.Request) {
+	metadata, status, err := h.service.Metadata(r.PathValue("provider"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(metadata)
+}
+
+// StartLogin godoc
+// @Summary      Sign in with a SAML identity provider
+// @Description  Redirect the browser to the provider with an AuthnRequest (HTTP-Redirect binding). The provider posts the response to /saml/{provider}/acs
+// @Tags         saml
+// @Param        provider  path      string  true  "Identity provider id"
+// @Success      302       {string}  string  "Redirect to the identity provider"
+// @Failure      404       {object}  string  "Not Found"
+// @Failure      500       {object}  string  "Internal Server Error"
+// @Router       /saml/{provider}/login [get]
+func (h *SAMLHandler) StartLogin(w http.ResponseWriter, r *http.Request) {
+	redirect, status, err := h.service.StartLogin(r.PathValue("provider"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	http.Redirect(w, r, redirect, status)
+}
+
+// AssertionConsumer godoc
+// @Summary      SAML assertion consumer service
+// @Description  Verify the signed SAMLResponse posted by the identity provider (HTTP-POST binding), link the subject to a local user and return a new pair of tokens
+// @Tags         saml
+// @Accept       x-www-form-urlencoded
+// @Produce      json
+// @Param        provider      path      string  true  "Identity provider id"
+// @Param        SAMLResponse  formData  string  true  "Base64 encoded SAML response"
+// @Param        RelayState    formData  string  true  "RelayState of the login request"
+// @Success      200           {object}  models.Response  "Newly generated tokens"
+// @Failure      400           {object}  string           "Bad Request"
+// @Failure      401           {object}  string           "Unauthorized"
+// @Failure      404           {object}  string           "Not Found"
+// @Failure      500           {object}  string           "Internal Server Error"
+// @Router       /saml/{provider}/acs [post]
+func (h *SAMLHandler) AssertionConsumer(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip, err := clientIP(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ua := r.Header.Get("User-Agent")
+
+	access, refresh, status, err := h.service.CompleteLogin(r.PathValue("provider"), r.PostForm.Get("SAMLResponse"), r.PostForm.Get("RelayState"), ip, ua, requestProof(r))
+	if err != nil {
+		writeError(w, err, status)
+		return
+	}
+	writeTokens(w, access, refresh)
+}
@@ -7,6 +7,10 @@ CREATE TABLE IF NOT EXISTS tokens (
 
 CREATE INDEX IF NOT EXISTS idx_tokens_guid ON tokens(guid);
 
-ALTER TABLE tokens
-  ADD CONSTRAINT status_check
-  CHECK (status IN ('unused', 'used', 'blocked'));
\ No newline at end of file
+DO $$
+BEGIN
+  ALTER TABLE tokens
+    ADD CONSTRAINT status_check
+    CHECK (status IN ('unused', 'used', 'blocked'));
+EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
@@ -0,0 +1,36 @@
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS saml_providers;
+DROP TABLE IF EXISTS external_identities;
+DROP TABLE IF EXISTS federation_states;
+DROP TABLE IF EXISTS identity_providers;
+DROP TABLE IF EXISTS webhook_subscriptions;
+DROP TABLE IF EXISTS tenants;
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS permissions;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS impersonation_grants;
+DROP TABLE IF EXISTS exchange_policies;
+DROP TABLE IF EXISTS device_codes;
+DROP TABLE IF EXISTS consents;
+DROP TABLE IF EXISTS authorization_codes;
+DROP TABLE IF EXISTS used_jtis;
+DROP TABLE IF EXISTS clients;
+DROP TABLE IF EXISTS login_codes;
+DROP TABLE IF EXISTS users;
+
+DROP INDEX IF EXISTS idx_tokens_guid;
+CREATE INDEX idx_tokens_guid ON tokens(guid);
+
+ALTER TABLE tokens
+    DROP COLUMN IF EXISTS x5t,
+    DROP COLUMN IF EXISTS jkt,
+    DROP COLUMN IF EXISTS act,
+    DROP COLUMN IF EXISTS audience,
+    DROP COLUMN IF EXISTS scope,
+    DROP COLUMN IF EXISTS client_id,
+    DROP COLUMN IF EXISTS amr,
+    DROP COLUMN IF EXISTS acr,
+    DROP COLUMN IF EXISTS auth_time,
+    DROP COLUMN IF EXISTS tenant_id;
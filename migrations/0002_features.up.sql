@@ -0,0 +1,262 @@
+-- Everything added to the schema of init.sql: the session claims and tenant
+-- of tokens and the tables of the other features.
+ALTER TABLE tokens
+    ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default',
+    ADD COLUMN IF NOT EXISTS auth_time TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS acr TEXT NOT NULL DEFAULT '0',
+    ADD COLUMN IF NOT EXISTS amr TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS client_id TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS scope TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS audience TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS act JSONB,
+    ADD COLUMN IF NOT EXISTS jkt TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS x5t TEXT NOT NULL DEFAULT '';
+
+DROP INDEX IF EXISTS idx_tokens_guid;
+CREATE INDEX idx_tokens_guid ON tokens(tenant_id, guid);
+
+CREATE TABLE IF NOT EXISTS users (
+    guid SERIAL PRIMARY KEY,
+    email TEXT UNIQUE,
+    email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    name TEXT NOT NULL DEFAULT '',
+    given_name TEXT NOT NULL DEFAULT '',
+    family_name TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS login_codes (
+    id SERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    email TEXT NOT NULL,
+    guid INTEGER NOT NULL,
+    code_hash TEXT NOT NULL,
+    link_hash TEXT NOT NULL UNIQUE,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    used BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_codes_email ON login_codes(tenant_id, email, created_at);
+
+CREATE TABLE IF NOT EXISTS clients (
+    client_id TEXT PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    secret_hash TEXT NOT NULL DEFAULT '',
+    name TEXT NOT NULL,
+    redirect_uris TEXT[] NOT NULL DEFAULT '{}',
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    grant_types TEXT[] NOT NULL DEFAULT '{authorization_code,refresh_token}',
+    auth_method TEXT NOT NULL DEFAULT 'client_secret_basic',
+    jwks TEXT NOT NULL DEFAULT '',
+    tls_subject_dn TEXT NOT NULL DEFAULT '',
+    cert_thumbprint TEXT NOT NULL DEFAULT '',
+    dpop_bound_access_tokens BOOLEAN NOT NULL DEFAULT FALSE,
+    tls_client_certificate_bound_access_tokens BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS used_jtis (
+    jti TEXT PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS authorization_codes (
+    code_hash TEXT PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    client_id TEXT NOT NULL,
+    guid INTEGER NOT NULL,
+    redirect_uri TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    nonce TEXT NOT NULL DEFAULT '',
+    code_challenge TEXT NOT NULL,
+    auth_time TIMESTAMPTZ NOT NULL,
+    acr TEXT NOT NULL,
+    amr TEXT[] NOT NULL DEFAULT '{}',
+    used BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS consents (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    guid INTEGER NOT NULL,
+    client_id TEXT NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, guid, client_id)
+);
+
+CREATE TABLE IF NOT EXISTS device_codes (
+    device_code_hash TEXT PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    user_code TEXT NOT NULL,
+    client_id TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'denied', 'consumed')),
+    guid INTEGER NOT NULL DEFAULT 0,
+    auth_time TIMESTAMPTZ,
+    acr TEXT NOT NULL DEFAULT '',
+    amr TEXT[] NOT NULL DEFAULT '{}',
+    interval_seconds INTEGER NOT NULL,
+    last_polled_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ NOT NULL,
+    UNIQUE (tenant_id, user_code)
+);
+
+CREATE TABLE IF NOT EXISTS exchange_policies (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    client_id TEXT NOT NULL,
+    audiences TEXT[] NOT NULL DEFAULT '{}',
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    impersonation BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, client_id)
+);
+
+-- subject_guid 0 lets the actor impersonate any user.
+CREATE TABLE IF NOT EXISTS impersonation_grants (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    actor_guid INTEGER NOT NULL,
+    subject_guid INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, actor_guid, subject_guid)
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    event TEXT NOT NULL,
+    guid INTEGER NOT NULL DEFAULT 0,
+    client_id TEXT NOT NULL DEFAULT '',
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_guid ON audit_log(tenant_id, guid, created_at);
+
+CREATE TABLE IF NOT EXISTS roles (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    name TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, name)
+);
+
+-- Permissions double as OAuth scopes, e.g. invoices:read.
+CREATE TABLE IF NOT EXISTS permissions (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (tenant_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    role TEXT NOT NULL,
+    permission TEXT NOT NULL,
+    PRIMARY KEY (tenant_id, role, permission),
+    FOREIGN KEY (tenant_id, role) REFERENCES roles(tenant_id, name) ON DELETE CASCADE,
+    FOREIGN KEY (tenant_id, permission) REFERENCES permissions(tenant_id, name) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    guid INTEGER NOT NULL,
+    role TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, guid, role),
+    FOREIGN KEY (tenant_id, role) REFERENCES roles(tenant_id, name) ON DELETE CASCADE
+);
+
+-- Tenants other than 'default', which is configured through the environment.
+-- secret signs access tokens, signing_key (PEM) signs ID tokens.
+CREATE TABLE IF NOT EXISTS tenants (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL DEFAULT '',
+    hosts TEXT[] NOT NULL DEFAULT '{}',
+    issuer TEXT NOT NULL DEFAULT '',
+    secret TEXT NOT NULL,
+    signing_key TEXT NOT NULL,
+    access_token_ttl_seconds INTEGER NOT NULL DEFAULT 86400,
+    require_dpop BOOLEAN NOT NULL DEFAULT FALSE,
+    require_dpop_nonce BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- events lists the webhook events to deliver, all of them when empty.
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id SERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    url TEXT NOT NULL,
+    events TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_subscriptions_tenant ON webhook_subscriptions(tenant_id);
+
+-- Upstream OpenID Connect providers the tenant federates with.
+CREATE TABLE IF NOT EXISTS identity_providers (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    id TEXT NOT NULL,
+    issuer TEXT NOT NULL,
+    client_id TEXT NOT NULL,
+    client_secret TEXT NOT NULL DEFAULT '',
+    scopes TEXT[] NOT NULL DEFAULT '{openid,email,profile}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS federation_states (
+    state_hash TEXT PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    provider_id TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- subject is the sub claim of the provider's ID tokens.
+CREATE TABLE IF NOT EXISTS external_identities (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    provider_id TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    guid INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, provider_id, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_external_identities_guid ON external_identities(tenant_id, guid);
+
+-- Upstream SAML identity providers. certificate is the PEM certificate
+-- assertions are signed with; attributes maps user claims to SAML attributes.
+CREATE TABLE IF NOT EXISTS saml_providers (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    id TEXT NOT NULL,
+    entity_id TEXT NOT NULL,
+    sso_url TEXT NOT NULL,
+    certificate TEXT NOT NULL,
+    attributes JSONB NOT NULL DEFAULT '{}',
+    link_by_email BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, id)
+);
+
+-- API keys of users (guid) or clients (client_id). id is the public part of
+-- the key, secret_hash the SHA-256 hash of its secret.
+CREATE TABLE IF NOT EXISTS api_keys (
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    id TEXT NOT NULL,
+    guid INTEGER NOT NULL DEFAULT 0,
+    client_id TEXT NOT NULL DEFAULT '',
+    name TEXT NOT NULL DEFAULT '',
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    secret_hash TEXT NOT NULL,
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_guid ON api_keys(tenant_id, guid);
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS tokens_archive;
+
+DROP INDEX IF EXISTS idx_tokens_retention;
+
+ALTER TABLE tokens
+    DROP COLUMN IF EXISTS status_changed_at,
+    DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,10 @@
+ALTER TABLE tokens
+    ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS status_changed_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS idx_tokens_retention ON tokens(status, status_changed_at) WHERE status <> 'unused';
+
+CREATE TABLE IF NOT EXISTS tokens_archive (
+    LIKE tokens,
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
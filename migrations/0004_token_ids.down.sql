@@ -0,0 +1,9 @@
+ALTER TABLE tokens ALTER COLUMN id SET DEFAULT nextval('tokens_id_seq');
+
+DROP FUNCTION IF EXISTS tokens_next_id();
+DROP FUNCTION IF EXISTS tokens_id_time(BIGINT);
+DROP SEQUENCE IF EXISTS tokens_id_counter;
+
+-- Fails once time-encoded ids have been issued.
+ALTER TABLE tokens_archive ALTER COLUMN id TYPE INTEGER;
+ALTER TABLE tokens ALTER COLUMN id TYPE INTEGER;
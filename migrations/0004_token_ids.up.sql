@@ -0,0 +1,27 @@
+-- Session ids encode their creation time: milliseconds since 2024-01-01 UTC
+-- in the high bits and a 12-bit counter in the low ones. They stay below
+-- 2^53, so they survive JSON numbers in JWT claims, and let queries by id
+-- skip partitions created before the session. Older SERIAL ids decode to
+-- times around 2024-01-01, which every session was created after.
+-- Sessions with time-encoded ids must be created at tokens_id_time(id), so
+-- that lookups can match created_at exactly.
+-- The counter allows 4096 ids per millisecond across all instances. It
+-- wraps after that, and the insert of a repeated id fails with a unique
+-- violation.
+ALTER TABLE tokens ALTER COLUMN id TYPE BIGINT;
+ALTER TABLE tokens_archive ALTER COLUMN id TYPE BIGINT;
+
+CREATE SEQUENCE IF NOT EXISTS tokens_id_counter MINVALUE 0 MAXVALUE 4095 START 0 CYCLE;
+
+CREATE OR REPLACE FUNCTION tokens_id_time(id BIGINT) RETURNS TIMESTAMPTZ
+LANGUAGE SQL IMMUTABLE PARALLEL SAFE
+AS $$ SELECT TIMESTAMPTZ '2024-01-01 00:00:00+00' + (id >> 12) * INTERVAL '1 millisecond' $$;
+
+CREATE OR REPLACE FUNCTION tokens_next_id() RETURNS BIGINT
+LANGUAGE SQL VOLATILE
+AS $$
+    SELECT (floor(extract(epoch FROM clock_timestamp() - TIMESTAMPTZ '2024-01-01 00:00:00+00') * 1000)::BIGINT << 12)
+        | nextval('tokens_id_counter')
+$$;
+
+ALTER TABLE tokens ALTER COLUMN id SET DEFAULT tokens_next_id();
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_users_tenant_email;
+
+-- Fails once an email address has accounts in several tenants.
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
+
+ALTER TABLE users DROP COLUMN IF EXISTS tenant_id;
@@ -0,0 +1,14 @@
+-- Users belong to a tenant like everything else, so an email address can
+-- have an account in several tenants. Users only linked to accounts of one
+-- other tenant move there; all others stay with the default tenant.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+
+UPDATE users u SET tenant_id = linked.tenant_id
+FROM (
+    SELECT guid, min(tenant_id) AS tenant_id FROM external_identities
+    GROUP BY guid HAVING count(DISTINCT tenant_id) = 1
+) linked
+WHERE linked.guid = u.guid AND u.tenant_id = 'default';
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_tenant_email ON users(tenant_id, email);
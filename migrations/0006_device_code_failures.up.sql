@@ -0,0 +1,10 @@
+-- Wrong user codes entered on the device verification page, counted per
+-- user so that user codes cannot be guessed.
+CREATE TABLE IF NOT EXISTS device_code_failures (
+    id SERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL DEFAULT 'default',
+    guid INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_code_failures_guid ON device_code_failures(tenant_id, guid, created_at);
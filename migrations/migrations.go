@@ -0,0 +1,8 @@
+// Package migrations embeds the Postgres schema. Every version has a
+// NNNN_name.up.sql file and a NNNN_name.down.sql file undoing it.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS